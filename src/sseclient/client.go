@@ -0,0 +1,184 @@
+package sseclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrNoContent is returned by Err when the server answered 204, which per the
+// spec tells the client to stop reconnecting.
+var ErrNoContent = errors.New("sseclient: server responded with 204 No Content")
+
+// Client consumes a text/event-stream endpoint and reconnects when the stream
+// ends or the connection drops, resending the last seen event id.
+type Client struct {
+	URL        string
+	HTTPClient *http.Client
+	Header     http.Header
+
+	// OnError is called with connection errors that are followed by a
+	// reconnect. Useful for logging in load tools.
+	OnError func(error)
+
+	// the stream updates these while callers read them, use the getters
+	mu          sync.Mutex
+	err         error
+	retry       time.Duration
+	lastEventID string
+}
+
+func New(url string) *Client {
+	return &Client{
+		URL:        url,
+		HTTPClient: http.DefaultClient,
+		Header:     make(http.Header),
+		retry:      3 * time.Second,
+	}
+}
+
+// Retry is the delay before reconnecting. The server can change it with a
+// retry field.
+func (c *Client) Retry() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.retry
+}
+
+func (c *Client) SetRetry(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retry = d
+}
+
+// LastEventID is sent as the Last-Event-ID header. It is updated as events
+// arrive so it can be used to resume a later subscription.
+func (c *Client) LastEventID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastEventID
+}
+
+func (c *Client) SetLastEventID(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastEventID = id
+}
+
+// Subscribe starts streaming in the background. The returned channel is
+// closed when ctx is cancelled or the connection fails in a way the spec says
+// not to retry (a status other than 200 or a wrong content type), after which
+// Err tells why.
+func (c *Client) Subscribe(ctx context.Context) <-chan Event {
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for {
+			err := c.stream(ctx, events)
+			if ctx.Err() != nil {
+				return
+			}
+			var fatal fatalError
+			if errors.As(err, &fatal) {
+				c.setErr(fatal.err)
+				return
+			}
+			if err != nil && c.OnError != nil {
+				c.OnError(err)
+			}
+
+			select {
+			case <-time.After(c.Retry()):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// Err returns the error that closed the channel returned by Subscribe, or nil
+// if it was closed by cancelling the context.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Client) setErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+type fatalError struct {
+	err error
+}
+
+func (e fatalError) Error() string {
+	return e.err.Error()
+}
+
+func (c *Client) stream(ctx context.Context, events chan<- Event) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return fatalError{err}
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	lastEventID := c.LastEventID()
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return fatalError{ErrNoContent}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fatalError{fmt.Errorf("sseclient: unexpected status %s", resp.Status)}
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/event-stream" {
+		return fatalError{fmt.Errorf("sseclient: unexpected content type %q", resp.Header.Get("Content-Type"))}
+	}
+
+	parser := NewParser(resp.Body)
+	parser.LastEventID = lastEventID
+	for {
+		e, err := parser.Next()
+		// retry fields take effect right away, ids once their event is
+		// dispatched
+		c.mu.Lock()
+		c.lastEventID = parser.LastEventID
+		if parser.HasRetry {
+			c.retry = parser.Retry
+		}
+		c.mu.Unlock()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case events <- e:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package sseclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParser(t *testing.T) {
+	stream := "\uFEFF: comment\r\n" +
+		"retry: 1500\r\n" +
+		"id: 1\revent: chat\rdata: hello\rdata\rdata:  world\r\r" +
+		"data: no id\n\n" +
+		"id\n\n" +
+		"event: dropped\n\n" +
+		"data: cut off"
+
+	p := NewParser(strings.NewReader(stream))
+	expected := []Event{
+		{ID: "1", Event: "chat", Data: "hello\n\n world"},
+		{ID: "1", Event: "message", Data: "no id"},
+	}
+	for _, want := range expected {
+		got, err := p.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("expected %+v but got %+v", want, got)
+		}
+	}
+	if _, err := p.Next(); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	}
+	if p.LastEventID != "" {
+		t.Errorf("expected empty id field to reset the last event id, got %q", p.LastEventID)
+	}
+	if p.Retry != 1500*time.Millisecond || !p.HasRetry {
+		t.Errorf("expected retry 1.5s but got %v", p.Retry)
+	}
+}
+
+func TestReconnectWithLastEventID(t *testing.T) {
+	var lastIDs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastIDs = append(lastIDs, r.Header.Get("Last-Event-ID"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		if len(lastIDs) > 2 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprintf(w, "retry: 10\nid: %d\ndata: %d\n\n", len(lastIDs), len(lastIDs))
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	var got []string
+	for e := range c.Subscribe(context.Background()) {
+		got = append(got, e.Data)
+	}
+
+	if strings.Join(got, ",") != "1,2" {
+		t.Errorf("expected events 1,2 but got %v", got)
+	}
+	if strings.Join(lastIDs, ",") != ",1,2" {
+		t.Errorf("expected Last-Event-ID headers ,1,2 but got %v", lastIDs)
+	}
+	if c.Err() != ErrNoContent {
+		t.Errorf("expected ErrNoContent but got %v", c.Err())
+	}
+	if c.LastEventID() != "2" || c.Retry() != 10*time.Millisecond {
+		t.Errorf("expected id 2 and retry 10ms but got %q %v", c.LastEventID(), c.Retry())
+	}
+}
+
+func TestRetryZero(t *testing.T) {
+	p := NewParser(strings.NewReader("retry: 0\ndata: x\n\n"))
+	if _, err := p.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.HasRetry || p.Retry != 0 {
+		t.Errorf("expected retry 0 to be kept but got %v %v", p.HasRetry, p.Retry)
+	}
+
+	var conns atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conns.Add(1) > 1 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "retry: 0\ndata: x\n\n")
+	}))
+	defer srv.Close()
+
+	// reconnects right away instead of after the default 3s
+	c := New(srv.URL)
+	start := time.Now()
+	for range c.Subscribe(context.Background()) {
+	}
+	if c.Retry() != 0 || time.Since(start) > time.Second {
+		t.Errorf("expected to reconnect right away but retry is %v after %v", c.Retry(), time.Since(start))
+	}
+}
+
+func TestTruncatedEventKeepsLastEventID(t *testing.T) {
+	p := NewParser(strings.NewReader("id: 1\ndata: a\n\nid: 2\ndata: cut"))
+	p.Next()
+	if _, err := p.Next(); err != io.EOF {
+		t.Fatalf("expected EOF but got %v", err)
+	}
+	if p.LastEventID != "1" {
+		t.Errorf("expected the id of the cut off event to be ignored but got %q", p.LastEventID)
+	}
+
+	var lastIDs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastIDs = append(lastIDs, r.Header.Get("Last-Event-ID"))
+		if len(lastIDs) > 1 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "retry: 10\nid: 1\ndata: a\n\nid: 2\ndata: cut")
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	for range c.Subscribe(context.Background()) {
+	}
+	if strings.Join(lastIDs, ",") != ",1" {
+		t.Errorf("expected to reconnect after event 1 but sent Last-Event-ID %v", lastIDs)
+	}
+}
@@ -0,0 +1,64 @@
+// ssetail prints the events of an SSE endpoint. With -c it opens several
+// connections and reports throughput instead, which is handy for load testing
+// the w1/sse broker or the polling service's status stream.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sseclient"
+)
+
+func main() {
+	conns := flag.Int("c", 1, "number of concurrent connections")
+	lastID := flag.String("last-event-id", "", "resume after this event id")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Println("usage: ssetail [-c n] [-last-event-id id] <url>")
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var received atomic.Int64
+	var wg sync.WaitGroup
+	for i := range *conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := sseclient.New(flag.Arg(0))
+			c.SetLastEventID(*lastID)
+			c.OnError = func(err error) {
+				fmt.Printf("[%d] %v, reconnecting in %v\n", i, err, c.Retry())
+			}
+			for e := range c.Subscribe(ctx) {
+				received.Add(1)
+				if *conns == 1 {
+					fmt.Printf("id=%s event=%s data=%q\n", e.ID, e.Event, e.Data)
+				}
+			}
+			if err := c.Err(); err != nil {
+				fmt.Printf("[%d] stopped: %v\n", i, err)
+			}
+		}()
+	}
+
+	if *conns > 1 {
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for range ticker.C {
+				fmt.Printf("%d connections, %d events/s\n", *conns, received.Swap(0))
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,3 @@
+module sseclient
+
+go 1.24.1
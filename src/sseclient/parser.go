@@ -0,0 +1,129 @@
+package sseclient
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a dispatched server-sent event.
+type Event struct {
+	ID    string
+	Event string // "message" unless the server set an event name
+	Data  string
+}
+
+// Parser reads events from a text/event-stream body following the
+// interpretation rules of the HTML living standard.
+type Parser struct {
+	scanner *bufio.Scanner
+	first   bool
+	id      string // of the event being read, until it is dispatched
+
+	// LastEventID is the id of the last dispatched event. It survives
+	// events without an id field and is what a client resends when
+	// reconnecting. An id of an event cut off by the end of the stream
+	// doesn't count.
+	LastEventID string
+	// Retry is the reconnection time requested by the server, valid if
+	// HasRetry is set. A retry of 0 asks to reconnect right away.
+	Retry    time.Duration
+	HasRetry bool
+}
+
+func NewParser(r io.Reader) *Parser {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), 1<<20)
+	scanner.Split(scanLines)
+	return &Parser{scanner: scanner, first: true}
+}
+
+// Next returns the next complete event. An event that is cut off by the end
+// of the stream is discarded and io.EOF is returned.
+func (p *Parser) Next() (Event, error) {
+	var data strings.Builder
+	eventType := ""
+	hasData := false
+
+	if p.first {
+		// the caller may have set LastEventID to carry on from
+		p.id = p.LastEventID
+	}
+	for p.scanner.Scan() {
+		line := p.scanner.Text()
+		if p.first {
+			line = strings.TrimPrefix(line, "\uFEFF")
+			p.first = false
+		}
+
+		if line == "" {
+			p.LastEventID = p.id
+			if !hasData {
+				eventType = ""
+				continue
+			}
+			if eventType == "" {
+				eventType = "message"
+			}
+			return Event{ID: p.LastEventID, Event: eventType, Data: strings.TrimSuffix(data.String(), "\n")}, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue // comment
+		}
+
+		field, value, found := strings.Cut(line, ":")
+		if found {
+			value = strings.TrimPrefix(value, " ")
+		}
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			data.WriteString(value)
+			data.WriteString("\n")
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				p.id = value
+			}
+		case "retry":
+			if ms, err := strconv.ParseUint(value, 10, 63); err == nil {
+				p.Retry, p.HasRetry = time.Duration(ms)*time.Millisecond, true
+			}
+		}
+	}
+	if err := p.scanner.Err(); err != nil {
+		return Event{}, err
+	}
+	return Event{}, io.EOF
+}
+
+// scanLines splits on CRLF, LF or a lone CR. A CR at the end of the buffer
+// waits for more input since it may be the first half of a CRLF.
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if atEOF {
+			return i + 1, data[:i], nil
+		}
+		return 0, nil, nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -92,4 +92,44 @@ func SetupServer(r *gin.Engine) {
 			return
 		}
 	})
+	// Server-sent events version of the long poll: every status change is
+	// pushed as a "status" event whose id is the status itself, so a client
+	// reconnecting with Last-Event-ID doesn't get the same status twice.
+	r.GET("/EC2/status/stream", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Query("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		if _, ok := db.Load(id); !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "EC2 not found"})
+			return
+		}
+		last := c.GetHeader("Last-Event-ID")
+		if last == "done" {
+			// tells the client there is nothing more to wait for
+			c.Status(http.StatusNoContent)
+			return
+		}
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+
+		for {
+			curr_status, _ := db.Load(id)
+			if curr_status != last {
+				last = curr_status.(string)
+				fmt.Fprintf(c.Writer, "id: %s\nevent: status\ndata: {\"ID\":%d,\"status\":%q}\n\n", last, id, last)
+				c.Writer.Flush()
+			}
+			if last == "done" {
+				return
+			}
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-time.After(1 * time.Second):
+			}
+		}
+	})
 }
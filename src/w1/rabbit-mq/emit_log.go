@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"rabbitmq/mq"
+)
+
+// EmitLogs publishes to the "logs" fanout exchange, every queue bound to it
+// gets a copy of each message.
+func EmitLogs(b mq.Broker) {
+	SetupTopology(b, "logs")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := range 10 {
+		body := fmt.Sprintf("info: log line %d", i)
+		err := b.Publish(ctx, "logs", "", mq.Message{
+			Body:        []byte(body),
+			ContentType: "text/plain",
+		})
+		FailOnError(err, "Failed to publish a log")
+		log.Printf(" [x] Sent %s", body)
+		time.Sleep(100 * time.Millisecond)
+	}
+}
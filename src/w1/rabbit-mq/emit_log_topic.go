@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"rabbitmq/mq"
+)
+
+type logLine struct {
+	exchange string
+	key      string
+	headers  map[string]any
+	body     string
+}
+
+// EmitTopicLogs publishes to the routing exchanges of topic_logs.json:
+// "<facility>.<severity>" keys on the topic exchange, the severity alone on
+// the direct exchange and team/page headers on the headers exchange.
+func EmitTopicLogs(b mq.Broker) {
+	SetupTopology(b, "topic_logs")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lines := []logLine{
+		{exchange: "topic_logs", key: "kern.critical", body: "kernel panic"},
+		{exchange: "topic_logs", key: "kern.info", body: "kernel booted"},
+		{exchange: "topic_logs", key: "app.critical", body: "app out of memory"},
+		{exchange: "topic_logs", key: "app.db.info", body: "app connected to db"},
+		{exchange: "severity_logs", key: "error", body: "request failed"},
+		{exchange: "severity_logs", key: "info", body: "request served"},
+		{exchange: "tagged_logs", headers: map[string]any{"team": "infra", "page": "yes"}, body: "disk full"},
+		{exchange: "tagged_logs", headers: map[string]any{"team": "infra", "page": "no"}, body: "disk at 80%"},
+	}
+	for _, l := range lines {
+		err := b.Publish(ctx, l.exchange, l.key, mq.Message{
+			Body:        []byte(l.body),
+			ContentType: "text/plain",
+			Headers:     l.headers,
+		})
+		FailOnError(err, "Failed to publish a log")
+		log.Printf(" [x] Sent %s:%s %v %s", l.exchange, l.key, l.headers, l.body)
+	}
+}
@@ -2,4 +2,4 @@ module rabbitmq
 
 go 1.24.1
 
-require github.com/rabbitmq/amqp091-go v1.10.0 // indirect
+require github.com/rabbitmq/amqp091-go v1.10.0
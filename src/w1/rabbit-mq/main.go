@@ -1,33 +1,97 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+
+	"rabbitmq/mq"
 )
 
+var demo = flag.String("demo", "work", "demo to run: work, logs, topics or rpc")
+
 func main() {
-	var wg sync.WaitGroup
+	flag.Parse()
+	// the first signal starts a graceful shutdown, a second one kills the
+	// process as usual
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, func() {
+		stop()
+		log.Printf("Shutting down, waiting up to %s for messages in progress", *grace)
+	})
+
+	b := Connect()
+	defer b.Close()
+
+	switch *demo {
+	case "logs":
+		runRouting(ctx, b, "logs", EmitLogs)
+	case "topics":
+		runRouting(ctx, b, "topic_logs", EmitTopicLogs)
+	case "rpc":
+		runRPC(ctx, b)
+	default:
+		runWork(ctx, b)
+	}
+}
 
+// runWork runs the producers and consumers of the hello and task queues,
+// the consumers run until the process is told to stop.
+func runWork(ctx context.Context, b mq.Broker) {
+	var wg sync.WaitGroup
+	wg.Add(2)
 	go func() {
-		Receive()
-		wg.Done()
+		defer wg.Done()
+		Receive(ctx, b)
 	}()
 	go func() {
-		Send()
-		wg.Done()
+		defer wg.Done()
+		Send(b)
 	}()
 	consumers := 2
 	for i := range consumers {
 		wg.Add(1)
 		go func() {
-			Consume(i)
-			wg.Done()
+			defer wg.Done()
+			Consume(ctx, b, i)
 		}()
 	}
 	wg.Add(1)
-
 	go func() {
-		CreateTasks()
-		wg.Done()
+		defer wg.Done()
+		CreateTasks(b)
 	}()
 	wg.Wait()
 }
+
+// runRouting declares a topology, starts a receiver per queue and emits.
+func runRouting(ctx context.Context, b mq.Broker, topology string, emit func(mq.Broker)) {
+	var wg sync.WaitGroup
+	for _, q := range SetupTopology(b, topology) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ReceiveLogs(ctx, b, q)
+		}()
+	}
+	emit(b)
+	wg.Wait()
+}
+
+// runRPC starts the server in the background, places the orders and then
+// stops the server.
+func runRPC(ctx context.Context, b mq.Broker) {
+	ctx, cancel := context.WithCancel(ctx)
+	served := make(chan error, 1)
+	go func() { served <- ServeDelivery(ctx, b) }()
+	PlaceOrders(b)
+	cancel()
+	if err := <-served; err != nil {
+		log.Printf("RPC server: %v", err)
+	}
+}
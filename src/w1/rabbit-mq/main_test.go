@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"rabbitmq/mq"
+)
+
+func TestCreateTasks(t *testing.T) {
+	b := mq.NewMemoryBroker()
+	defer b.Close()
+	q := SetupTasks(b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msgs, err := b.Consume(ctx, q, mq.ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan []string, 1)
+	go func() { accepted <- CreateTasks(b) }()
+	for i := range 10 {
+		d, ok := <-msgs
+		if !ok {
+			t.Fatalf("got %d tasks before timing out", i)
+		}
+		if !d.Persistent {
+			t.Errorf("expected task %s to be persistent", d.Body)
+		}
+		d.Ack()
+	}
+	if n := len(<-accepted); n != 10 {
+		t.Errorf("expected all 10 tasks to be confirmed but got %d", n)
+	}
+}
@@ -0,0 +1,525 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	ErrDisconnected = errors.New("mq: not connected to the broker")
+	ErrNotConfirmed = errors.New("mq: broker did not confirm the message")
+)
+
+type AMQPOptions struct {
+	// Reconnection delays grow exponentially from MinBackoff to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// PublishBuffer is how many publishes may wait for a reconnection. Any
+	// publish beyond that, or any publish at all when it is zero, fails
+	// right away with ErrDisconnected while the broker is unreachable.
+	PublishBuffer int
+}
+
+func DefaultAMQPOptions() AMQPOptions {
+	return AMQPOptions{
+		MinBackoff:    250 * time.Millisecond,
+		MaxBackoff:    30 * time.Second,
+		PublishBuffer: 100,
+	}
+}
+
+// AMQPBroker talks to RabbitMQ. It reconnects with backoff when the
+// connection or channel closes, declares the topology again on the new
+// connection and resubscribes consumers. Publishing and declarations share
+// one channel in confirm mode, every consumer gets a channel of its own.
+// A publishing channel the broker closes, say after a publish to a missing
+// exchange, is opened again on the same connection.
+//
+// If the topology can't be declared again on a new connection the broker
+// gives up, since retrying won't fix it, and every call returns why.
+type AMQPBroker struct {
+	url  string
+	opts AMQPOptions
+
+	mu        sync.Mutex
+	conn      *amqp.Connection
+	ch        *amqp.Channel
+	connected chan struct{} // closed while a connection is up
+	waiting   int           // publishes waiting for a connection
+	closed    bool
+	err       error // why the broker gave up, if it did
+	done      chan struct{}
+
+	// declarations made so far, replayed in order on a new connection.
+	// Declaring the same queue, exchange or binding again replaces its
+	// entry, so repeated setup doesn't grow the list. topologyMu is held
+	// for the network calls of declaring and replaying, mu isn't.
+	topologyMu  sync.Mutex
+	topology    []func(*amqp.Channel) error
+	declared    map[string]int // index in topology by what was declared
+	serverNamed map[string]bool
+}
+
+// DialAMQP connects to RabbitMQ, retrying until ctx expires. Later connection
+// losses are recovered in the background.
+func DialAMQP(ctx context.Context, url string, opts AMQPOptions) (*AMQPBroker, error) {
+	b := &AMQPBroker{
+		url:         url,
+		opts:        opts,
+		connected:   make(chan struct{}),
+		done:        make(chan struct{}),
+		declared:    make(map[string]int),
+		serverNamed: make(map[string]bool),
+	}
+	if err := b.reconnect(ctx); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// topologyError is a declaration that failed on a new connection.
+type topologyError struct{ err error }
+
+func (e topologyError) Error() string {
+	return fmt.Sprintf("mq: declaring the topology again failed: %v", e.err)
+}
+
+func (e topologyError) Unwrap() error { return e.err }
+
+// reconnect dials until it succeeds, ctx expires or the broker is closed.
+// A topology that can't be declared again is returned right away.
+func (b *AMQPBroker) reconnect(ctx context.Context) error {
+	for attempt := 0; ; attempt++ {
+		err := b.connect()
+		var topoErr topologyError
+		if err == nil || errors.As(err, &topoErr) {
+			return err
+		}
+		delay := backoff(b.opts.MinBackoff, b.opts.MaxBackoff, attempt)
+		log.Printf("mq: connecting to RabbitMQ failed: %v, retrying in %v", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		case <-b.done:
+			return ErrClosed
+		}
+	}
+}
+
+func (b *AMQPBroker) connect() error {
+	conn, err := amqp.Dial(b.url)
+	if err != nil {
+		return err
+	}
+	ch, err := openChannel(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	// declarations wait for the replay, so they are either replayed or
+	// made on the new channel
+	b.topologyMu.Lock()
+	defer b.topologyMu.Unlock()
+	for _, declare := range b.topology {
+		if err := declare(ch); err != nil {
+			conn.Close()
+			return topologyError{err}
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		conn.Close()
+		return ErrClosed
+	}
+	b.conn, b.ch = conn, ch
+	close(b.connected)
+	go b.watch(conn, ch)
+	return nil
+}
+
+// openChannel opens a publishing channel in confirm mode.
+func openChannel(conn *amqp.Connection) (*amqp.Channel, error) {
+	ch, err := conn.Channel()
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+	return ch, err
+}
+
+// watch waits for the connection to close and then starts over with a new
+// one. When only the publishing channel closes it opens another one.
+func (b *AMQPBroker) watch(conn *amqp.Connection, ch *amqp.Channel) {
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	var reason *amqp.Error
+	for {
+		chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+		select {
+		case reason = <-connClosed:
+		case reason = <-chClosed:
+			if next, err := openChannel(conn); err == nil {
+				log.Printf("mq: publishing channel closed: %v, opened another", reason)
+				b.mu.Lock()
+				b.ch = next
+				b.mu.Unlock()
+				ch = next
+				continue
+			}
+		case <-b.done:
+			return
+		}
+		break
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.conn, b.ch = nil, nil
+	b.connected = make(chan struct{})
+	b.mu.Unlock()
+	conn.Close()
+
+	log.Printf("mq: connection lost: %v, reconnecting", reason)
+	if err := b.reconnect(context.Background()); err != nil {
+		log.Printf("mq: giving up: %v", err)
+		b.fail(err)
+	}
+}
+
+// fail closes the broker for good, every call returns err from then on.
+func (b *AMQPBroker) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed, b.err = true, err
+		close(b.done)
+	}
+}
+
+// closedErr is what calls return once the broker is closed. Must be
+// called with b.mu held.
+func (b *AMQPBroker) closedErr() error {
+	if b.err != nil {
+		return b.err
+	}
+	return ErrClosed
+}
+
+func backoff(minDelay, maxDelay time.Duration, attempt int) time.Duration {
+	d := minDelay << min(attempt, 16)
+	if d <= 0 || d > maxDelay {
+		d = maxDelay
+	}
+	// jitter so a crowd of clients doesn't reconnect in lockstep
+	return d/2 + rand.N(d/2+1)
+}
+
+// session returns the current publishing channel, waiting for a connection
+// if the publish buffer has room.
+func (b *AMQPBroker) session(ctx context.Context) (*amqp.Channel, error) {
+	b.mu.Lock()
+	for b.ch == nil {
+		if b.closed {
+			err := b.closedErr()
+			b.mu.Unlock()
+			return nil, err
+		}
+		if b.waiting >= b.opts.PublishBuffer {
+			b.mu.Unlock()
+			return nil, ErrDisconnected
+		}
+		b.waiting++
+		connected := b.connected
+		b.mu.Unlock()
+		select {
+		case <-connected:
+		case <-ctx.Done():
+		case <-b.done:
+		}
+		b.mu.Lock()
+		b.waiting--
+		if err := ctx.Err(); err != nil {
+			b.mu.Unlock()
+			return nil, err
+		}
+	}
+	ch := b.ch
+	b.mu.Unlock()
+	return ch, nil
+}
+
+func (b *AMQPBroker) DeclareQueue(name string, opts QueueOptions) (string, error) {
+	b.topologyMu.Lock()
+	defer b.topologyMu.Unlock()
+	ch, err := b.channel()
+	if err != nil {
+		return "", err
+	}
+	q, err := ch.QueueDeclare(name, opts.Durable, opts.AutoDelete, opts.Exclusive, false, amqp.Table(opts.Args))
+	if err != nil {
+		return "", err
+	}
+	// server named queues can't be declared again under the same name
+	if name == "" {
+		b.serverNamed[q.Name] = true
+		return q.Name, nil
+	}
+	b.remember("queue\x00"+name, func(ch *amqp.Channel) error {
+		_, err := ch.QueueDeclare(name, opts.Durable, opts.AutoDelete, opts.Exclusive, false, amqp.Table(opts.Args))
+		return err
+	})
+	return q.Name, nil
+}
+
+// channel returns the publishing channel, or why there is none.
+func (b *AMQPBroker) channel() (*amqp.Channel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, b.closedErr()
+	}
+	if b.ch == nil {
+		return nil, ErrDisconnected
+	}
+	return b.ch, nil
+}
+
+// remember records a declaration for the next connection under key,
+// replacing the one made before under the same key. Must be called with
+// b.topologyMu held.
+func (b *AMQPBroker) remember(key string, declare func(*amqp.Channel) error) {
+	if i, ok := b.declared[key]; ok {
+		b.topology[i] = declare
+		return
+	}
+	b.declared[key] = len(b.topology)
+	b.topology = append(b.topology, declare)
+}
+
+func (b *AMQPBroker) DeclareExchange(name, kind string, opts ExchangeOptions) error {
+	declare := func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclare(name, kind, opts.Durable, opts.AutoDelete, false, false, amqp.Table(opts.Args))
+	}
+	return b.declare("exchange\x00"+name, declare, func() bool { return true })
+}
+
+func (b *AMQPBroker) BindQueue(queue, key, exchange string, args map[string]any) error {
+	declare := func(ch *amqp.Channel) error {
+		return ch.QueueBind(queue, key, exchange, false, amqp.Table(args))
+	}
+	replay := func() bool { return !b.serverNamed[queue] }
+	return b.declare("binding\x00"+queue+"\x00"+key+"\x00"+exchange, declare, replay)
+}
+
+// declare runs declare on the publishing channel and, if replay says so,
+// remembers it under key for the next connection.
+func (b *AMQPBroker) declare(key string, declare func(*amqp.Channel) error, replay func() bool) error {
+	b.topologyMu.Lock()
+	defer b.topologyMu.Unlock()
+	ch, err := b.channel()
+	if err != nil {
+		return err
+	}
+	if err := declare(ch); err != nil {
+		return err
+	}
+	if replay() {
+		b.remember(key, declare)
+	}
+	return nil
+}
+
+// Publish returns once the broker confirmed the message. A message that was
+// nacked, or whose channel went away before the confirm arrived, returns
+// ErrNotConfirmed and should be considered lost.
+func (b *AMQPBroker) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	var confirm *amqp.DeferredConfirmation
+	for {
+		ch, err := b.session(ctx)
+		if err != nil {
+			return err
+		}
+		confirm, err = ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, toPublishing(msg))
+		if errors.Is(err, amqp.ErrClosed) {
+			// the channel died before the message went out, wait for the
+			// next connection like any other publish while disconnected
+			select {
+			case <-time.After(b.opts.MinBackoff):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+	ok, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotConfirmed
+	}
+	return nil
+}
+
+// Consume keeps the consumer subscribed across reconnections. Deliveries
+// received before a connection loss can no longer be acked, the broker
+// redelivers them instead.
+func (b *AMQPBroker) Consume(ctx context.Context, queue string, opts ConsumeOptions) (<-chan Delivery, error) {
+	msgs, ch, err := b.subscribe(ctx, queue, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Delivery)
+	go func() {
+		defer close(out)
+		for {
+			b.pump(ctx, queue, opts, msgs, out)
+			ch.Close() // requeues whatever wasn't acked
+			if msgs, ch = b.resubscribe(ctx, queue, opts); msgs == nil {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// resubscribe waits for the broker to reconnect and consumes again. It
+// returns nil once ctx is cancelled or the broker is closed.
+func (b *AMQPBroker) resubscribe(ctx context.Context, queue string, opts ConsumeOptions) (<-chan amqp.Delivery, *amqp.Channel) {
+	for ctx.Err() == nil {
+		b.mu.Lock()
+		connected, closed := b.connected, b.closed
+		b.mu.Unlock()
+		if closed {
+			return nil, nil
+		}
+		select {
+		case <-connected:
+		case <-ctx.Done():
+			return nil, nil
+		case <-b.done:
+			return nil, nil
+		}
+
+		msgs, ch, err := b.subscribe(ctx, queue, opts)
+		if err == nil {
+			return msgs, ch
+		}
+		log.Printf("mq: resubscribing to %s failed: %v", queue, err)
+		select {
+		case <-time.After(b.opts.MinBackoff):
+		case <-ctx.Done():
+		}
+	}
+	return nil, nil
+}
+
+func (b *AMQPBroker) subscribe(ctx context.Context, queue string, opts ConsumeOptions) (<-chan amqp.Delivery, *amqp.Channel, error) {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	if conn == nil {
+		return nil, nil, ErrDisconnected
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Prefetch > 0 && !opts.AutoAck {
+		if err := ch.Qos(opts.Prefetch, 0, false); err != nil {
+			ch.Close()
+			return nil, nil, err
+		}
+	}
+	msgs, err := ch.ConsumeWithContext(ctx, queue, "", opts.AutoAck, opts.Exclusive, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, nil, err
+	}
+	return msgs, ch, nil
+}
+
+// pump forwards deliveries until the channel closes or ctx is cancelled.
+func (b *AMQPBroker) pump(ctx context.Context, queue string, opts ConsumeOptions, msgs <-chan amqp.Delivery, out chan<- Delivery) {
+	for {
+		select {
+		case d, ok := <-msgs:
+			if !ok {
+				return
+			}
+			select {
+			case out <- fromDelivery(queue, d, opts.AutoAck):
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *AMQPBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	if b.conn == nil {
+		return nil
+	}
+	return b.conn.Close()
+}
+
+func toPublishing(msg Message) amqp.Publishing {
+	p := amqp.Publishing{
+		Headers:       amqp.Table(msg.Headers),
+		ContentType:   msg.ContentType,
+		CorrelationId: msg.CorrelationID,
+		ReplyTo:       msg.ReplyTo,
+		Body:          msg.Body,
+	}
+	if msg.Persistent {
+		p.DeliveryMode = amqp.Persistent
+	}
+	return p
+}
+
+func fromDelivery(queue string, d amqp.Delivery, autoAck bool) Delivery {
+	delivery := Delivery{
+		Message: Message{
+			Body:          d.Body,
+			ContentType:   d.ContentType,
+			Headers:       map[string]any(d.Headers),
+			Persistent:    d.DeliveryMode == amqp.Persistent,
+			CorrelationID: d.CorrelationId,
+			ReplyTo:       d.ReplyTo,
+		},
+		Queue:       queue,
+		Redelivered: d.Redelivered,
+	}
+	if !autoAck {
+		delivery.ack = func() error { return d.Ack(false) }
+		delivery.nack = func(requeue bool) error { return d.Nack(false, requeue) }
+	}
+	return delivery
+}
@@ -0,0 +1,50 @@
+package mq
+
+import (
+	"context"
+	"maps"
+)
+
+const (
+	// DeliveryCountHeader is set by quorum queues on every redelivery.
+	DeliveryCountHeader = "x-delivery-count"
+	// Headers added to dead-lettered messages.
+	OriginalQueueHeader = "x-original-queue"
+	DeathReasonHeader   = "x-death-reason"
+)
+
+// DeadLetterQueue is the name of the queue that collects the messages of
+// queue that couldn't be processed.
+func DeadLetterQueue(queue string) string {
+	return queue + ".dlq"
+}
+
+// DeliveryCount returns how many times a message was delivered before,
+// according to its x-delivery-count header.
+func DeliveryCount(headers map[string]any) int64 {
+	switch n := headers[DeliveryCountHeader].(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	}
+	return 0
+}
+
+// DeadLetter moves the delivery to the dead-letter queue of the queue it
+// came from, recording why, and acks the original.
+func DeadLetter(ctx context.Context, p Publisher, d Delivery, reason error) error {
+	msg := d.Message
+	msg.Headers = maps.Clone(msg.Headers)
+	if msg.Headers == nil {
+		msg.Headers = make(map[string]any)
+	}
+	msg.Headers[OriginalQueueHeader] = d.Queue
+	msg.Headers[DeathReasonHeader] = reason.Error()
+	if err := p.Publish(ctx, "", DeadLetterQueue(d.Queue), msg); err != nil {
+		return err
+	}
+	return d.Ack()
+}
@@ -0,0 +1,483 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBroker is an in-process broker with the RabbitMQ semantics the demos
+// rely on: direct, fanout, topic and headers exchanges, x-max-length,
+// competing consumers, manual acks with prefetch, requeue on nack
+// and on consumer shutdown, and the redelivered flag. Messages expire after
+// x-message-ttl, and expired, rejected and overflowing messages go to the
+// x-dead-letter-exchange if the queue has one. Queues declared with
+// x-queue-type=quorum count deliveries in the x-delivery-count header like
+// RabbitMQ quorum queues do.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	queues    map[string]*memQueue
+	exchanges map[string]*memExchange
+	changed   chan struct{} // closed and replaced whenever a queue changes
+	closed    bool
+	nextID    int
+	nextTag   uint64
+}
+
+type memQueue struct {
+	name      string
+	opts      QueueOptions
+	ready     []memMessage
+	consumers int
+	exclusive bool // has an exclusive consumer
+}
+
+type memExchange struct {
+	name     string
+	kind     string
+	opts     ExchangeOptions
+	bindings []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+	args  map[string]any
+}
+
+type memMessage struct {
+	msg         Message
+	key         string    // routing key it was published with
+	expires     time.Time // zero unless the queue has x-message-ttl
+	redelivered bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		queues:    make(map[string]*memQueue),
+		exchanges: make(map[string]*memExchange),
+		changed:   make(chan struct{}),
+	}
+}
+
+// notify wakes up every waiting consumer. Must be called with mu held.
+func (b *MemoryBroker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *MemoryBroker) DeclareQueue(name string, opts QueueOptions) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return "", ErrClosed
+	}
+	if name == "" {
+		b.nextID++
+		name = fmt.Sprintf("amq.gen-%d", b.nextID)
+	}
+	if _, ok := b.queues[name]; !ok {
+		b.queues[name] = &memQueue{name: name, opts: opts}
+	}
+	return name, nil
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, exchange, key string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	queues, err := b.route(exchange, key, msg.Headers)
+	if err != nil {
+		return err
+	}
+	// like RabbitMQ without the mandatory flag, unroutable messages are
+	// dropped
+	for _, q := range queues {
+		m := msg
+		m.Headers = maps.Clone(msg.Headers)
+		b.push(q, memMessage{msg: m, key: key})
+	}
+	b.notify()
+	return nil
+}
+
+// route returns the queues a message published to exchange with key ends
+// up in. Must be called with mu held.
+func (b *MemoryBroker) route(exchange, key string, headers map[string]any) ([]*memQueue, error) {
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			return []*memQueue{q}, nil
+		}
+		return nil, nil
+	}
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return nil, fmt.Errorf("mq: exchange %q not found", exchange)
+	}
+
+	var queues []*memQueue
+	for _, bind := range e.bindings {
+		q, ok := b.queues[bind.queue]
+		if !ok || slices.Contains(queues, q) || !e.matches(bind, key, headers) {
+			continue
+		}
+		queues = append(queues, q)
+	}
+	return queues, nil
+}
+
+func (e *memExchange) matches(bind memBinding, key string, headers map[string]any) bool {
+	switch e.kind {
+	case Fanout:
+		return true
+	case Topic:
+		return matchTopic(strings.Split(bind.key, "."), strings.Split(key, "."))
+	case Headers:
+		return matchHeaders(bind.args, headers)
+	default:
+		return bind.key == key
+	}
+}
+
+// matchTopic matches dot separated words where "*" stands for exactly one
+// word and "#" for zero or more.
+func matchTopic(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchTopic(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchTopic(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchTopic(pattern[1:], words[1:])
+	}
+}
+
+// matchHeaders compares the binding arguments with the message headers,
+// requiring all of them or, with x-match=any, one of them.
+func matchHeaders(args, headers map[string]any) bool {
+	matchAny := args["x-match"] == "any"
+	for k, v := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		h, ok := headers[k]
+		matched := ok && fmt.Sprint(h) == fmt.Sprint(v)
+		if matchAny && matched {
+			return true
+		}
+		if !matchAny && !matched {
+			return false
+		}
+	}
+	return !matchAny
+}
+
+// push appends a message, dropping the oldest ones beyond x-max-length.
+// Must be called with mu held.
+func (b *MemoryBroker) push(q *memQueue, m memMessage) {
+	if ttl, ok := intArg(q.opts.Args, "x-message-ttl"); ok {
+		d := time.Duration(ttl) * time.Millisecond
+		m.expires = time.Now().Add(d)
+		time.AfterFunc(d, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if !b.closed && b.queues[q.name] == q {
+				b.expire(q)
+				b.notify()
+			}
+		})
+	}
+	q.ready = append(q.ready, m)
+	if maxLen, ok := intArg(q.opts.Args, "x-max-length"); ok {
+		for int64(len(q.ready)) > maxLen {
+			head := q.ready[0]
+			q.ready = q.ready[1:]
+			b.deadLetter(q, head, "maxlen")
+		}
+	}
+}
+
+// expire dead-letters the expired messages at the head of the queue. Like
+// RabbitMQ it only looks at the head, which is enough as long as every
+// message gets the same TTL. Must be called with mu held.
+func (b *MemoryBroker) expire(q *memQueue) {
+	now := time.Now()
+	for len(q.ready) > 0 && !q.ready[0].expires.IsZero() && !now.Before(q.ready[0].expires) {
+		head := q.ready[0]
+		q.ready = q.ready[1:]
+		b.deadLetter(q, head, "expired")
+	}
+}
+
+// deadLetter republishes a message that leaves q for reason through the
+// queue's x-dead-letter-exchange, using x-dead-letter-routing-key or else
+// the original key. Without a dead-letter exchange the message is dropped.
+// Must be called with mu held.
+func (b *MemoryBroker) deadLetter(q *memQueue, m memMessage, reason string) {
+	exchange, ok := q.opts.Args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := m.key
+	if k, ok := q.opts.Args["x-dead-letter-routing-key"].(string); ok {
+		key = k
+	}
+	queues, err := b.route(exchange, key, m.msg.Headers)
+	if err != nil {
+		return
+	}
+	msg := m.msg
+	msg.Headers = maps.Clone(msg.Headers)
+	if msg.Headers == nil {
+		msg.Headers = make(map[string]any)
+	}
+	if _, ok := msg.Headers["x-first-death-queue"]; !ok {
+		msg.Headers["x-first-death-queue"] = q.name
+		msg.Headers["x-first-death-reason"] = reason
+	}
+	for _, dst := range queues {
+		dm := msg
+		dm.Headers = maps.Clone(msg.Headers)
+		b.push(dst, memMessage{msg: dm, key: key})
+	}
+}
+
+func intArg(args map[string]any, key string) (int64, bool) {
+	switch n := args[key].(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+func (b *MemoryBroker) DeclareExchange(name, kind string, opts ExchangeOptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	if e, ok := b.exchanges[name]; ok {
+		if e.kind != kind {
+			return fmt.Errorf("mq: exchange %q already declared as %s", name, e.kind)
+		}
+		return nil
+	}
+	b.exchanges[name] = &memExchange{name: name, kind: kind, opts: opts}
+	return nil
+}
+
+func (b *MemoryBroker) BindQueue(queue, key, exchange string, args map[string]any) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("mq: exchange %q not found", exchange)
+	}
+	if _, ok := b.queues[queue]; !ok {
+		return fmt.Errorf("mq: queue %q not found", queue)
+	}
+	for _, bind := range e.bindings {
+		if bind.queue == queue && bind.key == key && maps.Equal(bind.args, args) {
+			return nil
+		}
+	}
+	e.bindings = append(e.bindings, memBinding{queue: queue, key: key, args: maps.Clone(args)})
+	return nil
+}
+
+// deleteQueue removes the queue and its bindings, and auto-delete exchanges
+// left without bindings. Must be called with mu held.
+func (b *MemoryBroker) deleteQueue(name string) {
+	delete(b.queues, name)
+	for _, e := range b.exchanges {
+		n := len(e.bindings)
+		e.bindings = slices.DeleteFunc(e.bindings, func(bind memBinding) bool { return bind.queue == name })
+		if e.opts.AutoDelete && n > 0 && len(e.bindings) == 0 {
+			delete(b.exchanges, e.name)
+		}
+	}
+}
+
+func (b *MemoryBroker) Consume(ctx context.Context, queue string, opts ConsumeOptions) (<-chan Delivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, fmt.Errorf("mq: queue %q not found", queue)
+	}
+	if q.exclusive || (opts.Exclusive && q.consumers > 0) {
+		return nil, fmt.Errorf("mq: queue %q is used by an exclusive consumer", queue)
+	}
+	q.consumers++
+	q.exclusive = opts.Exclusive
+
+	c := &memConsumer{broker: b, queue: q, opts: opts, unacked: make(map[uint64]memMessage)}
+	out := make(chan Delivery)
+	go c.run(ctx, out)
+	return out, nil
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		b.notify()
+	}
+	return nil
+}
+
+type memConsumer struct {
+	broker  *MemoryBroker
+	queue   *memQueue
+	opts    ConsumeOptions
+	unacked map[uint64]memMessage
+}
+
+func (c *memConsumer) run(ctx context.Context, out chan<- Delivery) {
+	b := c.broker
+	defer close(out)
+	defer c.stop()
+
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return
+		}
+		b.expire(c.queue)
+		full := !c.opts.AutoAck && c.opts.Prefetch > 0 && len(c.unacked) >= c.opts.Prefetch
+		if len(c.queue.ready) == 0 || full {
+			wait := b.changed
+			b.mu.Unlock()
+			select {
+			case <-wait:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		m := c.queue.ready[0]
+		c.queue.ready = c.queue.ready[1:]
+		b.nextTag++
+		tag := b.nextTag
+		if !c.opts.AutoAck {
+			c.unacked[tag] = m
+		}
+		b.mu.Unlock()
+
+		select {
+		case out <- c.delivery(tag, m):
+		case <-ctx.Done():
+			// never handed out, put it back as it was
+			c.requeue(tag, m)
+			return
+		}
+	}
+}
+
+func (c *memConsumer) delivery(tag uint64, m memMessage) Delivery {
+	d := Delivery{
+		Message:     m.msg,
+		Queue:       c.queue.name,
+		Redelivered: m.redelivered,
+	}
+	d.Headers = maps.Clone(m.msg.Headers)
+	if !c.opts.AutoAck {
+		d.ack = func() error { return c.settle(tag, false) }
+		d.nack = func(requeue bool) error { return c.settle(tag, requeue) }
+	}
+	return d
+}
+
+func (c *memConsumer) settle(tag uint64, requeue bool) error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := c.unacked[tag]
+	if !ok {
+		return ErrUnknownTag
+	}
+	delete(c.unacked, tag)
+	if requeue {
+		c.queue.ready = append([]memMessage{c.queue.redeliver(m)}, c.queue.ready...)
+	} else {
+		b.deadLetter(c.queue, m, "rejected")
+	}
+	b.notify()
+	return nil
+}
+
+// redeliver marks a message that goes back to the queue after being handed
+// to a consumer.
+func (q *memQueue) redeliver(m memMessage) memMessage {
+	m.redelivered = true
+	if q.opts.Args["x-queue-type"] == "quorum" {
+		m.msg.Headers = maps.Clone(m.msg.Headers)
+		if m.msg.Headers == nil {
+			m.msg.Headers = make(map[string]any)
+		}
+		m.msg.Headers[DeliveryCountHeader] = DeliveryCount(m.msg.Headers) + 1
+	}
+	return m
+}
+
+func (c *memConsumer) requeue(tag uint64, m memMessage) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(c.unacked, tag)
+	c.queue.ready = append([]memMessage{m}, c.queue.ready...)
+	b.notify()
+}
+
+// stop puts the unacknowledged deliveries back in the queue, the same thing
+// RabbitMQ does when a consumer's channel closes.
+func (c *memConsumer) stop() {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var requeued []memMessage
+	for _, tag := range slices.Sorted(maps.Keys(c.unacked)) {
+		requeued = append(requeued, c.queue.redeliver(c.unacked[tag]))
+	}
+	c.unacked = make(map[uint64]memMessage)
+	c.queue.ready = append(requeued, c.queue.ready...)
+
+	c.queue.consumers--
+	c.queue.exclusive = false
+	if c.queue.opts.AutoDelete && c.queue.consumers == 0 {
+		b.deleteQueue(c.queue.name)
+	}
+	b.notify()
+}
@@ -0,0 +1,274 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, msgs <-chan Delivery) Delivery {
+	t.Helper()
+	select {
+	case d, ok := <-msgs:
+		if !ok {
+			t.Fatal("delivery channel closed")
+		}
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a delivery")
+	}
+	return Delivery{}
+}
+
+func TestNackRequeue(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	ctx := context.Background()
+
+	q, _ := b.DeclareQueue("test", QueueOptions{})
+	b.Publish(ctx, "", q, Message{Body: []byte("a"), Headers: map[string]any{"k": "v"}})
+	b.Publish(ctx, "", q, Message{Body: []byte("b")})
+
+	msgs, err := b.Consume(ctx, q, ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := receive(t, msgs)
+	if string(d.Body) != "a" || d.Headers["k"] != "v" || d.Redelivered {
+		t.Fatalf("unexpected first delivery %+v", d)
+	}
+	d.Nack(true)
+
+	// without a prefetch limit b is already on its way to the consumer
+	d = receive(t, msgs)
+	if string(d.Body) != "b" {
+		t.Fatalf("expected b, got %s", d.Body)
+	}
+	d.Nack(false)
+
+	d = receive(t, msgs)
+	if string(d.Body) != "a" || !d.Redelivered {
+		t.Fatalf("expected a redelivered, got %+v", d)
+	}
+	d.Ack()
+	if err := d.Ack(); err != ErrUnknownTag {
+		t.Errorf("expected double ack to fail, got %v", err)
+	}
+
+	select {
+	case d := <-msgs:
+		t.Errorf("expected the queue to be empty, got %s", d.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestUnackedRequeuedWhenConsumerStops(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	q, _ := b.DeclareQueue("test", QueueOptions{})
+	b.Publish(context.Background(), "", q, Message{Body: []byte("a")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs, _ := b.Consume(ctx, q, ConsumeOptions{})
+	receive(t, msgs) // never acked
+	cancel()
+	for range msgs {
+	}
+
+	msgs, _ = b.Consume(context.Background(), q, ConsumeOptions{})
+	d := receive(t, msgs)
+	if string(d.Body) != "a" || !d.Redelivered {
+		t.Fatalf("expected a redelivered, got %+v", d)
+	}
+}
+
+func TestCompetingConsumers(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	ctx := context.Background()
+
+	q, _ := b.DeclareQueue("test", QueueOptions{})
+	first, _ := b.Consume(ctx, q, ConsumeOptions{AutoAck: true})
+	second, _ := b.Consume(ctx, q, ConsumeOptions{AutoAck: true})
+	for range 10 {
+		b.Publish(ctx, "", q, Message{Body: []byte("x")})
+	}
+
+	received := 0
+	for received < 10 {
+		select {
+		case <-first:
+		case <-second:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %d deliveries", received)
+		}
+		received++
+	}
+}
+
+func TestPrefetchAndDeliveryCount(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	ctx := context.Background()
+
+	q, _ := b.DeclareQueue("tasks", QueueOptions{Durable: true, Args: map[string]any{"x-queue-type": "quorum"}})
+	dlq, _ := b.DeclareQueue(DeadLetterQueue(q), QueueOptions{Durable: true})
+	b.Publish(ctx, "", q, Message{Body: []byte("a")})
+	b.Publish(ctx, "", q, Message{Body: []byte("b")})
+
+	msgs, _ := b.Consume(ctx, q, ConsumeOptions{Prefetch: 1})
+	for i := range 3 {
+		d := receive(t, msgs)
+		if string(d.Body) != "a" || DeliveryCount(d.Headers) != int64(i) {
+			t.Fatalf("expected a with delivery count %d, got %s with %v", i, d.Body, d.Headers)
+		}
+		if i < 2 {
+			d.Nack(true)
+			continue
+		}
+		DeadLetter(ctx, b, d, errors.New("boom"))
+	}
+	if d := receive(t, msgs); string(d.Body) != "b" {
+		t.Fatalf("expected b, got %s", d.Body)
+	}
+
+	dead, _ := b.Consume(ctx, dlq, ConsumeOptions{})
+	d := receive(t, dead)
+	if string(d.Body) != "a" || d.Headers[OriginalQueueHeader] != q || d.Headers[DeathReasonHeader] != "boom" {
+		t.Errorf("unexpected dead letter %s with %v", d.Body, d.Headers)
+	}
+}
+
+func TestTopologyRouting(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	ctx := context.Background()
+
+	topology, err := ParseTopology([]byte(`{
+		"exchanges": [{"name": "events", "kind": "topic"}, {"name": "tagged", "kind": "headers"}],
+		"queues": [{"name": "kern"}, {"name": "all", "max_length": 2}, {"name": "infra"}],
+		"bindings": [
+			{"queue": "kern", "exchange": "events", "key": "kern.*"},
+			{"queue": "all", "exchange": "events", "key": "#"},
+			{"queue": "infra", "exchange": "tagged", "args": {"x-match": "any", "team": "infra", "priority": 1}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := topology.Declare(b); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"kern.info", "kern.disk.full", "app.info"} {
+		b.Publish(ctx, "events", key, Message{Body: []byte(key)})
+	}
+	b.Publish(ctx, "tagged", "", Message{Body: []byte("p1"), Headers: map[string]any{"priority": 1}})
+	b.Publish(ctx, "tagged", "", Message{Body: []byte("p2"), Headers: map[string]any{"priority": 2}})
+
+	expected := map[string][]string{
+		"kern":  {"kern.info"},
+		"all":   {"kern.disk.full", "app.info"}, // max_length drops the oldest
+		"infra": {"p1"},
+	}
+	for queue, bodies := range expected {
+		msgs, _ := b.Consume(ctx, queue, ConsumeOptions{AutoAck: true})
+		for _, body := range bodies {
+			if d := receive(t, msgs); string(d.Body) != body {
+				t.Errorf("expected %s in %s, got %s", body, queue, d.Body)
+			}
+		}
+		select {
+		case d := <-msgs:
+			t.Errorf("unexpected %s in %s", d.Body, queue)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+func TestJitterSpreadsRetriesOverTiers(t *testing.T) {
+	policy := RetryPolicy{
+		Tiers:     []time.Duration{time.Second, 5 * time.Second, 30 * time.Second},
+		BaseDelay: 4 * time.Second,
+		MaxDelay:  time.Minute,
+		Jitter:    0.5,
+	}
+	// the first retry waits 2s to 4s, which goes to the 1s or the 5s tier,
+	// each half of the time on average
+	counts := make(map[time.Duration]int)
+	for range 10000 {
+		counts[policy.tier(policy.Delay(1))]++
+	}
+	if len(counts) != 2 || counts[time.Second] < 4500 || counts[5*time.Second] < 4500 {
+		t.Errorf("expected retries to be spread over the 1s and 5s tiers but got %v", counts)
+	}
+
+	for delay, want := range map[time.Duration]time.Duration{
+		500 * time.Millisecond: time.Second,
+		5 * time.Second:        5 * time.Second,
+		time.Minute:            30 * time.Second,
+	} {
+		if got := policy.tier(delay); got != want {
+			t.Errorf("expected %v to go to the %v tier but got %v", delay, want, got)
+		}
+	}
+}
+
+func TestRetryThroughDelayQueues(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	ctx := context.Background()
+
+	policy := RetryPolicy{
+		Tiers:       []time.Duration{20 * time.Millisecond, 50 * time.Millisecond},
+		BaseDelay:   20 * time.Millisecond,
+		MaxDelay:    50 * time.Millisecond,
+		MaxAttempts: 3,
+	}
+	q, _ := b.DeclareQueue("work", QueueOptions{})
+	if err := DeclareRetryQueues(b, q, policy); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := b.Consume(ctx, q, ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var attempts []int
+	handle := WithRetry(b, q, policy, func(ctx context.Context, d Delivery) error {
+		attempts = append(attempts, Attempt(d.Headers))
+		if string(d.Body) == "ok" && Attempt(d.Headers) == 1 {
+			return nil
+		}
+		return errors.New("failed")
+	})
+
+	b.Publish(ctx, "", q, Message{Body: []byte("ok")})
+	start := time.Now()
+	handle(ctx, receive(t, msgs))
+	handle(ctx, receive(t, msgs))
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("expected the retry to wait for the first tier, came back after %v", elapsed)
+	}
+
+	b.Publish(ctx, "", q, Message{Body: []byte("bad")})
+	for range policy.MaxAttempts {
+		handle(ctx, receive(t, msgs))
+	}
+	if want := []int{0, 1, 0, 1, 2}; !slices.Equal(attempts, want) {
+		t.Errorf("expected attempts %v but got %v", want, attempts)
+	}
+
+	parked, err := b.Consume(ctx, ParkingQueue(q), ConsumeOptions{AutoAck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := receive(t, parked)
+	if string(d.Body) != "bad" || Attempt(d.Headers) != 3 || d.Headers[OriginalQueueHeader] != q {
+		t.Errorf("unexpected parked message %s %v", d.Body, d.Headers)
+	}
+}
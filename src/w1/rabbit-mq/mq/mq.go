@@ -0,0 +1,105 @@
+// Package mq hides the message broker behind small Publisher/Consumer
+// interfaces so the demos can run against RabbitMQ or fully in memory.
+package mq
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrClosed     = errors.New("mq: broker closed")
+	ErrUnknownTag = errors.New("mq: unknown delivery tag")
+)
+
+type Message struct {
+	Body          []byte
+	ContentType   string
+	Headers       map[string]any
+	Persistent    bool
+	CorrelationID string
+	ReplyTo       string
+}
+
+// Delivery is a message handed to a consumer. Unless the consumer was
+// started with AutoAck, it must be acknowledged with Ack or Nack.
+type Delivery struct {
+	Message
+	Queue       string
+	Redelivered bool
+
+	ack  func() error
+	nack func(requeue bool) error
+}
+
+func (d Delivery) Ack() error {
+	if d.ack == nil {
+		return nil
+	}
+	return d.ack()
+}
+
+// Nack rejects the delivery. With requeue the broker delivers it again,
+// otherwise it is dropped, or dead-lettered if the queue has an
+// x-dead-letter-exchange.
+func (d Delivery) Nack(requeue bool) error {
+	if d.nack == nil {
+		return nil
+	}
+	return d.nack(requeue)
+}
+
+type QueueOptions struct {
+	Durable    bool
+	AutoDelete bool // deleted when its last consumer goes away
+	Exclusive  bool
+	Args       map[string]any
+}
+
+// Exchange kinds.
+const (
+	Direct  = "direct"
+	Fanout  = "fanout"
+	Topic   = "topic"
+	Headers = "headers"
+)
+
+type ExchangeOptions struct {
+	Durable    bool
+	AutoDelete bool // deleted when its last binding goes away
+	Args       map[string]any
+}
+
+type ConsumeOptions struct {
+	AutoAck   bool
+	Exclusive bool
+	// Prefetch caps the number of unacknowledged deliveries the consumer
+	// holds, zero means no limit. Ignored with AutoAck.
+	Prefetch int
+}
+
+type Publisher interface {
+	// Publish sends the message to an exchange. The default exchange ""
+	// routes to the queue named by key.
+	Publish(ctx context.Context, exchange, key string, msg Message) error
+}
+
+type Consumer interface {
+	// Consume delivers messages of the queue until ctx is cancelled or the
+	// broker is closed, then closes the channel. Unacknowledged deliveries
+	// are requeued when the consumer goes away.
+	Consume(ctx context.Context, queue string, opts ConsumeOptions) (<-chan Delivery, error)
+}
+
+type Broker interface {
+	Publisher
+	Consumer
+	// DeclareQueue creates the queue if it doesn't exist and returns its
+	// name, which is generated by the broker when name is empty.
+	DeclareQueue(name string, opts QueueOptions) (string, error)
+	DeclareExchange(name, kind string, opts ExchangeOptions) error
+	// BindQueue routes messages published to exchange with a matching key
+	// to queue. Headers exchanges match on args instead of the key.
+	BindQueue(queue, key, exchange string, args map[string]any) error
+	Close() error
+}
@@ -0,0 +1,81 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrGraceExpired is returned by Process when handlers were still running at
+// the end of the grace period.
+var ErrGraceExpired = errors.New("mq: grace period expired with deliveries in flight")
+
+// DefaultGrace is how long in-flight deliveries get to finish on shutdown.
+const DefaultGrace = 10 * time.Second
+
+// Process consumes queue and runs handle for each delivery on the given
+// number of workers until ctx is cancelled or the broker is closed.
+//
+// Cancelling ctx only stops taking new deliveries: the consumer itself stays
+// open so handlers already running can finish and ack within the grace
+// period. Their ctx is cancelled once it expires. After that the consumer
+// is closed, which hands anything left unacked back to the broker.
+func Process(ctx context.Context, c Consumer, queue string, opts ConsumeOptions, workers int, grace time.Duration, handle func(context.Context, Delivery)) error {
+	consumeCtx, stopConsuming := context.WithCancel(context.WithoutCancel(ctx))
+	msgs, err := c.Consume(consumeCtx, queue, opts)
+	if err != nil {
+		stopConsuming()
+		return err
+	}
+	handleCtx, cancelHandlers := context.WithCancel(context.WithoutCancel(ctx))
+	defer func() {
+		cancelHandlers()
+		stopConsuming()
+		// wait for the consumer to go away, whatever it still had for us
+		// goes back to the queue
+		for d := range msgs {
+			d.Nack(true)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case d, ok := <-msgs:
+					if !ok {
+						return
+					}
+					if ctx.Err() != nil && !opts.AutoAck {
+						d.Nack(true)
+						return
+					}
+					handle(handleCtx, d)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(grace):
+		return ErrGraceExpired
+	}
+}
@@ -0,0 +1,71 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProcessFinishesInFlight(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	q, _ := b.DeclareQueue("work", QueueOptions{})
+	for _, body := range []string{"a", "b"} {
+		b.Publish(context.Background(), "", q, Message{Body: []byte(body)})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	acked := make(chan error, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- Process(ctx, b, q, ConsumeOptions{Prefetch: 1}, 1, time.Second, func(ctx context.Context, d Delivery) {
+			close(started)
+			time.Sleep(50 * time.Millisecond)
+			acked <- d.Ack()
+		})
+	}()
+
+	<-started
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("expected a clean shutdown but got %v", err)
+	}
+	if err := <-acked; err != nil {
+		t.Errorf("expected the in-flight delivery to be acked but got %v", err)
+	}
+
+	// only the delivery that was in progress got processed
+	msgs, _ := b.Consume(context.Background(), q, ConsumeOptions{AutoAck: true})
+	if d := receive(t, msgs); string(d.Body) != "b" {
+		t.Errorf("expected b to be left in the queue, got %s", d.Body)
+	}
+}
+
+func TestProcessGraceExpires(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	q, _ := b.DeclareQueue("work", QueueOptions{})
+	b.Publish(context.Background(), "", q, Message{Body: []byte("a")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- Process(ctx, b, q, ConsumeOptions{}, 1, 10*time.Millisecond, func(ctx context.Context, d Delivery) {
+			close(started)
+			<-ctx.Done()
+		})
+	}()
+
+	<-started
+	cancel()
+	if err := <-done; !errors.Is(err, ErrGraceExpired) {
+		t.Fatalf("expected the grace period to expire but got %v", err)
+	}
+	msgs, _ := b.Consume(context.Background(), q, ConsumeOptions{AutoAck: true})
+	if d := receive(t, msgs); string(d.Body) != "a" || !d.Redelivered {
+		t.Errorf("expected a to be requeued, got %+v", d)
+	}
+}
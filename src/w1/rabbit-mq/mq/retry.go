@@ -0,0 +1,161 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// AttemptHeader counts how many times a message has been retried.
+const AttemptHeader = "x-retry-attempt"
+
+// Handler processes a delivery. It must not ack or nack it, returning an
+// error marks it for a retry.
+type Handler func(ctx context.Context, d Delivery) error
+
+// RetryPolicy sets how failed messages are retried. Delays are computed as
+// BaseDelay * 2^(attempt-1), capped at MaxDelay, and jittered down by up to
+// Jitter of that. Since RabbitMQ only expires messages at the head of a
+// queue, each delay tier gets its own queue with a fixed TTL instead of
+// using per-message expiration. A jittered delay between two tiers goes to
+// one of them at random, weighted by how close it is, so the jitter still
+// spreads retries out after the delay is tiered.
+type RetryPolicy struct {
+	Tiers       []time.Duration
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64 // fraction of the delay, 0 to 1
+	MaxAttempts int     // attempts before the message is parked
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Tiers:       []time.Duration{time.Second, 5 * time.Second, 30 * time.Second, 2 * time.Minute},
+		BaseDelay:   time.Second,
+		MaxDelay:    2 * time.Minute,
+		Jitter:      0.5,
+		MaxAttempts: 5,
+	}
+}
+
+// RetryQueue is the name of the delay queue of queue for one tier.
+func RetryQueue(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", queue, delay)
+}
+
+// ParkingQueue is where messages of queue end up after the last attempt,
+// they stay there until someone looks at them.
+func ParkingQueue(queue string) string {
+	return queue + ".parking"
+}
+
+// Attempt returns the number of retries recorded in the headers.
+func Attempt(headers map[string]any) int {
+	switch n := headers[AttemptHeader].(type) {
+	case int:
+		return n
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	}
+	return 0
+}
+
+// DeclareRetryQueues declares a delay queue per tier, which dead-letters
+// expired messages back to queue through the default exchange, and the
+// parking queue.
+func DeclareRetryQueues(b Broker, queue string, p RetryPolicy) error {
+	for _, tier := range p.Tiers {
+		_, err := b.DeclareQueue(RetryQueue(queue, tier), QueueOptions{
+			Durable: true,
+			Args: map[string]any{
+				"x-message-ttl":             tier.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queue,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("declaring retry queue for %s: %w", tier, err)
+		}
+	}
+	if _, err := b.DeclareQueue(ParkingQueue(queue), QueueOptions{Durable: true}); err != nil {
+		return fmt.Errorf("declaring parking queue: %w", err)
+	}
+	return nil
+}
+
+// Delay returns the jittered backoff before the given attempt, starting at 1.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 && d > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// tier picks the tier of delay. A delay between two tiers goes to the
+// upper one with a probability of how far it is from the lower one, so on
+// average the retry waits delay. Shorter and longer delays go to the
+// smallest and largest tier.
+func (p RetryPolicy) tier(delay time.Duration) time.Duration {
+	tiers := slices.Sorted(slices.Values(p.Tiers))
+	i, found := slices.BinarySearch(tiers, delay)
+	switch {
+	case found || i == 0:
+		return tiers[i]
+	case i == len(tiers):
+		return tiers[i-1]
+	}
+	lo, hi := tiers[i-1], tiers[i]
+	if rand.Float64()*float64(hi-lo) < float64(delay-lo) {
+		return hi
+	}
+	return lo
+}
+
+// WithRetry turns a handler into a function that settles the delivery
+// itself: it acks on success, and on failure republishes a copy with the
+// attempt counter incremented to the delay queue matching the backoff, or
+// to the parking queue once MaxAttempts is reached, and then acks the
+// original. If the republish fails the delivery is requeued instead. The
+// delay and parking queues must be declared with DeclareRetryQueues.
+func WithRetry(p Publisher, queue string, policy RetryPolicy, h Handler) func(ctx context.Context, d Delivery) {
+	return func(ctx context.Context, d Delivery) {
+		err := h(ctx, d)
+		if err == nil {
+			d.Ack()
+			return
+		}
+
+		attempt := Attempt(d.Headers) + 1
+		msg := d.Message
+		msg.Headers = maps.Clone(msg.Headers)
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]any)
+		}
+		msg.Headers[AttemptHeader] = int64(attempt)
+		msg.Headers[DeathReasonHeader] = err.Error()
+
+		key := ParkingQueue(queue)
+		if attempt < policy.MaxAttempts && len(policy.Tiers) > 0 {
+			key = RetryQueue(queue, policy.tier(policy.Delay(attempt)))
+		} else {
+			msg.Headers[OriginalQueueHeader] = queue
+		}
+		if err := p.Publish(ctx, "", key, msg); err != nil {
+			d.Nack(true)
+			return
+		}
+		d.Ack()
+	}
+}
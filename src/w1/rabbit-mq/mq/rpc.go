@@ -0,0 +1,212 @@
+package mq
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// MethodHeader names the handler a request is for.
+	MethodHeader = "x-rpc-method"
+	// ErrorHeader is set on replies whose handler failed.
+	ErrorHeader = "x-rpc-error"
+)
+
+// RPCError is an error returned by the remote handler.
+type RPCError struct {
+	Method  string
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("mq: %s failed: %s", e.Method, e.Message)
+}
+
+// RPCClient sends requests to the queue of an RPCServer and waits for the
+// reply on its own exclusive callback queue, matching replies to calls by
+// correlation id. It is safe for concurrent use.
+type RPCClient struct {
+	b       Broker
+	queue   string
+	replyTo string
+	// Timeout bounds calls whose ctx has no deadline, zero means none.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string]chan Delivery
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewRPCClient declares the request queue, so requests sent before a server
+// is up aren't dropped, and the callback queue and starts listening on it.
+// The callback queue is named by the client rather than the broker so an
+// AMQP broker can declare it again after a reconnect, replies in flight at
+// that moment are lost and those calls time out.
+func NewRPCClient(b Broker, queue string, timeout time.Duration) (*RPCClient, error) {
+	if _, err := b.DeclareQueue(queue, QueueOptions{}); err != nil {
+		return nil, err
+	}
+	replyTo, err := b.DeclareQueue("rpc.reply."+rand.Text(), QueueOptions{Exclusive: true, AutoDelete: true})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	replies, err := b.Consume(ctx, replyTo, ConsumeOptions{AutoAck: true, Exclusive: true})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	c := &RPCClient{
+		b:       b,
+		queue:   queue,
+		replyTo: replyTo,
+		Timeout: timeout,
+		pending: make(map[string]chan Delivery),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go c.dispatch(replies)
+	return c, nil
+}
+
+func (c *RPCClient) dispatch(replies <-chan Delivery) {
+	defer close(c.done)
+	for d := range replies {
+		c.mu.Lock()
+		ch, ok := c.pending[d.CorrelationID]
+		c.mu.Unlock()
+		if !ok {
+			// the call already timed out
+			continue
+		}
+		select {
+		case ch <- d:
+		default: // duplicate reply
+		}
+	}
+}
+
+// Call invokes method on the server and returns the reply payload. It fails
+// with an *RPCError if the handler did, and with the ctx error if no reply
+// came in time.
+func (c *RPCClient) Call(ctx context.Context, method string, payload []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok && c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	id := rand.Text()
+	reply := make(chan Delivery, 1)
+	c.mu.Lock()
+	c.pending[id] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	err := c.b.Publish(ctx, "", c.queue, Message{
+		Body:          payload,
+		Headers:       map[string]any{MethodHeader: method},
+		CorrelationID: id,
+		ReplyTo:       c.replyTo,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("mq: calling %s: %w", method, err)
+	}
+
+	select {
+	case d := <-reply:
+		if msg, ok := d.Headers[ErrorHeader].(string); ok {
+			return nil, &RPCError{Method: method, Message: msg}
+		}
+		return d.Body, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("mq: calling %s: %w", method, ctx.Err())
+	case <-c.done:
+		return nil, fmt.Errorf("mq: calling %s: %w", method, ErrClosed)
+	}
+}
+
+// Close stops listening for replies, which deletes the callback queue.
+func (c *RPCClient) Close() error {
+	c.cancel()
+	<-c.done
+	return nil
+}
+
+// RPCHandler serves one method, the returned bytes are the reply payload.
+type RPCHandler func(ctx context.Context, payload []byte) ([]byte, error)
+
+// RPCServer consumes requests from a queue and dispatches them to the
+// handler registered for their method, running at most Workers at once.
+// Several servers on the same queue share the load.
+type RPCServer struct {
+	b       Broker
+	queue   string
+	workers int
+	// Grace is how long requests being handled get to finish when Serve
+	// is stopped.
+	Grace time.Duration
+
+	mu       sync.RWMutex
+	handlers map[string]RPCHandler
+}
+
+func NewRPCServer(b Broker, queue string, workers int) *RPCServer {
+	if workers < 1 {
+		workers = 1
+	}
+	return &RPCServer{b: b, queue: queue, workers: workers, Grace: DefaultGrace, handlers: make(map[string]RPCHandler)}
+}
+
+func (s *RPCServer) Handle(method string, h RPCHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method] = h
+}
+
+// Serve declares the request queue and handles requests until ctx is
+// cancelled, then lets the requests in progress finish, see Process. The
+// prefetch limit matches the worker count, so requests this server can't
+// start yet stay in the queue for other servers.
+func (s *RPCServer) Serve(ctx context.Context) error {
+	if _, err := s.b.DeclareQueue(s.queue, QueueOptions{}); err != nil {
+		return err
+	}
+	return Process(ctx, s.b, s.queue, ConsumeOptions{Prefetch: s.workers}, s.workers, s.Grace, s.serve)
+}
+
+func (s *RPCServer) serve(ctx context.Context, d Delivery) {
+	method, _ := d.Headers[MethodHeader].(string)
+	s.mu.RLock()
+	h, ok := s.handlers[method]
+	s.mu.RUnlock()
+
+	var body []byte
+	var err error
+	if ok {
+		body, err = h(ctx, d.Body)
+	} else {
+		err = fmt.Errorf("unknown method %q", method)
+	}
+
+	if d.ReplyTo != "" {
+		reply := Message{Body: body, CorrelationID: d.CorrelationID}
+		if err != nil {
+			reply.Headers = map[string]any{ErrorHeader: err.Error()}
+		}
+		if err := s.b.Publish(ctx, "", d.ReplyTo, reply); err != nil {
+			log.Printf("mq: replying to %s: %v", method, err)
+		}
+	}
+	d.Ack()
+}
@@ -0,0 +1,61 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRPC(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewRPCServer(b, "rpc", 2)
+	s.Handle("echo", func(ctx context.Context, payload []byte) ([]byte, error) {
+		return payload, nil
+	})
+	s.Handle("fail", func(ctx context.Context, payload []byte) ([]byte, error) {
+		return nil, errors.New("boom")
+	})
+
+	c, err := NewRPCClient(b, "rpc", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// requests sent before the server is up wait in the queue
+	echoed := make(chan []byte, 1)
+	go func() {
+		reply, err := c.Call(ctx, "echo", []byte("hi"))
+		if err != nil {
+			t.Error(err)
+		}
+		echoed <- reply
+	}()
+	go s.Serve(ctx)
+	if reply := <-echoed; string(reply) != "hi" {
+		t.Errorf("expected hi but got %q", reply)
+	}
+
+	var rpcErr *RPCError
+	if _, err := c.Call(ctx, "fail", nil); !errors.As(err, &rpcErr) || rpcErr.Message != "boom" {
+		t.Errorf("expected the handler error but got %v", err)
+	}
+	if _, err := c.Call(ctx, "missing", nil); !errors.As(err, &rpcErr) {
+		t.Errorf("expected an unknown method error but got %v", err)
+	}
+
+	short, cancelShort := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelShort()
+	s.Handle("slow", func(ctx context.Context, payload []byte) ([]byte, error) {
+		time.Sleep(50 * time.Millisecond)
+		return payload, nil
+	})
+	if _, err := c.Call(short, "slow", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a timeout but got %v", err)
+	}
+}
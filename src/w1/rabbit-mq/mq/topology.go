@@ -0,0 +1,137 @@
+package mq
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+)
+
+// Topology describes exchanges, queues and the bindings between them so a
+// routing setup can live in a config file instead of code.
+type Topology struct {
+	Exchanges []ExchangeSpec `json:"exchanges"`
+	Queues    []QueueSpec    `json:"queues"`
+	Bindings  []BindingSpec  `json:"bindings"`
+}
+
+type ExchangeSpec struct {
+	Name       string         `json:"name"`
+	Kind       string         `json:"kind"`
+	Durable    bool           `json:"durable"`
+	AutoDelete bool           `json:"auto_delete"`
+	Args       map[string]any `json:"args"`
+}
+
+// QueueSpec has fields for the common x- arguments, anything else can go in
+// Args.
+type QueueSpec struct {
+	Name       string `json:"name"`
+	Durable    bool   `json:"durable"`
+	AutoDelete bool   `json:"auto_delete"`
+	Exclusive  bool   `json:"exclusive"`
+
+	MessageTTL           int64  `json:"message_ttl_ms"` // x-message-ttl
+	MaxLength            int64  `json:"max_length"`     // x-max-length
+	DeadLetterExchange   string `json:"dead_letter_exchange"`
+	DeadLetterRoutingKey string `json:"dead_letter_routing_key"`
+
+	Args map[string]any `json:"args"`
+}
+
+type BindingSpec struct {
+	Queue    string         `json:"queue"`
+	Exchange string         `json:"exchange"`
+	Key      string         `json:"key"`
+	Args     map[string]any `json:"args"` // match arguments of headers exchanges
+}
+
+func LoadTopology(path string) (Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Topology{}, err
+	}
+	return ParseTopology(data)
+}
+
+func ParseTopology(data []byte) (Topology, error) {
+	var t Topology
+	if err := json.Unmarshal(data, &t); err != nil {
+		return t, err
+	}
+	for _, e := range t.Exchanges {
+		switch e.Kind {
+		case Direct, Fanout, Topic, Headers:
+		default:
+			return t, fmt.Errorf("mq: exchange %q has unknown kind %q", e.Name, e.Kind)
+		}
+	}
+	return t, nil
+}
+
+func (q QueueSpec) Options() QueueOptions {
+	args := normalizeArgs(q.Args)
+	if args == nil {
+		args = make(map[string]any)
+	}
+	if q.MessageTTL > 0 {
+		args["x-message-ttl"] = q.MessageTTL
+	}
+	if q.MaxLength > 0 {
+		args["x-max-length"] = q.MaxLength
+	}
+	if q.DeadLetterExchange != "" || q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	return QueueOptions{Durable: q.Durable, AutoDelete: q.AutoDelete, Exclusive: q.Exclusive, Args: args}
+}
+
+// Declare creates everything in the topology, exchanges first. It returns
+// the actual queue names by their names in the topology, which only differ
+// for server named queues. Bindings refer to those by the name "" too, so a
+// topology should have at most one of them.
+func (t Topology) Declare(b Broker) (map[string]string, error) {
+	for _, e := range t.Exchanges {
+		opts := ExchangeOptions{Durable: e.Durable, AutoDelete: e.AutoDelete, Args: normalizeArgs(e.Args)}
+		if err := b.DeclareExchange(e.Name, e.Kind, opts); err != nil {
+			return nil, fmt.Errorf("declaring exchange %q: %w", e.Name, err)
+		}
+	}
+	names := make(map[string]string, len(t.Queues))
+	for _, q := range t.Queues {
+		name, err := b.DeclareQueue(q.Name, q.Options())
+		if err != nil {
+			return nil, fmt.Errorf("declaring queue %q: %w", q.Name, err)
+		}
+		names[q.Name] = name
+	}
+	for _, bind := range t.Bindings {
+		queue, ok := names[bind.Queue]
+		if !ok {
+			queue = bind.Queue
+		}
+		if err := b.BindQueue(queue, bind.Key, bind.Exchange, normalizeArgs(bind.Args)); err != nil {
+			return nil, fmt.Errorf("binding %q to %q: %w", queue, bind.Exchange, err)
+		}
+	}
+	return names, nil
+}
+
+// normalizeArgs turns the float64 that encoding/json produces for whole
+// numbers into int64, RabbitMQ rejects x-message-ttl and friends as doubles.
+func normalizeArgs(args map[string]any) map[string]any {
+	if args == nil {
+		return nil
+	}
+	args = maps.Clone(args)
+	for k, v := range args {
+		if f, ok := v.(float64); ok && f == math.Trunc(f) {
+			args[k] = int64(f)
+		}
+	}
+	return args
+}
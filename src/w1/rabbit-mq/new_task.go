@@ -3,28 +3,37 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
 	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
+	"rabbitmq/mq"
 )
 
-func CreateTasks() {
-	conn, chn, q := Setup()
-	defer conn.Close()
-	defer chn.Close()
+// CreateTasks publishes ten persistent tasks and returns the ones the broker
+// confirmed. Publish only returns nil once RabbitMQ has taken responsibility
+// for the message, so anything missing from the result has to be resent.
+func CreateTasks(b mq.Broker) []string {
+	q := SetupTasks(b)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	var accepted []string
 	for i := range 10 {
 		body := fmt.Sprintf("msg %d", i)
-		err := chn.PublishWithContext(ctx, "", q.Name, false, false, amqp.Publishing{
-			Body:         []byte(body),
-			DeliveryMode: amqp.Persistent,
-			ContentType:  "text/plain",
+		err := b.Publish(ctx, "", q, mq.Message{
+			Body:        []byte(body),
+			Persistent:  true,
+			ContentType: "text/plain",
 		})
-		FailOnError(err, "Failed to publish a message")
+		if err != nil {
+			log.Printf(" [!] %s was not accepted: %v", body, err)
+			continue
+		}
+		accepted = append(accepted, body)
 		// log.Printf(" [x] Sent %s", body)
 		time.Sleep(100 * time.Millisecond)
 	}
+	log.Printf(" [x] Broker accepted %d of 10 tasks", len(accepted))
+	return accepted
 }
@@ -1,33 +1,19 @@
 package main
 
 import (
+	"context"
 	"log"
-)
-
-func Receive() {
-	conn, ch, q := Setup()
-	defer conn.Close()
-	defer ch.Close()
 
-	msgs, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		true,   // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
-	FailOnError(err, "Failed to register a consumer")
-
-	var forever chan struct{}
+	"rabbitmq/mq"
+)
 
-	go func() {
-		for d := range msgs {
-			log.Printf("Received a message: %s", d.Body)
-		}
-	}()
+// Receive prints messages until ctx is cancelled.
+func Receive(ctx context.Context, b mq.Broker) {
+	q := Setup(b)
 
 	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
-	<-forever
+	err := mq.Process(ctx, b, q, mq.ConsumeOptions{AutoAck: true}, 1, *grace, func(ctx context.Context, d mq.Delivery) {
+		log.Printf("Received a message: %s", d.Body)
+	})
+	FailOnError(err, "Failed to consume")
 }
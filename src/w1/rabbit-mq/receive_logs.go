@@ -0,0 +1,18 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"rabbitmq/mq"
+)
+
+// ReceiveLogs prints what ends up in one of the queues of a topology until
+// ctx is cancelled.
+func ReceiveLogs(ctx context.Context, b mq.Broker, queue string) {
+	log.Printf(" [*] Waiting for logs on %s. To exit press CTRL+C", queue)
+	err := mq.Process(ctx, b, queue, mq.ConsumeOptions{AutoAck: true}, 1, *grace, func(ctx context.Context, d mq.Delivery) {
+		log.Printf("[%s] %s", queue, d.Body)
+	})
+	FailOnError(err, "Failed to consume")
+}
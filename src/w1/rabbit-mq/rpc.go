@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rabbitmq/mq"
+)
+
+var (
+	rpcQueue   = flag.String("rpc-queue", "rpc_queue", "queue the RPC server listens on")
+	rpcWorkers = flag.Int("rpc-workers", 4, "requests the RPC server handles at once")
+	rpcTimeout = flag.Duration("rpc-timeout", 5*time.Second, "how long a call waits for its reply")
+)
+
+// ServeDelivery answers the calls food_delivery's order service makes over
+// HTTP to the food and agent services, with a made up processing time, so
+// the two can be compared.
+func ServeDelivery(ctx context.Context, b mq.Broker) error {
+	s := mq.NewRPCServer(b, *rpcQueue, *rpcWorkers)
+	for _, method := range []string{"food.reserve", "agent.reserve", "food.book", "agent.book"} {
+		s.Handle(method, func(ctx context.Context, payload []byte) ([]byte, error) {
+			time.Sleep(time.Duration(10+rand.IntN(40)) * time.Millisecond)
+			if rand.Float64() < *failRate/4 {
+				return nil, errors.New("nothing left to " + method)
+			}
+			return payload, nil
+		})
+	}
+	return s.Serve(ctx)
+}
+
+var orderID atomic.Int64
+
+// PlaceOrder is order/svc.PlaceOrder with the HTTP requests replaced by
+// calls over the queue.
+func PlaceOrder(ctx context.Context, c *mq.RPCClient) (string, error) {
+	if _, err := c.Call(ctx, "food.reserve", nil); err != nil {
+		return "", err
+	}
+	if _, err := c.Call(ctx, "agent.reserve", nil); err != nil {
+		return "", err
+	}
+	id := fmt.Sprintf("order-%d", orderID.Add(1))
+	if _, err := c.Call(ctx, "food.book", []byte(id)); err != nil {
+		return "", err
+	}
+	if _, err := c.Call(ctx, "agent.book", []byte(id)); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// PlaceOrders places 10 orders at once like the order service's main does.
+func PlaceOrders(b mq.Broker) {
+	c, err := mq.NewRPCClient(b, *rpcQueue, *rpcTimeout)
+	FailOnError(err, "Failed to create the RPC client")
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := PlaceOrder(context.Background(), c)
+			if err != nil {
+				log.Printf("Error placing order: %v", err)
+				return
+			}
+			log.Printf("Order placed successfully: %s", id)
+		}()
+	}
+	wg.Wait()
+	log.Printf("Took %f seconds", time.Since(start).Seconds())
+}
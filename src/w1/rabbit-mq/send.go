@@ -5,20 +5,18 @@ import (
 	"log"
 	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
+	"rabbitmq/mq"
 )
 
-func Send() {
-	conn, chn, q := Setup()
-	defer conn.Close()
-	defer chn.Close()
+func Send(b mq.Broker) {
+	q := Setup(b)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	body := "Hello World!"
 	for range 10 {
-		err := chn.PublishWithContext(ctx, "", q.Name, false, false, amqp.Publishing{
+		err := b.Publish(ctx, "", q, mq.Message{
 			Body:        []byte(body),
 			ContentType: "text/plain",
 		})
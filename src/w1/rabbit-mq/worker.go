@@ -1,36 +1,105 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"math/rand/v2"
 	"time"
+
+	"rabbitmq/mq"
+)
+
+var (
+	prefetch      = flag.Int("prefetch", 1, "unacknowledged tasks a worker may hold")
+	maxDeliveries = flag.Int64("max-deliveries", 3, "deliveries of a failing task before it goes to the dead-letter queue")
+	failRate      = flag.Float64("fail-rate", 0.2, "probability that processing a task fails")
+	retry         = flag.Bool("retry", false, "retry failed tasks with a backoff through delay queues instead of requeueing them right away")
 )
 
-func Consume(num int) {
-	conn, ch, q := Setup()
-	defer conn.Close()
-	defer ch.Close()
-
-	msgs, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		true,   // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
-	FailOnError(err, "Failed to register a consumer")
-
-	var forever chan struct{}
-
-	go func() {
-		for d := range msgs {
+// Consume processes tasks with manual acks until ctx is cancelled. A task is
+// only acked once it is done, so if the worker dies mid-task the broker hands
+// it to another one, and the prefetch limit keeps a single worker from
+// hoarding the backlog. On shutdown the task in progress gets the grace
+// period to finish.
+func Consume(ctx context.Context, b mq.Broker, num int) {
+	q := SetupTasks(b)
+
+	handle := func(ctx context.Context, d mq.Delivery) {
+		log.Printf("[%d] Received a message: %s", num, d.Body)
+		if err := process(ctx, d); err != nil {
+			handleFailure(ctx, b, num, d, err)
+			return
+		}
+		if err := d.Ack(); err != nil {
+			log.Printf("[%d] Failed to ack %s: %v", num, d.Body, err)
+		}
+	}
+	if *retry {
+		handle = mq.WithRetry(b, q, retryPolicy(), func(ctx context.Context, d mq.Delivery) error {
 			log.Printf("[%d] Received a message: %s", num, d.Body)
-			time.Sleep(time.Duration(rand.Int64N(1000)) * time.Millisecond)
+			err := process(ctx, d)
+			if err != nil {
+				log.Printf("[%d] Failed %s (attempt %d): %v", num, d.Body, mq.Attempt(d.Headers)+1, err)
+			}
+			return err
+		})
+	}
+
+	log.Printf("[%d] Waiting for tasks. To exit press CTRL+C", num)
+	err := mq.Process(ctx, b, q, mq.ConsumeOptions{Prefetch: *prefetch}, 1, *grace, handle)
+	if errors.Is(err, mq.ErrGraceExpired) {
+		log.Printf("[%d] Gave up on the task in progress, the broker will redeliver it", num)
+		return
+	}
+	FailOnError(err, "Failed to consume")
+}
+
+func process(ctx context.Context, d mq.Delivery) error {
+	select {
+	case <-time.After(time.Duration(rand.Int64N(1000)) * time.Millisecond):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if rand.Float64() < *failRate {
+		return errors.New("simulated failure")
+	}
+	return nil
+}
+
+// handleFailure requeues the task unless it has already been delivered
+// max-deliveries times, in which case it is parked in the dead-letter queue.
+func handleFailure(ctx context.Context, b mq.Broker, num int, d mq.Delivery, err error) {
+	if ctx.Err() != nil {
+		// out of time during shutdown, the broker redelivers it when the
+		// consumer closes
+		log.Printf("[%d] Abandoned %s: %v", num, d.Body, err)
+		return
+	}
+	deliveries := mq.DeliveryCount(d.Headers) + 1
+	if deliveries < *maxDeliveries {
+		log.Printf("[%d] Failed %s (delivery %d): %v, requeueing", num, d.Body, deliveries, err)
+		if err := d.Nack(true); err != nil {
+			log.Printf("[%d] Failed to nack %s: %v", num, d.Body, err)
 		}
-	}()
+		return
+	}
+
+	log.Printf("[%d] Failed %s %d times, dead-lettering: %v", num, d.Body, deliveries, err)
+	// a publish while the broker is away or blocked would wait until
+	// shutdown, give up after a while and nack instead
+	dlCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := mq.DeadLetter(dlCtx, b, d, err); err != nil {
+		log.Printf("[%d] Failed to dead-letter %s: %v", num, d.Body, err)
+		d.Nack(true)
+	}
+}
 
-	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
-	<-forever
+// retryPolicy is the default policy, giving up after max-deliveries attempts.
+func retryPolicy() mq.RetryPolicy {
+	p := mq.DefaultRetryPolicy()
+	p.MaxAttempts = int(*maxDeliveries)
+	return p
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+var numUsers atomic.Int64
+
+// Chatroom reproduces the events of the original express/socket.io demo so
+// public/main.js works unchanged.
+func Chatroom(socket *Socket) {
+	addedUser := false
+	username := ""
+
+	// when the client emits 'new message', this listens and executes
+	socket.On("new message", func(args []json.RawMessage, ack func(...any)) {
+		// we tell the client to execute 'new message'
+		socket.Broadcast("new message", map[string]any{
+			"username": username,
+			"message":  arg(args, 0),
+		})
+	})
+
+	// when the client emits 'add user', this listens and executes
+	socket.On("add user", func(args []json.RawMessage, ack func(...any)) {
+		if addedUser {
+			return
+		}
+
+		// we store the username in the socket session for this client
+		json.Unmarshal(arg(args, 0), &username)
+		n := numUsers.Add(1)
+		addedUser = true
+		socket.Emit("login", map[string]any{
+			"numUsers": n,
+		})
+		// echo globally (all clients) that a person has connected
+		socket.Broadcast("user joined", map[string]any{
+			"username": username,
+			"numUsers": n,
+		})
+	})
+
+	// when the client emits 'typing', we broadcast it to others
+	socket.On("typing", func(args []json.RawMessage, ack func(...any)) {
+		socket.Broadcast("typing", map[string]any{
+			"username": username,
+		})
+	})
+
+	// when the client emits 'stop typing', we broadcast it to others
+	socket.On("stop typing", func(args []json.RawMessage, ack func(...any)) {
+		socket.Broadcast("stop typing", map[string]any{
+			"username": username,
+		})
+	})
+
+	// when the user disconnects.. perform this
+	socket.On("disconnect", func(args []json.RawMessage, ack func(...any)) {
+		if addedUser {
+			n := numUsers.Add(-1)
+
+			// echo globally that this client has left
+			socket.Broadcast("user left", map[string]any{
+				"username": username,
+				"numUsers": n,
+			})
+		}
+	})
+}
+
+// arg returns the i-th event argument, or JSON null when the client sent
+// fewer arguments.
+func arg(args []json.RawMessage, i int) json.RawMessage {
+	if i < len(args) {
+		return args[i]
+	}
+	return json.RawMessage("null")
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Engine.IO v4 packet types. A packet on the wire is the type digit followed
+// by its payload, e.g. "4hello" is a message and "2" a ping.
+const (
+	packetOpen    = '0'
+	packetClose   = '1'
+	packetPing    = '2'
+	packetPong    = '3'
+	packetMessage = '4'
+	packetUpgrade = '5'
+	packetNoop    = '6'
+)
+
+// Polling payloads carry several packets separated by the record separator.
+const recordSeparator = "\x1e"
+
+var (
+	pingInterval = 25 * time.Second
+	pingTimeout  = 20 * time.Second
+	maxPayload   = 1_000_000
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// EngineServer manages Engine.IO sessions over the polling and websocket
+// transports and hands complete message packets to the layer above.
+type EngineServer struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+
+	OnOpen    func(s *Session)
+	OnMessage func(s *Session, data string)
+	OnClose   func(s *Session, reason string)
+}
+
+func NewEngineServer() *EngineServer {
+	return &EngineServer{sessions: make(map[string]*Session)}
+}
+
+type Session struct {
+	ID     string
+	server *EngineServer
+
+	mu       sync.Mutex
+	queue    []string      // packets waiting to be sent
+	notify   chan struct{} // signalled when queue gets a packet
+	closed   chan struct{}
+	polling  bool // a GET is currently waiting for packets
+	upgraded bool
+	lastPong time.Time
+}
+
+func (e *EngineServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("EIO") != "4" {
+		engineError(w, 5, "Unsupported protocol version")
+		return
+	}
+	transport := q.Get("transport")
+	sid := q.Get("sid")
+
+	if sid == "" {
+		switch {
+		case transport == "polling" && r.Method == http.MethodGet:
+			s := e.open()
+			// the handshake is answered right away, the open packet is the
+			// only packet in the payload
+			writePayload(w, []string{s.handshake()})
+		case transport == "websocket":
+			e.serveWebsocket(w, r, nil)
+		default:
+			engineError(w, 2, "Bad handshake method")
+		}
+		return
+	}
+
+	e.mu.Lock()
+	s, ok := e.sessions[sid]
+	e.mu.Unlock()
+	if !ok {
+		engineError(w, 1, "Session ID unknown")
+		return
+	}
+
+	switch {
+	case transport == "websocket":
+		e.serveWebsocket(w, r, s)
+	case transport == "polling" && r.Method == http.MethodGet:
+		s.poll(w, r)
+	case transport == "polling" && r.Method == http.MethodPost:
+		s.receive(w, r)
+	default:
+		engineError(w, 3, "Bad request")
+	}
+}
+
+func (e *EngineServer) open() *Session {
+	s := &Session{
+		ID:       newID(),
+		server:   e,
+		notify:   make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+		lastPong: time.Now(),
+	}
+	e.mu.Lock()
+	e.sessions[s.ID] = s
+	e.mu.Unlock()
+
+	go s.heartbeat()
+	if e.OnOpen != nil {
+		e.OnOpen(s)
+	}
+	return s
+}
+
+func (s *Session) handshake() string {
+	open, _ := json.Marshal(map[string]any{
+		"sid":          s.ID,
+		"upgrades":     []string{"websocket"},
+		"pingInterval": pingInterval.Milliseconds(),
+		"pingTimeout":  pingTimeout.Milliseconds(),
+		"maxPayload":   maxPayload,
+	})
+	return string(packetOpen) + string(open)
+}
+
+// Send queues a message packet for the client.
+func (s *Session) Send(data string) {
+	s.enqueue(string(packetMessage) + data)
+}
+
+func (s *Session) enqueue(packet string) {
+	s.mu.Lock()
+	s.queue = append(s.queue, packet)
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Session) drain() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	packets := s.queue
+	s.queue = nil
+	return packets
+}
+
+// poll answers a long-polling GET with the queued packets, waiting for at
+// least one. The heartbeat guarantees a ping every pingInterval so the
+// request never hangs for longer than that.
+func (s *Session) poll(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	if s.polling || s.upgraded {
+		s.mu.Unlock()
+		engineError(w, 3, "Bad request")
+		s.Close("multiple polling requests")
+		return
+	}
+	s.polling = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.polling = false
+		s.mu.Unlock()
+	}()
+
+	for {
+		if packets := s.drain(); len(packets) > 0 {
+			writePayload(w, packets)
+			return
+		}
+		select {
+		case <-s.notify:
+		case <-s.closed:
+			writePayload(w, []string{string(packetClose)})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Session) receive(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(maxPayload)+1))
+	if err != nil || len(body) > maxPayload {
+		engineError(w, 3, "Bad request")
+		s.Close("parse error")
+		return
+	}
+	for _, packet := range strings.Split(string(body), recordSeparator) {
+		s.handle(packet)
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte("ok"))
+}
+
+func (s *Session) handle(packet string) {
+	if packet == "" {
+		return
+	}
+	switch packet[0] {
+	case packetPong:
+		s.mu.Lock()
+		s.lastPong = time.Now()
+		s.mu.Unlock()
+	case packetMessage:
+		if s.server.OnMessage != nil {
+			s.server.OnMessage(s, packet[1:])
+		}
+	case packetClose:
+		s.Close("transport close")
+	case 'b':
+		fmt.Printf("Session %s: binary packets are not supported, dropping\n", s.ID)
+	}
+}
+
+// heartbeat pings the client every pingInterval and closes the session when
+// the previous ping wasn't answered within pingTimeout.
+func (s *Session) heartbeat() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			late := time.Since(s.lastPong) > pingInterval+pingTimeout
+			s.mu.Unlock()
+			if late {
+				s.Close("ping timeout")
+				return
+			}
+			s.enqueue(string(packetPing))
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// serveWebsocket handles both a direct websocket connection (s == nil) and
+// the upgrade of an existing polling session.
+func (e *EngineServer) serveWebsocket(w http.ResponseWriter, r *http.Request, s *Session) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Println("Websocket upgrade failed:", err)
+		return
+	}
+	conn.SetReadLimit(int64(maxPayload))
+
+	if s == nil {
+		s = e.open()
+		conn.WriteMessage(websocket.TextMessage, []byte(s.handshake()))
+	} else {
+		// probe: the client checks the websocket works before switching
+		// over, then sends the upgrade packet
+		_, msg, err := conn.ReadMessage()
+		if err != nil || string(msg) != string(packetPing)+"probe" {
+			conn.Close()
+			return
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(string(packetPong)+"probe"))
+		// make a pending poll return so the client can pause polling
+		s.enqueue(string(packetNoop))
+
+		_, msg, err = conn.ReadMessage()
+		if err != nil || string(msg) != string(packetUpgrade) {
+			conn.Close()
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.upgraded = true
+	s.mu.Unlock()
+
+	go s.writeWebsocket(conn)
+	for {
+		mType, msg, err := conn.ReadMessage()
+		if err != nil {
+			s.Close("transport close")
+			return
+		}
+		if mType != websocket.TextMessage {
+			fmt.Printf("Session %s: binary frames are not supported, dropping\n", s.ID)
+			continue
+		}
+		s.handle(string(msg))
+	}
+}
+
+func (s *Session) writeWebsocket(conn *websocket.Conn) {
+	for {
+		for _, packet := range s.drain() {
+			if packet == string(packetNoop) {
+				continue // only meaningful for polling
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(packet)); err != nil {
+				s.Close("transport error")
+				return
+			}
+		}
+		select {
+		case <-s.notify:
+		case <-s.closed:
+			conn.WriteMessage(websocket.TextMessage, []byte(string(packetClose)))
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Close ends the session once. Pending polls are answered with a close packet.
+func (s *Session) Close(reason string) {
+	s.server.mu.Lock()
+	_, ok := s.server.sessions[s.ID]
+	delete(s.server.sessions, s.ID)
+	s.server.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	close(s.closed)
+	if s.server.OnClose != nil {
+		s.server.OnClose(s, reason)
+	}
+}
+
+func writePayload(w http.ResponseWriter, packets []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.Write([]byte(strings.Join(packets, recordSeparator)))
+}
+
+func engineError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]any{"code": code, "message": message})
+}
+
+func newID() string {
+	b := make([]byte, 15)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
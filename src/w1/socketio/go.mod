@@ -0,0 +1,5 @@
+module socketio
+
+go 1.24.1
+
+require github.com/gorilla/websocket v1.5.3
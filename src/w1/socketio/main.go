@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+)
+
+func main() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3000"
+	}
+
+	io := NewServer()
+	io.Of("/").OnConnection(Chatroom)
+
+	mux := http.NewServeMux()
+	mux.Handle("/socket.io/", io)
+	// Routing
+	mux.Handle("/", http.FileServer(http.Dir("public")))
+
+	fmt.Printf("Server listening at port %s\n", port)
+	if err := http.ListenAndServe(":"+port, mux); err != nil {
+		fmt.Println("Server stopped:", err)
+	}
+}
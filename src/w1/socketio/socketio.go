@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Socket.IO v5 packet types, carried inside Engine.IO message packets.
+const (
+	typeConnect = iota
+	typeDisconnect
+	typeEvent
+	typeAck
+	typeConnectError
+	typeBinaryEvent
+	typeBinaryAck
+)
+
+// Packet is a decoded Socket.IO packet. On the wire it looks like
+// <type>[<namespace>,][<ack id>][<json data>], e.g. `2/admin,12["ping"]`.
+// The namespace is omitted for "/".
+type Packet struct {
+	Type      int
+	Namespace string
+	ID        int // ack id, -1 when the sender doesn't want an ack
+	Data      json.RawMessage
+}
+
+func (p Packet) Encode() string {
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(p.Type))
+	if p.Namespace != "" && p.Namespace != "/" {
+		b.WriteString(p.Namespace)
+		b.WriteString(",")
+	}
+	if p.ID >= 0 {
+		b.WriteString(strconv.Itoa(p.ID))
+	}
+	b.Write(p.Data)
+	return b.String()
+}
+
+func DecodePacket(s string) (Packet, error) {
+	p := Packet{Namespace: "/", ID: -1}
+	if s == "" || s[0] < '0' || s[0] > '6' {
+		return p, errors.New("invalid packet type")
+	}
+	p.Type = int(s[0] - '0')
+	s = s[1:]
+	if p.Type == typeBinaryEvent || p.Type == typeBinaryAck {
+		return p, errors.New("binary packets are not supported")
+	}
+	if strings.HasPrefix(s, "/") {
+		ns, rest, found := strings.Cut(s, ",")
+		if !found {
+			// a namespace without payload, e.g. "0/admin"
+			ns, rest = s, ""
+		}
+		p.Namespace, s = ns, rest
+	}
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i > 0 {
+		p.ID, _ = strconv.Atoi(s[:i])
+	}
+	if s = s[i:]; s != "" {
+		if !json.Valid([]byte(s)) {
+			return p, errors.New("invalid payload")
+		}
+		p.Data = json.RawMessage(s)
+	}
+	return p, nil
+}
+
+// EventHandler receives the event arguments. ack is nil unless the client
+// asked for an acknowledgement.
+type EventHandler func(args []json.RawMessage, ack func(args ...any))
+
+type Server struct {
+	engine *EngineServer
+
+	mu         sync.Mutex
+	namespaces map[string]*Namespace
+	clients    map[*Session]map[string]*Socket // sockets of a session by namespace
+}
+
+func NewServer() *Server {
+	srv := &Server{
+		engine:     NewEngineServer(),
+		namespaces: make(map[string]*Namespace),
+		clients:    make(map[*Session]map[string]*Socket),
+	}
+	srv.engine.OnMessage = srv.onMessage
+	srv.engine.OnClose = srv.onClose
+	srv.Of("/")
+	return srv
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.engine.ServeHTTP(w, r)
+}
+
+// Of returns the namespace with the given name, creating it if needed.
+func (srv *Server) Of(name string) *Namespace {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	ns, ok := srv.namespaces[name]
+	if !ok {
+		ns = &Namespace{name: name, sockets: make(map[string]*Socket)}
+		srv.namespaces[name] = ns
+	}
+	return ns
+}
+
+func (srv *Server) onMessage(s *Session, data string) {
+	p, err := DecodePacket(data)
+	if err != nil {
+		fmt.Printf("Session %s: %v, dropping packet %q\n", s.ID, err, data)
+		return
+	}
+
+	srv.mu.Lock()
+	socket := srv.clients[s][p.Namespace]
+	ns := srv.namespaces[p.Namespace]
+	srv.mu.Unlock()
+
+	switch p.Type {
+	case typeConnect:
+		if ns == nil {
+			errData, _ := json.Marshal(map[string]string{"message": "Invalid namespace"})
+			s.Send(Packet{Type: typeConnectError, Namespace: p.Namespace, ID: -1, Data: errData}.Encode())
+			return
+		}
+		if socket != nil {
+			return
+		}
+		srv.connect(s, ns, p.Data)
+	case typeDisconnect:
+		if socket != nil {
+			srv.disconnect(socket, "client namespace disconnect")
+		}
+	case typeEvent:
+		if socket != nil {
+			socket.onEvent(p)
+		}
+	case typeAck:
+		if socket != nil {
+			socket.onAck(p)
+		}
+	}
+}
+
+func (srv *Server) connect(s *Session, ns *Namespace, auth json.RawMessage) {
+	socket := &Socket{
+		ID:        newID(),
+		Auth:      auth,
+		server:    srv,
+		session:   s,
+		namespace: ns,
+		handlers:  make(map[string]EventHandler),
+		acks:      make(map[int]func([]json.RawMessage)),
+		calls:     make(chan func(), 64),
+	}
+	go socket.run()
+	srv.mu.Lock()
+	if srv.clients[s] == nil {
+		srv.clients[s] = make(map[string]*Socket)
+	}
+	srv.clients[s][ns.name] = socket
+	srv.mu.Unlock()
+	ns.add(socket)
+
+	connectData, _ := json.Marshal(map[string]string{"sid": socket.ID})
+	s.Send(Packet{Type: typeConnect, Namespace: ns.name, ID: -1, Data: connectData}.Encode())
+
+	if ns.onConnection != nil {
+		ns.onConnection(socket)
+	}
+}
+
+func (srv *Server) disconnect(socket *Socket, reason string) {
+	srv.mu.Lock()
+	connected := srv.clients[socket.session][socket.namespace.name] == socket
+	delete(srv.clients[socket.session], socket.namespace.name)
+	srv.mu.Unlock()
+	if !connected {
+		return
+	}
+	socket.namespace.remove(socket)
+
+	reasonData, _ := json.Marshal(reason)
+	socket.dispatch(func() {
+		if h := socket.handler("disconnect"); h != nil {
+			h([]json.RawMessage{reasonData}, nil)
+		}
+	})
+	socket.callsMu.Lock()
+	socket.closed = true
+	close(socket.calls)
+	socket.callsMu.Unlock()
+}
+
+func (srv *Server) onClose(s *Session, reason string) {
+	srv.mu.Lock()
+	var sockets []*Socket
+	for _, socket := range srv.clients[s] {
+		sockets = append(sockets, socket)
+	}
+	srv.mu.Unlock()
+
+	for _, socket := range sockets {
+		srv.disconnect(socket, reason)
+	}
+	srv.mu.Lock()
+	delete(srv.clients, s)
+	srv.mu.Unlock()
+}
+
+type Namespace struct {
+	name         string
+	onConnection func(*Socket)
+
+	mu      sync.Mutex
+	sockets map[string]*Socket
+}
+
+func (ns *Namespace) OnConnection(fn func(*Socket)) {
+	ns.onConnection = fn
+}
+
+func (ns *Namespace) add(s *Socket) {
+	ns.mu.Lock()
+	ns.sockets[s.ID] = s
+	ns.mu.Unlock()
+}
+
+func (ns *Namespace) remove(s *Socket) {
+	ns.mu.Lock()
+	delete(ns.sockets, s.ID)
+	ns.mu.Unlock()
+}
+
+// Emit sends the event to every socket connected to the namespace.
+func (ns *Namespace) Emit(event string, args ...any) error {
+	return ns.broadcast(nil, event, args)
+}
+
+func (ns *Namespace) broadcast(except *Socket, event string, args []any) error {
+	data, err := encodeEvent(event, args)
+	if err != nil {
+		return err
+	}
+	packet := Packet{Type: typeEvent, Namespace: ns.name, ID: -1, Data: data}.Encode()
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	for _, s := range ns.sockets {
+		if s != except {
+			s.session.Send(packet)
+		}
+	}
+	return nil
+}
+
+type Socket struct {
+	ID   string
+	Auth json.RawMessage // payload of the CONNECT packet, if any
+
+	server    *Server
+	session   *Session
+	namespace *Namespace
+
+	mu       sync.Mutex
+	handlers map[string]EventHandler
+	acks     map[int]func([]json.RawMessage)
+	nextAck  int
+
+	callsMu sync.Mutex
+	calls   chan func()
+	closed  bool
+}
+
+// run calls the handlers of the socket one at a time, in the order the
+// packets arrived, like the single threaded node server does. Handlers can
+// keep per-socket state in plain variables.
+func (s *Socket) run() {
+	for call := range s.calls {
+		call()
+	}
+}
+
+func (s *Socket) dispatch(call func()) {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	if !s.closed {
+		s.calls <- call
+	}
+}
+
+// On registers the handler of an event. "disconnect" is emitted locally with
+// the reason as its only argument.
+func (s *Socket) On(event string, h EventHandler) {
+	s.mu.Lock()
+	s.handlers[event] = h
+	s.mu.Unlock()
+}
+
+func (s *Socket) handler(event string) EventHandler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handlers[event]
+}
+
+func (s *Socket) Emit(event string, args ...any) error {
+	return s.emit(event, args, nil)
+}
+
+// EmitWithAck emits the event and calls ack with the arguments the client
+// passes to its acknowledgement callback.
+func (s *Socket) EmitWithAck(event string, ack func([]json.RawMessage), args ...any) error {
+	return s.emit(event, args, ack)
+}
+
+// Broadcast emits the event to every other socket of the namespace.
+func (s *Socket) Broadcast(event string, args ...any) error {
+	return s.namespace.broadcast(s, event, args)
+}
+
+// Disconnect closes the socket's namespace connection, the underlying
+// session stays open for the other namespaces.
+func (s *Socket) Disconnect() {
+	s.session.Send(Packet{Type: typeDisconnect, Namespace: s.namespace.name, ID: -1}.Encode())
+	s.server.disconnect(s, "server namespace disconnect")
+}
+
+func (s *Socket) emit(event string, args []any, ack func([]json.RawMessage)) error {
+	data, err := encodeEvent(event, args)
+	if err != nil {
+		return err
+	}
+	p := Packet{Type: typeEvent, Namespace: s.namespace.name, ID: -1, Data: data}
+	if ack != nil {
+		s.mu.Lock()
+		p.ID = s.nextAck
+		s.acks[p.ID] = ack
+		s.nextAck++
+		s.mu.Unlock()
+	}
+	s.session.Send(p.Encode())
+	return nil
+}
+
+func (s *Socket) onEvent(p Packet) {
+	var args []json.RawMessage
+	if err := json.Unmarshal(p.Data, &args); err != nil || len(args) == 0 {
+		fmt.Printf("Socket %s: invalid event payload %s\n", s.ID, p.Data)
+		return
+	}
+	var event string
+	if err := json.Unmarshal(args[0], &event); err != nil {
+		fmt.Printf("Socket %s: invalid event name %s\n", s.ID, args[0])
+		return
+	}
+	h := s.handler(event)
+	if h == nil {
+		return
+	}
+
+	var ack func(args ...any)
+	if p.ID >= 0 {
+		ack = func(ackArgs ...any) {
+			if ackArgs == nil {
+				ackArgs = []any{}
+			}
+			data, err := json.Marshal(ackArgs)
+			if err != nil {
+				fmt.Printf("Socket %s: failed to encode ack: %v\n", s.ID, err)
+				return
+			}
+			s.session.Send(Packet{Type: typeAck, Namespace: s.namespace.name, ID: p.ID, Data: data}.Encode())
+		}
+	}
+	s.dispatch(func() { h(args[1:], ack) })
+}
+
+func (s *Socket) onAck(p Packet) {
+	s.mu.Lock()
+	ack, ok := s.acks[p.ID]
+	delete(s.acks, p.ID)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	var args []json.RawMessage
+	json.Unmarshal(p.Data, &args)
+	s.dispatch(func() { ack(args) })
+}
+
+func encodeEvent(event string, args []any) (json.RawMessage, error) {
+	return json.Marshal(append([]any{event}, args...))
+}
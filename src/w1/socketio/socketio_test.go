@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	cases := []string{
+		`0`,
+		`0/admin,{"token":"x"}`,
+		`2["new message","hi"]`,
+		`2/admin,12["ping"]`,
+		`312["ok"]`,
+		`41`,
+	}
+	for _, c := range cases {
+		p, err := DecodePacket(c)
+		if err != nil {
+			t.Fatalf("decode %q: %v", c, err)
+		}
+		if got := p.Encode(); got != c {
+			t.Errorf("expected %q but got %q", c, got)
+		}
+	}
+
+	p, _ := DecodePacket(`2/admin,12["ping"]`)
+	if p.Type != typeEvent || p.Namespace != "/admin" || p.ID != 12 {
+		t.Errorf("unexpected packet %+v", p)
+	}
+}
+
+func poll(t *testing.T, url string) string {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func post(t *testing.T, url, payload string) {
+	resp, err := http.Post(url, "text/plain;charset=UTF-8", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestPollingThenUpgrade(t *testing.T) {
+	server := NewServer()
+	server.Of("/").OnConnection(func(s *Socket) {
+		s.On("echo", func(args []json.RawMessage, ack func(...any)) {
+			ack(args[0])
+		})
+	})
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	handshake := poll(t, srv.URL+"/socket.io/?EIO=4&transport=polling")
+	var open struct{ Sid string }
+	if handshake[0] != '0' || json.Unmarshal([]byte(handshake[1:]), &open) != nil {
+		t.Fatalf("unexpected handshake %q", handshake)
+	}
+	url := srv.URL + "/socket.io/?EIO=4&transport=polling&sid=" + open.Sid
+
+	post(t, url, "40")
+	if got := poll(t, url); !strings.HasPrefix(got, `40{"sid":`) {
+		t.Fatalf("expected connect packet but got %q", got)
+	}
+	post(t, url, `421["echo","hi"]`)
+	if got := poll(t, url); got != `431["hi"]` {
+		t.Fatalf("expected ack but got %q", got)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/socket.io/?EIO=4&transport=websocket&sid=" + open.Sid
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.WriteMessage(websocket.TextMessage, []byte("2probe"))
+	if _, msg, _ := ws.ReadMessage(); string(msg) != "3probe" {
+		t.Fatalf("expected 3probe but got %q", msg)
+	}
+	if got := poll(t, url); got != "6" {
+		t.Fatalf("expected noop to flush the poll but got %q", got)
+	}
+	ws.WriteMessage(websocket.TextMessage, []byte("5"))
+	ws.WriteMessage(websocket.TextMessage, []byte(`427["echo","ws"]`))
+	if _, msg, _ := ws.ReadMessage(); string(msg) != `437["ws"]` {
+		t.Fatalf("expected ack over websocket but got %q", msg)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// topicIdleTTL is how long a topic nobody listens to keeps its replay
+	// buffer for clients that reconnect.
+	topicIdleTTL = 10 * time.Minute
+	// maxIdleTopics bounds the topics nobody listens to, topic names come
+	// from clients.
+	maxIdleTopics = 1000
+)
+
+// Event is a single server-sent event. ID is assigned by the broker from a
+// sequence shared by all topics, so a client subscribed to several topics can
+// resume with a single Last-Event-ID.
+type Event struct {
+	ID    uint64
+	Topic string
+	Name  string // written as the "event:" field, empty means "message"
+	Data  string
+}
+
+// WriteTo writes the event using text/event-stream framing. Every line of a
+// multi-line payload gets its own "data:" field and the event is terminated by
+// a blank line.
+func (e Event) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "id: %d\n", e.ID)
+	if e.Name != "" {
+		fmt.Fprintf(&b, "event: %s\n", e.Name)
+	}
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+type Topic struct {
+	name        string
+	replay      []Event // ring buffer of the last replaySize events
+	start       int
+	subscribers map[*Subscriber]struct{}
+	idleSince   time.Time // when the last subscriber left
+}
+
+func (t *Topic) append(e Event, size int) {
+	if size <= 0 {
+		return
+	}
+	if len(t.replay) < size {
+		t.replay = append(t.replay, e)
+		return
+	}
+	t.replay[t.start] = e
+	t.start = (t.start + 1) % size
+}
+
+// since returns the buffered events with an ID greater than lastID, oldest first.
+func (t *Topic) since(lastID uint64) []Event {
+	var events []Event
+	for i := range t.replay {
+		e := t.replay[(t.start+i)%len(t.replay)]
+		if e.ID > lastID {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+type Subscriber struct {
+	topics []string
+	Send   chan Event
+	// Dropped is closed when the broker gives up on a subscriber that
+	// can't keep up. The client is expected to reconnect and replay.
+	Dropped chan struct{}
+}
+
+type Broker struct {
+	mu         sync.Mutex
+	topics     map[string]*Topic
+	lastID     uint64
+	replaySize int
+	bufferSize int
+}
+
+func NewBroker(replaySize int, bufferSize int) *Broker {
+	return &Broker{
+		topics:     make(map[string]*Topic),
+		replaySize: replaySize,
+		bufferSize: bufferSize,
+	}
+}
+
+func (b *Broker) topic(name string) *Topic {
+	t, ok := b.topics[name]
+	if !ok {
+		b.evict()
+		t = &Topic{name: name, subscribers: make(map[*Subscriber]struct{}), idleSince: time.Now()}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// evict drops the topics nobody listened to for topicIdleTTL, and the ones
+// idle the longest while there are more than maxIdleTopics.
+func (b *Broker) evict() {
+	var idle []*Topic
+	for name, t := range b.topics {
+		switch {
+		case len(t.subscribers) > 0:
+		case len(t.replay) == 0 || time.Since(t.idleSince) > topicIdleTTL:
+			delete(b.topics, name)
+		default:
+			idle = append(idle, t)
+		}
+	}
+	if len(idle) < maxIdleTopics {
+		return
+	}
+	slices.SortFunc(idle, func(a, b *Topic) int { return a.idleSince.Compare(b.idleSince) })
+	for _, t := range idle[:len(idle)-maxIdleTopics+1] {
+		delete(b.topics, t.name)
+	}
+}
+
+// Publish assigns the next ID to the event, stores it in the topic's replay
+// buffer and fans it out to the current subscribers.
+func (b *Broker) Publish(topic, name, data string) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e := Event{ID: b.lastID, Topic: topic, Name: name, Data: data}
+	t := b.topic(topic)
+	t.append(e, b.replaySize)
+	for s := range t.subscribers {
+		select {
+		case s.Send <- e:
+		default:
+			fmt.Printf("Subscriber on %s is too slow, dropping it\n", topic)
+			b.remove(s)
+		}
+	}
+	return e
+}
+
+// Subscribe registers a subscriber for the given topics. If lastID is non
+// zero, the buffered events published after it are returned so the caller
+// can write them before anything received on Send.
+func (b *Broker) Subscribe(topics []string, lastID uint64) (*Subscriber, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := &Subscriber{
+		topics:  topics,
+		Send:    make(chan Event, b.bufferSize),
+		Dropped: make(chan struct{}),
+	}
+	var backlog []Event
+	for _, name := range topics {
+		t := b.topic(name)
+		t.subscribers[s] = struct{}{}
+		if lastID > 0 {
+			backlog = append(backlog, t.since(lastID)...)
+		}
+	}
+	// events of different topics are interleaved by ID
+	slices.SortFunc(backlog, func(a, b Event) int { return cmp.Compare(a.ID, b.ID) })
+	return s, backlog
+}
+
+func (b *Broker) Unsubscribe(s *Subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(s)
+}
+
+func (b *Broker) remove(s *Subscriber) {
+	removed := false
+	for _, name := range s.topics {
+		t, ok := b.topics[name]
+		if !ok {
+			continue
+		}
+		if _, ok := t.subscribers[s]; ok {
+			delete(t.subscribers, s)
+			removed = true
+		}
+		// the replay buffer is kept for clients that reconnect, evict
+		// drops the topic later
+		if len(t.subscribers) == 0 {
+			t.idleSince = time.Now()
+			if len(t.replay) == 0 {
+				delete(b.topics, name)
+			}
+		}
+	}
+	if removed {
+		close(s.Dropped)
+	}
+}
+
+func (b *Broker) Topics() map[string]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	topics := make(map[string]int, len(b.topics))
+	for name, t := range b.topics {
+		topics[name] = len(t.subscribers)
+	}
+	return topics
+}
+
+func parseEventID(id string) uint64 {
+	n, err := strconv.ParseUint(strings.TrimSpace(id), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEventFraming(t *testing.T) {
+	var b strings.Builder
+	Event{ID: 7, Name: "chat", Data: "hello\r\nworld"}.WriteTo(&b)
+
+	expected := "id: 7\nevent: chat\ndata: hello\ndata: world\n\n"
+	if b.String() != expected {
+		t.Errorf("expected %q but got %q", expected, b.String())
+	}
+}
+
+func TestReplayAfterLastEventID(t *testing.T) {
+	broker := NewBroker(3, 10)
+	for i := range 5 {
+		broker.Publish("a", "", strings.Repeat("a", i))
+		broker.Publish("b", "", strings.Repeat("b", i))
+	}
+
+	// "a" kept ids 5, 7, 9 and "b" kept 6, 8, 10
+	sub, backlog := broker.Subscribe([]string{"a", "b"}, 6)
+	defer broker.Unsubscribe(sub)
+
+	var ids []uint64
+	for _, e := range backlog {
+		ids = append(ids, e.ID)
+	}
+	expected := []uint64{7, 8, 9, 10}
+	if len(ids) != len(expected) {
+		t.Fatalf("expected %v but got %v", expected, ids)
+	}
+	for i := range ids {
+		if ids[i] != expected[i] {
+			t.Fatalf("expected %v but got %v", expected, ids)
+		}
+	}
+
+	e := broker.Publish("b", "", "live")
+	if got := <-sub.Send; got.ID != e.ID {
+		t.Errorf("expected live event %d but got %d", e.ID, got.ID)
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	broker := NewBroker(0, 1)
+	sub, _ := broker.Subscribe([]string{"a"}, 0)
+
+	broker.Publish("a", "", "1")
+	broker.Publish("a", "", "2")
+
+	select {
+	case <-sub.Dropped:
+	default:
+		t.Error("expected subscriber to be dropped")
+	}
+	broker.Unsubscribe(sub)
+}
+
+func TestEmptyTopicsAreRemoved(t *testing.T) {
+	broker := NewBroker(1, 1)
+	a, _ := broker.Subscribe([]string{"a", "b"}, 0)
+	b, _ := broker.Subscribe([]string{"b"}, 0)
+
+	broker.Unsubscribe(a)
+	if topics := broker.Topics(); len(topics) != 1 || topics["b"] != 1 {
+		t.Errorf("expected only b to be left but got %v", topics)
+	}
+	broker.Unsubscribe(b)
+	if topics := broker.Topics(); len(topics) != 0 {
+		t.Errorf("expected no topics but got %v", topics)
+	}
+}
+
+func TestIdleTopicsKeepTheirReplay(t *testing.T) {
+	broker := NewBroker(3, 1)
+	s, _ := broker.Subscribe([]string{"a"}, 0)
+	first := broker.Publish("a", "", "1")
+	// the buffer of 1 is full, the sole subscriber is dropped
+	broker.Publish("a", "", "2")
+	select {
+	case <-s.Dropped:
+	default:
+		t.Fatal("expected the slow subscriber to be dropped")
+	}
+
+	_, backlog := broker.Subscribe([]string{"a"}, first.ID)
+	if len(backlog) != 1 || backlog[0].Data != "2" {
+		t.Errorf("expected the reconnecting client to get event 2 but got %v", backlog)
+	}
+
+	for i := range maxIdleTopics + 10 {
+		broker.Publish(fmt.Sprintf("t%d", i), "", "x")
+	}
+	if topics := broker.Topics(); len(topics) > maxIdleTopics+1 {
+		t.Errorf("expected at most %d idle topics but got %d", maxIdleTopics, len(topics)-1)
+	}
+}
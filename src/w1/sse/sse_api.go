@@ -1,31 +1,162 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
+var (
+	addr       = flag.String("addr", ":8080", "address to listen on")
+	replaySize = flag.Int("replay", 100, "number of events kept per topic for Last-Event-ID replay")
+	heartbeat  = flag.Duration("heartbeat", 15*time.Second, "interval between comment heartbeats")
+	retry      = flag.Duration("retry", 3*time.Second, "reconnection delay advertised to clients")
+)
+
 func main() {
-	http.HandleFunc("/events", EventHandler)
-	http.ListenAndServe(":8080", nil)
+	flag.Parse()
+
+	broker := NewBroker(*replaySize, 64)
+	http.HandleFunc("GET /events", EventHandler(broker))
+	http.HandleFunc("POST /topics/{topic}/events", PublishHandler(broker))
+	http.HandleFunc("GET /topics", TopicsHandler(broker))
+
+	// keep the original counter demo running on the "numbers" topic
+	go func() {
+		for i := 0; ; i++ {
+			broker.Publish("numbers", "", strconv.Itoa(i))
+			time.Sleep(1 * time.Second)
+		}
+	}()
+
+	fmt.Printf("SSE broker listening on %s\n", *addr)
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		fmt.Println("Server stopped:", err)
+	}
+}
+
+// EventHandler streams events of the topics given as ?topic=a&topic=b (or
+// ?topic=a,b). Reconnecting clients send the Last-Event-ID header and get the
+// buffered events they missed before the live stream. Since EventSource can't
+// set headers on the first connection, ?lastEventId= is accepted as well.
+func EventHandler(broker *Broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Set CORS headers to allow all origins. You may want to restrict this to specific origins in a production environment.
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Type")
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		topics := parseTopics(r.URL.Query()["topic"])
+		if len(topics) == 0 {
+			http.Error(w, "at least one topic is required", http.StatusBadRequest)
+			return
+		}
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("lastEventId")
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		sub, backlog := broker.Subscribe(topics, parseEventID(lastID))
+		defer broker.Unsubscribe(sub)
+
+		fmt.Fprintf(w, "retry: %d\n\n", retry.Milliseconds())
+		for _, e := range backlog {
+			if _, err := e.WriteTo(w); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		ticker := time.NewTicker(*heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case e := <-sub.Send:
+				if _, err := e.WriteTo(w); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-ticker.C:
+				// comment lines are ignored by clients but keep proxies from
+				// timing out an idle connection
+				if _, err := fmt.Fprintf(w, ": heartbeat %d\n\n", time.Now().Unix()); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-sub.Dropped:
+				return
+			case <-r.Context().Done():
+				fmt.Println("Client disconnected")
+				return
+			}
+		}
+	}
+}
+
+type publishRequest struct {
+	Event string `json:"event"`
+	Data  string `json:"data"`
+}
+
+// PublishHandler publishes the request body to a topic. A JSON body of the
+// form {"event": "...", "data": "..."} sets the event name, any other body is
+// sent as is with the name taken from ?event=.
+func PublishHandler(broker *Broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		req := publishRequest{Event: r.URL.Query().Get("event"), Data: string(body)}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.Unmarshal(body, &req); err != nil {
+				http.Error(w, "invalid json body", http.StatusBadRequest)
+				return
+			}
+		}
+		if strings.ContainsAny(req.Event, "\r\n") {
+			http.Error(w, "event name can't contain line breaks", http.StatusBadRequest)
+			return
+		}
+
+		e := broker.Publish(r.PathValue("topic"), req.Event, req.Data)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"id": e.ID, "topic": e.Topic, "event": e.Name})
+	}
+}
+
+func TopicsHandler(broker *Broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(broker.Topics())
+	}
 }
-func EventHandler(w http.ResponseWriter, r *http.Request) {
-	// Set CORS headers to allow all origins. You may want to restrict this to specific origins in a production environment.
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Type")
-
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	for i := 0; i < 10; i++ {
-		fmt.Fprintf(w, "data: %d\n", i)
-		time.Sleep(1 * time.Second)
-		w.(http.Flusher).Flush() // Flush the response to the client
+
+func parseTopics(values []string) []string {
+	var topics []string
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			t = strings.TrimSpace(t)
+			if t != "" && !slices.Contains(topics, t) {
+				topics = append(topics, t)
+			}
+		}
 	}
-	// closeNotifier := w.(http.CloseNotifier).CloseNotify()
-	closeNotifier := r.Context().Done()
-	<-closeNotifier
-	fmt.Println("Client disconnected")
+	return topics
 }
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// antiEntropyLock keeps the kv servers sharing a database from checking it
+// at the same time.
+const antiEntropyLock = "kv.antientropy"
+
+type AntiEntropyOptions struct {
+	Cadence time.Duration // pause between checks
+	// Depth makes the trees have 2^Depth leaves, from 1 to 16.
+	Depth int
+	// Settle skips keys written this recently, replication may not have
+	// brought them over yet.
+	Settle time.Duration
+	// Repair copies the differing keys from the primary to the replica,
+	// otherwise they are only reported.
+	Repair bool
+	// MaxDifferences bounds the keys one check looks at, the rest are left
+	// to the next.
+	MaxDifferences int
+}
+
+func DefaultAntiEntropyOptions() AntiEntropyOptions {
+	return AntiEntropyOptions{
+		Cadence:        10 * time.Minute,
+		Depth:          10,
+		Settle:         10 * time.Second,
+		MaxDifferences: 1000,
+	}
+}
+
+// Difference is a key the replica doesn't have like the primary.
+type Difference struct {
+	Key      string `json:"key"`
+	Kind     string `json:"kind"` // missing or extra on the replica, or different
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+type AntiEntropyReport struct {
+	Started   time.Time     `json:"started"`
+	Took      time.Duration `json:"took"`
+	Rows      int64         `json:"rows"`     // on the primary
+	Compared  int           `json:"compared"` // tree nodes compared
+	Ranges    int           `json:"ranges"`   // leaves that differ
+	Settling  int           `json:"settling"` // keys skipped because they were just written
+	Truncated bool          `json:"truncated,omitempty"`
+	Repaired  int           `json:"repaired"`
+	Skipped   bool          `json:"skipped,omitempty"` // another server had the lock
+
+	Differences []Difference `json:"differences"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// AntiEntropy checks that the replica has the same kv.store as the primary.
+// Both sides hash their rows into Merkle trees over ranges of the hash of
+// the keys, so the keys of a range are spread over the whole table and
+// every range has about as many. Ranges of the keys themselves would need
+// boundaries sampled from one side and agreed on by both, and skewed keys
+// would make them uneven; the price of hashing is that reading the rows of
+// a leaf scans the table instead of a range of the primary key.
+//
+// Comparing the trees from the root down only visits the subtrees that
+// differ, and only the rows of the leaves that differ are read and
+// compared key by key.
+//
+// A leaf is the XOR of the hashes of its rows, which MySQL computes without
+// sending the rows over, and their count. A row hashes its key, the SHA1
+// of its value and expired_at.
+type AntiEntropy struct {
+	primary, replica *sql.DB
+	opts             AntiEntropyOptions
+
+	mu   sync.Mutex
+	last AntiEntropyReport
+}
+
+func NewAntiEntropy(primary, replica *sql.DB, opts AntiEntropyOptions) *AntiEntropy {
+	opts.Depth = max(1, min(opts.Depth, 16))
+	return &AntiEntropy{primary: primary, replica: replica, opts: opts}
+}
+
+// Last returns the report of the last check.
+func (a *AntiEntropy) Last() AntiEntropyReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.last
+}
+
+// Run checks every Cadence until ctx is cancelled.
+func (a *AntiEntropy) Run(ctx context.Context) {
+	for {
+		if _, err := a.Check(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Anti-entropy check failed: %v", err)
+		}
+		select {
+		case <-time.After(a.opts.Cadence):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Check compares the replica to the primary once, repairing it if
+// Repair is set.
+func (a *AntiEntropy) Check(ctx context.Context) (AntiEntropyReport, error) {
+	report := AntiEntropyReport{Started: time.Now()}
+	err := a.check(ctx, &report)
+	report.Took = time.Since(report.Started)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	if report.Differences == nil {
+		report.Differences = []Difference{}
+	}
+	a.mu.Lock()
+	a.last = report
+	a.mu.Unlock()
+	return report, err
+}
+
+func (a *AntiEntropy) check(ctx context.Context, report *AntiEntropyReport) error {
+	conn, err := a.primary.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", antiEntropyLock).Scan(&locked); err != nil {
+		return err
+	}
+	if locked.Int64 != 1 {
+		report.Skipped = true
+		return nil
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), "SELECT RELEASE_LOCK(?)", antiEntropyLock)
+
+	primary, rows, err := buildTree(ctx, a.primary, a.opts.Depth)
+	if err != nil {
+		return fmt.Errorf("primary: %w", err)
+	}
+	replica, _, err := buildTree(ctx, a.replica, a.opts.Depth)
+	if err != nil {
+		return fmt.Errorf("replica: %w", err)
+	}
+	report.Rows = rows
+	leaves, compared := primary.Diff(replica)
+	report.Ranges, report.Compared = len(leaves), compared
+
+	// a few leaves at a time, every query scans the table
+	for chunk := range slices.Chunk(leaves, 64) {
+		if len(report.Differences) >= a.opts.MaxDifferences {
+			report.Truncated = true
+			break
+		}
+		if err := a.compareLeaves(ctx, chunk, report); err != nil {
+			return err
+		}
+	}
+	slices.SortFunc(report.Differences, func(a, b Difference) int { return strings.Compare(a.Key, b.Key) })
+	if len(report.Differences) > 0 {
+		log.Printf("Anti-entropy found %d keys that differ on the replica", len(report.Differences))
+	}
+	if !a.opts.Repair || len(report.Differences) == 0 {
+		return nil
+	}
+	return a.repair(ctx, report)
+}
+
+// leafOf is the leaf of a key in a tree of the given depth, the top bits
+// of the MD5 of the key.
+func leafOf(depth int) string {
+	return fmt.Sprintf("(CONV(LEFT(MD5(k), 4), 16, 10) >> %d)", 16-depth)
+}
+
+const rowHash = "CAST(CONV(LEFT(SHA1(CONCAT(k, 0x00, SHA1(value), 0x00, expired_at)), 16), 16, 10) AS UNSIGNED)"
+
+func buildTree(ctx context.Context, db *sql.DB, depth int) (*merkleTree, int64, error) {
+	leaves := make([]uint64, 1<<depth)
+	rows, err := db.QueryContext(ctx, "SELECT "+leafOf(depth)+" AS leaf, BIT_XOR("+rowHash+"), COUNT(*) FROM kv.store GROUP BY leaf")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var total int64
+	for rows.Next() {
+		var leaf int
+		var xor uint64
+		var count int64
+		if err := rows.Scan(&leaf, &xor, &count); err != nil {
+			return nil, 0, err
+		}
+		leaves[leaf] = hashPair(xor, uint64(count))
+		total += count
+	}
+	return newMerkleTree(leaves), total, rows.Err()
+}
+
+type rowDigest struct {
+	value     []byte // SHA1
+	expiredAt int64
+	version   uint64
+}
+
+// leafRows reads the digests of the rows in the given leaves.
+func leafRows(ctx context.Context, db *sql.DB, depth int, leaves []int) (map[string]rowDigest, error) {
+	args := make([]any, len(leaves))
+	for i, leaf := range leaves {
+		args[i] = leaf
+	}
+	query := "SELECT k, UNHEX(SHA1(value)), expired_at, version FROM kv.store WHERE " + leafOf(depth) +
+		" IN (?" + strings.Repeat(", ?", len(leaves)-1) + ")"
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	digests := make(map[string]rowDigest)
+	for rows.Next() {
+		var key string
+		var d rowDigest
+		if err := rows.Scan(&key, &d.value, &d.expiredAt, &d.version); err != nil {
+			return nil, err
+		}
+		digests[key] = d
+	}
+	return digests, rows.Err()
+}
+
+func (a *AntiEntropy) compareLeaves(ctx context.Context, leaves []int, report *AntiEntropyReport) error {
+	primary, err := leafRows(ctx, a.primary, a.opts.Depth, leaves)
+	if err != nil {
+		return err
+	}
+	replica, err := leafRows(ctx, a.replica, a.opts.Depth, leaves)
+	if err != nil {
+		return err
+	}
+	// versions start at the time of the write in microseconds
+	settled := uint64(time.Now().Add(-a.opts.Settle).UnixMicro())
+	add := func(key, kind string, versions ...uint64) {
+		for _, v := range versions {
+			if v > settled {
+				report.Settling++
+				return
+			}
+		}
+		if len(report.Differences) < a.opts.MaxDifferences {
+			report.Differences = append(report.Differences, Difference{Key: key, Kind: kind})
+		} else {
+			report.Truncated = true
+		}
+	}
+	// rows of deleted and expired keys read as missing, and the cleanup
+	// removes them without a new version, so a key that is gone on one
+	// side and has a dead row or none on the other doesn't differ
+	now := time.Now().Unix()
+	dead := func(d rowDigest) bool { return d.expiredAt <= now }
+	for key, p := range primary {
+		r, ok := replica[key]
+		switch {
+		case !ok:
+			if !dead(p) {
+				add(key, "missing", p.version)
+			}
+		case dead(p) && dead(r):
+		case !bytes.Equal(p.value, r.value) || p.expiredAt != r.expiredAt:
+			add(key, "different", p.version, r.version)
+		}
+	}
+	for key, r := range replica {
+		if _, ok := primary[key]; !ok && !dead(r) {
+			add(key, "extra", r.version)
+		}
+	}
+	return nil
+}
+
+// repair copies the differing keys from the primary to the replica, with
+// the binary log off so the writes don't go further down the replication
+// chain. The user needs to be allowed to write to a read only replica.
+//
+// A repair that replication then applies again stops it with a duplicate
+// or missing row, so the replica has to be running and less than Settle
+// behind.
+func (a *AntiEntropy) repair(ctx context.Context, report *AntiEntropyReport) error {
+	conn, err := a.replica.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := checkLag(ctx, conn, a.opts.Settle); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "SET SESSION sql_log_bin = 0"); err != nil {
+		return err
+	}
+	// the session goes back to the pool
+	defer conn.ExecContext(context.WithoutCancel(ctx), "SET SESSION sql_log_bin = 1")
+
+	settled := uint64(time.Now().Add(-a.opts.Settle).UnixMicro())
+	for i := range report.Differences {
+		d := &report.Differences[i]
+		var value []byte
+		var expiredAt int64
+		var version uint64
+		err := a.primary.QueryRowContext(ctx, "SELECT value, expired_at, version FROM kv.store WHERE k = ?", d.Key).
+			Scan(&value, &expiredAt, &version)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			_, err = conn.ExecContext(ctx, "DELETE FROM kv.store WHERE k = ?", d.Key)
+		case err == nil && version > settled:
+			// written since the comparison, replication brings it over
+			report.Settling++
+			continue
+		case err == nil:
+			_, err = conn.ExecContext(ctx, "INSERT INTO kv.store (k, value, expired_at, version) VALUES (?, ?, ?, ?) "+
+				"ON DUPLICATE KEY UPDATE value = ?, expired_at = ?, version = ?", d.Key, value, expiredAt, version, value, expiredAt, version)
+		}
+		if err != nil {
+			return fmt.Errorf("repairing %s: %w", d.Key, err)
+		}
+		d.Repaired = true
+		report.Repaired++
+	}
+	log.Printf("Anti-entropy repaired %d keys on the replica", report.Repaired)
+	return nil
+}
+
+// checkLag fails unless replication is running and less than maxLag
+// behind. A server that isn't a replica passes.
+func checkLag(ctx context.Context, conn *sql.Conn, maxLag time.Duration) error {
+	rows, err := conn.QueryContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return rows.Err()
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return err
+	}
+	i := slices.Index(columns, "Seconds_Behind_Source")
+	if i < 0 {
+		return errors.New("not repairing, the replica doesn't report its lag")
+	}
+	lag := values[i]
+	if lag == nil {
+		return errors.New("not repairing, replication is stopped")
+	}
+	if seconds, err := strconv.Atoi(string(lag)); err != nil || time.Duration(seconds)*time.Second > maxLag {
+		return fmt.Errorf("not repairing, the replica is %ss behind", lag)
+	}
+	return nil
+}
+
+// merkleTree keeps its nodes in an array, the root at 1 and the children of
+// i at 2i and 2i+1, so the leaves are the second half.
+type merkleTree struct {
+	nodes []uint64
+}
+
+func newMerkleTree(leaves []uint64) *merkleTree {
+	n := len(leaves)
+	t := &merkleTree{nodes: make([]uint64, 2*n)}
+	copy(t.nodes[n:], leaves)
+	for i := n - 1; i >= 1; i-- {
+		t.nodes[i] = hashPair(t.nodes[2*i], t.nodes[2*i+1])
+	}
+	return t
+}
+
+func hashPair(a, b uint64) uint64 {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:], a)
+	binary.BigEndian.PutUint64(buf[8:], b)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return h.Sum64()
+}
+
+// Diff returns the leaves that differ from o, a tree of the same depth, in
+// order, and how many nodes it compared to find them.
+func (t *merkleTree) Diff(o *merkleTree) ([]int, int) {
+	n := len(t.nodes) / 2
+	var leaves []int
+	compared := 0
+	var walk func(i int)
+	walk = func(i int) {
+		compared++
+		if t.nodes[i] == o.nodes[i] {
+			return
+		}
+		if i >= n {
+			leaves = append(leaves, i-n)
+			return
+		}
+		walk(2 * i)
+		walk(2*i + 1)
+	}
+	walk(1)
+	return leaves, compared
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestMerkleTreeDiff(t *testing.T) {
+	leaves := make([]uint64, 1024)
+	for i := range leaves {
+		leaves[i] = uint64(i) * 7919
+	}
+	a := newMerkleTree(leaves)
+	if diff, compared := a.Diff(newMerkleTree(slices.Clone(leaves))); len(diff) != 0 || compared != 1 {
+		t.Errorf("expected equal trees to only compare their roots but got %v after %d", diff, compared)
+	}
+
+	changed := slices.Clone(leaves)
+	changed[3]++
+	changed[700] = 0
+	diff, compared := a.Diff(newMerkleTree(changed))
+	if !slices.Equal(diff, []int{3, 700}) {
+		t.Errorf("expected leaves 3 and 700 to differ but got %v", diff)
+	}
+	// two paths of 11 nodes and the siblings along them
+	if compared > 2*2*11 {
+		t.Errorf("expected to compare only the paths to the changed leaves but compared %d nodes", compared)
+	}
+}
+
+// TestAntiEntropy needs the MySQL primary from kv.sql on port 3306 and its
+// replica on 3307.
+func TestAntiEntropy(t *testing.T) {
+	primary, replica := NewConn("3306"), NewConn("3307")
+	defer primary.Close()
+	defer replica.Close()
+	if err := errors.Join(primary.Ping(), replica.Ping()); err != nil {
+		t.Skipf("MySQL not available: %v", err)
+	}
+	ctx := context.Background()
+
+	// a key only the replica has
+	conn, err := replica.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.ExecContext(ctx, "SET SESSION sql_log_bin = 0")
+	if err == nil {
+		_, err = conn.ExecContext(ctx, "REPLACE INTO kv.store (k, value, expired_at, version) VALUES ('antientropy-test', 'x', ?, 1)", NoExpiry)
+	}
+	// and a deleted one, which reads the same as none
+	if err == nil {
+		_, err = conn.ExecContext(ctx, "REPLACE INTO kv.store (k, value, expired_at, version) VALUES ('antientropy-dead', 'x', -1, 1)")
+	}
+	conn.ExecContext(ctx, "SET SESSION sql_log_bin = 1")
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultAntiEntropyOptions()
+	opts.Repair = true
+	report, err := NewAntiEntropy(primary, replica, opts).Check(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Difference{Key: "antientropy-test", Kind: "extra", Repaired: true}
+	if !slices.Contains(report.Differences, want) {
+		t.Errorf("expected %+v in %+v", want, report.Differences)
+	}
+	for _, d := range report.Differences {
+		if d.Key == "antientropy-dead" {
+			t.Errorf("expected the deleted key not to differ but got %+v", d)
+		}
+	}
+	var n int
+	replica.QueryRowContext(ctx, "SELECT COUNT(*) FROM kv.store WHERE k = 'antientropy-test'").Scan(&n)
+	if n != 0 {
+		t.Errorf("expected the repair to delete the extra key")
+	}
+	conn, err = replica.Conn(ctx)
+	if err == nil {
+		conn.ExecContext(ctx, "SET SESSION sql_log_bin = 0")
+		conn.ExecContext(ctx, "DELETE FROM kv.store WHERE k = 'antientropy-dead'")
+		conn.Close()
+	}
+}
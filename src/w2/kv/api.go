@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatch is the most keys MGET and MSET take at once.
+const maxBatch = 1000
+
+// API is the HTTP interface of the store:
+//
+//	GET    /keys/:key    value as raw bytes, or JSON with Accept: application/json
+//	PUT    /keys/:key    raw body with an optional ?ttl=, or JSON {"value", "ttl"}
+//	DELETE /keys/:key
+//	POST   /mget         {"keys": [...]}
+//	POST   /mset         {"entries": [{"key", "value", "ttl"}]}
+//	POST   /cas          {"key", "version", "value", "ttl"}
+//
+//	POST   /keys/:key/incr?by=    INCR/INCRBY, by defaults to 1
+//	POST   /keys/:key/decr?by=    DECR/DECRBY
+//	GET    /keys/:key/ttl         TTL, null for keys that don't expire
+//	PUT    /keys/:key/ttl?ttl=    EXPIRE
+//	DELETE /keys/:key/ttl         PERSIST
+//	POST   /keys/:key/getset      GETSET, takes the same body as PUT
+//
+//	GET    /watch?prefix=&since=  changes as server sent events or a long poll
+//
+// In sharded mode there is also /ring, see registerRing. In quorum mode
+// requests take ?n=, ?r= and ?w=, see registerQuorum. With namespaces all
+// of the above is also under /ns/:ns, or takes an X-Namespace header, with
+// the API key of the namespace, see registerNamespaces.
+//
+// ttl is in seconds, keys without one never expire. Reads go to the replica
+// unless ?consistent=true is given.
+//
+// The ETag of a key is its version. PUT and DELETE take If-Match with an
+// ETag or *, PUT also takes If-None-Match: * to only create the key, and
+// GET answers If-None-Match with 304. /cas writes the key if it is at the
+// given version, version 0 meaning it must not exist, and returns the new
+// version. Writes whose condition fails get 412.
+type API struct {
+	primary Store
+	replica Store
+	changes ChangeLog // of the primary, nil if it has none
+
+	// set in sharded mode, where primary and replica are the same
+	sharded   *shardedStore
+	openShard func(spec string) (Store, error)
+	shardDir  string // bitcask shards can only be added in it
+
+	// set in quorum mode, local is the replica this node keeps
+	quorum *quorumStore
+	local  *localReplica
+
+	// nil without namespaces, adminKey manages them
+	namespaces *Namespaces
+	adminKey   string
+}
+
+func (a *API) Register(r gin.IRouter) {
+	if a.quorum != nil {
+		r.Use(a.quorumParams)
+	}
+	a.registerKeys(r.Group("", a.namespace))
+	if a.namespaces != nil {
+		a.registerKeys(r.Group("/ns/:ns", a.namespace))
+		a.registerNamespaces(r)
+	}
+	if a.sharded != nil {
+		a.registerRing(r)
+	}
+	if a.quorum != nil {
+		a.registerQuorum(r)
+	}
+}
+
+func (a *API) registerKeys(r gin.IRouter) {
+	r.GET("/keys/:key", a.get)
+	r.PUT("/keys/:key", a.put)
+	r.DELETE("/keys/:key", a.delete)
+	r.POST("/mget", a.mget)
+	r.POST("/mset", a.mset)
+	r.POST("/cas", a.cas)
+	r.POST("/keys/:key/incr", a.incr(1))
+	r.POST("/keys/:key/decr", a.incr(-1))
+	r.GET("/keys/:key/ttl", a.ttl)
+	r.PUT("/keys/:key/ttl", a.expire)
+	r.DELETE("/keys/:key/ttl", a.persist)
+	r.POST("/keys/:key/getset", a.getset)
+	r.GET("/watch", a.watch)
+}
+
+// entryJSON is how entries look in JSON bodies. Values are strings, binary
+// values need the raw API.
+type entryJSON struct {
+	Key     string  `json:"key,omitempty"`
+	Value   *string `json:"value"`
+	TTL     *int64  `json:"ttl,omitempty"`
+	Version uint64  `json:"version,omitempty"`
+}
+
+func toJSON(e Entry) entryJSON {
+	value := string(e.Value)
+	j := entryJSON{Key: e.Key, Value: &value, Version: e.Version}
+	if e.ExpiredAt != NoExpiry {
+		ttl := max(e.ExpiredAt-time.Now().Unix(), 0)
+		j.TTL = &ttl
+	}
+	return j
+}
+
+func (a *API) reader(c *gin.Context) Store {
+	if consistent, _ := strconv.ParseBool(c.Query("consistent")); consistent {
+		return a.writer(c)
+	}
+	if ns, ok := c.Get(nsContextKey); ok {
+		return ns.(*nsContext).replica
+	}
+	return a.replica
+}
+
+// writer is the primary, or its part the namespace of the request has.
+func (a *API) writer(c *gin.Context) Store {
+	if ns, ok := c.Get(nsContextKey); ok {
+		return ns.(*nsContext).primary
+	}
+	return a.primary
+}
+
+func (a *API) get(c *gin.Context) {
+	key := c.Param("key")
+	if err := checkKey(key); err != nil {
+		fail(c, err)
+		return
+	}
+	e, err := a.reader(c).Get(c.Request.Context(), key)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.Header("ETag", etag(e.Version))
+	if noneMatch(c.GetHeader("If-None-Match"), e.Version) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	if c.NegotiateFormat("application/octet-stream", gin.MIMEJSON) == gin.MIMEJSON {
+		c.JSON(http.StatusOK, toJSON(e))
+		return
+	}
+	if e.ExpiredAt != NoExpiry {
+		c.Header("X-TTL", strconv.FormatInt(max(e.ExpiredAt-time.Now().Unix(), 0), 10))
+	}
+	c.Data(http.StatusOK, "application/octet-stream", e.Value)
+}
+
+func (a *API) put(c *gin.Context) {
+	key := c.Param("key")
+	if err := checkKey(key); err != nil {
+		fail(c, err)
+		return
+	}
+	value, expiredAt, err := readValue(c)
+	var cond Condition
+	if err == nil {
+		cond, err = condition(c)
+	}
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	version, created, err := a.writer(c).Put(c.Request.Context(), key, value, expiredAt, cond)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.Header("ETag", etag(version))
+	if created {
+		c.Header("Location", "/keys/"+key)
+		c.Status(http.StatusCreated)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// readValue reads the value and expiry of a write from the raw body and
+// ?ttl=, or from a JSON body.
+func readValue(c *gin.Context) ([]byte, int64, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, 2*MaxValueSize))
+	if err != nil {
+		return nil, 0, errTooLarge
+	}
+	value := body
+	expiredAt, err := parseTTL(c.Query("ttl"))
+	if err == nil && c.ContentType() == gin.MIMEJSON {
+		var j entryJSON
+		if err := json.Unmarshal(body, &j); err != nil || j.Value == nil {
+			return nil, 0, badRequest("expected a JSON body with a value")
+		}
+		value = []byte(*j.Value)
+		if j.TTL != nil {
+			expiredAt, err = expiry(*j.TTL)
+		}
+	}
+	if err == nil {
+		err = checkValue(value)
+	}
+	return value, expiredAt, err
+}
+
+func (a *API) delete(c *gin.Context) {
+	key := c.Param("key")
+	if err := checkKey(key); err != nil {
+		fail(c, err)
+		return
+	}
+	cond, err := condition(c)
+	if err == nil {
+		err = a.writer(c).Delete(c.Request.Context(), key, cond)
+	}
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// cas writes a key only if it is still at the version the client read.
+func (a *API) cas(c *gin.Context) {
+	var e entryJSON
+	if err := c.ShouldBindJSON(&e); err != nil {
+		fail(c, badRequest("expected a JSON body with a key, version and value"))
+		return
+	}
+	if err := checkEntry(e); err != nil {
+		fail(c, err)
+		return
+	}
+	expiredAt := int64(NoExpiry)
+	if e.TTL != nil {
+		var err error
+		if expiredAt, err = expiry(*e.TTL); err != nil {
+			fail(c, err)
+			return
+		}
+	}
+	cond := Condition{IfVersion: e.Version}
+	if e.Version == 0 {
+		cond = Condition{IfAbsent: true}
+	}
+
+	version, created, err := a.writer(c).Put(c.Request.Context(), e.Key, []byte(*e.Value), expiredAt, cond)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.Header("ETag", etag(version))
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	c.JSON(code, gin.H{"version": version})
+}
+
+// mget returns the values in the order of the keys, null for missing ones.
+func (a *API) mget(c *gin.Context) {
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, badRequest("expected a JSON body with keys"))
+		return
+	}
+	if len(req.Keys) > maxBatch {
+		fail(c, badRequest(fmt.Sprintf("at most %d keys at once", maxBatch)))
+		return
+	}
+	for _, key := range req.Keys {
+		if err := checkKey(key); err != nil {
+			fail(c, err)
+			return
+		}
+	}
+
+	s := a.reader(c)
+	values := make([]*string, len(req.Keys))
+	for i, key := range req.Keys {
+		e, err := s.Get(c.Request.Context(), key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			fail(c, err)
+			return
+		}
+		value := string(e.Value)
+		values[i] = &value
+	}
+	c.JSON(http.StatusOK, gin.H{"values": values})
+}
+
+// mset writes the entries one after the other, it is not atomic. On error
+// the response says how many were written.
+func (a *API) mset(c *gin.Context) {
+	var req struct {
+		Entries []entryJSON `json:"entries"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, badRequest("expected a JSON body with entries"))
+		return
+	}
+	if len(req.Entries) > maxBatch {
+		fail(c, badRequest(fmt.Sprintf("at most %d entries at once", maxBatch)))
+		return
+	}
+	expiredAt := make([]int64, len(req.Entries))
+	for i, e := range req.Entries {
+		if err := checkEntry(e); err != nil {
+			fail(c, err)
+			return
+		}
+		expiredAt[i] = NoExpiry
+		if e.TTL != nil {
+			var err error
+			if expiredAt[i], err = expiry(*e.TTL); err != nil {
+				fail(c, err)
+				return
+			}
+		}
+	}
+
+	var created, updated int
+	for i, e := range req.Entries {
+		_, ok, err := a.writer(c).Put(c.Request.Context(), e.Key, []byte(*e.Value), expiredAt[i], Condition{})
+		if err != nil {
+			code, msg := status(c, err)
+			c.AbortWithStatusJSON(code, gin.H{"error": msg, "written": created + updated})
+			return
+		}
+		if ok {
+			created++
+		} else {
+			updated++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"created": created, "updated": updated})
+}
+
+// requestError is an error caused by the request, returned with its status.
+type requestError struct {
+	status int
+	msg    string
+}
+
+func (e *requestError) Error() string { return e.msg }
+
+func badRequest(msg string) error {
+	return &requestError{http.StatusBadRequest, msg}
+}
+
+var errTooLarge = &requestError{http.StatusRequestEntityTooLarge, fmt.Sprintf("values are limited to %d bytes", MaxValueSize)}
+
+func checkKey(key string) error {
+	if key == "" || len(key) > MaxKeyLen {
+		return badRequest(fmt.Sprintf("keys must have 1 to %d bytes", MaxKeyLen))
+	}
+	if strings.HasPrefix(key, nsSep) {
+		return badRequest(`keys can't start with \x1e, it's kept for namespaces`)
+	}
+	return nil
+}
+
+func checkValue(value []byte) error {
+	if len(value) > MaxValueSize {
+		return errTooLarge
+	}
+	return nil
+}
+
+func checkEntry(e entryJSON) error {
+	if err := checkKey(e.Key); err != nil {
+		return err
+	}
+	if e.Value == nil {
+		return badRequest("entry " + e.Key + " has no value")
+	}
+	return checkValue([]byte(*e.Value))
+}
+
+// parseTTL turns a ttl in seconds into the expired_at to store, no ttl
+// means no expiry.
+func parseTTL(ttl string) (int64, error) {
+	if ttl == "" {
+		return NoExpiry, nil
+	}
+	seconds, err := strconv.ParseInt(ttl, 10, 64)
+	if err != nil {
+		return 0, errBadTTL
+	}
+	return expiry(seconds)
+}
+
+var errBadTTL = badRequest("ttl must be a positive number of seconds")
+
+func expiry(ttl int64) (int64, error) {
+	now := time.Now().Unix()
+	if ttl <= 0 || ttl >= NoExpiry-now {
+		return 0, errBadTTL
+	}
+	return now + ttl, nil
+}
+
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// condition turns If-Match and If-None-Match into the condition of a write.
+// An If-Match that isn't one of our ETags can never match.
+func condition(c *gin.Context) (Condition, error) {
+	var cond Condition
+	switch match := c.GetHeader("If-Match"); match {
+	case "":
+	case "*":
+		cond.IfExists = true
+	default:
+		version, err := strconv.ParseUint(strings.Trim(match, `"`), 10, 64)
+		if err != nil || version == 0 {
+			return cond, ErrConflict
+		}
+		cond.IfVersion = version
+	}
+	switch c.GetHeader("If-None-Match") {
+	case "":
+	case "*":
+		cond.IfAbsent = true
+	default:
+		return cond, badRequest("writes only take If-None-Match: *")
+	}
+	return cond, nil
+}
+
+// noneMatch reports whether an If-None-Match header lists the ETag of
+// version.
+func noneMatch(header string, version uint64) bool {
+	for tag := range strings.SplitSeq(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// status returns the response status and message for err. Store errors are
+// logged rather than shown to the client.
+func status(c *gin.Context, err error) (int, string) {
+	var reqErr *requestError
+	switch {
+	case errors.As(err, &reqErr):
+		return reqErr.status, reqErr.msg
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, err.Error()
+	case errors.Is(err, ErrConflict):
+		return http.StatusPreconditionFailed, err.Error()
+	case errors.Is(err, ErrTruncated):
+		return http.StatusGone, err.Error()
+	case errors.Is(err, ErrNotInteger):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, ErrQuorum):
+		return http.StatusServiceUnavailable, err.Error()
+	case errors.Is(err, ErrQuota):
+		return http.StatusInsufficientStorage, err.Error()
+	case errors.Is(err, ErrThrottled):
+		c.Header("Retry-After", "1")
+		return http.StatusTooManyRequests, err.Error()
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "storage timed out"
+	default:
+		log.Printf("%s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+		return http.StatusInternalServerError, strings.ToLower(http.StatusText(http.StatusInternalServerError))
+	}
+}
+
+func fail(c *gin.Context, err error) {
+	if errors.Is(err, context.Canceled) {
+		// the client went away
+		c.Abort()
+		return
+	}
+	code, msg := status(c, err)
+	c.AbortWithStatusJSON(code, gin.H{"error": msg})
+}
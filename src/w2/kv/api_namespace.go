@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errUnauthorized = &requestError{http.StatusUnauthorized, "missing or wrong API key"}
+	errAdminOnly    = &requestError{http.StatusForbidden, "needs the admin key"}
+)
+
+// nsContextKey is where the namespace of a request is kept in its gin
+// context.
+const nsContextKey = "namespace"
+
+type nsContext struct {
+	name             string
+	primary, replica Store
+}
+
+// namespace picks the namespace of the request from /ns/:ns or the
+// X-Namespace header, and checks the API key, from Authorization: Bearer
+// or X-API-Key. The admin key works for every namespace. Requests without
+// a namespace use the keys outside of namespaces, without a key.
+func (a *API) namespace(c *gin.Context) {
+	name := c.Param("ns")
+	if name == "" {
+		name = c.GetHeader("X-Namespace")
+	}
+	if name == "" {
+		return
+	}
+	if a.namespaces == nil {
+		fail(c, errNoNamespace)
+		return
+	}
+	var err error
+	if a.isAdmin(c) {
+		_, err = a.namespaces.Get(c.Request.Context(), name)
+	} else {
+		_, err = a.namespaces.Authenticate(c.Request.Context(), name, apiKey(c))
+	}
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	primary, replica := a.namespaces.Stores(name)
+	c.Set(nsContextKey, &nsContext{name: name, primary: primary, replica: replica})
+}
+
+func apiKey(c *gin.Context) string {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return c.GetHeader("X-API-Key")
+}
+
+func (a *API) isAdmin(c *gin.Context) bool {
+	return isAdmin(c, a.adminKey)
+}
+
+func isAdmin(c *gin.Context, adminKey string) bool {
+	return adminKey != "" && subtle.ConstantTimeCompare([]byte(apiKey(c)), []byte(adminKey)) == 1
+}
+
+// adminOnly keeps the endpoints that run the server, and see the keys of
+// every namespace, to the admin once there are namespaces. Without an
+// admin key the server has one tenant and they stay open.
+func adminOnly(adminKey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminKey != "" && !isAdmin(c, adminKey) {
+			fail(c, errAdminOnly)
+		}
+	}
+}
+
+// registerNamespaces adds the endpoints that manage namespaces, all but
+// GET /namespaces/:ns and POST /namespaces/:ns/key need the admin key,
+// those take the key of the namespace too:
+//
+//	POST /namespaces               {"name", "max_keys", "max_bytes"} creates a namespace, returns its API key
+//	GET  /namespaces               all namespaces with their usage
+//	GET  /namespaces/:ns           usage of a namespace
+//	PUT  /namespaces/:ns/quota     {"max_keys", "max_bytes"}, 0 for no limit
+//	POST /namespaces/:ns/key       replaces the API key
+//	POST /namespaces/:ns/recount   counts the keys again, dropping expired ones
+//
+// The keys of a namespace are under /ns/:ns, like /ns/:ns/keys/:key, or
+// on the usual paths with an X-Namespace header. Writes over a quota get
+// 507.
+func (a *API) registerNamespaces(r gin.IRouter) {
+	admin := r.Group("/namespaces", func(c *gin.Context) {
+		if !a.isAdmin(c) {
+			fail(c, errAdminOnly)
+		}
+	})
+	admin.POST("", a.createNamespace)
+	admin.GET("", a.listNamespaces)
+	admin.PUT("/:ns/quota", a.setQuota)
+	admin.POST("/:ns/recount", a.recount)
+
+	own := r.Group("/namespaces/:ns", a.namespace, func(c *gin.Context) {
+		if _, ok := c.Get(nsContextKey); !ok {
+			fail(c, errNoNamespace)
+		}
+	})
+	own.GET("", a.namespaceStats)
+	own.POST("/key", a.rotateKey)
+}
+
+type quotaJSON struct {
+	MaxKeys  int64 `json:"max_keys"`
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+func (q quotaJSON) check() error {
+	if q.MaxKeys < 0 || q.MaxBytes < 0 {
+		return badRequest("quotas can't be negative")
+	}
+	return nil
+}
+
+func (a *API) createNamespace(c *gin.Context) {
+	var req struct {
+		Name string `json:"name"`
+		quotaJSON
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, badRequest("expected a JSON body with a name"))
+		return
+	}
+	if err := req.check(); err != nil {
+		fail(c, err)
+		return
+	}
+	key, err := a.namespaces.Create(c.Request.Context(), req.Name, req.MaxKeys, req.MaxBytes)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"name": req.Name, "api_key": key})
+}
+
+func (a *API) listNamespaces(c *gin.Context) {
+	list, err := a.namespaces.List(c.Request.Context())
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	stats := make([]NamespaceStats, len(list))
+	for i, ns := range list {
+		stats[i] = a.namespaces.Stats(ns)
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+func (a *API) namespaceStats(c *gin.Context) {
+	ns, err := a.namespaces.Get(c.Request.Context(), c.Param("ns"))
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, a.namespaces.Stats(ns))
+}
+
+func (a *API) setQuota(c *gin.Context) {
+	var q quotaJSON
+	if err := c.ShouldBindJSON(&q); err != nil {
+		fail(c, badRequest("expected a JSON body with max_keys and max_bytes"))
+		return
+	}
+	if err := q.check(); err != nil {
+		fail(c, err)
+		return
+	}
+	ns, err := a.namespaces.SetQuota(c.Request.Context(), c.Param("ns"), q.MaxKeys, q.MaxBytes)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, a.namespaces.Stats(ns))
+}
+
+func (a *API) rotateKey(c *gin.Context) {
+	key, err := a.namespaces.RotateKey(c.Request.Context(), c.Param("ns"))
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"name": c.Param("ns"), "api_key": key})
+}
+
+func (a *API) recount(c *gin.Context) {
+	ns, err := a.namespaces.Recount(c.Request.Context(), c.Param("ns"))
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, a.namespaces.Stats(ns))
+}
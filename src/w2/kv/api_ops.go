@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// incr handles INCR and DECR, sign is -1 for DECR.
+func (a *API) incr(sign int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.Param("key")
+		if err := checkKey(key); err != nil {
+			fail(c, err)
+			return
+		}
+		by := int64(1)
+		if q := c.Query("by"); q != "" {
+			var err error
+			if by, err = strconv.ParseInt(q, 10, 64); err != nil || by == math.MinInt64 {
+				fail(c, badRequest("by must be an integer"))
+				return
+			}
+		}
+		n, err := Incr(c.Request.Context(), a.writer(c), key, sign*by)
+		if err != nil {
+			fail(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"value": n})
+	}
+}
+
+func (a *API) ttl(c *gin.Context) {
+	key := c.Param("key")
+	if err := checkKey(key); err != nil {
+		fail(c, err)
+		return
+	}
+	e, err := a.reader(c).Get(c.Request.Context(), key)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ttl": toJSON(e).TTL})
+}
+
+func (a *API) expire(c *gin.Context) {
+	key := c.Param("key")
+	if err := checkKey(key); err != nil {
+		fail(c, err)
+		return
+	}
+	expiredAt, err := parseTTL(c.Query("ttl"))
+	if err == nil && c.Query("ttl") == "" {
+		err = errBadTTL
+	}
+	if err == nil {
+		err = Expire(c.Request.Context(), a.writer(c), key, expiredAt)
+	}
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (a *API) persist(c *gin.Context) {
+	key := c.Param("key")
+	if err := checkKey(key); err != nil {
+		fail(c, err)
+		return
+	}
+	if err := Expire(c.Request.Context(), a.writer(c), key, NoExpiry); err != nil {
+		fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// getset returns the old entry as JSON, with a null value if there was
+// none.
+func (a *API) getset(c *gin.Context) {
+	key := c.Param("key")
+	if err := checkKey(key); err != nil {
+		fail(c, err)
+		return
+	}
+	value, expiredAt, err := readValue(c)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	old, found, err := GetSet(c.Request.Context(), a.writer(c), key, value, expiredAt)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	if !found {
+		c.JSON(http.StatusOK, entryJSON{Key: key})
+		return
+	}
+	j := toJSON(old)
+	j.Version = 0 // replaced, so of no use for a conditional write
+	c.JSON(http.StatusOK, j)
+}
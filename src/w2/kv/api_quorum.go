@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registerQuorum adds the endpoints of the quorum mode. Every request can
+// pick its quorum with ?n=, ?r= and ?w=, the ones left out are the
+// defaults of the server.
+//
+//	GET /debug/quorum              the quorum, hints waiting for delivery and repairs
+//	GET /internal/records/:key     the record of key on this node
+//	PUT /internal/records/:key     writes a record, {"applied"} tells if it was newer
+//	GET /internal/records?after=&limit=
+//
+// The /internal endpoints are how the other nodes reach this one.
+func (a *API) registerQuorum(r gin.IRouter) {
+	r.GET("/debug/quorum", adminOnly(a.adminKey), func(c *gin.Context) {
+		c.JSON(http.StatusOK, a.quorum.Stats())
+	})
+	r.GET("/internal/records/:key", a.readRecord)
+	r.PUT("/internal/records/:key", a.writeRecord)
+	r.GET("/internal/records", a.scanRecords)
+}
+
+// quorumParams puts the quorum of the request into its context.
+func (a *API) quorumParams(c *gin.Context) {
+	q := a.quorum.def
+	for _, p := range []struct {
+		name string
+		n    *int
+	}{{"n", &q.N}, {"r", &q.R}, {"w", &q.W}} {
+		v := c.Query(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			fail(c, badRequest(p.name+" must be a number"))
+			return
+		}
+		*p.n = n
+	}
+	c.Request = c.Request.WithContext(WithQuorum(c.Request.Context(), q))
+}
+
+func (a *API) readRecord(c *gin.Context) {
+	r, err := a.local.Read(c.Request.Context(), c.Param("key"))
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+func (a *API) writeRecord(c *gin.Context) {
+	var r Record
+	if err := c.ShouldBindJSON(&r); err != nil || r.Key != c.Param("key") || r.Version == 0 {
+		fail(c, badRequest("expected a JSON record of the key with a version"))
+		return
+	}
+	applied, err := a.local.Write(c.Request.Context(), r)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"applied": applied})
+}
+
+func (a *API) scanRecords(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		fail(c, badRequest("limit must be from 1 to 1000"))
+		return
+	}
+	records, err := a.local.Scan(c.Request.Context(), c.Query("after"), limit)
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
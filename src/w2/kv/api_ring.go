@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registerRing adds the endpoints of a sharded store:
+//
+//	GET    /ring?key=           shards, their share of the keys and the owners of key
+//	POST   /ring/shards         {"name", "spec"} adds a shard, spec is bitcask:<dir> or sql:<port>,
+//	                            the dir must be in -data
+//	DELETE /ring/shards/:name   removes a shard
+//
+// Adding and removing start a rebalance and return 202, /ring shows how it
+// is going. They need the admin key if there is one.
+func (a *API) registerRing(r gin.IRouter) {
+	r.GET("/ring", func(c *gin.Context) {
+		c.JSON(http.StatusOK, a.sharded.Ring(c.Query("key")))
+	})
+	admin := r.Group("/ring/shards", adminOnly(a.adminKey))
+	admin.POST("", a.addShard)
+	admin.DELETE("/:name", a.removeShard)
+}
+
+func (a *API) addShard(c *gin.Context) {
+	var req struct {
+		Name string `json:"name"`
+		Spec string `json:"spec"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Name == "" || req.Spec == "" {
+		fail(c, badRequest("expected a JSON body with a name and spec"))
+		return
+	}
+	if dir, ok := strings.CutPrefix(req.Spec, "bitcask:"); ok && !inDir(a.shardDir, dir) {
+		fail(c, badRequest("bitcask shards must be in "+a.shardDir))
+		return
+	}
+	st, err := a.openShard(req.Spec)
+	if err != nil {
+		fail(c, badRequest(err.Error()))
+		return
+	}
+	// the rebalance outlives the request
+	if err := a.sharded.AddShard(context.WithoutCancel(c.Request.Context()), req.Name, st); err != nil {
+		st.Close()
+		fail(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, a.sharded.Ring(""))
+}
+
+func (a *API) removeShard(c *gin.Context) {
+	if err := a.sharded.RemoveShard(context.WithoutCancel(c.Request.Context()), c.Param("name")); err != nil {
+		fail(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, a.sharded.Ring(""))
+}
+
+// inDir reports whether path is below dir, after following symlinks as far
+// as they exist.
+func inDir(dir, path string) bool {
+	if dir == "" {
+		return false
+	}
+	dir, err := resolve(dir)
+	if err != nil {
+		return false
+	}
+	path, err = resolve(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolve makes path absolute and follows the symlinks of the part of it
+// that exists, the rest is created when the shard is opened.
+func resolve(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	var rest []string
+	for {
+		real, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(path)}, rest...)
+		path = parent
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestAPI(t *testing.T) http.Handler {
+	t.Helper()
+	s, err := OpenBitcask(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	(&API{primary: s, replica: s, changes: s.(ChangeLog)}).Register(r)
+	return r
+}
+
+func do(h http.Handler, method, path, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPI(t *testing.T) {
+	h := newTestAPI(t)
+	steps := []struct {
+		method, path, contentType, body string
+		code                            int
+		resp                            string
+	}{
+		{"GET", "/keys/a", "", "", 404, ""},
+		{"PUT", "/keys/a", "text/plain", "hello", 201, ""},
+		{"PUT", "/keys/a", "", "again", 200, ""},
+		{"GET", "/keys/a", "", "", 200, "again"},
+		{"PUT", "/keys/b", "application/json", `{"value": "json", "ttl": 60}`, 201, ""},
+		{"PUT", "/keys/b", "application/json", `{"ttl": 60}`, 400, ""},
+		{"PUT", "/keys/c?ttl=-1", "", "x", 400, ""},
+		{"PUT", "/keys/c", "", strings.Repeat("x", MaxValueSize+1), 413, ""},
+		{"PUT", "/keys/" + strings.Repeat("k", MaxKeyLen+1), "", "x", 400, ""},
+		{"POST", "/mset", "application/json", `{"entries": [{"key": "a", "value": "1"}, {"key": "d", "value": "4"}]}`, 200, `{"created":1,"updated":1}`},
+		{"POST", "/mget", "application/json", `{"keys": ["a", "b", "c", "d"]}`, 200, `{"values":["1","json",null,"4"]}`},
+		{"DELETE", "/keys/a", "", "", 204, ""},
+		{"DELETE", "/keys/a", "", "", 404, ""},
+		{"GET", "/keys/a", "", "", 404, ""},
+	}
+	for _, s := range steps {
+		w := do(h, s.method, s.path, s.contentType, s.body)
+		if w.Code != s.code {
+			t.Fatalf("%s %s: expected %d but got %d %s", s.method, s.path, s.code, w.Code, w.Body)
+		}
+		if s.resp != "" && w.Body.String() != s.resp {
+			t.Errorf("%s %s: expected %s but got %s", s.method, s.path, s.resp, w.Body)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/keys/b", nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	var e entryJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || *e.Value != "json" || e.TTL == nil || *e.TTL > 60 {
+		t.Errorf("unexpected JSON entry %s", w.Body)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	h := newTestAPI(t)
+	withHeader := func(method, path, header, value, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(header, value)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := withHeader("PUT", "/keys/a", "If-Match", "*", "1"); w.Code != 412 {
+		t.Errorf("expected If-Match: * to fail for a missing key but got %d", w.Code)
+	}
+	w := withHeader("PUT", "/keys/a", "If-None-Match", "*", "1")
+	v1 := w.Header().Get("ETag")
+	if w.Code != 201 || v1 == "" {
+		t.Fatalf("expected a create with an ETag but got %d %q", w.Code, v1)
+	}
+	if w := withHeader("PUT", "/keys/a", "If-None-Match", "*", "2"); w.Code != 412 {
+		t.Errorf("expected a second create to fail but got %d", w.Code)
+	}
+	if w := withHeader("GET", "/keys/a", "If-None-Match", v1, ""); w.Code != 304 {
+		t.Errorf("expected 304 for the current ETag but got %d", w.Code)
+	}
+
+	w = withHeader("PUT", "/keys/a", "If-Match", v1, "2")
+	v2 := w.Header().Get("ETag")
+	if w.Code != 200 || v2 == v1 {
+		t.Fatalf("expected the update to change the ETag, got %d %q", w.Code, v2)
+	}
+	if w := withHeader("PUT", "/keys/a", "If-Match", v1, "3"); w.Code != 412 {
+		t.Errorf("expected a stale If-Match to fail but got %d", w.Code)
+	}
+	if w := withHeader("DELETE", "/keys/a", "If-Match", v1, ""); w.Code != 412 {
+		t.Errorf("expected a stale delete to fail but got %d", w.Code)
+	}
+
+	version := strings.Trim(v2, `"`)
+	if w := do(h, "POST", "/cas", "application/json", `{"key": "a", "version": 1, "value": "x"}`); w.Code != 412 {
+		t.Errorf("expected CAS with a wrong version to fail but got %d", w.Code)
+	}
+	w = do(h, "POST", "/cas", "application/json", `{"key": "a", "version": `+version+`, "value": "x"}`)
+	var resp struct{ Version uint64 }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); w.Code != 200 || err != nil || etag(resp.Version) != w.Header().Get("ETag") {
+		t.Errorf("expected CAS to return the new version but got %d %s", w.Code, w.Body)
+	}
+	if w := do(h, "POST", "/cas", "application/json", `{"key": "b", "value": "x"}`); w.Code != 201 {
+		t.Errorf("expected CAS without a version to create b but got %d", w.Code)
+	}
+	if w := withHeader("DELETE", "/keys/a", "If-Match", etag(resp.Version), ""); w.Code != 204 {
+		t.Errorf("expected a delete at the current version to succeed but got %d", w.Code)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	h := newTestAPI(t)
+	steps := []struct {
+		method, path, body string
+		code               int
+		resp               string
+	}{
+		{"POST", "/keys/n/incr", "", 200, `{"value":1}`},
+		{"POST", "/keys/n/incr?by=10", "", 200, `{"value":11}`},
+		{"POST", "/keys/n/decr?by=20", "", 200, `{"value":-9}`},
+		{"POST", "/keys/n/incr?by=x", "", 400, ""},
+		{"PUT", "/keys/s", "abc", 201, ""},
+		{"POST", "/keys/s/incr", "", 409, ""},
+		{"PUT", "/keys/m", "9223372036854775807", 201, ""},
+		{"POST", "/keys/m/incr", "", 409, ""},
+		{"GET", "/keys/n/ttl", "", 200, `{"ttl":null}`},
+		{"PUT", "/keys/n/ttl?ttl=100", "", 204, ""},
+		{"POST", "/keys/n/incr", "", 200, `{"value":-8}`},
+		{"PUT", "/keys/n/ttl", "", 400, ""},
+		{"PUT", "/keys/missing/ttl?ttl=100", "", 404, ""},
+		{"DELETE", "/keys/n/ttl", "", 204, ""},
+		{"GET", "/keys/n/ttl", "", 200, `{"ttl":null}`},
+		{"GET", "/keys/missing/ttl", "", 404, ""},
+		{"POST", "/keys/g/getset", "1", 200, `{"key":"g","value":null}`},
+		{"POST", "/keys/g/getset", "2", 200, `{"key":"g","value":"1"}`},
+		{"GET", "/keys/g", "", 200, "2"},
+	}
+	for _, s := range steps {
+		w := do(h, s.method, s.path, "", s.body)
+		if w.Code != s.code {
+			t.Fatalf("%s %s: expected %d but got %d %s", s.method, s.path, s.code, w.Code, w.Body)
+		}
+		if s.resp != "" && w.Body.String() != s.resp {
+			t.Errorf("%s %s: expected %s but got %s", s.method, s.path, s.resp, w.Body)
+		}
+	}
+
+	// the ttl survives incr
+	do(h, "PUT", "/keys/n/ttl?ttl=100", "", "")
+	do(h, "POST", "/keys/n/incr", "", "")
+	w := do(h, "GET", "/keys/n/ttl", "", "")
+	if w.Body.String() == `{"ttl":null}` {
+		t.Errorf("expected incr to keep the ttl but got %s", w.Body)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	h := newTestAPI(t)
+	do(h, "PUT", "/keys/a", "", "1")
+	do(h, "PUT", "/keys/bx", "", "2")
+	do(h, "DELETE", "/keys/a", "", "")
+
+	var resp struct {
+		Changes []changeJSON
+		Next    uint64
+	}
+	w := do(h, "GET", "/watch?since=0&prefix=a", "", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Changes) != 2 ||
+		resp.Changes[0].Op != "put" || *resp.Changes[0].Value != "1" || resp.Changes[1].Op != "delete" {
+		t.Fatalf("expected the put and delete of a but got %d %s", w.Code, w.Body)
+	}
+	if resp.Next != 3 {
+		t.Errorf("expected to continue after the last change but got %d", resp.Next)
+	}
+
+	// a long poll waits for the next change
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- do(h, "GET", "/watch?since=3&timeout=5", "", "") }()
+	time.Sleep(20 * time.Millisecond)
+	do(h, "PUT", "/keys/c", "", "3")
+	select {
+	case w := <-done:
+		if !strings.Contains(w.Body.String(), `"key":"c"`) {
+			t.Errorf("expected the put of c but got %s", w.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the long poll to return on the put")
+	}
+
+	if w := do(h, "GET", "/watch?since=4&timeout=0", "", ""); w.Code != 200 || !strings.Contains(w.Body.String(), `"changes":[]`) {
+		t.Errorf("expected no changes after the timeout but got %d %s", w.Code, w.Body)
+	}
+	if w := do(h, "GET", "/watch?since=100", "", ""); w.Code != 410 {
+		t.Errorf("expected 410 for a seq the log doesn't have but got %d", w.Code)
+	}
+}
+
+func TestWatchStream(t *testing.T) {
+	srv := httptest.NewServer(newTestAPI(t))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/watch?prefix=k", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	put := func(key string) {
+		r, _ := http.NewRequest("PUT", srv.URL+"/keys/"+key, strings.NewReader("v"))
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	put("other")
+	put("k1")
+
+	lines := bufio.NewScanner(resp.Body)
+	var event []string
+	for lines.Scan() && lines.Text() != "" {
+		event = append(event, lines.Text())
+	}
+	if len(event) != 3 || event[0] != "id: 2" || event[1] != "event: put" || !strings.Contains(event[2], `"key":"k1"`) {
+		t.Errorf("expected the put of k1 but got %q", event)
+	}
+}
+
+func TestRingAPI(t *testing.T) {
+	s := NewShardedStore(openShards(t, "a", "b"), 16, 2)
+	defer s.Close()
+	gin.SetMode(gin.TestMode)
+	h := gin.New()
+	dir := t.TempDir()
+	(&API{primary: s, replica: s, sharded: s, openShard: OpenShard, shardDir: dir}).Register(h)
+
+	do(h, "PUT", "/keys/k", "", "v")
+	if w := do(h, "POST", "/ring/shards", "application/json", `{"name": "c", "spec": "nope"}`); w.Code != 400 {
+		t.Errorf("expected a bad spec to be refused but got %d", w.Code)
+	}
+	for _, path := range []string{t.TempDir(), dir, dir + "/../c"} {
+		if w := do(h, "POST", "/ring/shards", "application/json", `{"name": "c", "spec": "bitcask:`+path+`"}`); w.Code != 400 {
+			t.Errorf("expected a shard in %s, outside of %s, to be refused but got %d", path, dir, w.Code)
+		}
+	}
+	w := do(h, "POST", "/ring/shards", "application/json", `{"name": "c", "spec": "bitcask:`+dir+`/c"}`)
+	if w.Code != 202 {
+		t.Fatalf("expected the rebalance to start but got %d %s", w.Code, w.Body)
+	}
+	waitForRebalance(t, s)
+	var info RingInfo
+	w = do(h, "GET", "/ring?key=k", "", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || len(info.Shards) != 3 || len(info.Owners) != 2 {
+		t.Errorf("expected three shards and two owners of k but got %s", w.Body)
+	}
+	if w := do(h, "GET", "/keys/k", "", ""); w.Body.String() != "v" {
+		t.Errorf("expected k to survive the rebalance but got %d %s", w.Code, w.Body)
+	}
+	if w := do(h, "DELETE", "/ring/shards/x", "", ""); w.Code != 404 {
+		t.Errorf("expected removing an unknown shard to fail but got %d", w.Code)
+	}
+
+	// with namespaces only the admin changes the shards
+	h = gin.New()
+	(&API{primary: s, replica: s, sharded: s, openShard: OpenShard, shardDir: dir, adminKey: "admin"}).Register(h)
+	if w := doAs(h, "DELETE", "/ring/shards/c", "", "X-API-Key", "nope"); w.Code != 403 {
+		t.Errorf("expected removing a shard without the admin key to be refused but got %d", w.Code)
+	}
+	if w := doAs(h, "DELETE", "/ring/shards/x", "", "X-API-Key", "admin"); w.Code != 404 {
+		t.Errorf("expected the admin to reach the shards but got %d", w.Code)
+	}
+}
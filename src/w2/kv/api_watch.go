@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	watchBatch     = 100
+	maxPollTimeout = time.Minute
+	// sseHeartbeat keeps idle streams from being closed by proxies.
+	sseHeartbeat = 15 * time.Second
+)
+
+// changeJSON is how changes look on /watch.
+type changeJSON struct {
+	Seq     uint64  `json:"seq"`
+	Op      string  `json:"op"`
+	Key     string  `json:"key"`
+	Value   *string `json:"value,omitempty"`
+	TTL     *int64  `json:"ttl,omitempty"`
+	Version uint64  `json:"version,omitempty"`
+}
+
+// toChangeJSON shows a change in the key space of the request, changes
+// outside of it are left out.
+func (a *API) toChangeJSON(ctx *gin.Context, c Change) (changeJSON, bool) {
+	key := c.Key
+	if ns, ok := ctx.Get(nsContextKey); ok {
+		key = strings.TrimPrefix(key, nsPrefix(ns.(*nsContext).name))
+	} else if strings.HasPrefix(key, nsSep) {
+		return changeJSON{}, false
+	}
+	j := changeJSON{Seq: c.Seq, Op: c.Op, Key: key, Version: c.Version}
+	if c.Op == "put" {
+		e := toJSON(Entry{Value: c.Value, ExpiredAt: c.ExpiredAt})
+		j.Value, j.TTL = e.Value, e.TTL
+	}
+	return j, true
+}
+
+func (a *API) watchPrefix(c *gin.Context) string {
+	if ns, ok := c.Get(nsContextKey); ok {
+		return nsPrefix(ns.(*nsContext).name) + c.Query("prefix")
+	}
+	return c.Query("prefix")
+}
+
+// watch streams the changes of keys starting with ?prefix= after ?since=,
+// or from now on. With Accept: text/event-stream they are sent as server
+// sent events whose id is the seq, so reconnects resume with Last-Event-ID.
+// Otherwise it is a long poll that waits up to ?timeout= seconds for
+// changes and returns them with the seq to pass as since next time.
+//
+// Readers that fell behind what the log keeps get 410, or a truncated
+// event, and have to read the keys again.
+func (a *API) watch(c *gin.Context) {
+	if a.changes == nil {
+		fail(c, &requestError{http.StatusNotImplemented, "this backend has no change log"})
+		return
+	}
+	ctx := c.Request.Context()
+	since := c.Query("since")
+	if id := c.GetHeader("Last-Event-ID"); id != "" {
+		since = id
+	}
+	var after uint64
+	var err error
+	if since == "" {
+		after, err = a.changes.Head(ctx)
+	} else if after, err = strconv.ParseUint(since, 10, 64); err != nil {
+		err = badRequest("since must be a seq")
+	}
+	if err != nil {
+		fail(c, err)
+		return
+	}
+
+	if c.NegotiateFormat(gin.MIMEJSON, "text/event-stream") == "text/event-stream" {
+		a.stream(c, after)
+		return
+	}
+
+	timeout := 30 * time.Second
+	if t := c.Query("timeout"); t != "" {
+		seconds, err := strconv.ParseInt(t, 10, 64)
+		if err != nil || seconds < 0 {
+			fail(c, badRequest("timeout must be a number of seconds"))
+			return
+		}
+		timeout = min(time.Duration(seconds)*time.Second, maxPollTimeout)
+	}
+	pollCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	changes, next, err := Watch(pollCtx, a.changes, after, a.watchPrefix(c), watchBatch)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	resp := make([]changeJSON, 0, len(changes))
+	for _, ch := range changes {
+		if j, ok := a.toChangeJSON(c, ch); ok {
+			resp = append(resp, j)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"changes": resp, "next": next})
+}
+
+func (a *API) stream(c *gin.Context, after uint64) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	for ctx.Err() == nil {
+		waitCtx, cancel := context.WithTimeout(ctx, sseHeartbeat)
+		changes, next, err := Watch(waitCtx, a.changes, after, a.watchPrefix(c), watchBatch)
+		cancel()
+		if errors.Is(err, ErrTruncated) {
+			fmt.Fprintf(c.Writer, "event: truncated\ndata: %s\n\n", err)
+			return
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Watch failed: %v", err)
+			}
+			return
+		}
+		after = next
+		if len(changes) == 0 {
+			fmt.Fprint(c.Writer, ": ping\n\n")
+		}
+		for _, ch := range changes {
+			j, ok := a.toChangeJSON(c, ch)
+			if !ok {
+				continue
+			}
+			data, _ := json.Marshal(j)
+			fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", ch.Seq, ch.Op, data)
+		}
+		c.Writer.Flush()
+	}
+}
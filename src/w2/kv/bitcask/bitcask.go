@@ -0,0 +1,545 @@
+// Package bitcask is an embedded key/value engine modelled on Bitcask. Writes
+// are appended to a data file, an in-memory key directory points at the
+// latest record of every key, and a merge rewrites the live records to
+// reclaim the space taken by overwritten, deleted and expired ones.
+//
+// Every record carries a sequence number, so on open the key directory is
+// rebuilt by replaying the data files in any order and keeping the highest
+// sequence number per key. A record torn by a crash is cut off the end of
+// its file.
+package bitcask
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("bitcask: key not found")
+	ErrClosed   = errors.New("bitcask: closed")
+	ErrTooLarge = errors.New("bitcask: key or value too large")
+	ErrLocked   = errors.New("bitcask: open elsewhere")
+)
+
+type Options struct {
+	// MaxFileSize is the size beyond which the active data file is closed
+	// and a new one started.
+	MaxFileSize int64
+	// Sync makes every write wait for fsync.
+	Sync bool
+	// MergeInterval is how often to check if a merge is worth it, zero
+	// disables background merges.
+	MergeInterval time.Duration
+	// MergeRatio is the fraction of dead bytes that triggers a merge.
+	MergeRatio float64
+	// OnWrite is called after every put and delete, in the order of their
+	// sequence numbers. It runs under the write lock and must not block or
+	// use the database.
+	OnWrite func(e Entry, deleted bool)
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MaxFileSize:   64 << 20,
+		MergeInterval: time.Minute,
+		MergeRatio:    0.5,
+	}
+}
+
+// Entry is the current value of a key. ExpiredAt is a unix timestamp in
+// seconds, zero means it never expires. Seq increases with every write to
+// the database.
+type Entry struct {
+	Key       string
+	Value     []byte
+	ExpiredAt int64
+	Seq       uint64
+}
+
+func (e Entry) expired(now int64) bool {
+	return e.ExpiredAt != 0 && e.ExpiredAt <= now
+}
+
+// location is where the latest record of a key is.
+type location struct {
+	file      uint32
+	offset    int64 // of the record
+	size      int64 // of the record
+	expiredAt int64
+	seq       uint64
+}
+
+type dataFile struct {
+	id   uint32
+	f    *os.File
+	size int64
+	dead int64 // bytes of records that are no longer current
+}
+
+type DB struct {
+	dir  string
+	opts Options
+	lock *os.File // held until Close
+
+	mu       sync.RWMutex
+	keydir   map[string]location
+	index    keyIndex
+	files    map[uint32]*dataFile
+	active   *dataFile
+	nextFile uint32
+	seq      uint64
+	closed   bool
+
+	merging sync.Mutex // one merge at a time
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Open opens the database in dir, creating it if needed, and rebuilds the
+// key directory from the data files.
+func Open(dir string, opts Options) (*DB, error) {
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = DefaultOptions().MaxFileSize
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{
+		dir:    dir,
+		opts:   opts,
+		lock:   lock,
+		keydir: make(map[string]location),
+		files:  make(map[uint32]*dataFile),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if err := db.load(); err != nil {
+		db.closeFiles()
+		return nil, err
+	}
+	// carry on with the last file if nothing was written to it
+	if last, ok := db.files[db.nextFile-1]; ok && last.size == 0 {
+		db.active = last
+	}
+	if err := db.rotate(); err != nil {
+		db.closeFiles()
+		return nil, err
+	}
+	go db.mergeLoop()
+	return db, nil
+}
+
+// lockDir takes the lock file of dir, so that a second process, such as an
+// export next to the running server, can't open the database and append to
+// or merge away the files the first one is using.
+func lockDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "LOCK"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, dir)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+func (db *DB) path(id uint32) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%09d.data", id))
+}
+
+// load replays every data file into the key directory.
+func (db *DB) load() error {
+	names, err := filepath.Glob(filepath.Join(db.dir, "*.data"))
+	if err != nil {
+		return err
+	}
+	var ids []uint32
+	for _, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".data"), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	slices.Sort(ids)
+
+	// sequence numbers of deletes, so that a put replayed after the
+	// delete that superseded it doesn't come back
+	deleted := make(map[string]uint64)
+	for _, id := range ids {
+		f, err := os.OpenFile(db.path(id), os.O_RDWR, 0o644)
+		if err != nil {
+			return err
+		}
+		df := &dataFile{id: id, f: f}
+		db.files[id] = df
+		db.nextFile = max(db.nextFile, id+1)
+		if err := db.replay(df, deleted); err != nil {
+			return fmt.Errorf("bitcask: replaying %s: %w", f.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (db *DB) replay(df *dataFile, deleted map[string]uint64) error {
+	r := bufio.NewReader(io.NewSectionReader(df.f, 0, 1<<62))
+	var off int64
+	for {
+		rec, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("bitcask: %s is damaged at offset %d (%v), truncating", df.f.Name(), off, err)
+			if err := df.f.Truncate(off); err != nil {
+				return err
+			}
+			break
+		}
+		size := rec.size()
+		db.seq = max(db.seq, rec.seq)
+
+		cur, ok := db.keydir[rec.key]
+		switch {
+		case ok && cur.seq >= rec.seq, deleted[rec.key] >= rec.seq:
+			df.dead += size
+		case rec.tombstone:
+			if ok {
+				db.files[cur.file].dead += cur.size
+				delete(db.keydir, rec.key)
+			}
+			deleted[rec.key] = rec.seq
+			df.dead += size
+		default:
+			if ok {
+				db.files[cur.file].dead += cur.size
+			}
+			db.keydir[rec.key] = location{file: df.id, offset: off, size: size, expiredAt: rec.expiredAt, seq: rec.seq}
+		}
+		off += size
+	}
+	df.size = off
+	return nil
+}
+
+// rotate starts a new active file, unless the current one is still empty.
+// Must be called with mu held.
+func (db *DB) rotate() error {
+	if db.active != nil && db.active.size == 0 {
+		return nil
+	}
+	df, err := db.create()
+	if err != nil {
+		return err
+	}
+	db.active = df
+	return nil
+}
+
+// create adds a new empty data file. Must be called with mu held.
+func (db *DB) create() (*dataFile, error) {
+	id := db.nextFile
+	f, err := os.OpenFile(db.path(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	db.nextFile++
+	df := &dataFile{id: id, f: f}
+	db.files[id] = df
+	return df, nil
+}
+
+// write appends a record to the active file. Must be called with mu held.
+func (db *DB) write(rec record) (location, error) {
+	buf := rec.encode()
+	if db.active.size > 0 && db.active.size+int64(len(buf)) > db.opts.MaxFileSize {
+		if err := db.rotate(); err != nil {
+			return location{}, err
+		}
+	}
+	df := db.active
+	if _, err := df.f.WriteAt(buf, df.size); err != nil {
+		// don't leave half a record behind for the next write to follow
+		df.f.Truncate(df.size)
+		return location{}, err
+	}
+	if db.opts.Sync {
+		if err := df.f.Sync(); err != nil {
+			return location{}, err
+		}
+	}
+	loc := location{file: df.id, offset: df.size, size: int64(len(buf)), expiredAt: rec.expiredAt, seq: rec.seq}
+	df.size += loc.size
+	return loc, nil
+}
+
+func (db *DB) Get(key string) (Entry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return Entry{}, ErrClosed
+	}
+	return db.get(key)
+}
+
+// get reads the live entry of key. Must be called with mu held.
+func (db *DB) get(key string) (Entry, error) {
+	loc, ok := db.keydir[key]
+	if !ok {
+		return Entry{}, ErrNotFound
+	}
+	e := Entry{Key: key, ExpiredAt: loc.expiredAt, Seq: loc.seq}
+	if e.expired(time.Now().Unix()) {
+		return Entry{}, ErrNotFound
+	}
+	value := make([]byte, loc.size-headerSize-int64(len(key)))
+	if _, err := db.files[loc.file].f.ReadAt(value, loc.offset+headerSize+int64(len(key))); err != nil {
+		return Entry{}, err
+	}
+	e.Value = value
+	return e, nil
+}
+
+// Scan returns up to limit live entries with keys after the given one, in
+// key order.
+func (db *DB) Scan(after string, limit int) ([]Entry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	now := time.Now().Unix()
+	keys := db.index.sorted(db.keydir)
+	i, found := slices.BinarySearch(keys, after)
+	if found {
+		i++
+	}
+	entries := make([]Entry, 0, min(limit, len(keys)-i))
+	for _, key := range keys[i:] {
+		if len(entries) >= limit {
+			break
+		}
+		loc, ok := db.keydir[key]
+		if !ok || (Entry{ExpiredAt: loc.expiredAt}).expired(now) {
+			continue
+		}
+		e, err := db.get(key)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Put sets the value of key. It returns the sequence number of the write
+// and whether it replaced a live value.
+func (db *DB) Put(key string, value []byte, expiredAt int64) (uint64, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return 0, false, ErrClosed
+	}
+	return db.put(key, value, expiredAt)
+}
+
+// put must be called with mu held.
+func (db *DB) put(key string, value []byte, expiredAt int64) (uint64, bool, error) {
+	if len(key) > maxKeySize || len(value) > maxValueSize {
+		return 0, false, ErrTooLarge
+	}
+	rec := record{seq: db.seq + 1, expiredAt: expiredAt, key: key, value: value}
+	loc, err := db.write(rec)
+	if err != nil {
+		return 0, false, err
+	}
+	db.seq = rec.seq
+	if db.opts.OnWrite != nil {
+		db.opts.OnWrite(Entry{Key: key, Value: value, ExpiredAt: expiredAt, Seq: rec.seq}, false)
+	}
+	old, replaced := db.keydir[key]
+	if replaced {
+		db.files[old.file].dead += old.size
+		replaced = !(Entry{ExpiredAt: old.expiredAt}).expired(time.Now().Unix())
+	} else {
+		db.index.add(key)
+	}
+	db.keydir[key] = loc
+	return rec.seq, replaced, nil
+}
+
+// Delete removes key, or returns ErrNotFound if it doesn't exist or has
+// expired.
+func (db *DB) Delete(key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.delete(key)
+}
+
+// delete must be called with mu held.
+func (db *DB) delete(key string) error {
+	old, ok := db.keydir[key]
+	if !ok || (Entry{ExpiredAt: old.expiredAt}).expired(time.Now().Unix()) {
+		return ErrNotFound
+	}
+	rec := record{seq: db.seq + 1, tombstone: true, key: key}
+	loc, err := db.write(rec)
+	if err != nil {
+		return err
+	}
+	db.seq = rec.seq
+	if db.opts.OnWrite != nil {
+		db.opts.OnWrite(Entry{Key: key, Seq: rec.seq}, true)
+	}
+	db.files[old.file].dead += old.size
+	db.files[loc.file].dead += loc.size
+	delete(db.keydir, key)
+	db.index.remove()
+	return nil
+}
+
+// Update reads, modifies and writes key without other writes getting in
+// between. fn gets the live entry of key, or nil, and returns what to write:
+// a new entry, nil to delete the key, or an error to leave it alone. Update
+// returns the written entry with its sequence number.
+func (db *DB) Update(key string, fn func(cur *Entry) (*Entry, error)) (Entry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return Entry{}, ErrClosed
+	}
+	var cur *Entry
+	e, err := db.get(key)
+	switch {
+	case err == nil:
+		cur = &e
+	case !errors.Is(err, ErrNotFound):
+		return Entry{}, err
+	}
+
+	next, err := fn(cur)
+	if err != nil {
+		return Entry{}, err
+	}
+	if next == nil {
+		if cur == nil {
+			return Entry{}, nil
+		}
+		return Entry{Key: key}, db.delete(key)
+	}
+	seq, _, err := db.put(key, next.Value, next.ExpiredAt)
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{Key: key, Value: next.Value, ExpiredAt: next.ExpiredAt, Seq: seq}, nil
+}
+
+// Seq returns the sequence number of the last write.
+func (db *DB) Seq() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.seq
+}
+
+type Stats struct {
+	Keys      int // including expired ones not merged away yet
+	Files     int
+	Bytes     int64
+	DeadBytes int64
+}
+
+func (db *DB) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	s := Stats{Keys: len(db.keydir), Files: len(db.files)}
+	for _, df := range db.files {
+		s.Bytes += df.size
+		s.DeadBytes += df.dead
+	}
+	return s
+}
+
+func (db *DB) mergeLoop() {
+	defer close(db.done)
+	if db.opts.MergeInterval <= 0 {
+		return
+	}
+	t := time.NewTicker(db.opts.MergeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-db.stop:
+			return
+		}
+		s := db.Stats()
+		if s.DeadBytes == 0 || float64(s.DeadBytes) < db.opts.MergeRatio*float64(s.Bytes) {
+			continue
+		}
+		if err := db.Merge(); err != nil {
+			log.Printf("bitcask: merge failed: %v", err)
+		}
+	}
+}
+
+// Sync flushes the active file to disk.
+func (db *DB) Sync() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.active.f.Sync()
+}
+
+func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+	close(db.stop)
+	db.mu.Unlock()
+	<-db.done
+
+	// wait for a merge in progress
+	db.merging.Lock()
+	defer db.merging.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	err := db.active.f.Sync()
+	return errors.Join(err, db.closeFiles())
+}
+
+// closeFiles closes the data files and then releases the lock.
+func (db *DB) closeFiles() error {
+	var errs []error
+	for _, df := range db.files {
+		errs = append(errs, df.f.Close())
+	}
+	errs = append(errs, db.lock.Close())
+	return errors.Join(errs...)
+}
@@ -0,0 +1,293 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func open(t *testing.T, dir string, opts Options) *DB {
+	t.Helper()
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func expectValue(t *testing.T, db *DB, key, want string) {
+	t.Helper()
+	e, err := db.Get(key)
+	if err != nil {
+		t.Fatalf("expected %s=%s but got %v", key, want, err)
+	}
+	if string(e.Value) != want {
+		t.Errorf("expected %s=%s but got %s", key, want, e.Value)
+	}
+}
+
+func expectMissing(t *testing.T, db *DB, key string) {
+	t.Helper()
+	if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %s to be missing but got %v", key, err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	db := open(t, dir, Options{MaxFileSize: 256})
+	for i := range 20 {
+		db.Put(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i)), 0)
+	}
+	db.Put("k1", []byte("updated"), 0)
+	db.Delete("k2")
+	db.Put("gone", []byte("x"), time.Now().Unix()-1)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = open(t, dir, Options{MaxFileSize: 256})
+	defer db.Close()
+	if s := db.Stats(); s.Files < 2 {
+		t.Errorf("expected the writes to span several files, got %d", s.Files)
+	}
+	expectValue(t, db, "k0", "v0")
+	expectValue(t, db, "k1", "updated")
+	expectValue(t, db, "k19", "v19")
+	expectMissing(t, db, "k2")
+	expectMissing(t, db, "gone")
+
+	// sequence numbers carry on where they stopped
+	seq, replaced, _ := db.Put("k3", []byte("v3"), 0)
+	if seq != 24 || !replaced {
+		t.Errorf("expected seq 24 replacing k3 but got %d, %v", seq, replaced)
+	}
+}
+
+func TestOpenLocksTheDirectory(t *testing.T) {
+	dir := t.TempDir()
+	db := open(t, dir, Options{})
+	if _, err := Open(dir, Options{}); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected a second open to fail with ErrLocked but got %v", err)
+	}
+	db.Close()
+	db = open(t, dir, Options{})
+	db.Close()
+}
+
+func TestTornWriteIsTruncated(t *testing.T) {
+	dir := t.TempDir()
+	db := open(t, dir, Options{})
+	db.Put("a", []byte("1"), 0)
+	db.Put("b", []byte("2"), 0)
+	db.Close()
+
+	// simulate a crash in the middle of writing b
+	path := filepath.Join(dir, fmt.Sprintf("%09d.data", 0))
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	db = open(t, dir, Options{})
+	defer db.Close()
+	expectValue(t, db, "a", "1")
+	expectMissing(t, db, "b")
+	info, _ = os.Stat(path)
+	if want := (record{key: "a", value: []byte("1")}).size(); info.Size() != want {
+		t.Errorf("expected the file to be cut to %d bytes but it has %d", want, info.Size())
+	}
+	db.Put("b", []byte("3"), 0)
+	expectValue(t, db, "b", "3")
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	db := open(t, dir, Options{MaxFileSize: 512})
+	for i := range 50 {
+		db.Put(fmt.Sprintf("k%d", i%10), []byte(fmt.Sprintf("v%d", i)), 0)
+	}
+	db.Put("deleted", []byte("x"), 0)
+	db.Delete("deleted")
+	db.Put("expired", []byte("x"), time.Now().Unix()-1)
+
+	before := db.Stats()
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	after := db.Stats()
+	if after.Bytes >= before.Bytes || after.DeadBytes != 0 || after.Keys != 10 {
+		t.Errorf("expected merge to reclaim space, before %+v after %+v", before, after)
+	}
+	for i := range 10 {
+		expectValue(t, db, fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", 40+i))
+	}
+	db.Put("k0", []byte("new"), 0)
+	db.Close()
+
+	db = open(t, dir, Options{MaxFileSize: 512})
+	defer db.Close()
+	expectValue(t, db, "k0", "new")
+	expectValue(t, db, "k9", "v49")
+	expectMissing(t, db, "deleted")
+	expectMissing(t, db, "expired")
+}
+
+func TestDeleteNotResurrectedByMergeOutput(t *testing.T) {
+	dir := t.TempDir()
+	db := open(t, dir, Options{})
+	db.Put("k", []byte("v"), 0)
+	db.Merge()
+	// the live copy of k now sits in a file after the active one
+	db.Delete("k")
+	db.Close()
+
+	db = open(t, dir, Options{})
+	defer db.Close()
+	expectMissing(t, db, "k")
+}
+
+func TestUpdate(t *testing.T) {
+	db := open(t, t.TempDir(), Options{})
+	defer db.Close()
+
+	appendX := func(cur *Entry) (*Entry, error) {
+		if cur == nil {
+			return &Entry{Value: []byte("x")}, nil
+		}
+		return &Entry{Value: append(cur.Value, 'x'), ExpiredAt: cur.ExpiredAt}, nil
+	}
+	db.Update("k", appendX)
+	e, err := db.Update("k", appendX)
+	if err != nil || string(e.Value) != "xx" || e.Seq != 2 {
+		t.Errorf("expected xx at seq 2 but got %+v %v", e, err)
+	}
+
+	boom := errors.New("boom")
+	if _, err := db.Update("k", func(*Entry) (*Entry, error) { return nil, boom }); err != boom {
+		t.Errorf("expected the error of fn but got %v", err)
+	}
+	expectValue(t, db, "k", "xx")
+
+	db.Update("k", func(*Entry) (*Entry, error) { return nil, nil })
+	expectMissing(t, db, "k")
+}
+
+func TestScan(t *testing.T) {
+	db := open(t, t.TempDir(), DefaultOptions())
+	defer db.Close()
+	for _, key := range []string{"c", "a", "d", "b"} {
+		db.Put(key, []byte(key), 0)
+	}
+	db.Delete("c")
+	db.Put("e", []byte("e"), time.Now().Unix()-1)
+
+	var keys []string
+	for after := ""; ; {
+		entries, err := db.Scan(after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		after = entries[len(entries)-1].Key
+	}
+	if strings.Join(keys, ",") != "a,b,d" {
+		t.Errorf("expected a,b,d but got %v", keys)
+	}
+}
+
+// TestScanWhileWriting scans with writes between the pages, which the
+// sorted index of the keys has to catch up with.
+func TestScanWhileWriting(t *testing.T) {
+	db := open(t, t.TempDir(), DefaultOptions())
+	defer db.Close()
+	for _, key := range []string{"a", "c", "e", "g"} {
+		db.Put(key, []byte(key), 0)
+	}
+
+	var keys []string
+	for after, page := "", 0; ; page++ {
+		entries, err := db.Scan(after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		after = entries[len(entries)-1].Key
+		if page == 0 {
+			db.Put("b", []byte("b"), 0) // behind the scan
+			db.Put("d", []byte("d"), 0)
+			db.Delete("e")
+			db.Delete("g")
+			db.Put("g", []byte("g"), 0)
+			db.Put("f", []byte("f"), time.Now().Unix()-1)
+		}
+	}
+	if strings.Join(keys, ",") != "a,c,d,g" {
+		t.Errorf("expected a,c,d,g but got %v", keys)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	db := open(t, t.TempDir(), Options{MaxFileSize: 512})
+	defer db.Close()
+	for i := range 20 {
+		db.Put(fmt.Sprintf("u%02d", i), []byte("old"), 0)
+	}
+	db.Put("other", []byte("x"), 0)
+
+	s, err := db.Snapshot("u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writes carry on, a merge waits for the snapshot
+	for i := range 20 {
+		db.Put(fmt.Sprintf("u%02d", i), []byte("new"), 0)
+	}
+	db.Delete("u00")
+	db.Put("u99", []byte("new"), 0)
+	merged := make(chan error)
+	go func() { merged <- db.Merge() }()
+
+	var keys []string
+	for {
+		e, err := s.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(e.Value) != "old" {
+			t.Errorf("expected the snapshot to have the old value of %s but got %s", e.Key, e.Value)
+		}
+		keys = append(keys, e.Key)
+	}
+	if len(keys) != 20 || keys[0] != "u00" || keys[19] != "u19" {
+		t.Errorf("expected u00 to u19 but got %v", keys)
+	}
+	select {
+	case <-merged:
+		t.Errorf("expected the merge to wait for the snapshot")
+	default:
+	}
+	s.Close()
+	if err := <-merged; err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, db, "u01", "new")
+}
@@ -0,0 +1,81 @@
+package bitcask
+
+import (
+	"slices"
+	"sync"
+)
+
+// keyIndex keeps the keys of the keydir in order for Scan. It is built on
+// the first scan, and later scans merge in the keys added since instead
+// of sorting them all again. Removed keys stay in it until they make up
+// half of it.
+type keyIndex struct {
+	// added and removed change with the keydir, under the write lock of
+	// the DB
+	built   bool
+	added   []string // since the index was built, not sorted
+	removed int
+
+	// sorting happens in scans, which only hold the read lock
+	mu   sync.Mutex
+	keys []string // never changed in place, scans keep using old ones
+}
+
+// add must be called with the write lock held when key is new to the
+// keydir.
+func (x *keyIndex) add(key string) {
+	if !x.built {
+		return
+	}
+	x.added = append(x.added, key)
+	// a DB that is written but rarely scanned sorts everything next time
+	if len(x.added) > len(x.keys)+1024 {
+		x.reset()
+	}
+}
+
+// remove must be called with the write lock held when key leaves the
+// keydir.
+func (x *keyIndex) remove() {
+	if x.built {
+		x.removed++
+	}
+}
+
+func (x *keyIndex) reset() {
+	x.built, x.added, x.removed, x.keys = false, nil, 0, nil
+}
+
+// sorted returns the keys of keydir in order, and maybe keys that are no
+// longer in it. It must be called with the read lock held.
+func (x *keyIndex) sorted(keydir map[string]location) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	switch {
+	case !x.built || x.removed > len(x.keys)/2:
+		keys := make([]string, 0, len(keydir))
+		for key := range keydir {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		x.built, x.added, x.removed, x.keys = true, nil, 0, keys
+	case len(x.added) > 0:
+		slices.Sort(x.added)
+		keys := make([]string, 0, len(x.keys)+len(x.added))
+		i, j := 0, 0
+		for i < len(x.keys) || j < len(x.added) {
+			var key string
+			if j == len(x.added) || i < len(x.keys) && x.keys[i] <= x.added[j] {
+				key, i = x.keys[i], i+1
+			} else {
+				key, j = x.added[j], j+1
+			}
+			// a key removed and added again is in both
+			if len(keys) == 0 || keys[len(keys)-1] != key {
+				keys = append(keys, key)
+			}
+		}
+		x.added, x.keys = nil, keys
+	}
+	return x.keys
+}
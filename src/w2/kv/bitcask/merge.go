@@ -0,0 +1,174 @@
+package bitcask
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+// moved is a live record copied by a merge.
+type moved struct {
+	key string
+	seq uint64
+	loc location
+}
+
+// Merge rewrites the live records of all data files but the active one into
+// new files and deletes the old ones. Deletes and expired records are
+// dropped. Reads and writes carry on while the records are copied, a record
+// overwritten in the meantime is simply not switched over.
+//
+// Tombstones can be dropped because every file older than the active one
+// takes part, so no older record of the key is left for them to hide.
+// Replaying an interrupted merge is safe too: the copies have the same
+// sequence numbers as the originals.
+func (db *DB) Merge() error {
+	db.merging.Lock()
+	defer db.merging.Unlock()
+
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	if err := db.rotate(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	var old []*dataFile
+	for id, df := range db.files {
+		if id != db.active.id {
+			old = append(old, df)
+		}
+	}
+	db.mu.Unlock()
+	slices.SortFunc(old, func(a, b *dataFile) int { return int(a.id) - int(b.id) })
+	if len(old) == 0 {
+		return nil
+	}
+
+	m := &merger{db: db}
+	now := time.Now().Unix()
+	for _, df := range old {
+		if err := m.copyLive(df, now); err != nil {
+			m.abort()
+			return err
+		}
+	}
+	if err := m.sync(); err != nil {
+		m.abort()
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	merged := make(map[uint32]bool, len(old))
+	for _, df := range old {
+		merged[df.id] = true
+	}
+	for _, mv := range m.moved {
+		if cur, ok := db.keydir[mv.key]; ok && cur.seq == mv.seq && merged[cur.file] {
+			db.keydir[mv.key] = mv.loc
+		} else {
+			db.files[mv.loc.file].dead += mv.loc.size
+		}
+	}
+	for _, e := range m.expired {
+		if cur, ok := db.keydir[e.key]; ok && cur.seq == e.seq && merged[cur.file] {
+			delete(db.keydir, e.key)
+			db.index.remove()
+		}
+	}
+	var errs []error
+	for _, df := range old {
+		delete(db.files, df.id)
+		errs = append(errs, df.f.Close(), os.Remove(df.f.Name()))
+	}
+	return errors.Join(errs...)
+}
+
+type merger struct {
+	db      *DB
+	out     *dataFile
+	outputs []*dataFile
+	moved   []moved
+	expired []moved
+}
+
+// copyLive appends the records of df that the key directory still points
+// to, to the merge output.
+func (m *merger) copyLive(df *dataFile, now int64) error {
+	r := bufio.NewReader(io.NewSectionReader(df.f, 0, df.size))
+	var off int64
+	for {
+		rec, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		size := rec.size()
+		m.db.mu.RLock()
+		cur, ok := m.db.keydir[rec.key]
+		m.db.mu.RUnlock()
+		live := ok && cur.file == df.id && cur.offset == off
+
+		switch {
+		case !live:
+		case (Entry{ExpiredAt: rec.expiredAt}).expired(now):
+			m.expired = append(m.expired, moved{key: rec.key, seq: rec.seq})
+		default:
+			loc, err := m.write(rec)
+			if err != nil {
+				return err
+			}
+			m.moved = append(m.moved, moved{key: rec.key, seq: rec.seq, loc: loc})
+		}
+		off += size
+	}
+}
+
+func (m *merger) write(rec record) (location, error) {
+	buf := rec.encode()
+	if m.out == nil || (m.out.size > 0 && m.out.size+int64(len(buf)) > m.db.opts.MaxFileSize) {
+		if err := m.sync(); err != nil {
+			return location{}, err
+		}
+		m.db.mu.Lock()
+		df, err := m.db.create()
+		m.db.mu.Unlock()
+		if err != nil {
+			return location{}, err
+		}
+		m.out = df
+		m.outputs = append(m.outputs, df)
+	}
+	if _, err := m.out.f.WriteAt(buf, m.out.size); err != nil {
+		return location{}, err
+	}
+	loc := location{file: m.out.id, offset: m.out.size, size: int64(len(buf)), expiredAt: rec.expiredAt, seq: rec.seq}
+	m.out.size += loc.size
+	return loc, nil
+}
+
+func (m *merger) sync() error {
+	if m.out == nil {
+		return nil
+	}
+	return m.out.f.Sync()
+}
+
+// abort removes the output of a failed merge.
+func (m *merger) abort() {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+	for _, df := range m.outputs {
+		delete(m.db.files, df.id)
+		df.f.Close()
+		os.Remove(df.f.Name())
+	}
+}
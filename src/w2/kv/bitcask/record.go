@@ -0,0 +1,87 @@
+package bitcask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// Every record in a data file is laid out as
+//
+//	crc uint32 | seq uint64 | expiredAt int64 | flags uint8 | keyLen uint32 | valueLen uint32 | key | value
+//
+// with the crc covering everything after it. Integers are big endian.
+const headerSize = 4 + 8 + 8 + 1 + 4 + 4
+
+const flagTombstone = 1
+
+// sanity limits so a corrupt header isn't taken for a huge record
+const (
+	maxKeySize   = 1 << 16
+	maxValueSize = 1 << 30
+)
+
+var errCorrupt = errors.New("bitcask: corrupt record")
+
+type record struct {
+	seq       uint64
+	expiredAt int64
+	tombstone bool
+	key       string
+	value     []byte
+}
+
+func (r record) size() int64 {
+	return int64(headerSize + len(r.key) + len(r.value))
+}
+
+func (r record) encode() []byte {
+	buf := make([]byte, r.size())
+	binary.BigEndian.PutUint64(buf[4:], r.seq)
+	binary.BigEndian.PutUint64(buf[12:], uint64(r.expiredAt))
+	if r.tombstone {
+		buf[20] = flagTombstone
+	}
+	binary.BigEndian.PutUint32(buf[21:], uint32(len(r.key)))
+	binary.BigEndian.PutUint32(buf[25:], uint32(len(r.value)))
+	copy(buf[headerSize:], r.key)
+	copy(buf[headerSize+len(r.key):], r.value)
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// readRecord reads the next record. It returns io.EOF at the clean end of
+// the file, and io.ErrUnexpectedEOF or errCorrupt for a torn or damaged
+// record, which is what a crash in the middle of a write leaves behind.
+func readRecord(r *bufio.Reader) (record, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return record{}, err
+	}
+	keyLen := binary.BigEndian.Uint32(header[21:])
+	valueLen := binary.BigEndian.Uint32(header[25:])
+	if keyLen > maxKeySize || valueLen > maxValueSize {
+		return record{}, errCorrupt
+	}
+	data := make([]byte, keyLen+valueLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return record{}, err
+	}
+	crc := crc32.ChecksumIEEE(header[4:])
+	crc = crc32.Update(crc, crc32.IEEETable, data)
+	if crc != binary.BigEndian.Uint32(header[:]) {
+		return record{}, errCorrupt
+	}
+	return record{
+		seq:       binary.BigEndian.Uint64(header[4:]),
+		expiredAt: int64(binary.BigEndian.Uint64(header[12:])),
+		tombstone: header[20]&flagTombstone != 0,
+		key:       string(data[:keyLen]),
+		value:     data[keyLen:],
+	}, nil
+}
@@ -0,0 +1,73 @@
+package bitcask
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Snapshot is the live entries of the database at the time it was taken.
+// Writes carry on meanwhile: records are only ever appended, so the ones
+// the snapshot points at stay where they are, and it holds off merges,
+// which would delete their files, until it is closed. Close the database
+// only after its snapshots.
+type Snapshot struct {
+	db    *DB
+	keys  []string
+	locs  map[string]location
+	files map[uint32]*dataFile
+	next  int
+}
+
+// Snapshot takes a snapshot of the keys starting with prefix.
+func (db *DB) Snapshot(prefix string) (*Snapshot, error) {
+	db.merging.Lock()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		db.merging.Unlock()
+		return nil, ErrClosed
+	}
+	s := &Snapshot{db: db, locs: make(map[string]location), files: make(map[uint32]*dataFile, len(db.files))}
+	now := time.Now().Unix()
+	for key, loc := range db.keydir {
+		if strings.HasPrefix(key, prefix) && !(Entry{ExpiredAt: loc.expiredAt}).expired(now) {
+			s.keys = append(s.keys, key)
+			s.locs[key] = loc
+		}
+	}
+	slices.Sort(s.keys)
+	for id, df := range db.files {
+		s.files[id] = df
+	}
+	return s, nil
+}
+
+// Len is how many entries the snapshot has.
+func (s *Snapshot) Len() int {
+	return len(s.keys)
+}
+
+// Next returns the next entry in key order, or io.EOF after the last.
+func (s *Snapshot) Next() (Entry, error) {
+	if s.next >= len(s.keys) {
+		return Entry{}, io.EOF
+	}
+	key := s.keys[s.next]
+	s.next++
+	loc := s.locs[key]
+	value := make([]byte, loc.size-headerSize-int64(len(key)))
+	if _, err := s.files[loc.file].f.ReadAt(value, loc.offset+headerSize+int64(len(key))); err != nil {
+		return Entry{}, err
+	}
+	return Entry{Key: key, Value: value, ExpiredAt: loc.expiredAt, Seq: loc.seq}, nil
+}
+
+// Close lets merges run again.
+func (s *Snapshot) Close() {
+	if s.db != nil {
+		s.db.merging.Unlock()
+		s.db = nil
+	}
+}
@@ -0,0 +1,145 @@
+// Package bloom is a scalable Bloom filter (Almeida et al.): a set that
+// answers "maybe" or "no", never "no" for a key it was given. When a stage
+// is full a bigger one with a lower false positive rate is added, so the
+// filter grows with its keys and the rate of all stages together stays
+// below the target.
+package bloom
+
+import (
+	"hash/maphash"
+	"math"
+	"sync"
+)
+
+const (
+	// growth is how many times the capacity of each stage is of the last
+	growth = 2
+	// tightening is how many times the false positive rate of each stage
+	// is of the last, the rates add up to at most 1/(1-tightening) of the
+	// first
+	tightening = 0.8
+)
+
+// Filter is safe for concurrent use and must be created with New.
+type Filter struct {
+	seed maphash.Seed
+
+	mu     sync.RWMutex
+	stages []*stage
+	keys   int
+}
+
+type stage struct {
+	bits     []uint64
+	m        uint64 // bits
+	k        int    // hashes
+	capacity int
+	keys     int
+	rate     float64
+}
+
+// New creates a filter whose first stage takes capacity keys, with a false
+// positive rate of at most rate over all stages.
+func New(capacity int, rate float64) *Filter {
+	f := &Filter{seed: maphash.MakeSeed()}
+	f.stages = append(f.stages, newStage(max(capacity, 1), rate*(1-tightening)))
+	return f
+}
+
+func newStage(capacity int, rate float64) *stage {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	return &stage{
+		bits:     make([]uint64, m/64),
+		m:        m,
+		k:        max(int(math.Ceil(-math.Log2(rate))), 1),
+		capacity: capacity,
+		rate:     rate,
+	}
+}
+
+// has reports whether the k bits of hash h are set. The bits come from
+// the two halves of h, by Kirsch and Mitzenmacher's double hashing.
+func (s *stage) has(h uint64) bool {
+	h1, h2 := h&math.MaxUint32, h>>32|1
+	for i := range uint64(s.k) {
+		bit := (h1 + i*h2) % s.m
+		if s.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *stage) add(h uint64) {
+	h1, h2 := h&math.MaxUint32, h>>32|1
+	for i := range uint64(s.k) {
+		bit := (h1 + i*h2) % s.m
+		s.bits[bit/64] |= 1 << (bit % 64)
+	}
+	s.keys++
+}
+
+// Has reports whether key may have been added, false means it wasn't.
+func (f *Filter) Has(key string) bool {
+	h := maphash.String(f.seed, key)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.has(h)
+}
+
+func (f *Filter) has(h uint64) bool {
+	for _, s := range f.stages {
+		if s.has(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add adds key. Keys the filter may have already don't take up room.
+func (f *Filter) Add(key string) {
+	h := maphash.String(f.seed, key)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.has(h) {
+		return
+	}
+	last := f.stages[len(f.stages)-1]
+	if last.keys >= last.capacity {
+		last = newStage(last.capacity*growth, last.rate*tightening)
+		f.stages = append(f.stages, last)
+	}
+	last.add(h)
+	f.keys++
+}
+
+// Len returns how many keys were added, less the ones the filter had
+// already.
+func (f *Filter) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.keys
+}
+
+// Stats describe the filter.
+type Stats struct {
+	Keys   int `json:"keys"` // added, less the ones the filter had already
+	Stages int `json:"stages"`
+	Bytes  int `json:"bytes"`
+	// FalsePositiveRate is estimated from how full the stages are.
+	FalsePositiveRate float64 `json:"false_positive_rate"`
+}
+
+func (f *Filter) Stats() Stats {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	s := Stats{Keys: f.keys, Stages: len(f.stages)}
+	negative := 1.0
+	for _, st := range f.stages {
+		s.Bytes += len(st.bits) * 8
+		negative *= 1 - math.Pow(1-math.Exp(-float64(st.k)*float64(st.keys)/float64(st.m)), float64(st.k))
+	}
+	s.FalsePositiveRate = 1 - negative
+	return s
+}
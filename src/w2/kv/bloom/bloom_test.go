@@ -0,0 +1,46 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNoFalseNegatives(t *testing.T) {
+	f := New(1000, 0.01)
+	for i := range 50000 {
+		f.Add(fmt.Sprintf("key%d", i))
+	}
+	for i := range 50000 {
+		if !f.Has(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("expected key%d to be in the filter", i)
+		}
+	}
+	if s := f.Stats(); s.Keys < 49000 || s.Stages != 6 {
+		t.Errorf("expected the filter to grow to 6 stages but got %+v", s)
+	}
+}
+
+func TestFalsePositiveRate(t *testing.T) {
+	f := New(1000, 0.01)
+	for i := range 20000 {
+		f.Add(fmt.Sprintf("key%d", i))
+	}
+	positives := 0
+	for i := range 100000 {
+		if f.Has(fmt.Sprintf("other%d", i)) {
+			positives++
+		}
+	}
+	rate := float64(positives) / 100000
+	if rate > 0.01 {
+		t.Errorf("expected at most 1%% false positives but got %f", rate)
+	}
+	if est := f.Stats().FalsePositiveRate; est > 0.01 || est < rate/2 || est > rate*2 {
+		t.Errorf("expected an estimate close to %f but got %f", rate, est)
+	}
+
+	f.Add("key1")
+	if s := f.Stats(); s.Keys > 20000 {
+		t.Errorf("expected keys added again not to count but got %d", s.Keys)
+	}
+}
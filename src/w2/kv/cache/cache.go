@@ -0,0 +1,258 @@
+// Package cache is an in-process read-through cache: a sharded LRU bounded
+// in bytes, whose entries expire at a time given by the loader. Concurrent
+// misses of a key share one load, and keys the loader didn't find are
+// remembered for a short while too.
+package cache
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Options struct {
+	// MaxBytes bounds the total size of the entries, split evenly across
+	// the shards.
+	MaxBytes int64
+	Shards   int
+	// MaxTTL bounds how long an entry is kept even if it expires later,
+	// which limits how stale it gets when the data is changed elsewhere.
+	// Zero means no bound.
+	MaxTTL time.Duration
+	// NegativeTTL is how long a missing key is remembered, zero disables
+	// negative caching.
+	NegativeTTL time.Duration
+	// Hold is how long after an invalidation loads of the key aren't
+	// cached, for loaders that read a copy which catches up with writes
+	// later. Zero caches the first load after an invalidation.
+	Hold time.Duration
+}
+
+// Loader fetches a key on a miss. It returns the value and when it expires,
+// or found=false if the key doesn't exist. Errors aren't cached.
+type Loader[V any] func() (value V, expires time.Time, found bool, err error)
+
+// Cache must be created with New. Cached values are shared between callers
+// and must not be modified.
+type Cache[V any] struct {
+	opts   Options
+	size   func(key string, v V) int64
+	shards []*shard[V]
+
+	hits, negativeHits, misses, collapsed, evictions, expired atomic.Int64
+}
+
+// Stats are counted since the cache was created.
+type Stats struct {
+	Hits         int64 `json:"hits"`
+	NegativeHits int64 `json:"negative_hits"`
+	Misses       int64 `json:"misses"`
+	Collapsed    int64 `json:"collapsed"` // misses that waited for another load
+	Evictions    int64 `json:"evictions"`
+	Expired      int64 `json:"expired"`
+	Entries      int   `json:"entries"`
+	Bytes        int64 `json:"bytes"`
+}
+
+type shard[V any] struct {
+	mu       sync.Mutex
+	items    map[string]*list.Element
+	lru      *list.List // front is most recently used
+	bytes    int64
+	maxBytes int64
+	calls    map[string]*call[V]
+	// epoch changes on every invalidation, a load that started before
+	// one may have read the old value and isn't cached
+	epoch uint64
+	// held keys were invalidated less than Hold ago, loads of them aren't
+	// cached until the time they map to
+	held    map[string]time.Time
+	sweepAt int
+}
+
+type item[V any] struct {
+	key     string
+	value   V
+	found   bool
+	expires time.Time
+	size    int64
+}
+
+type call[V any] struct {
+	done  chan struct{}
+	value V
+	found bool
+	err   error
+}
+
+// entryOverhead is roughly what the bookkeeping of an entry costs.
+const entryOverhead = 100
+
+// New creates a cache, size returns the number of bytes a value takes.
+func New[V any](opts Options, size func(key string, v V) int64) *Cache[V] {
+	if opts.Shards <= 0 {
+		opts.Shards = 16
+	}
+	c := &Cache[V]{opts: opts, size: size}
+	for range opts.Shards {
+		c.shards = append(c.shards, &shard[V]{
+			items:    make(map[string]*list.Element),
+			lru:      list.New(),
+			maxBytes: opts.MaxBytes / int64(opts.Shards),
+			calls:    make(map[string]*call[V]),
+			held:     make(map[string]time.Time),
+		})
+	}
+	return c
+}
+
+func (c *Cache[V]) shard(key string) *shard[V] {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+// Get returns the cached value of key, or loads it. found is false for keys
+// the loader didn't find.
+func (c *Cache[V]) Get(key string, load Loader[V]) (V, bool, error) {
+	sh := c.shard(key)
+	now := time.Now()
+
+	sh.mu.Lock()
+	if el, ok := sh.items[key]; ok {
+		it := el.Value.(*item[V])
+		if now.Before(it.expires) {
+			sh.lru.MoveToFront(el)
+			sh.mu.Unlock()
+			if it.found {
+				c.hits.Add(1)
+			} else {
+				c.negativeHits.Add(1)
+			}
+			return it.value, it.found, nil
+		}
+		sh.remove(el)
+		c.expired.Add(1)
+	}
+	c.misses.Add(1)
+	if cl, ok := sh.calls[key]; ok {
+		sh.mu.Unlock()
+		c.collapsed.Add(1)
+		<-cl.done
+		return cl.value, cl.found, cl.err
+	}
+	cl := &call[V]{done: make(chan struct{})}
+	sh.calls[key] = cl
+	epoch := sh.epoch
+	sh.mu.Unlock()
+
+	var expires time.Time
+	cl.value, expires, cl.found, cl.err = load()
+
+	sh.mu.Lock()
+	if sh.calls[key] == cl {
+		delete(sh.calls, key)
+	}
+	if cl.err == nil && sh.epoch == epoch && !sh.isHeld(key) {
+		c.add(sh, key, cl.value, cl.found, expires)
+	}
+	sh.mu.Unlock()
+	close(cl.done)
+	return cl.value, cl.found, cl.err
+}
+
+// add caches a loaded value. Must be called with the shard locked.
+func (c *Cache[V]) add(sh *shard[V], key string, v V, found bool, expires time.Time) {
+	now := time.Now()
+	if !found {
+		if c.opts.NegativeTTL <= 0 {
+			return
+		}
+		expires = now.Add(c.opts.NegativeTTL)
+	} else if c.opts.MaxTTL > 0 && expires.After(now.Add(c.opts.MaxTTL)) {
+		expires = now.Add(c.opts.MaxTTL)
+	}
+	if !now.Before(expires) {
+		return
+	}
+
+	it := &item[V]{key: key, value: v, found: found, expires: expires, size: int64(len(key)) + entryOverhead}
+	if found {
+		it.size += c.size(key, v)
+	}
+	if it.size > sh.maxBytes {
+		return
+	}
+	if el, ok := sh.items[key]; ok {
+		sh.remove(el)
+	}
+	sh.items[key] = sh.lru.PushFront(it)
+	sh.bytes += it.size
+	for sh.bytes > sh.maxBytes {
+		sh.remove(sh.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (sh *shard[V]) remove(el *list.Element) {
+	it := sh.lru.Remove(el).(*item[V])
+	delete(sh.items, it.key)
+	sh.bytes -= it.size
+}
+
+// isHeld tells if loads of key mustn't be cached yet. Must be called with
+// the shard locked.
+func (sh *shard[V]) isHeld(key string) bool {
+	until, ok := sh.held[key]
+	if ok && !time.Now().Before(until) {
+		delete(sh.held, key)
+		ok = false
+	}
+	return ok
+}
+
+// Invalidate drops key, and makes sure a load in progress doesn't put back
+// what it read before the change, nor loads in the next Hold.
+func (c *Cache[V]) Invalidate(key string) {
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if el, ok := sh.items[key]; ok {
+		sh.remove(el)
+	}
+	delete(sh.calls, key)
+	sh.epoch++
+	if c.opts.Hold > 0 {
+		now := time.Now()
+		// keys written once and never read again are dropped here
+		if len(sh.held) >= sh.sweepAt {
+			for k, until := range sh.held {
+				if !now.Before(until) {
+					delete(sh.held, k)
+				}
+			}
+			sh.sweepAt = max(2*len(sh.held), 1024)
+		}
+		sh.held[key] = now.Add(c.opts.Hold)
+	}
+}
+
+func (c *Cache[V]) Stats() Stats {
+	s := Stats{
+		Hits:         c.hits.Load(),
+		NegativeHits: c.negativeHits.Load(),
+		Misses:       c.misses.Load(),
+		Collapsed:    c.collapsed.Load(),
+		Evictions:    c.evictions.Load(),
+		Expired:      c.expired.Load(),
+	}
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		s.Entries += len(sh.items)
+		s.Bytes += sh.bytes
+		sh.mu.Unlock()
+	}
+	return s
+}
@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCache(opts Options) *Cache[string] {
+	return New(opts, func(key string, v string) int64 { return int64(len(v)) })
+}
+
+func value(v string, ttl time.Duration) Loader[string] {
+	return func() (string, time.Time, bool, error) {
+		return v, time.Now().Add(ttl), true, nil
+	}
+}
+
+func TestHitsAndExpiry(t *testing.T) {
+	c := newCache(Options{MaxBytes: 1 << 20, Shards: 1})
+	c.Get("a", value("1", 50*time.Millisecond))
+	if v, found, _ := c.Get("a", value("2", time.Minute)); v != "1" || !found {
+		t.Errorf("expected a cached 1 but got %s", v)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if v, _, _ := c.Get("a", value("2", time.Minute)); v != "2" {
+		t.Errorf("expected the expired value to be reloaded but got %s", v)
+	}
+	if s := c.Stats(); s.Hits != 1 || s.Misses != 2 || s.Expired != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestMaxTTL(t *testing.T) {
+	c := newCache(Options{MaxBytes: 1 << 20, MaxTTL: 20 * time.Millisecond})
+	c.Get("a", value("1", time.Hour))
+	time.Sleep(30 * time.Millisecond)
+	if v, _, _ := c.Get("a", value("2", time.Hour)); v != "2" {
+		t.Errorf("expected MaxTTL to bound the entry but got %s", v)
+	}
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	// room for two entries of 100 bytes
+	c := newCache(Options{MaxBytes: 2 * (100 + 1 + entryOverhead), Shards: 1})
+	big := func(s string) string { return fmt.Sprintf("%-100s", s) }
+	c.Get("a", value(big("a"), time.Hour))
+	c.Get("b", value(big("b"), time.Hour))
+	c.Get("a", value(big("x"), time.Hour)) // a is now more recent than b
+	c.Get("c", value(big("c"), time.Hour))
+
+	if v, _, _ := c.Get("a", value(big("reloaded"), time.Hour)); v != big("a") {
+		t.Errorf("expected a to stay cached")
+	}
+	if v, _, _ := c.Get("b", value(big("reloaded"), time.Hour)); v != big("reloaded") {
+		t.Errorf("expected b to be evicted")
+	}
+	if s := c.Stats(); s.Evictions != 2 || s.Entries != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	c := newCache(Options{MaxBytes: 1 << 20, NegativeTTL: time.Minute})
+	var loads int
+	missing := func() (string, time.Time, bool, error) {
+		loads++
+		return "", time.Time{}, false, nil
+	}
+	for range 3 {
+		if _, found, _ := c.Get("a", missing); found {
+			t.Fatal("expected a to be missing")
+		}
+	}
+	if loads != 1 || c.Stats().NegativeHits != 2 {
+		t.Errorf("expected one load and two negative hits, got %d loads and %+v", loads, c.Stats())
+	}
+
+	failing := func() (string, time.Time, bool, error) {
+		loads++
+		return "", time.Time{}, false, errors.New("down")
+	}
+	c.Get("b", failing)
+	if _, _, err := c.Get("b", failing); err == nil || loads != 3 {
+		t.Errorf("expected errors not to be cached")
+	}
+}
+
+func TestConcurrentMissesShareALoad(t *testing.T) {
+	c := newCache(Options{MaxBytes: 1 << 20})
+	var loads atomic.Int32
+	release := make(chan struct{})
+	slow := func() (string, time.Time, bool, error) {
+		loads.Add(1)
+		<-release
+		return "v", time.Now().Add(time.Hour), true, nil
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, _, _ := c.Get("a", slow); v != "v" {
+				t.Errorf("expected v but got %s", v)
+			}
+		}()
+	}
+	for c.Stats().Misses < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if n := loads.Load(); n != 1 {
+		t.Errorf("expected one load but got %d", n)
+	}
+}
+
+func TestInvalidateDuringLoad(t *testing.T) {
+	c := newCache(Options{MaxBytes: 1 << 20})
+	c.Get("a", func() (string, time.Time, bool, error) {
+		// a write lands while the old value is being read
+		c.Invalidate("a")
+		return "old", time.Now().Add(time.Hour), true, nil
+	})
+	if v, _, _ := c.Get("a", value("new", time.Hour)); v != "new" {
+		t.Errorf("expected the load racing the invalidation not to be cached, got %s", v)
+	}
+}
+
+func TestHold(t *testing.T) {
+	c := newCache(Options{MaxBytes: 1 << 20, Hold: 50 * time.Millisecond})
+	c.Get("a", value("old", time.Hour))
+	c.Invalidate("a")
+	// the copy read from hasn't seen the write yet
+	c.Get("a", value("old", time.Hour))
+	if v, _, _ := c.Get("a", value("new", time.Hour)); v != "new" {
+		t.Errorf("expected a load right after the invalidation not to be cached but got %s", v)
+	}
+	time.Sleep(60 * time.Millisecond)
+	c.Get("a", value("new", time.Hour))
+	if v, _, _ := c.Get("a", value("newer", time.Hour)); v != "new" {
+		t.Errorf("expected loads to be cached again after the hold but got %s", v)
+	}
+}
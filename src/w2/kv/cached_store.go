@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"kv/cache"
+)
+
+// cachedStore answers Get from an in-process cache and loads misses from
+// the store it wraps. Writes made through it invalidate the key.
+//
+// Writes made by other kv servers stay invisible until the entry expires,
+// which is at most MaxTTL. Reads of a key in the Hold after a write through
+// it aren't cached, the replica may not have the write yet.
+type cachedStore struct {
+	invalidating
+}
+
+func newCachedStore(s Store, c *cache.Cache[Entry]) *cachedStore {
+	return &cachedStore{invalidating{Store: s, cache: c}}
+}
+
+func NewCache(opts cache.Options) *cache.Cache[Entry] {
+	return cache.New(opts, func(key string, e Entry) int64 { return int64(len(e.Value)) })
+}
+
+func (s *cachedStore) Get(ctx context.Context, key string) (Entry, error) {
+	// a load is shared by everyone waiting for the key, so it shouldn't
+	// fail because the first of them went away
+	ctx = context.WithoutCancel(ctx)
+	e, found, err := s.cache.Get(key, func() (Entry, time.Time, bool, error) {
+		e, err := s.Store.Get(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			return Entry{}, time.Time{}, false, nil
+		}
+		return e, time.Unix(e.ExpiredAt, 0), err == nil, err
+	})
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return e, err
+}
+
+// invalidating drops keys written through it from the cache, it wraps the
+// primary while the cache sits in front of the replica. Keys are compared
+// as bytes by every store, so the exact key is the only one to drop.
+type invalidating struct {
+	Store
+	cache *cache.Cache[Entry]
+}
+
+func (s *invalidating) Put(ctx context.Context, key string, value []byte, expiredAt int64, cond Condition) (uint64, bool, error) {
+	defer s.cache.Invalidate(key)
+	return s.Store.Put(ctx, key, value, expiredAt, cond)
+}
+
+func (s *invalidating) Delete(ctx context.Context, key string, cond Condition) error {
+	defer s.cache.Invalidate(key)
+	return s.Store.Delete(ctx, key, cond)
+}
+
+func (s *invalidating) Update(ctx context.Context, key string, fn func(cur *Entry) (*Entry, error)) (Entry, error) {
+	defer s.cache.Invalidate(key)
+	return s.Store.Update(ctx, key, fn)
+}
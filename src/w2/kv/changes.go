@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"kv/bitcask"
+)
+
+// Change is an entry of the mutation log. Seq increases with every change,
+// Value and ExpiredAt are only set for puts.
+type Change struct {
+	Seq       uint64
+	Op        string // put, delete or expire
+	Key       string
+	Value     []byte
+	ExpiredAt int64
+	Version   uint64
+}
+
+// ErrTruncated is returned when reading changes that are no longer kept.
+// The reader has to start over from a fresh read of the keys it needs.
+var ErrTruncated = errors.New("changes are no longer available")
+
+// ChangeLog is the mutation log of a store.
+type ChangeLog interface {
+	// Changes returns up to limit changes after seq, and the seq to
+	// continue from.
+	Changes(ctx context.Context, after uint64, limit int) ([]Change, uint64, error)
+	// Head is the seq of the last change.
+	Head(ctx context.Context) (uint64, error)
+	// Wait returns when there may be changes after seq, or ctx is done.
+	Wait(ctx context.Context, after uint64)
+}
+
+// Watch returns the changes after seq of keys starting with prefix, waiting
+// until there is at least one or ctx is done.
+func Watch(ctx context.Context, log ChangeLog, after uint64, prefix string, limit int) ([]Change, uint64, error) {
+	for {
+		changes, next, err := log.Changes(ctx, after, limit)
+		if err != nil {
+			if ctx.Err() != nil && !errors.Is(err, ErrTruncated) {
+				// the wait ran out while reading
+				return nil, after, nil
+			}
+			return nil, after, err
+		}
+		matching := changes[:0]
+		for _, c := range changes {
+			if strings.HasPrefix(c.Key, prefix) {
+				matching = append(matching, c)
+			}
+		}
+		after = next
+		if len(matching) > 0 {
+			return matching, after, nil
+		}
+		if len(changes) == 0 {
+			log.Wait(ctx, after)
+		}
+		// don't read again with a context that is done, the SQL log would
+		// fail the query
+		if ctx.Err() != nil {
+			return nil, after, nil
+		}
+	}
+}
+
+// notifier wakes up everyone waiting for the next write.
+type notifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func (n *notifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+func (n *notifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// memLog keeps the last changes of the bitcask store in memory, so readers
+// that fell further behind, or were reading before a restart, get
+// ErrTruncated.
+type memLog struct {
+	max int
+
+	mu      sync.Mutex
+	changes []Change
+	start   uint64 // all changes after start are kept
+	head    uint64
+	written notifier
+}
+
+func newMemLog(max int) *memLog {
+	return &memLog{max: max}
+}
+
+// onWrite is the bitcask write hook feeding the log.
+func (l *memLog) onWrite(e bitcask.Entry, deleted bool) {
+	c := Change{Seq: e.Seq, Op: "put", Key: e.Key, Value: e.Value, ExpiredAt: e.ExpiredAt, Version: e.Seq}
+	if deleted {
+		c = Change{Seq: e.Seq, Op: "delete", Key: e.Key}
+	}
+	l.append(c)
+}
+
+func (l *memLog) append(c Change) {
+	c.Value = bytes.Clone(c.Value)
+	l.mu.Lock()
+	if len(l.changes) >= l.max {
+		// drop the older half rather than shift on every append
+		drop := max(len(l.changes)/2, 1)
+		l.start = l.changes[drop-1].Seq
+		l.changes = append(l.changes[:0], l.changes[drop:]...)
+	}
+	l.changes = append(l.changes, c)
+	l.head = c.Seq
+	l.mu.Unlock()
+	l.written.notify()
+}
+
+func (l *memLog) Changes(ctx context.Context, after uint64, limit int) ([]Change, uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if after < l.start || after > l.head {
+		return nil, after, ErrTruncated
+	}
+	i := sort.Search(len(l.changes), func(i int) bool { return l.changes[i].Seq > after })
+	changes := l.changes[i:min(i+limit, len(l.changes))]
+	if len(changes) == 0 {
+		return nil, after, nil
+	}
+	return append([]Change(nil), changes...), changes[len(changes)-1].Seq, nil
+}
+
+func (l *memLog) Head(ctx context.Context) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.head, nil
+}
+
+func (l *memLog) Wait(ctx context.Context, after uint64) {
+	wait := l.written.wait()
+	if head, _ := l.Head(ctx); head > after {
+		return
+	}
+	select {
+	case <-wait:
+	case <-ctx.Done():
+	}
+}
+
+const (
+	// changesPoll is how often watchers of the SQL store look for changes
+	// made by other kv servers.
+	changesPoll = 250 * time.Millisecond
+	// gapWait is how long a gap in kv.changes holds readers back. The seq
+	// is taken on insert but the transaction may commit after later ones,
+	// a gap older than this is a rolled back transaction.
+	gapWait = 5 * time.Second
+)
+
+func (s *sqlStore) Changes(ctx context.Context, after uint64, limit int) ([]Change, uint64, error) {
+	if after > 0 {
+		var oldest sql.NullInt64
+		if err := s.db.QueryRowContext(ctx, "SELECT MIN(seq) FROM kv.changes").Scan(&oldest); err != nil {
+			return nil, after, err
+		}
+		if oldest.Valid && after+1 < uint64(oldest.Int64) {
+			return nil, after, ErrTruncated
+		}
+	}
+	rows, err := s.db.QueryContext(ctx, "SELECT seq, k, op, value, COALESCE(expired_at, 0), version, TIMESTAMPDIFF(MICROSECOND, at, NOW(6)) "+
+		"FROM kv.changes WHERE seq > ? ORDER BY seq LIMIT ?", after, limit)
+	if err != nil {
+		return nil, after, err
+	}
+	defer rows.Close()
+
+	var changes []Change
+	next := after
+	for rows.Next() {
+		var c Change
+		var age int64
+		if err := rows.Scan(&c.Seq, &c.Key, &c.Op, &c.Value, &c.ExpiredAt, &c.Version, &age); err != nil {
+			return nil, after, err
+		}
+		if c.Seq != next+1 && time.Duration(age)*time.Microsecond < gapWait {
+			break
+		}
+		changes = append(changes, c)
+		next = c.Seq
+	}
+	return changes, next, rows.Err()
+}
+
+func (s *sqlStore) Head(ctx context.Context) (uint64, error) {
+	var head uint64
+	err := s.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(seq), 0) FROM kv.changes").Scan(&head)
+	return head, err
+}
+
+func (s *sqlStore) Wait(ctx context.Context, after uint64) {
+	select {
+	case <-s.written.wait():
+	case <-time.After(changesPoll):
+	case <-ctx.Done():
+	}
+}
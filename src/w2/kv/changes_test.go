@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// doneLog fails reads once ctx is done, like a SQL query would.
+type doneLog struct{ *memLog }
+
+func (l doneLog) Changes(ctx context.Context, after uint64, limit int) ([]Change, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, after, err
+	}
+	return l.memLog.Changes(ctx, after, limit)
+}
+
+func TestWatchTimeout(t *testing.T) {
+	log := doneLog{newMemLog(10)}
+	log.append(Change{Seq: 1, Op: "put", Key: "other"})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	changes, next, err := Watch(ctx, log, 0, "k", 10)
+	if err != nil || len(changes) != 0 || next != 1 {
+		t.Errorf("expected no changes and no error after the timeout but got %v %d %v", changes, next, err)
+	}
+}
+
+// TestWatchSQL needs the MySQL primary from kv.sql on port 3306.
+func TestWatchSQL(t *testing.T) {
+	s := NewSQLStore("3306").(*sqlStore)
+	defer s.Close()
+	if err := s.db.Ping(); err != nil {
+		t.Skipf("MySQL not available: %v", err)
+	}
+	ctx := context.Background()
+	head, err := s.Head(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a watch that times out returns nothing rather than a failed query
+	waitCtx, cancel := context.WithTimeout(ctx, changesPoll/2)
+	defer cancel()
+	changes, _, err := Watch(waitCtx, s, head, "watch-test-", 10)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("expected no changes and no error after the timeout but got %v %v", changes, err)
+	}
+
+	defer s.db.ExecContext(ctx, "DELETE FROM kv.store WHERE k = 'watch-test-key'")
+	if _, _, err := s.Put(ctx, "watch-test-key", []byte("v"), NoExpiry, Condition{}); err != nil {
+		t.Fatal(err)
+	}
+	waitCtx, cancel = context.WithTimeout(ctx, gapWait)
+	defer cancel()
+	changes, _, err = Watch(waitCtx, s, head, "watch-test-", 10)
+	if err != nil || len(changes) != 1 || changes[0].Op != "put" || string(changes[0].Value) != "v" {
+		t.Errorf("expected the put of watch-test-key but got %+v %v", changes, err)
+	}
+
+	// a delete is logged with the version of the tombstone, not of the put
+	if err := s.Delete(ctx, "watch-test-key", Condition{}); err != nil {
+		t.Fatal(err)
+	}
+	changes, _, err = Watch(waitCtx, s, head, "watch-test-", 10)
+	if err != nil || len(changes) != 2 || changes[1].Op != "delete" || changes[1].Version <= changes[0].Version {
+		t.Errorf("expected the delete of watch-test-key after its put but got %+v %v", changes, err)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// cleanupLock is the MySQL named lock that makes sure only one of the kv
+// servers sharing a database runs the cleanup at a time.
+const cleanupLock = "kv.cleanup"
+
+type CleanupOptions struct {
+	Cadence time.Duration // pause between rounds
+	// The batch size adapts to keep each DELETE around TargetLatency, so
+	// it never holds locks on a large range of the index.
+	MinBatch      int
+	MaxBatch      int
+	TargetLatency time.Duration
+	RowsPerSecond int // 0 means no limit
+	MaxBackoff    time.Duration
+	// ChangeRetention is how long kv.changes keeps changes for watchers.
+	ChangeRetention time.Duration
+}
+
+func DefaultCleanupOptions() CleanupOptions {
+	return CleanupOptions{
+		Cadence:         time.Minute,
+		MinBatch:        10,
+		MaxBatch:        5000,
+		TargetLatency:   50 * time.Millisecond,
+		RowsPerSecond:   10000,
+		MaxBackoff:      5 * time.Minute,
+		ChangeRetention: 24 * time.Hour,
+	}
+}
+
+type CleanupStats struct {
+	Rounds       int64         `json:"rounds"`
+	Skipped      int64         `json:"skipped"` // another server had the lock
+	Batches      int64         `json:"batches"`
+	Expired      int64         `json:"expired"`
+	Tombstones   int64         `json:"tombstones"`
+	Changes      int64         `json:"changes"` // trimmed from kv.changes
+	Errors       int64         `json:"errors"`
+	LastError    string        `json:"last_error,omitempty"`
+	BatchSize    int           `json:"batch_size"`
+	LastRound    time.Time     `json:"last_round"`
+	LastDuration time.Duration `json:"last_duration"`
+}
+
+// Cleaner removes expired keys and the tombstones left by deleteKey2 and
+// deleteKey3 from kv.store, in small batches along expired_at_idx. Expired
+// keys are logged to kv.changes as they are removed, and changes older
+// than ChangeRetention are trimmed.
+type Cleaner struct {
+	db   *sql.DB
+	opts CleanupOptions
+
+	mu    sync.Mutex
+	stats CleanupStats
+}
+
+func NewCleaner(db *sql.DB, opts CleanupOptions) *Cleaner {
+	return &Cleaner{db: db, opts: opts, stats: CleanupStats{BatchSize: opts.MinBatch}}
+}
+
+func (c *Cleaner) Stats() CleanupStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Run cleans up every Cadence until ctx is cancelled. After a failure it
+// waits with an exponential backoff instead.
+func (c *Cleaner) Run(ctx context.Context) {
+	var failures int
+	for {
+		wait := c.opts.Cadence
+		if err := c.round(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Cleanup failed: %v", err)
+			c.mu.Lock()
+			c.stats.Errors++
+			c.stats.LastError = err.Error()
+			c.mu.Unlock()
+			failures++
+			wait = backoff(failures, c.opts.MaxBackoff)
+		} else {
+			failures = 0
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// backoff is 1s doubling with every failure, jittered so that servers that
+// failed together don't retry together.
+func backoff(failures int, maxDelay time.Duration) time.Duration {
+	d := time.Second << min(failures-1, 20)
+	d = min(d, maxDelay)
+	return d/2 + rand.N(d/2+1)
+}
+
+func (c *Cleaner) round(ctx context.Context) error {
+	// named locks belong to the session, so everything runs on one
+	// connection
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", cleanupLock).Scan(&locked); err != nil {
+		return err
+	}
+	if locked.Int64 != 1 {
+		c.mu.Lock()
+		c.stats.Skipped++
+		c.mu.Unlock()
+		return nil
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), "SELECT RELEASE_LOCK(?)", cleanupLock)
+
+	start := time.Now()
+	cutoff := start.Unix()
+	err = errors.Join(
+		c.purge(ctx, deleteRows(ctx, conn, "DELETE FROM kv.store WHERE expired_at = -1 LIMIT ?"), &c.stats.Tombstones),
+		c.purge(ctx, expire(ctx, conn, cutoff), &c.stats.Expired),
+		c.trimChanges(ctx, conn),
+	)
+
+	c.mu.Lock()
+	c.stats.Rounds++
+	c.stats.LastRound = start
+	c.stats.LastDuration = time.Since(start)
+	c.mu.Unlock()
+	return err
+}
+
+// deleteBatch deletes up to batch rows and returns how many it deleted.
+type deleteBatch func(batch int) (int64, error)
+
+// deleteRows runs a DELETE whose last argument is the batch size.
+func deleteRows(ctx context.Context, conn *sql.Conn, query string, args ...any) deleteBatch {
+	return func(batch int) (int64, error) {
+		res, err := conn.ExecContext(ctx, query, append(args, batch)...)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+}
+
+// expire deletes keys that expired before cutoff and logs them to
+// kv.changes. The INSERT locks the rows it logs, and puts can't move a key
+// below cutoff, so the DELETE removes the same rows.
+func expire(ctx context.Context, conn *sql.Conn, cutoff int64) deleteBatch {
+	return func(batch int) (int64, error) {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+		_, err = tx.ExecContext(ctx, "INSERT INTO kv.changes (k, op, version) SELECT k, 'expire', version FROM kv.store "+
+			"WHERE expired_at >= 0 AND expired_at < ? ORDER BY expired_at LIMIT ? FOR UPDATE", cutoff, batch)
+		if err != nil {
+			return 0, err
+		}
+		res, err := tx.ExecContext(ctx, "DELETE FROM kv.store WHERE expired_at >= 0 AND expired_at < ? ORDER BY expired_at LIMIT ?", cutoff, batch)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		return n, tx.Commit()
+	}
+}
+
+// trimChanges drops changes older than ChangeRetention, but always keeps
+// the last one so readers can tell they fell behind.
+func (c *Cleaner) trimChanges(ctx context.Context, conn *sql.Conn) error {
+	var last sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT MAX(seq) FROM kv.changes").Scan(&last); err != nil || !last.Valid {
+		return err
+	}
+	del := deleteRows(ctx, conn, "DELETE FROM kv.changes WHERE at < NOW(6) - INTERVAL ? SECOND AND seq < ? ORDER BY seq LIMIT ?",
+		int64(c.opts.ChangeRetention/time.Second), last.Int64)
+	return c.purge(ctx, del, &c.stats.Changes)
+}
+
+// purge deletes batches until one comes back short.
+func (c *Cleaner) purge(ctx context.Context, del deleteBatch, counter *int64) error {
+	for {
+		c.mu.Lock()
+		batch := c.stats.BatchSize
+		c.mu.Unlock()
+
+		start := time.Now()
+		n, err := del(batch)
+		if err != nil {
+			return err
+		}
+		took := time.Since(start)
+
+		c.mu.Lock()
+		c.stats.Batches++
+		*counter += n
+		c.stats.BatchSize = c.nextBatchSize(batch, int(n), took)
+		c.mu.Unlock()
+		if n > 0 {
+			log.Printf("Cleanup deleted %d rows in %s", n, took)
+		}
+		if int(n) < batch {
+			return nil
+		}
+
+		// stay under the rate limit
+		pause := time.Duration(0)
+		if c.opts.RowsPerSecond > 0 {
+			pause = time.Duration(n) * time.Second / time.Duration(c.opts.RowsPerSecond)
+		}
+		select {
+		case <-time.After(max(pause-took, 0)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// nextBatchSize halves the batch when it was slow and doubles it when a
+// full batch was quick.
+func (c *Cleaner) nextBatchSize(batch, deleted int, took time.Duration) int {
+	switch {
+	case took > c.opts.TargetLatency:
+		batch /= 2
+	case deleted == batch && took < c.opts.TargetLatency/2:
+		batch *= 2
+	}
+	return max(c.opts.MinBatch, min(batch, c.opts.MaxBatch))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNextBatchSize(t *testing.T) {
+	c := NewCleaner(nil, CleanupOptions{MinBatch: 10, MaxBatch: 1000, TargetLatency: 100 * time.Millisecond})
+	tests := []struct {
+		batch, deleted int
+		took           time.Duration
+		expected       int
+	}{
+		{100, 100, 10 * time.Millisecond, 200},  // full and quick
+		{100, 50, 10 * time.Millisecond, 100},   // short batch
+		{100, 100, 70 * time.Millisecond, 100},  // full but not quick enough
+		{100, 100, 200 * time.Millisecond, 50},  // slow
+		{100, 20, 200 * time.Millisecond, 50},   // slow and short
+		{800, 800, 10 * time.Millisecond, 1000}, // capped at MaxBatch
+		{15, 15, time.Second, 10},               // not below MinBatch
+	}
+	for _, tt := range tests {
+		if got := c.nextBatchSize(tt.batch, tt.deleted, tt.took); got != tt.expected {
+			t.Errorf("expected %d after deleting %d of %d in %s but got %d", tt.expected, tt.deleted, tt.batch, tt.took, got)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		maxDelay time.Duration
+		min, max time.Duration
+	}{
+		{1, time.Minute, 500 * time.Millisecond, time.Second},
+		{2, time.Minute, time.Second, 2 * time.Second},
+		{4, time.Minute, 4 * time.Second, 8 * time.Second},
+		{10, time.Minute, 30 * time.Second, time.Minute},
+		{1000, time.Minute, 30 * time.Second, time.Minute},
+		{3, time.Second, 500 * time.Millisecond, time.Second},
+	}
+	for _, tt := range tests {
+		for range 100 {
+			if got := backoff(tt.failures, tt.maxDelay); got < tt.min || got > tt.max {
+				t.Errorf("expected a backoff in [%s, %s] after %d failures but got %s", tt.min, tt.max, tt.failures, got)
+				break
+			}
+		}
+	}
+}
+
+func TestPurgeAdaptsBatches(t *testing.T) {
+	c := NewCleaner(nil, CleanupOptions{MinBatch: 2, MaxBatch: 8, TargetLatency: time.Second})
+	rows := 20
+	var batches []int
+	var counter int64
+	err := c.purge(context.Background(), func(batch int) (int64, error) {
+		batches = append(batches, batch)
+		n := min(batch, rows)
+		rows -= n
+		return int64(n), nil
+	}, &counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2, 4, 8, 8 deletes 20 rows, the last batch is short
+	if fmt.Sprint(batches) != "[2 4 8 8]" || counter != 20 {
+		t.Errorf("expected batches [2 4 8 8] deleting 20 rows but got %v deleting %d", batches, counter)
+	}
+	if stats := c.Stats(); stats.Batches != 4 || stats.BatchSize != 8 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// TestCleanup needs the MySQL primary from kv.sql on port 3306.
+func TestCleanup(t *testing.T) {
+	db := NewConn("3306")
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Skipf("MySQL not available: %v", err)
+	}
+	ctx := context.Background()
+
+	past := time.Now().Add(-time.Hour).Unix()
+	for i := range 5 {
+		for _, row := range []struct {
+			key       string
+			expiredAt int64
+		}{
+			{fmt.Sprintf("cleanup-test-expired%d", i), past},
+			{fmt.Sprintf("cleanup-test-tombstone%d", i), -1},
+			{fmt.Sprintf("cleanup-test-live%d", i), NoExpiry},
+		} {
+			if _, err := db.ExecContext(ctx, "REPLACE INTO kv.store (k, value, expired_at, version) VALUES (?, 'x', ?, 1)", row.key, row.expiredAt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	defer db.ExecContext(ctx, "DELETE FROM kv.store WHERE k LIKE 'cleanup-test-%'")
+
+	opts := DefaultCleanupOptions()
+	opts.MinBatch, opts.MaxBatch = 2, 2
+	opts.RowsPerSecond = 0
+	c := NewCleaner(db, opts)
+	if err := c.round(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := c.Stats()
+	if stats.Skipped != 0 {
+		t.Skip("another server holds the cleanup lock")
+	}
+	if stats.Expired < 5 || stats.Tombstones < 5 || stats.Batches < 6 {
+		t.Errorf("expected 5 expired rows and 5 tombstones to be purged in batches of 2 but got %+v", stats)
+	}
+	var left, live int
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM kv.store WHERE k LIKE 'cleanup-test-%' AND expired_at <= UNIX_TIMESTAMP()").Scan(&left)
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM kv.store WHERE k LIKE 'cleanup-test-live%'").Scan(&live)
+	if left != 0 || live != 5 {
+		t.Errorf("expected only the 5 live rows to be left but got %d expired and %d live", left, live)
+	}
+	var logged int
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM kv.changes WHERE k LIKE 'cleanup-test-expired%' AND op = 'expire'").Scan(&logged)
+	if logged < 5 {
+		t.Errorf("expected the expired rows to be logged to kv.changes but got %d", logged)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+)
+
+// runCommand runs the command given after the flags of the server, on the
+// store the -backend flags pick:
+//
+//	kv [flags] export [-o file] [-prefix p] [-format jsonl|binary] [-gzip] [-snapshot]
+//	kv [flags] import [-prefix p] [-if-absent] [-resume] file
+//
+// An import writes how far it got to file.progress every so often, and
+// -resume carries on from there after a failure.
+//
+// The bitcask and quorum backends, and sharded with bitcask shards, open
+// the data directory themselves, so they only work while no server has it
+// open: bitcask.Open refuses a directory another process holds. The sql
+// backend can be exported and imported next to running servers.
+func runCommand(args []string) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var err error
+	switch args[0] {
+	case "export":
+		err = exportCommand(ctx, args[1:])
+	case "import":
+		err = importCommand(ctx, args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q, expected export or import", args[0])
+	}
+	if err != nil {
+		log.Printf("%s failed: %v", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// commandStore opens the store of the -backend flags, without the
+// background work of the server.
+func commandStore() (Store, error) {
+	switch *backend {
+	case "bitcask":
+		return OpenBitcask(*dataDir)
+	case "sql":
+		return NewSQLStore("3306"), nil
+	case "sharded":
+		return openSharded(OpenShard), nil
+	case "quorum":
+		s, _ := openQuorum()
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q", *backend)
+}
+
+func exportCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "-", "file to write, - for stdout")
+	prefix := fs.String("prefix", "", "only export keys starting with this")
+	format := fs.String("format", "jsonl", "jsonl or binary")
+	gz := fs.Bool("gzip", false, "compress the export, the default for files ending in .gz")
+	snapshot := fs.Bool("snapshot", false, "export the store as of one point in time")
+	fs.Parse(args)
+	if *format != "jsonl" && *format != "binary" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	s, err := commandStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if *out != "-" {
+		if f, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	opts := ExportOptions{
+		Prefix:   *prefix,
+		Binary:   *format == "binary",
+		Gzip:     *gz || strings.HasSuffix(*out, ".gz"),
+		Snapshot: *snapshot,
+	}
+	n, err := Export(ctx, s, w, opts)
+	if err != nil {
+		return err
+	}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	log.Printf("Exported %d keys", n)
+	return nil
+}
+
+// importProgressEvery is how many entries an import goes through between
+// writes of its progress file.
+const importProgressEvery = 10000
+
+func importCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "only import keys starting with this")
+	ifAbsent := fs.Bool("if-absent", false, "leave keys that exist alone")
+	resume := fs.Bool("resume", false, "carry on from the progress file of an earlier import")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("expected the file to import, - for stdin")
+	}
+	file := fs.Arg(0)
+
+	opts := ImportOptions{Prefix: *prefix, IfAbsent: *ifAbsent, ProgressEvery: importProgressEvery}
+	var r io.Reader = os.Stdin
+	progressFile := file + ".progress"
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+		opts.Progress = func(done int64) error {
+			return os.WriteFile(progressFile, []byte(strconv.FormatInt(done, 10)), 0o644)
+		}
+		if *resume {
+			b, err := os.ReadFile(progressFile)
+			if err != nil {
+				return err
+			}
+			if opts.Skip, err = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err != nil {
+				return fmt.Errorf("bad progress file %s: %w", progressFile, err)
+			}
+			log.Printf("Resuming after %d entries", opts.Skip)
+		}
+	} else if *resume {
+		return errors.New("can't resume an import from stdin")
+	}
+
+	s, err := commandStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	stats, err := Import(ctx, s, r, opts)
+	log.Printf("Imported %d keys, %d left alone, %d filtered out, %d entries read", stats.Written, stats.Existing, stats.Filtered, stats.Read)
+	if err != nil {
+		if opts.Progress != nil {
+			log.Printf("Run again with -resume to carry on from %s", progressFile)
+		}
+		return err
+	}
+	if opts.Progress != nil {
+		os.Remove(progressFile)
+	}
+	return nil
+}
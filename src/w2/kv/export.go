@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Exports are a stream of the live entries in key order, each with the TTL
+// it had left, so an import gives it the same time to live again. There
+// are two formats:
+//
+//	jsonl   a header line {"kv_export":1,"at","prefix"}, a line per entry
+//	        {"key","value","ttl"} with the value in base64 and no ttl for
+//	        keys that don't expire, and a last line {"count"}
+//	binary  "KVX1", then per entry the uvarint length and bytes of the key
+//	        and the value and the varint ttl, -1 for none, and a zero
+//	        length key followed by the uvarint count at the end
+//
+// Either can be gzipped, imports tell from the first bytes. The count at
+// the end tells a complete export from a truncated one.
+
+const exportVersion = 1
+
+var binaryMagic = []byte("KVX1")
+
+// ErrIncomplete is returned by Import for exports that end before their
+// count.
+var ErrIncomplete = errors.New("export is incomplete")
+
+type ExportOptions struct {
+	Prefix string
+	Binary bool
+	Gzip   bool
+	// Snapshot exports the entries as of one point in time, which needs a
+	// store that can take a snapshot. Otherwise the export pages through
+	// the store while it is written to.
+	Snapshot bool
+}
+
+// Snapshotter is a store that can read all its entries as of one point in
+// time.
+type Snapshotter interface {
+	// Snapshot calls fn with the live entries whose keys start with prefix,
+	// in key order.
+	Snapshot(ctx context.Context, prefix string, fn func(Entry) error) error
+}
+
+// exported is an entry of an export.
+type exported struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+	TTL   *int64 `json:"ttl,omitempty"`
+}
+
+type exportHeader struct {
+	Version int       `json:"kv_export"`
+	At      time.Time `json:"at"`
+	Prefix  string    `json:"prefix,omitempty"`
+}
+
+type exportTrailer struct {
+	Count *int64 `json:"count"`
+}
+
+// Export writes the entries of s to w and returns how many it wrote.
+func Export(ctx context.Context, s Store, w io.Writer, opts ExportOptions) (int64, error) {
+	var gz *gzip.Writer
+	if opts.Gzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	bw := bufio.NewWriter(w)
+	var enc exportEncoder = &jsonEncoder{enc: json.NewEncoder(bw)}
+	if opts.Binary {
+		enc = &binaryEncoder{w: bw}
+	}
+	if err := enc.header(exportHeader{Version: exportVersion, At: time.Now().UTC(), Prefix: opts.Prefix}); err != nil {
+		return 0, err
+	}
+	var count int64
+	write := func(e Entry) error {
+		x := exported{Key: e.Key, Value: e.Value}
+		if e.ExpiredAt != NoExpiry {
+			ttl := e.ExpiredAt - time.Now().Unix()
+			if ttl <= 0 {
+				return nil
+			}
+			x.TTL = &ttl
+		}
+		count++
+		return enc.entry(x)
+	}
+	var err error
+	if opts.Snapshot {
+		snap, ok := s.(Snapshotter)
+		if !ok {
+			return 0, errors.New("the store can't take snapshots")
+		}
+		err = snap.Snapshot(ctx, opts.Prefix, write)
+	} else {
+		err = scanPrefix(ctx, s, opts.Prefix, write)
+	}
+	if err != nil {
+		return count, err
+	}
+	if err := enc.trailer(count); err != nil {
+		return count, err
+	}
+	if err := bw.Flush(); err != nil {
+		return count, err
+	}
+	if gz != nil {
+		return count, gz.Close()
+	}
+	return count, nil
+}
+
+// scanPrefix pages through the live entries whose keys start with prefix.
+// Those are the key prefix itself and the keys after it, up to the first
+// that doesn't start with it.
+func scanPrefix(ctx context.Context, s Store, prefix string, fn func(Entry) error) error {
+	if prefix != "" {
+		e, err := s.Get(ctx, prefix)
+		switch {
+		case err == nil:
+			if err := fn(e); err != nil {
+				return err
+			}
+		case !errors.Is(err, ErrNotFound):
+			return err
+		}
+	}
+	for after := prefix; ; {
+		entries, err := s.Scan(ctx, after, exportBatch)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !strings.HasPrefix(e.Key, prefix) {
+				return nil
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if len(entries) < exportBatch {
+			return nil
+		}
+		after = entries[len(entries)-1].Key
+	}
+}
+
+// exportBatch is how many entries an export reads from the store at once.
+const exportBatch = 1000
+
+type exportEncoder interface {
+	header(h exportHeader) error
+	entry(x exported) error
+	trailer(count int64) error
+}
+
+type jsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (j *jsonEncoder) header(h exportHeader) error { return j.enc.Encode(h) }
+func (j *jsonEncoder) entry(x exported) error      { return j.enc.Encode(x) }
+func (j *jsonEncoder) trailer(count int64) error {
+	return j.enc.Encode(exportTrailer{Count: &count})
+}
+
+type binaryEncoder struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func (b *binaryEncoder) header(exportHeader) error {
+	_, err := b.w.Write(binaryMagic)
+	return err
+}
+
+func (b *binaryEncoder) entry(x exported) error {
+	ttl := int64(-1)
+	if x.TTL != nil {
+		ttl = *x.TTL
+	}
+	b.buf = binary.AppendUvarint(b.buf[:0], uint64(len(x.Key)))
+	b.buf = append(b.buf, x.Key...)
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(x.Value)))
+	b.buf = append(b.buf, x.Value...)
+	b.buf = binary.AppendVarint(b.buf, ttl)
+	_, err := b.w.Write(b.buf)
+	return err
+}
+
+func (b *binaryEncoder) trailer(count int64) error {
+	b.buf = binary.AppendUvarint(b.buf[:0], 0)
+	b.buf = binary.AppendUvarint(b.buf, uint64(count))
+	_, err := b.w.Write(b.buf)
+	return err
+}
+
+type ImportOptions struct {
+	Prefix string
+	// Skip is how many entries of the export an earlier import already
+	// went through, see Progress.
+	Skip int64
+	// IfAbsent leaves the keys that exist alone instead of overwriting
+	// them.
+	IfAbsent bool
+	// Progress is called every ProgressEvery entries and at the end with
+	// how many entries of the export were gone through, to pass as Skip
+	// when resuming.
+	Progress      func(done int64) error
+	ProgressEvery int64
+}
+
+type ImportStats struct {
+	Read     int64 `json:"read"` // entries of the export, including skipped ones
+	Written  int64 `json:"written"`
+	Existing int64 `json:"existing"` // left alone because of IfAbsent
+	Filtered int64 `json:"filtered"` // not matching the prefix
+}
+
+// Import writes the entries of an export to s. It returns ErrIncomplete,
+// after writing what there was, if the export was cut short.
+func Import(ctx context.Context, s Store, r io.Reader, opts ImportOptions) (ImportStats, error) {
+	var stats ImportStats
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return stats, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+	var dec exportDecoder
+	if magic, _ := br.Peek(len(binaryMagic)); bytes.Equal(magic, binaryMagic) {
+		br.Discard(len(binaryMagic))
+		dec = &binaryDecoder{r: br}
+	} else {
+		jd := &jsonDecoder{dec: json.NewDecoder(br)}
+		if err := jd.header(); err != nil {
+			return stats, err
+		}
+		dec = jd
+	}
+
+	progress := func() error {
+		if opts.Progress == nil {
+			return nil
+		}
+		return opts.Progress(stats.Read)
+	}
+	for {
+		x, count, err := dec.next()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return stats, errors.Join(ErrIncomplete, progress())
+		}
+		if err != nil {
+			return stats, err
+		}
+		if count >= 0 {
+			if count != stats.Read {
+				return stats, fmt.Errorf("export has %d entries but says %d", stats.Read, count)
+			}
+			return stats, progress()
+		}
+		stats.Read++
+		if stats.Read <= opts.Skip {
+			continue
+		}
+		if err := stats.write(ctx, s, x, opts); err != nil {
+			return stats, err
+		}
+		if opts.ProgressEvery > 0 && stats.Read%opts.ProgressEvery == 0 {
+			if err := progress(); err != nil {
+				return stats, err
+			}
+		}
+	}
+}
+
+func (stats *ImportStats) write(ctx context.Context, s Store, x exported, opts ImportOptions) error {
+	if !strings.HasPrefix(x.Key, opts.Prefix) {
+		stats.Filtered++
+		return nil
+	}
+	// keys of namespaces are imported as they are, so checkKey, which
+	// refuses them on the API, would be too strict
+	if x.Key == "" || len(x.Key) > MaxKeyLen {
+		return fmt.Errorf("entry %d: key of %d bytes", stats.Read, len(x.Key))
+	}
+	expiredAt := int64(NoExpiry)
+	if x.TTL != nil {
+		expiredAt = min(time.Now().Unix()+*x.TTL, NoExpiry)
+	}
+	_, _, err := s.Put(ctx, x.Key, x.Value, expiredAt, Condition{IfAbsent: opts.IfAbsent})
+	switch {
+	case errors.Is(err, ErrConflict):
+		stats.Existing++
+	case err != nil:
+		return fmt.Errorf("writing %s: %w", x.Key, err)
+	default:
+		stats.Written++
+	}
+	return nil
+}
+
+type exportDecoder interface {
+	// next returns the next entry, or the count at the end with count >= 0.
+	next() (x exported, count int64, err error)
+}
+
+type jsonDecoder struct {
+	dec *json.Decoder
+}
+
+func (j *jsonDecoder) header() error {
+	var h exportHeader
+	if err := j.dec.Decode(&h); err != nil {
+		return fmt.Errorf("not an export: %w", err)
+	}
+	if h.Version != exportVersion {
+		return fmt.Errorf("export version %d is not supported", h.Version)
+	}
+	return nil
+}
+
+func (j *jsonDecoder) next() (exported, int64, error) {
+	var line struct {
+		exported
+		exportTrailer
+	}
+	if err := j.dec.Decode(&line); err != nil {
+		return exported{}, 0, err
+	}
+	if line.Count != nil {
+		return exported{}, *line.Count, nil
+	}
+	return line.exported, -1, nil
+}
+
+type binaryDecoder struct {
+	r *bufio.Reader
+}
+
+func (b *binaryDecoder) next() (exported, int64, error) {
+	n, err := binary.ReadUvarint(b.r)
+	if err != nil {
+		return exported{}, 0, err
+	}
+	if n == 0 {
+		count, err := binary.ReadUvarint(b.r)
+		return exported{}, int64(count), eof(err)
+	}
+	if n > MaxKeyLen {
+		return exported{}, 0, fmt.Errorf("key of %d bytes in export", n)
+	}
+	key := make([]byte, n)
+	if _, err := io.ReadFull(b.r, key); err != nil {
+		return exported{}, 0, eof(err)
+	}
+	if n, err = binary.ReadUvarint(b.r); err != nil {
+		return exported{}, 0, eof(err)
+	}
+	if n > MaxValueSize {
+		return exported{}, 0, fmt.Errorf("value of %d bytes in export", n)
+	}
+	x := exported{Key: string(key), Value: make([]byte, n)}
+	if _, err := io.ReadFull(b.r, x.Value); err != nil {
+		return exported{}, 0, eof(err)
+	}
+	ttl, err := binary.ReadVarint(b.r)
+	if err != nil {
+		return exported{}, 0, eof(err)
+	}
+	if ttl >= 0 {
+		x.TTL = &ttl
+	}
+	return x, -1, nil
+}
+
+// eof turns the end of the stream in the middle of an entry into
+// io.ErrUnexpectedEOF.
+func eof(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func openBitcask(t *testing.T) Store {
+	t.Helper()
+	s, err := OpenBitcask(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	src := openBitcask(t)
+	now := time.Now().Unix()
+	for i := range 2500 {
+		src.Put(ctx, fmt.Sprintf("user:%04d", i), []byte{byte(i), 0, 0xff}, NoExpiry, Condition{})
+	}
+	src.Put(ctx, "user:", []byte("the prefix itself"), now+100, Condition{})
+	src.Put(ctx, "users", []byte("not under the prefix"), NoExpiry, Condition{})
+	src.Put(ctx, "expired", []byte("x"), now-1, Condition{})
+
+	for _, opts := range []ExportOptions{
+		{Prefix: "user:"},
+		{Prefix: "user:", Binary: true},
+		{Prefix: "user:", Gzip: true, Snapshot: true},
+		{Prefix: "user:", Binary: true, Gzip: true, Snapshot: true},
+	} {
+		var buf bytes.Buffer
+		n, err := Export(ctx, src, &buf, opts)
+		if err != nil || n != 2501 {
+			t.Fatalf("%+v: expected 2501 keys exported but got %d %v", opts, n, err)
+		}
+		dst := openBitcask(t)
+		stats, err := Import(ctx, dst, &buf, ImportOptions{})
+		if err != nil || stats.Written != 2501 {
+			t.Fatalf("%+v: expected 2501 keys imported but got %+v %v", opts, stats, err)
+		}
+		if e, err := dst.Get(ctx, "user:0300"); err != nil || !bytes.Equal(e.Value, []byte{44, 0, 0xff}) || e.ExpiredAt != NoExpiry {
+			t.Errorf("%+v: expected the value without ttl but got %+v %v", opts, e, err)
+		}
+		if e, err := dst.Get(ctx, "user:"); err != nil || e.ExpiredAt < now+99 || e.ExpiredAt > now+101 {
+			t.Errorf("%+v: expected the ttl to be kept but got %+v %v", opts, e, err)
+		}
+		if _, err := dst.Get(ctx, "users"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%+v: expected keys outside the prefix not to be exported", opts)
+		}
+	}
+}
+
+func TestImportResumes(t *testing.T) {
+	ctx := context.Background()
+	src := openBitcask(t)
+	for i := range 100 {
+		src.Put(ctx, fmt.Sprintf("k%03d", i), []byte("v"), NoExpiry, Condition{})
+	}
+	var buf bytes.Buffer
+	if _, err := Export(ctx, src, &buf, ExportOptions{Binary: true}); err != nil {
+		t.Fatal(err)
+	}
+	full := buf.Bytes()
+
+	// an export cut short imports what it has
+	dst := openBitcask(t)
+	var done int64
+	opts := ImportOptions{ProgressEvery: 10, Progress: func(n int64) error { done = n; return nil }}
+	stats, err := Import(ctx, dst, bytes.NewReader(full[:len(full)/2]), opts)
+	if !errors.Is(err, ErrIncomplete) || done != stats.Read || done < 40 {
+		t.Fatalf("expected an incomplete import with its progress but got %+v %v, progress %d", stats, err, done)
+	}
+
+	opts.Skip = done
+	stats, err = Import(ctx, dst, bytes.NewReader(full), opts)
+	if err != nil || stats.Read != 100 || stats.Written != 100-opts.Skip || done != 100 {
+		t.Fatalf("expected the rest to be imported but got %+v %v", stats, err)
+	}
+	if entries, _ := dst.Scan(ctx, "", 200); len(entries) != 100 {
+		t.Errorf("expected 100 keys but got %d", len(entries))
+	}
+
+	stats, err = Import(ctx, dst, bytes.NewReader(full), ImportOptions{Prefix: "k05", IfAbsent: true})
+	if err != nil || stats.Existing != 10 || stats.Filtered != 90 {
+		t.Errorf("expected existing keys to be left alone but got %+v %v", stats, err)
+	}
+	if _, err := Import(ctx, dst, bytes.NewReader([]byte("{}\n")), ImportOptions{}); err == nil {
+		t.Errorf("expected a file that is no export to be refused")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"kv/cache"
+	"kv/hotkeys"
+)
+
+// ErrThrottled is returned for requests to keys over their rate limit.
+var ErrThrottled = errors.New("too many requests for the key")
+
+// HotKeyLimit limits the requests per second of Key, or of each key
+// starting with it if Prefix is set. Every key has its own limit, a prefix
+// doesn't limit its keys together.
+type HotKeyLimit struct {
+	Key    string  `json:"key"`
+	Prefix bool    `json:"prefix,omitempty"`
+	Rate   float64 `json:"rate"`
+}
+
+// ParseHotKeyLimits parses limits as key=rate, with a * at the end of the
+// key for a prefix, comma separated, like "user:*=100,config=10".
+func ParseHotKeyLimits(s string) ([]HotKeyLimit, error) {
+	var limits []HotKeyLimit
+	for spec := range strings.SplitSeq(s, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		key, rate, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("limit %q is not key=rate", spec)
+		}
+		var l HotKeyLimit
+		l.Key, l.Prefix = strings.CutSuffix(key, "*")
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil || r <= 0 {
+			return nil, fmt.Errorf("limit %q needs a rate above 0", spec)
+		}
+		l.Rate = r
+		limits = append(limits, l)
+	}
+	// the longest key or prefix wins
+	slices.SortStableFunc(limits, func(a, b HotKeyLimit) int { return len(b.Key) - len(a.Key) })
+	return limits, nil
+}
+
+type HotKeyOptions struct {
+	hotkeys.Options
+	Limits []HotKeyLimit
+	// PromoteRate is how many reads per second move a key into the local
+	// cache, 0 disables it. Promoted keys are kept for CacheTTL, so reads
+	// can see writes other servers made that long ago.
+	PromoteRate float64
+	CacheTTL    time.Duration
+	CacheBytes  int64
+}
+
+// HotKeys counts the requests of every key, throttles the keys over their
+// limit and serves the reads of the busiest keys from a local cache.
+type HotKeys struct {
+	opts    HotKeyOptions
+	tracker *hotkeys.Tracker
+	cache   *cache.Cache[Entry] // nil if PromoteRate is 0
+
+	throttled atomic.Int64
+}
+
+func NewHotKeys(opts HotKeyOptions) *HotKeys {
+	h := &HotKeys{opts: opts, tracker: hotkeys.New(opts.Options)}
+	if opts.PromoteRate > 0 {
+		h.cache = NewCache(cache.Options{MaxBytes: opts.CacheBytes, MaxTTL: opts.CacheTTL, NegativeTTL: opts.CacheTTL})
+	}
+	return h
+}
+
+// Wrap counts and throttles the requests to s. Reads of hot keys come from
+// the local cache if reads is set, writes drop keys from it either way.
+func (h *HotKeys) Wrap(s Store, reads bool) Store {
+	return &hotStore{Store: s, hot: h, reads: reads}
+}
+
+// limit finds the limit of key. Limits are for the keys as clients see
+// them, so the keys of every namespace have the same limits.
+func (h *HotKeys) limit(key string) (HotKeyLimit, bool) {
+	if rest, ok := strings.CutPrefix(key, nsSep); ok {
+		_, key, _ = strings.Cut(rest, nsSep)
+	}
+	for _, l := range h.opts.Limits {
+		if l.Key == key || l.Prefix && strings.HasPrefix(key, l.Key) {
+			return l, true
+		}
+	}
+	return HotKeyLimit{}, false
+}
+
+// hit counts a request for key and returns its rate, or ErrThrottled if
+// the key is over its limit. Throttled requests aren't counted, so a key
+// gets going again as soon as its rate drops below the limit. The
+// settings and usage of namespaces are left alone, every write of a
+// namespace reads them.
+func (h *HotKeys) hit(key string) (float64, error) {
+	if strings.HasPrefix(key, nsSep+nsSep) {
+		return 0, nil
+	}
+	if l, ok := h.limit(key); ok && h.tracker.Rate(key) >= l.Rate {
+		h.throttled.Add(1)
+		return 0, ErrThrottled
+	}
+	return h.tracker.Add(key), nil
+}
+
+// HotKey is a heavy hitter as /debug/hotkeys shows it.
+type HotKey struct {
+	hotkeys.Key
+	Limit    float64 `json:"limit,omitempty"`
+	Promoted bool    `json:"promoted,omitempty"`
+}
+
+type HotKeyStats struct {
+	Top       []HotKey      `json:"top"`
+	Limits    []HotKeyLimit `json:"limits"`
+	Throttled int64         `json:"throttled"`
+	Cache     *cache.Stats  `json:"cache,omitempty"`
+}
+
+// Stats returns the n busiest keys.
+func (h *HotKeys) Stats(n int) HotKeyStats {
+	stats := HotKeyStats{Top: []HotKey{}, Limits: h.opts.Limits, Throttled: h.throttled.Load()}
+	for _, k := range h.tracker.Top(n) {
+		hk := HotKey{Key: k, Promoted: h.cache != nil && k.Rate >= h.opts.PromoteRate}
+		if l, ok := h.limit(k.Key); ok {
+			hk.Limit = l.Rate
+		}
+		stats.Top = append(stats.Top, hk)
+	}
+	if h.cache != nil {
+		cs := h.cache.Stats()
+		stats.Cache = &cs
+	}
+	return stats
+}
+
+// hotStore is a store whose requests HotKeys counts. Writes of a
+// namespace read the key through it first, so they count twice.
+type hotStore struct {
+	Store
+	hot   *HotKeys
+	reads bool
+}
+
+func (s *hotStore) Get(ctx context.Context, key string) (Entry, error) {
+	rate, err := s.hot.hit(key)
+	if err != nil {
+		return Entry{}, err
+	}
+	if !s.reads || s.hot.cache == nil || rate < s.hot.opts.PromoteRate {
+		return s.Store.Get(ctx, key)
+	}
+	// see cachedStore.Get
+	ctx = context.WithoutCancel(ctx)
+	e, found, err := s.hot.cache.Get(key, func() (Entry, time.Time, bool, error) {
+		e, err := s.Store.Get(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			return Entry{}, time.Time{}, false, nil
+		}
+		return e, time.Unix(e.ExpiredAt, 0), err == nil, err
+	})
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return e, err
+}
+
+// invalidate drops key from the local cache once a write is done.
+func (s *hotStore) invalidate(key string) {
+	if s.hot.cache != nil {
+		s.hot.cache.Invalidate(key)
+	}
+}
+
+func (s *hotStore) Put(ctx context.Context, key string, value []byte, expiredAt int64, cond Condition) (uint64, bool, error) {
+	if _, err := s.hot.hit(key); err != nil {
+		return 0, false, err
+	}
+	defer s.invalidate(key)
+	return s.Store.Put(ctx, key, value, expiredAt, cond)
+}
+
+func (s *hotStore) Delete(ctx context.Context, key string, cond Condition) error {
+	if _, err := s.hot.hit(key); err != nil {
+		return err
+	}
+	defer s.invalidate(key)
+	return s.Store.Delete(ctx, key, cond)
+}
+
+func (s *hotStore) Update(ctx context.Context, key string, fn func(cur *Entry) (*Entry, error)) (Entry, error) {
+	if _, err := s.hot.hit(key); err != nil {
+		return Entry{}, err
+	}
+	defer s.invalidate(key)
+	return s.Store.Update(ctx, key, fn)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// countingStore counts the reads that reach the store.
+type countingStore struct {
+	Store
+	gets atomic.Int64
+}
+
+func (s *countingStore) Get(ctx context.Context, key string) (Entry, error) {
+	s.gets.Add(1)
+	return s.Store.Get(ctx, key)
+}
+
+func TestParseHotKeyLimits(t *testing.T) {
+	limits, err := ParseHotKeyLimits("user:*=100, user:1=5,config=0.5")
+	if err != nil || len(limits) != 3 {
+		t.Fatalf("expected 3 limits but got %v %v", limits, err)
+	}
+	if limits[0] != (HotKeyLimit{Key: "user:1", Rate: 5}) || limits[2] != (HotKeyLimit{Key: "user:", Prefix: true, Rate: 100}) {
+		t.Errorf("expected the longest key first but got %v", limits)
+	}
+	for _, bad := range []string{"a", "a=", "a=-1", "a=x"} {
+		if _, err := ParseHotKeyLimits(bad); err == nil {
+			t.Errorf("expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestHotKeys(t *testing.T) {
+	counting := &countingStore{Store: openBitcask(t)}
+	limits, _ := ParseHotKeyLimits("limited*=5")
+	opts := HotKeyOptions{Limits: limits, PromoteRate: 2, CacheTTL: time.Minute, CacheBytes: 1 << 20}
+	opts.Window = time.Minute
+	hot := NewHotKeys(opts)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	(&API{primary: hot.Wrap(counting, false), replica: hot.Wrap(counting, true)}).Register(r)
+
+	// 5 per minute, counted over a minute, makes 300 requests
+	for i := range 300 {
+		if w := do(r, "PUT", "/keys/limited:a", "", "x"); w.Code != 201 && w.Code != 200 {
+			t.Fatalf("expected request %d to be allowed but got %d", i, w.Code)
+		}
+	}
+	w := do(r, "GET", "/keys/limited:a", "", "")
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 over the limit but got %d", w.Code)
+	}
+	if w := do(r, "GET", "/keys/limited:b", "", ""); w.Code != 404 {
+		t.Errorf("expected other keys of the prefix to have their own limit but got %d", w.Code)
+	}
+
+	// from 120 requests in a minute on, the write included, the key is
+	// read once more into the local cache
+	do(r, "PUT", "/keys/popular", "", "1")
+	before := counting.gets.Load()
+	for range 1000 {
+		do(r, "GET", "/keys/popular", "", "")
+	}
+	if gets := counting.gets.Load() - before; gets != 119 {
+		t.Errorf("expected the store to be read until the key got hot but it was read %d times", gets)
+	}
+	do(r, "PUT", "/keys/popular", "", "2")
+	if w := do(r, "GET", "/keys/popular", "", ""); w.Body.String() != "2" {
+		t.Errorf("expected writes to drop the key from the cache but got %s", w.Body)
+	}
+
+	var stats HotKeyStats
+	b, _ := json.Marshal(hot.Stats(2))
+	json.Unmarshal(b, &stats)
+	if len(stats.Top) != 2 || stats.Top[0].Key.Key != "popular" || !stats.Top[0].Promoted ||
+		stats.Top[1].Key.Key != "limited:a" || stats.Top[1].Limit != 5 || stats.Throttled != 1 {
+		t.Errorf("expected popular and limited:a to be the hot keys but got %s", b)
+	}
+}
+
+func TestHotKeysInNamespaces(t *testing.T) {
+	limits, _ := ParseHotKeyLimits("limited*=5,*=1000")
+	opts := HotKeyOptions{Limits: limits}
+	opts.Window = time.Minute
+	hot := NewHotKeys(opts)
+
+	// the limits are of the keys within the namespace
+	key := nsPrefix("acme") + "limited:a"
+	for i := range 300 {
+		if _, err := hot.hit(key); err != nil {
+			t.Fatalf("expected request %d to be allowed but got %v", i, err)
+		}
+	}
+	if _, err := hot.hit(key); err != ErrThrottled {
+		t.Errorf("expected the key of the namespace to be throttled but got %v", err)
+	}
+	if _, err := hot.hit(nsPrefix("other") + "limited:a"); err != nil {
+		t.Errorf("expected the key of another namespace to have its own limit but got %v", err)
+	}
+
+	// every write of a namespace reads its settings
+	for range 100000 {
+		if _, err := hot.hit(usageKey("acme", 0)); err != nil {
+			t.Fatalf("expected the usage of the namespace not to be throttled but got %v", err)
+		}
+	}
+	if _, err := hot.hit(metaKey("acme")); err != nil {
+		t.Errorf("expected the settings of the namespace not to be throttled but got %v", err)
+	}
+	for _, k := range hot.Stats(10).Top {
+		if strings.HasPrefix(k.Key.Key, nsSep+nsSep) {
+			t.Errorf("expected the keys of the namespace settings not to be tracked but got %+v", k)
+		}
+	}
+}
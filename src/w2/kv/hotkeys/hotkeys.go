@@ -0,0 +1,231 @@
+// Package hotkeys finds the keys that get the most requests. A count-min
+// sketch estimates the rate of every key in fixed memory, never below the
+// real rate, and the K keys with the highest estimates are kept as the
+// heavy hitters.
+//
+// Rates are per second over a sliding window: the count of the current
+// window plus the part of the previous one the window still covers, like
+// sliding window rate limiters do.
+package hotkeys
+
+import (
+	"cmp"
+	"container/heap"
+	"hash/maphash"
+	"slices"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	// Width is the number of counters in each of the Depth rows of the
+	// sketch. An estimate is over by at most 2/Width of the requests of
+	// its shard, with a probability of 1-2^-Depth.
+	Width, Depth int
+	// K is how many heavy hitters each shard keeps.
+	K      int
+	Window time.Duration
+	Shards int
+}
+
+func DefaultOptions() Options {
+	return Options{Width: 2048, Depth: 4, K: 32, Window: 10 * time.Second, Shards: 16}
+}
+
+// Key is a heavy hitter with its requests per second.
+type Key struct {
+	Key  string  `json:"key"`
+	Rate float64 `json:"rate"`
+}
+
+// Tracker must be created with New.
+type Tracker struct {
+	opts   Options
+	seed   maphash.Seed // of the sketch
+	pick   maphash.Seed // of the shards, so keys of a shard use every counter
+	shards []*shard
+	now    func() time.Time
+}
+
+type shard struct {
+	mu        sync.Mutex
+	cur, prev []uint32  // Depth rows of Width counters
+	start     time.Time // of the current window
+	top       topK
+}
+
+func New(opts Options) *Tracker {
+	def := DefaultOptions()
+	if opts.Width <= 0 {
+		opts.Width = def.Width
+	}
+	if opts.Depth <= 0 {
+		opts.Depth = def.Depth
+	}
+	if opts.K <= 0 {
+		opts.K = def.K
+	}
+	if opts.Window <= 0 {
+		opts.Window = def.Window
+	}
+	if opts.Shards <= 0 {
+		opts.Shards = def.Shards
+	}
+	t := &Tracker{opts: opts, seed: maphash.MakeSeed(), pick: maphash.MakeSeed(), now: time.Now}
+	for range opts.Shards {
+		t.shards = append(t.shards, &shard{
+			cur:   make([]uint32, opts.Width*opts.Depth),
+			prev:  make([]uint32, opts.Width*opts.Depth),
+			start: t.now(),
+			top:   topK{index: make(map[string]int)},
+		})
+	}
+	return t
+}
+
+func (t *Tracker) shard(key string) *shard {
+	return t.shards[maphash.String(t.pick, key)%uint64(len(t.shards))]
+}
+
+// counters returns where the counters of key are in each row. Each row
+// takes the next number of a splitmix64 sequence seeded with the hash of
+// the key, so two keys sharing a counter in one row rarely do in the others.
+func (t *Tracker) counters(key string, idx []int) []int {
+	x := maphash.String(t.seed, key)
+	for i := range t.opts.Depth {
+		x += 0x9e3779b97f4a7c15
+		z := (x ^ x>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		idx = append(idx, i*t.opts.Width+int((z^z>>31)%uint64(t.opts.Width)))
+	}
+	return idx
+}
+
+// Add counts a request for key and returns its rate, including this one.
+func (t *Tracker) Add(key string) float64 {
+	idx := t.counters(key, make([]int, 0, 8))
+	sh := t.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	now := t.now()
+	t.rotate(sh, now)
+	for _, i := range idx {
+		if sh.cur[i] < ^uint32(0) {
+			sh.cur[i]++
+		}
+	}
+	rate := t.rate(sh, idx, now)
+	sh.top.offer(key, rate, t.opts.K)
+	return rate
+}
+
+// Rate returns the requests per second of key.
+func (t *Tracker) Rate(key string) float64 {
+	idx := t.counters(key, make([]int, 0, 8))
+	sh := t.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	now := t.now()
+	t.rotate(sh, now)
+	return t.rate(sh, idx, now)
+}
+
+// Top returns up to n heavy hitters, the busiest first.
+func (t *Tracker) Top(n int) []Key {
+	var top []Key
+	for _, sh := range t.shards {
+		sh.mu.Lock()
+		now := t.now()
+		t.rotate(sh, now)
+		for _, k := range sh.top.keys {
+			if rate := t.rate(sh, t.counters(k.Key, nil), now); rate > 0 {
+				top = append(top, Key{k.Key, rate})
+			}
+		}
+		sh.mu.Unlock()
+	}
+	slices.SortFunc(top, func(a, b Key) int {
+		return cmp.Or(cmp.Compare(b.Rate, a.Rate), cmp.Compare(a.Key, b.Key))
+	})
+	return top[:min(n, len(top))]
+}
+
+// rate is the smallest count of the counters, the one the fewest other
+// keys add to. Must be called with the shard locked.
+func (t *Tracker) rate(sh *shard, idx []int, now time.Time) float64 {
+	cur, prev := ^uint32(0), ^uint32(0)
+	for _, i := range idx {
+		cur, prev = min(cur, sh.cur[i]), min(prev, sh.prev[i])
+	}
+	covered := 1 - float64(now.Sub(sh.start))/float64(t.opts.Window)
+	return (float64(cur) + float64(prev)*max(covered, 0)) / t.opts.Window.Seconds()
+}
+
+// rotate starts a new window once the current one is over, and rates the
+// heavy hitters again, so keys that went quiet make room. Must be called
+// with the shard locked.
+func (t *Tracker) rotate(sh *shard, now time.Time) {
+	passed := now.Sub(sh.start)
+	if passed < t.opts.Window {
+		return
+	}
+	sh.prev, sh.cur = sh.cur, sh.prev
+	clear(sh.cur)
+	if passed >= 2*t.opts.Window {
+		clear(sh.prev)
+	}
+	sh.start = now.Add(-passed % t.opts.Window)
+
+	keys := sh.top.keys[:0]
+	clear(sh.top.index)
+	for _, k := range sh.top.keys {
+		if k.Rate = t.rate(sh, t.counters(k.Key, nil), now); k.Rate > 0 {
+			sh.top.index[k.Key] = len(keys)
+			keys = append(keys, k)
+		}
+	}
+	sh.top.keys = keys
+	heap.Init(&sh.top)
+}
+
+// topK is a min-heap of the heavy hitters, so the least busy one is the
+// first to go.
+type topK struct {
+	keys  []Key
+	index map[string]int // of the keys in the heap
+}
+
+func (h *topK) Len() int           { return len(h.keys) }
+func (h *topK) Less(i, j int) bool { return h.keys[i].Rate < h.keys[j].Rate }
+func (h *topK) Swap(i, j int) {
+	h.keys[i], h.keys[j] = h.keys[j], h.keys[i]
+	h.index[h.keys[i].Key], h.index[h.keys[j].Key] = i, j
+}
+func (h *topK) Push(x any) {
+	k := x.(Key)
+	h.index[k.Key] = len(h.keys)
+	h.keys = append(h.keys, k)
+}
+func (h *topK) Pop() any {
+	k := h.keys[len(h.keys)-1]
+	h.keys = h.keys[:len(h.keys)-1]
+	delete(h.index, k.Key)
+	return k
+}
+
+// offer updates the rate of key if it is a heavy hitter, or makes it one
+// if there is room or it is busier than the least busy one.
+func (h *topK) offer(key string, rate float64, k int) {
+	switch i, ok := h.index[key]; {
+	case ok:
+		h.keys[i].Rate = rate
+		heap.Fix(h, i)
+	case len(h.keys) < k:
+		heap.Push(h, Key{key, rate})
+	case rate > h.keys[0].Rate:
+		delete(h.index, h.keys[0].Key)
+		h.keys[0] = Key{key, rate}
+		h.index[key] = 0
+		heap.Fix(h, 0)
+	}
+}
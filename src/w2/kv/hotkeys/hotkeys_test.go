@@ -0,0 +1,85 @@
+package hotkeys
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+// clock is a time that only moves when told to.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newTracker(opts Options) (*Tracker, *clock) {
+	c := &clock{time.Unix(1000, 0)}
+	t := New(opts)
+	t.now = c.now
+	for _, sh := range t.shards {
+		sh.start = c.t
+	}
+	return t, c
+}
+
+func TestHeavyHitters(t *testing.T) {
+	tr, _ := newTracker(Options{Width: 512, Depth: 4, K: 8, Window: time.Second, Shards: 4})
+	real := make(map[string]int)
+	r := rand.New(rand.NewPCG(1, 2))
+	zipf := rand.NewZipf(r, 1.2, 1, 9999)
+	for range 100000 {
+		key := fmt.Sprintf("key%d", zipf.Uint64())
+		real[key]++
+		tr.Add(key)
+	}
+	for key, n := range real {
+		if rate := tr.Rate(key); rate < float64(n) {
+			t.Fatalf("expected the rate of %s to be at least %d but got %f", key, n, rate)
+		}
+	}
+	top := tr.Top(5)
+	if len(top) != 5 {
+		t.Fatalf("expected 5 heavy hitters but got %v", top)
+	}
+	for i, k := range top {
+		if want := fmt.Sprintf("key%d", i); k.Key != want {
+			t.Errorf("expected %s at %d but got %v", want, i, top)
+		}
+		if over := k.Rate - float64(real[k.Key]); over > 100000*2/512 {
+			t.Errorf("expected %s to be over by at most %d but it is over by %f", k.Key, 100000*2/512, over)
+		}
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	tr, c := newTracker(Options{K: 2, Window: 10 * time.Second, Shards: 1})
+	for range 100 {
+		tr.Add("a")
+	}
+	if rate := tr.Rate("a"); rate != 10 {
+		t.Errorf("expected 10/s but got %f", rate)
+	}
+
+	// a quarter into the next window 3/4 of the last one still counts
+	c.t = c.t.Add(12500 * time.Millisecond)
+	if rate := tr.Rate("a"); rate != 7.5 {
+		t.Errorf("expected 7.5/s but got %f", rate)
+	}
+	for range 50 {
+		tr.Add("b")
+	}
+	tr.Add("c")
+	if top := tr.Top(10); len(top) != 2 || top[0].Key != "a" || top[1].Key != "b" {
+		t.Errorf("expected a and b to be the heavy hitters but got %v", top)
+	}
+
+	// keys that went quiet make room for new ones
+	c.t = c.t.Add(20 * time.Second)
+	if rate := tr.Rate("a"); rate != 0 {
+		t.Errorf("expected a to be quiet but got %f", rate)
+	}
+	tr.Add("c")
+	if top := tr.Top(10); len(top) != 1 || top[0] != (Key{"c", 0.1}) {
+		t.Errorf("expected only c but got %v", top)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kv/bloom"
+)
+
+// KeyFilter answers reads of keys that don't exist without asking the
+// store, from a Bloom filter of the keys. The filter is built from a scan
+// of the store and every write through this server adds its key, before
+// writing it, so the filter never misses a key this server wrote.
+//
+// Deleted and expired keys stay in the filter, as false positives, until
+// it is built again, which happens every so often and once deletes make up
+// RebuildRatio of the keys. Keys written around this server, by other
+// servers or imports, are missed until then too, so the filter is only for
+// stores this server is the only writer of, and is off unless asked for.
+// Stores that can list their keys along an index, like the SQL one, are
+// built from that instead of a scan of the entries.
+//
+// The filter hashes the bytes of keys, so the store must compare them as
+// bytes too. kv.sql gives the keys of the SQL one a binary collation, in
+// a case insensitive one a read of KEY would find key, which the filter
+// turns away.
+type KeyFilter struct {
+	source Store // scanned on builds, the primary
+	opts   KeyFilterOptions
+
+	filter atomic.Pointer[bloom.Filter] // nil until the first build
+	// writes hold mu for reading while they add their key and write it,
+	// so a build waits for the writes that started before it
+	mu       sync.RWMutex
+	building *bloom.Filter
+	built    time.Time
+
+	deletes                         atomic.Int64 // since the last build
+	rebuilds                        atomic.Int64
+	skipped, passed, falsePositives atomic.Int64
+}
+
+type KeyFilterOptions struct {
+	Capacity          int // keys of the first stage of the filter
+	FalsePositiveRate float64
+	// RebuildRatio is the part of the keys of the filter that can be
+	// deleted before it is built again.
+	RebuildRatio float64
+}
+
+func DefaultKeyFilterOptions() KeyFilterOptions {
+	return KeyFilterOptions{Capacity: 1 << 20, FalsePositiveRate: 0.01, RebuildRatio: 0.25}
+}
+
+func NewKeyFilter(source Store, opts KeyFilterOptions) *KeyFilter {
+	return &KeyFilter{source: source, opts: opts}
+}
+
+// Run builds the filter, and again every so often until ctx is cancelled.
+func (f *KeyFilter) Run(ctx context.Context, every time.Duration) {
+	for {
+		if err := f.Build(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Building the key filter failed: %v", err)
+		}
+		select {
+		case <-time.After(every):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Build scans the store into a new filter, which replaces the one in use
+// when it is done. Writes while it scans go to both.
+func (f *KeyFilter) Build(ctx context.Context) error {
+	next := bloom.New(f.opts.Capacity, f.opts.FalsePositiveRate)
+	f.mu.Lock()
+	if f.building != nil {
+		f.mu.Unlock()
+		return errors.New("the key filter is being built already")
+	}
+	f.building = next
+	f.mu.Unlock()
+
+	started := time.Now()
+	var err error
+	if ks, ok := f.source.(keyScanner); ok {
+		err = scanKeys(ctx, ks, next.Add)
+	} else {
+		err = scanPrefix(ctx, f.source, "", func(e Entry) error {
+			next.Add(e.Key)
+			return nil
+		})
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.building = nil
+	if err != nil {
+		return err
+	}
+	f.filter.Store(next)
+	f.built = started
+	f.deletes.Store(0)
+	f.rebuilds.Add(1)
+	return nil
+}
+
+// keyScanner is a store that can list its keys without their values, in
+// an order it has an index for.
+type keyScanner interface {
+	// ScanKeys returns up to limit live keys after the given one.
+	ScanKeys(ctx context.Context, after string, limit int) ([]string, error)
+}
+
+func scanKeys(ctx context.Context, s keyScanner, fn func(key string)) error {
+	for after := ""; ; {
+		keys, err := s.ScanKeys(ctx, after, exportBatch)
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+		for _, key := range keys {
+			fn(key)
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+// rebuild builds the filter again in the background once deletes make up
+// RebuildRatio of its keys.
+func (f *KeyFilter) rebuild() {
+	filter := f.filter.Load()
+	if filter == nil || float64(f.deletes.Add(1)) < f.opts.RebuildRatio*float64(filter.Len()) {
+		return
+	}
+	f.mu.RLock()
+	building := f.building != nil
+	f.mu.RUnlock()
+	if !building {
+		go func() {
+			if err := f.Build(context.Background()); err != nil {
+				log.Printf("Rebuilding the key filter failed: %v", err)
+			}
+		}()
+	}
+}
+
+// writing adds key to the filters, and returns the func to call once the
+// write is done.
+func (f *KeyFilter) writing(key string) func() {
+	f.mu.RLock()
+	if filter := f.filter.Load(); filter != nil {
+		filter.Add(key)
+	}
+	if f.building != nil {
+		f.building.Add(key)
+	}
+	return f.mu.RUnlock
+}
+
+type KeyFilterStats struct {
+	bloom.Stats
+	Ready    bool      `json:"ready"` // built once, reads use it
+	Building bool      `json:"building"`
+	Built    time.Time `json:"built,omitzero"`
+	Deletes  int64     `json:"deletes"` // since it was built
+	Rebuilds int64     `json:"rebuilds"`
+	// reads the filter answered, and the ones it passed on to the store,
+	// of which the store didn't have FalsePositives
+	Skipped        int64 `json:"skipped"`
+	Passed         int64 `json:"passed"`
+	FalsePositives int64 `json:"false_positives"`
+	// ObservedFalsePositiveRate is the part of the reads of missing keys
+	// the filter didn't answer.
+	ObservedFalsePositiveRate float64 `json:"observed_false_positive_rate"`
+}
+
+func (f *KeyFilter) Stats() KeyFilterStats {
+	s := KeyFilterStats{
+		Deletes:        f.deletes.Load(),
+		Rebuilds:       f.rebuilds.Load(),
+		Skipped:        f.skipped.Load(),
+		Passed:         f.passed.Load(),
+		FalsePositives: f.falsePositives.Load(),
+	}
+	if filter := f.filter.Load(); filter != nil {
+		s.Stats, s.Ready = filter.Stats(), true
+	}
+	f.mu.RLock()
+	s.Building, s.Built = f.building != nil, f.built
+	f.mu.RUnlock()
+	if missing := s.Skipped + s.FalsePositives; missing > 0 {
+		s.ObservedFalsePositiveRate = float64(s.FalsePositives) / float64(missing)
+	}
+	return s
+}
+
+// Wrap puts the filter in front of the reads of s and adds the keys of
+// its writes.
+func (f *KeyFilter) Wrap(s Store) Store {
+	return &filteredStore{Store: s, filter: f}
+}
+
+type filteredStore struct {
+	Store
+	filter *KeyFilter
+}
+
+func (s *filteredStore) Get(ctx context.Context, key string) (Entry, error) {
+	f := s.filter
+	filter := f.filter.Load()
+	if filter == nil {
+		return s.Store.Get(ctx, key)
+	}
+	if !filter.Has(key) {
+		f.skipped.Add(1)
+		return Entry{}, ErrNotFound
+	}
+	f.passed.Add(1)
+	e, err := s.Store.Get(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		f.falsePositives.Add(1)
+	}
+	return e, err
+}
+
+func (s *filteredStore) Put(ctx context.Context, key string, value []byte, expiredAt int64, cond Condition) (uint64, bool, error) {
+	defer s.filter.writing(key)()
+	return s.Store.Put(ctx, key, value, expiredAt, cond)
+}
+
+func (s *filteredStore) Delete(ctx context.Context, key string, cond Condition) error {
+	err := s.Store.Delete(ctx, key, cond)
+	if err == nil {
+		s.filter.rebuild()
+	}
+	return err
+}
+
+func (s *filteredStore) Update(ctx context.Context, key string, fn func(cur *Entry) (*Entry, error)) (Entry, error) {
+	var deleted bool
+	done := s.filter.writing(key)
+	e, err := s.Store.Update(ctx, key, func(cur *Entry) (*Entry, error) {
+		next, err := fn(cur)
+		deleted = cur != nil && next == nil && err == nil
+		return next, err
+	})
+	done()
+	if err == nil && deleted {
+		s.filter.rebuild()
+	}
+	return e, err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestKeyFilter(t *testing.T) {
+	ctx := context.Background()
+	counting := &countingStore{Store: openBitcask(t)}
+	for i := range 100 {
+		counting.Put(ctx, fmt.Sprintf("k%d", i), []byte("v"), NoExpiry, Condition{})
+	}
+	opts := DefaultKeyFilterOptions()
+	opts.Capacity = 100
+	kf := NewKeyFilter(counting, opts)
+	s := kf.Wrap(counting)
+
+	// until it is built the filter passes every read on
+	if _, err := s.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) || counting.gets.Load() != 1 {
+		t.Errorf("expected the read to reach the store but got %v", err)
+	}
+	if err := kf.Build(ctx); err != nil {
+		t.Fatal(err)
+	}
+	before := counting.gets.Load()
+	for i := range 1000 {
+		if _, err := s.Get(ctx, fmt.Sprintf("missing%d", i)); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected missing%d to be missing but got %v", i, err)
+		}
+	}
+	for i := range 100 {
+		if _, err := s.Get(ctx, fmt.Sprintf("k%d", i)); err != nil {
+			t.Fatalf("expected k%d to be found but got %v", i, err)
+		}
+	}
+	stats := kf.Stats()
+	if reads := counting.gets.Load() - before; reads != 100+stats.FalsePositives || stats.Skipped+stats.FalsePositives != 1000 {
+		t.Errorf("expected only existing keys and false positives to be read but the store got %d reads, %+v", reads, stats)
+	}
+	// keys the filter may have already don't count
+	if !stats.Ready || stats.Keys < 98 || stats.Keys > 100 || stats.ObservedFalsePositiveRate > 0.05 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// writes add their keys, also the ones of Update
+	s.Put(ctx, "new", []byte("v"), NoExpiry, Condition{})
+	s.Update(ctx, "counter", func(cur *Entry) (*Entry, error) { return &Entry{Value: []byte("1"), ExpiredAt: NoExpiry}, nil })
+	for _, key := range []string{"new", "counter"} {
+		if _, err := s.Get(ctx, key); err != nil {
+			t.Errorf("expected %s to be found but got %v", key, err)
+		}
+	}
+
+	// deleting a quarter of the keys builds the filter again without them
+	for i := range 26 {
+		if err := s.Delete(ctx, fmt.Sprintf("k%d", i), Condition{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for kf.Stats().Rebuilds < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := kf.Stats(); stats.Rebuilds != 2 || stats.Keys < 74 || stats.Keys > 76 || stats.Deletes != 0 {
+		t.Errorf("expected the filter to be built again with 76 keys but got %+v", stats)
+	}
+}
+
+// TestKeyFilterSQL needs the MySQL primary from kv.sql on port 3306.
+func TestKeyFilterSQL(t *testing.T) {
+	s := NewSQLStore("3306")
+	defer s.Close()
+	if err := s.(*sqlStore).db.Ping(); err != nil {
+		t.Skipf("MySQL not available: %v", err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"keyfilter-test-a", "keyfilter-test-b"} {
+		if _, _, err := s.Put(ctx, key, []byte("v"), NoExpiry, Condition{}); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Delete(ctx, key, Condition{})
+	}
+
+	kf := NewKeyFilter(s, DefaultKeyFilterOptions())
+	if err := kf.Build(ctx); err != nil {
+		t.Fatal(err)
+	}
+	filter := kf.filter.Load()
+	if !filter.Has("keyfilter-test-a") || !filter.Has("keyfilter-test-b") {
+		t.Errorf("expected the build to add the keys of the table")
+	}
+	// the filter tells keys apart by their bytes, so must the table
+	if _, err := s.Get(ctx, "KEYFILTER-TEST-A"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a key differing in case to be missing but got %v", err)
+	}
+}
@@ -39,14 +39,23 @@ USE `kv`;
 --
 -- Table structure for table `store`
 --
+-- Databases created before versions were added need
+--   ALTER TABLE `store` ADD COLUMN `version` bigint unsigned NOT NULL DEFAULT '1' AFTER `expired_at`;
+--
+-- and keys compared as bytes without padding, namespaced keys start with
+-- \x1e which the accent insensitive collations ignore, so older ones need
+--   ALTER TABLE `store` MODIFY `k` varchar(128) CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_bin NOT NULL;
+--   ALTER TABLE `changes` MODIFY `k` varchar(128) CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_bin NOT NULL;
+--
 
 DROP TABLE IF EXISTS `store`;
 /*!40101 SET @saved_cs_client     = @@character_set_client */;
 /*!50503 SET character_set_client = utf8mb4 */;
 CREATE TABLE `store` (
-  `k` varchar(128) NOT NULL,
+  `k` varchar(128) CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_bin NOT NULL,
   `value` blob NOT NULL,
   `expired_at` int NOT NULL,
+  `version` bigint unsigned NOT NULL DEFAULT '1',
   PRIMARY KEY (`k`),
   KEY `expired_at_idx` (`expired_at` DESC)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
@@ -60,6 +69,26 @@ LOCK TABLES `store` WRITE;
 /*!40000 ALTER TABLE `store` DISABLE KEYS */;
 /*!40000 ALTER TABLE `store` ENABLE KEYS */;
 UNLOCK TABLES;
+
+--
+-- Table structure for table `changes`, the mutation log behind /watch
+--
+
+DROP TABLE IF EXISTS `changes`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `changes` (
+  `seq` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `k` varchar(128) CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_bin NOT NULL,
+  `op` varchar(8) NOT NULL,
+  `value` blob,
+  `expired_at` int DEFAULT NULL,
+  `version` bigint unsigned NOT NULL,
+  `at` timestamp(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (`seq`),
+  KEY `at_idx` (`at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
 SET @@SESSION.SQL_LOG_BIN = @MYSQLDUMP_TEMP_LOG_BIN;
 /*!40103 SET TIME_ZONE=@OLD_TIME_ZONE */;
 
@@ -1,138 +1,223 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"flag"
 	"fmt"
+	"log"
+	"net"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"kv/cache"
+	"kv/hotkeys"
+
 	"github.com/gin-gonic/gin"
-	io "github.com/sanjay-vasudeva/ioutil"
 )
 
-func main() {
-	r := gin.Default()
+var (
+	addr     = flag.String("addr", ":8080", "address to listen on")
+	respAddr = flag.String("resp-addr", ":6380", "address for Redis clients to connect to, empty disables it")
+	backend  = flag.String("backend", "sql", "storage backend: sql (MySQL on 3306 with a replica on 3307), bitcask, sharded or quorum")
+	dataDir  = flag.String("data", "data", "directory of the bitcask backend, bitcask shards added through /ring/shards must be in it")
+
+	shards   = flag.String("shards", "a=bitcask:data/a,b=bitcask:data/b,c=bitcask:data/c", "shards of the sharded backend as name=bitcask:<dir> or name=sql:<port>, comma separated")
+	vnodes   = flag.Int("vnodes", 128, "points of each shard on the hash ring")
+	replicas = flag.Int("replicas", 2, "how many shards keep each key")
+
+	node   = flag.String("node", "a", "name of this node in quorum mode, it keeps its replica in -data")
+	peers  = flag.String("peers", "a=http://localhost:8080,b=http://localhost:8081,c=http://localhost:8082", "nodes of the quorum mode as name=url, comma separated")
+	quorum = flag.String("quorum", "3,2,2", "default N,R,W of the quorum mode")
+
+	cacheBytes       = flag.Int64("cache-bytes", 64<<20, "size of the read cache in front of the replica, 0 disables it")
+	cacheMaxTTL      = flag.Duration("cache-max-ttl", 30*time.Second, "longest a value stays cached")
+	cacheNegativeTTL = flag.Duration("cache-negative-ttl", 5*time.Second, "how long a missing key is remembered")
+	cacheHold        = flag.Duration("cache-hold", 2*time.Second, "how long after a write reads of the key aren't cached, to let it reach the replica")
 
-	db := NewConn("3306")
-	dbRead := NewConn("3307")
-	r.GET("/", func(ctx *gin.Context) {
-		key := ctx.Query("key")
-		consistent := ctx.Query("consistent")
+	cleanupEvery = flag.Duration("cleanup-every", time.Minute, "pause between rounds of deleting expired keys")
+	cleanupRate  = flag.Int("cleanup-rate", 10000, "most rows the cleanup deletes per second, 0 for no limit")
 
-		cons, err := strconv.ParseBool(consistent)
+	antiEntropyEvery  = flag.Duration("antientropy-every", 10*time.Minute, "pause between checks that the replica matches the primary, 0 disables them")
+	antiEntropyRepair = flag.Bool("antientropy-repair", false, "copy the keys that differ from the primary to the replica instead of only reporting them")
+
+	hotWindow     = flag.Duration("hot-window", 10*time.Second, "window over which the requests per second of keys are counted")
+	hotTop        = flag.Int("hot-top", 32, "how many of the busiest keys each of the 16 shards of the hot key tracker keeps")
+	hotLimits     = flag.String("hot-limits", "", "requests per second allowed for each key, as key=rate or prefix*=rate, comma separated")
+	hotPromote    = flag.Float64("hot-promote", 100, "reads per second that move a key into the local hot key cache, 0 disables it")
+	hotCacheTTL   = flag.Duration("hot-cache-ttl", time.Second, "how long a hot key stays in the local cache, which is also how stale it can get")
+	hotCacheBytes = flag.Int64("hot-cache-bytes", 8<<20, "size of the local hot key cache")
+
+	keyFilter      = flag.Bool("key-filter", false, "answer reads of missing keys from a Bloom filter of the keys of the sql and sharded backends, only for a server that is the only writer of its store, which kv servers sharing MySQL are not")
+	keyFilterEvery = flag.Duration("key-filter-rebuild-every", time.Hour, "pause between builds of the key filter, which drop deleted and expired keys")
+
+	adminKey     = flag.String("admin-key", "", "API key that manages namespaces, the shards and /debug, empty disables namespaces")
+	recountEvery = flag.Duration("recount-every", time.Hour, "pause between recounts of the usage of namespaces, 0 disables them")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
+	// reads that don't need to be consistent go to the replica
+	var primary, replica Store
+	var changes ChangeLog
+	var sharded *shardedStore
+	var coordinator *quorumStore
+	var local *localReplica
+	r := gin.Default()
+	// the debug endpoints show keys of every namespace
+	debug := r.Group("/debug", adminOnly(*adminKey))
+	switch *backend {
+	case "bitcask":
+		s, err := OpenBitcask(*dataDir)
 		if err != nil {
-			ctx.JSON(400, gin.H{"error": "Invalid consistent parameter"})
-			return
+			log.Fatalf("Failed to open %s: %v", *dataDir, err)
 		}
-		var row *sql.Row
-		if cons {
-			row = db.QueryRow("SELECT value FROM kv.store WHERE k = ? AND expired_at > UNIX_TIMESTAMP()", key)
-		} else {
-			row = dbRead.QueryRow("SELECT value FROM kv.store WHERE k = ? AND expired_at > UNIX_TIMESTAMP()", key)
+		primary, replica = s, s
+		changes = s.(ChangeLog)
+	case "sql":
+		primary, replica = NewSQLStore("3306"), NewSQLStore("3307")
+		changes = primary.(*sqlStore)
+		cleaner := startCleaner(primary)
+		debug.GET("/cleanup", func(ctx *gin.Context) {
+			ctx.JSON(200, cleaner.Stats())
+		})
+		if *antiEntropyEvery > 0 {
+			opts := DefaultAntiEntropyOptions()
+			opts.Cadence, opts.Repair = *antiEntropyEvery, *antiEntropyRepair
+			ae := NewAntiEntropy(primary.(*sqlStore).db, replica.(*sqlStore).db, opts)
+			go ae.Run(context.Background())
+			debug.GET("/antientropy", func(ctx *gin.Context) {
+				ctx.JSON(200, ae.Last())
+			})
+			// checks right away
+			debug.POST("/antientropy", func(ctx *gin.Context) {
+				report, _ := ae.Check(ctx.Request.Context())
+				ctx.JSON(200, report)
+			})
 		}
-		if row.Err() != nil {
-			ctx.JSON(500, gin.H{"error": "Internal Server Error"})
-			return
-		}
-		var value string
-		row.Scan(&value)
-		ctx.JSON(200, value)
-	})
+	case "sharded":
+		sharded = openSharded(openShard)
+		primary, replica = sharded, sharded
+	case "quorum":
+		coordinator, local = openQuorum()
+		primary, replica = coordinator, coordinator
+	default:
+		log.Fatalf("Unknown backend %q", *backend)
+	}
+	defer primary.Close()
+
+	// the key filter must see every write, so it is off unless this server
+	// is the only one using the store. In quorum mode other nodes write
+	// too, and bitcask keeps its keys in memory anyway.
+	if *keyFilter && (*backend == "sql" || *backend == "sharded") {
+		kf := NewKeyFilter(primary, DefaultKeyFilterOptions())
+		go kf.Run(context.Background(), *keyFilterEvery)
+		primary, replica = kf.Wrap(primary), kf.Wrap(replica)
+		debug.GET("/keyfilter", func(ctx *gin.Context) {
+			ctx.JSON(200, kf.Stats())
+		})
+	}
 
-	r.PUT("", func(c *gin.Context) {
-		key := c.Query("key")
-		value := c.Query("value")
-		ttl, err := strconv.Atoi(c.Query("ttl"))
+	// in quorum mode other nodes write too, the cache wouldn't see it
+	if *cacheBytes > 0 && coordinator == nil {
+		c := NewCache(cache.Options{MaxBytes: *cacheBytes, MaxTTL: *cacheMaxTTL, NegativeTTL: *cacheNegativeTTL, Hold: *cacheHold})
+		primary = &invalidating{Store: primary, cache: c}
+		replica = newCachedStore(replica, c)
+		debug.GET("/cache", func(ctx *gin.Context) {
+			ctx.JSON(200, c.Stats())
+		})
+	}
+	limits, err := ParseHotKeyLimits(*hotLimits)
+	if err != nil {
+		log.Fatalf("Bad -hot-limits: %v", err)
+	}
+	opts := HotKeyOptions{Options: hotkeys.DefaultOptions(), Limits: limits, PromoteRate: *hotPromote, CacheTTL: *hotCacheTTL, CacheBytes: *hotCacheBytes}
+	opts.Window, opts.K = *hotWindow, *hotTop
+	hot := NewHotKeys(opts)
+	primary, replica = hot.Wrap(primary, false), hot.Wrap(replica, true)
+	debug.GET("/hotkeys", func(ctx *gin.Context) {
+		n, _ := strconv.Atoi(ctx.DefaultQuery("n", "20"))
+		ctx.JSON(200, hot.Stats(n))
+	})
+	if *respAddr != "" {
+		ln, err := net.Listen("tcp", *respAddr)
 		if err != nil {
-			c.JSON(400, gin.H{"error": "Invalid ttl"})
-			return
+			log.Fatalf("Failed to listen on %s: %v", *respAddr, err)
 		}
-		expiredAt := time.Now().Unix() + int64(ttl)
-
-		defer func() {
-			if rec := recover(); rec != nil {
-				fmt.Println("Recovered in f", rec)
-				c.JSON(500, gin.H{"error": "Internal Server Error"})
-				return
+		go func() {
+			if err := NewRESPServer(primary, replica).Serve(context.Background(), ln); err != nil {
+				log.Fatalf("RESP server failed: %v", err)
 			}
 		}()
-		// putKey1(key, value, expiredAt, db)
-		putKey2(key, value, expiredAt, db)
-	})
-
-	r.DELETE("/", func(c *gin.Context) {
-		key := c.Query("key")
-		deleteKey3(key, db)
-	})
-
-	go backgroundCleanUp(60, db)
-	r.Run(":8080")
+	}
+	api := &API{primary: primary, replica: replica, changes: changes, sharded: sharded, openShard: openShard, shardDir: *dataDir, quorum: coordinator, local: local}
+	if *adminKey != "" {
+		api.namespaces, api.adminKey = NewNamespaces(primary, replica), *adminKey
+		if *recountEvery > 0 {
+			go api.namespaces.Recounts(context.Background(), *recountEvery)
+		}
+	}
+	api.Register(r)
+	r.Run(*addr)
 }
 
-func backgroundCleanUp(cadence int, db *sql.DB) {
-	for {
-		res, err := db.Exec("DELETE FROM kv.store WHERE expired_at < UNIX_TIMESTAMP()")
+func openSharded(open func(spec string) (Store, error)) *shardedStore {
+	stores := make(map[string]Store)
+	for shard := range strings.SplitSeq(*shards, ",") {
+		name, spec, _ := strings.Cut(shard, "=")
+		s, err := open(spec)
 		if err != nil {
-			fmt.Println("Error deleting expired keys:", err)
-			continue
-		}
-		rowsAffected, err := res.RowsAffected()
-		if err != nil {
-			fmt.Println("Error getting rows affected:", err)
-			continue
-		}
-		if rowsAffected > 0 {
-			fmt.Printf("Deleted %d expired keys\n", rowsAffected)
+			log.Fatalf("Failed to open shard %s: %v", name, err)
 		}
-		time.Sleep(time.Second * time.Duration(cadence))
+		stores[name] = s
 	}
+	return NewShardedStore(stores, *vnodes, *replicas)
 }
 
-// approach 1: Check if key exists and decide whether to insert or update
-func putKey1(key string, value string, expiredAt int64, db *sql.DB) {
-	row := db.QueryRow("SELECT COUNT(1) FROM kv.store WHERE k = ?", key)
-	if row.Err() != nil {
-		panic(row.Err())
+// openQuorum coordinates the -peers, keeping the replica of this node in
+// -data.
+func openQuorum() (*quorumStore, *localReplica) {
+	var q Quorum
+	if _, err := fmt.Sscanf(*quorum, "%d,%d,%d", &q.N, &q.R, &q.W); err != nil {
+		log.Fatalf("Bad quorum %q: %v", *quorum, err)
 	}
-	var count int
-	_ = row.Scan(&count)
-
-	var res sql.Result
-	var err error
-	if count == 0 {
-		res, err = db.Exec("INSERT INTO kv.store (k, value, expired_at) VALUES (?, ?, ?)", key, value, expiredAt)
-	} else {
-		res, err = db.Exec("UPDATE kv.store SET value = ?, expired_at = ? WHERE k = ?", value, expiredAt, key)
-	}
-
+	s, err := OpenBitcask(*dataDir)
 	if err != nil {
-		panic(err)
+		log.Fatalf("Failed to open %s: %v", *dataDir, err)
 	}
-	fmt.Println("Rows affected:", res)
-}
-
-// approach 2: Insert or update the key in a single query
-func putKey2(key string, value string, expiredAt int64, db *sql.DB) {
-	db.Exec("INSERT INTO kv.store (k, value, expired_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE value = ?, expired_at = ?", key, value, expiredAt, value, expiredAt)
-}
-
-// approach 1: delete the key from the database
-func deleteKey1(key string, db *sql.DB) {
-	db.Exec("DELETE FROM kv.store WHERE k = ?", key)
-}
-
-// approach 2: set the expired at column to special value so we can
-// avoid index rebalancing
-func deleteKey2(key string, db *sql.DB) {
-	db.Exec("UPDATE kv.store set expired_at = -1 where k = ?", key)
+	local := &localReplica{store: s}
+	nodes := map[string]Replica{*node: local}
+	for peer := range strings.SplitSeq(*peers, ",") {
+		name, url, _ := strings.Cut(peer, "=")
+		if name != *node {
+			nodes[name] = newHTTPReplica(url)
+		}
+	}
+	return NewQuorumStore(*node, nodes, *vnodes, q), local
 }
 
-// approach 3: Include where clause to filter out already expired keys
-// so that we can save 2 disk IOs. One in clustered index and other in secondary index
-func deleteKey3(key string, db *sql.DB) {
-	db.Exec("UPDATE kv.store set expired_at = -1 where k = ? and expired_at > UNIX_TIMESTAMP()", key)
+// openShard opens a shard and starts the cleanup of SQL ones.
+func openShard(spec string) (Store, error) {
+	s, err := OpenShard(spec)
+	if err == nil && strings.HasPrefix(spec, "sql:") {
+		startCleaner(s)
+	}
+	return s, err
 }
 
-func NewConn(port string) *sql.DB {
-	return io.NewConn(port, "root", "password", "kv")
+// startCleaner cleans up s until it is closed.
+func startCleaner(s Store) *Cleaner {
+	opts := DefaultCleanupOptions()
+	opts.Cadence, opts.RowsPerSecond = *cleanupEvery, *cleanupRate
+	st := s.(*sqlStore)
+	cleaner := NewCleaner(st.db, opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	st.stopCleanup = cancel
+	go cleaner.Run(ctx)
+	return cleaner
 }
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Namespaces are separate key spaces in the same store. The keys of
+// namespace ns are kept as \x1e ns \x1e key, and its settings and usage as
+// the JSON value of \x1e\x1e ns, so they live in kv.store like any other key
+// and every backend has them. Keys outside of namespaces can't start with
+// \x1e.
+//
+// Usage is counted by the writes of the namespace: a write first reserves
+// what it adds, failing with ErrQuota if that goes over a quota, and then
+// writes the key if it didn't change in between. Keys that expire are only
+// dropped from the usage when it is recounted.
+//
+// So that the writes of a namespace don't all wait for the lock on one
+// row, what they reserve is spread over usageShards keys \x1e\x1e ns \x1e i
+// and added to the usage kept with the settings when it is read. A write
+// checks the quota against the other shards as it read them, so writes
+// racing on different shards can go over it by what they add together.
+const nsSep = "\x1e"
+
+var (
+	ErrQuota       = errors.New("namespace quota exceeded")
+	nsName         = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+	errNoNamespace = &requestError{http.StatusNotFound, "namespace not found"}
+	errNsExists    = &requestError{http.StatusConflict, "namespace exists"}
+	errBadName     = badRequest("namespace names have 1 to 32 lowercase letters, digits, - and _")
+)
+
+// Namespace is what is kept of a namespace. Quotas of 0 mean no limit.
+type Namespace struct {
+	Name     string    `json:"name"`
+	KeyHash  string    `json:"key_hash"` // SHA256 of the API key
+	MaxKeys  int64     `json:"max_keys"`
+	MaxBytes int64     `json:"max_bytes"`
+	Keys     int64     `json:"keys"`
+	Bytes    int64     `json:"bytes"` // of the keys and values
+	Created  time.Time `json:"created"`
+	Counted  time.Time `json:"counted,omitzero"` // last recount
+}
+
+// NamespaceStats is how /namespaces shows a namespace, with the requests
+// this server handled for it.
+type NamespaceStats struct {
+	Name     string    `json:"name"`
+	MaxKeys  int64     `json:"max_keys"`
+	MaxBytes int64     `json:"max_bytes"`
+	Keys     int64     `json:"keys"`
+	Bytes    int64     `json:"bytes"`
+	Created  time.Time `json:"created"`
+	Counted  time.Time `json:"counted,omitzero"`
+	Reads    int64     `json:"reads"`
+	Writes   int64     `json:"writes"`
+	Rejected int64     `json:"rejected"` // writes over quota
+}
+
+type nsCounters struct {
+	reads, writes, rejected atomic.Int64
+}
+
+// Namespaces keeps the namespaces in primary, replica is where the reads
+// of namespaces go that don't need to be consistent.
+type Namespaces struct {
+	primary, replica Store
+
+	mu       sync.Mutex
+	counters map[string]*nsCounters
+	shard    atomic.Uint64 // the usage shard of the next write
+}
+
+func NewNamespaces(primary, replica Store) *Namespaces {
+	return &Namespaces{primary: primary, replica: replica, counters: make(map[string]*nsCounters)}
+}
+
+func metaKey(name string) string  { return nsSep + nsSep + name }
+func nsPrefix(name string) string { return nsSep + name + nsSep }
+
+// usageShards is how many keys the usage of a namespace is spread over.
+const usageShards = 8
+
+func usageKey(name string, i int) string { return metaKey(name) + nsSep + strconv.Itoa(i) }
+
+// usage is what a shard of the usage of a namespace counts, the writes
+// since the last recount.
+type usage struct {
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (ns *Namespace) add(u usage) {
+	ns.Keys, ns.Bytes = ns.Keys+u.Keys, ns.Bytes+u.Bytes
+}
+
+// clamp keeps the usage from going below 0, which keys that expired and
+// were deleted before a recount can make it.
+func (ns *Namespace) clamp() {
+	ns.Keys, ns.Bytes = max(ns.Keys, 0), max(ns.Bytes, 0)
+}
+
+func hashKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIKey() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (n *Namespaces) counter(name string) *nsCounters {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c := n.counters[name]
+	if c == nil {
+		c = &nsCounters{}
+		n.counters[name] = c
+	}
+	return c
+}
+
+// Create adds a namespace and returns its API key.
+func (n *Namespaces) Create(ctx context.Context, name string, maxKeys, maxBytes int64) (string, error) {
+	if !nsName.MatchString(name) {
+		return "", errBadName
+	}
+	apiKey := newAPIKey()
+	ns := Namespace{Name: name, KeyHash: hashKey(apiKey), MaxKeys: maxKeys, MaxBytes: maxBytes, Created: time.Now().UTC()}
+	value, err := json.Marshal(ns)
+	if err != nil {
+		return "", err
+	}
+	_, _, err = n.primary.Put(ctx, metaKey(name), value, NoExpiry, Condition{IfAbsent: true})
+	if errors.Is(err, ErrConflict) {
+		return "", errNsExists
+	}
+	return apiKey, err
+}
+
+// Get returns the namespace with its usage.
+func (n *Namespaces) Get(ctx context.Context, name string) (Namespace, error) {
+	ns, err := n.meta(ctx, name)
+	if err != nil {
+		return Namespace{}, err
+	}
+	shards, err := n.usage(ctx, name)
+	if err != nil {
+		return Namespace{}, err
+	}
+	for _, u := range shards {
+		ns.add(u)
+	}
+	ns.clamp()
+	return ns, nil
+}
+
+// meta returns the namespace as it is kept, without the usage in the
+// shards.
+func (n *Namespaces) meta(ctx context.Context, name string) (Namespace, error) {
+	e, err := n.primary.Get(ctx, metaKey(name))
+	if errors.Is(err, ErrNotFound) {
+		return Namespace{}, errNoNamespace
+	}
+	if err != nil {
+		return Namespace{}, err
+	}
+	var ns Namespace
+	return ns, json.Unmarshal(e.Value, &ns)
+}
+
+// usage reads the usage shards of the namespace, by key.
+func (n *Namespaces) usage(ctx context.Context, name string) (map[string]usage, error) {
+	// the shards sort right after the settings
+	prefix := metaKey(name) + nsSep
+	entries, err := n.primary.Scan(ctx, prefix, usageShards)
+	if err != nil {
+		return nil, err
+	}
+	shards := make(map[string]usage, len(entries))
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Key, prefix) {
+			break
+		}
+		var u usage
+		if err := json.Unmarshal(e.Value, &u); err != nil {
+			return nil, err
+		}
+		shards[e.Key] = u
+	}
+	return shards, nil
+}
+
+func (n *Namespaces) Stats(ns Namespace) NamespaceStats {
+	c := n.counter(ns.Name)
+	return NamespaceStats{
+		Name: ns.Name, MaxKeys: ns.MaxKeys, MaxBytes: ns.MaxBytes, Keys: ns.Keys, Bytes: ns.Bytes,
+		Created: ns.Created, Counted: ns.Counted,
+		Reads: c.reads.Load(), Writes: c.writes.Load(), Rejected: c.rejected.Load(),
+	}
+}
+
+func (n *Namespaces) List(ctx context.Context) ([]Namespace, error) {
+	var list []Namespace
+	err := scanPrefix(ctx, n.primary, nsSep+nsSep, func(e Entry) error {
+		// the usage shards of a namespace come right after it
+		if name, _, ok := strings.Cut(e.Key[2:], nsSep); ok {
+			var u usage
+			if err := json.Unmarshal(e.Value, &u); err != nil {
+				return err
+			}
+			if len(list) > 0 && list[len(list)-1].Name == name {
+				list[len(list)-1].add(u)
+			}
+			return nil
+		}
+		var ns Namespace
+		if err := json.Unmarshal(e.Value, &ns); err != nil {
+			return err
+		}
+		list = append(list, ns)
+		return nil
+	})
+	for i := range list {
+		list[i].clamp()
+	}
+	return list, err
+}
+
+// update changes the namespace as it is kept with fn, and returns it with
+// its usage.
+func (n *Namespaces) update(ctx context.Context, name string, fn func(ns *Namespace) error) (Namespace, error) {
+	var ns Namespace
+	_, err := n.primary.Update(ctx, metaKey(name), func(cur *Entry) (*Entry, error) {
+		if cur == nil {
+			return nil, errNoNamespace
+		}
+		ns = Namespace{}
+		if err := json.Unmarshal(cur.Value, &ns); err != nil {
+			return nil, err
+		}
+		if err := fn(&ns); err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(ns)
+		return &Entry{Value: value, ExpiredAt: NoExpiry}, err
+	})
+	if err != nil {
+		return Namespace{}, err
+	}
+	shards, err := n.usage(ctx, name)
+	for _, u := range shards {
+		ns.add(u)
+	}
+	ns.clamp()
+	return ns, err
+}
+
+func (n *Namespaces) SetQuota(ctx context.Context, name string, maxKeys, maxBytes int64) (Namespace, error) {
+	return n.update(ctx, name, func(ns *Namespace) error {
+		ns.MaxKeys, ns.MaxBytes = maxKeys, maxBytes
+		return nil
+	})
+}
+
+// RotateKey gives the namespace a new API key, the old one stops working.
+func (n *Namespaces) RotateKey(ctx context.Context, name string) (string, error) {
+	apiKey := newAPIKey()
+	_, err := n.update(ctx, name, func(ns *Namespace) error {
+		ns.KeyHash = hashKey(apiKey)
+		return nil
+	})
+	return apiKey, err
+}
+
+// Authenticate returns the namespace if apiKey is its key.
+func (n *Namespaces) Authenticate(ctx context.Context, name, apiKey string) (Namespace, error) {
+	ns, err := n.meta(ctx, name)
+	if err != nil {
+		return Namespace{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashKey(apiKey)), []byte(ns.KeyHash)) != 1 {
+		return Namespace{}, errUnauthorized
+	}
+	return ns, nil
+}
+
+// Recount counts the keys of the namespace again, dropping the ones that
+// expired. Writes while it counts can make it a little off.
+func (n *Namespaces) Recount(ctx context.Context, name string) (Namespace, error) {
+	var keys, bytes int64
+	prefix := nsPrefix(name)
+	err := scanPrefix(ctx, n.primary, prefix, func(e Entry) error {
+		keys++
+		bytes += int64(len(e.Key) - len(prefix) + len(e.Value))
+		return nil
+	})
+	if err != nil {
+		return Namespace{}, err
+	}
+	// what the shards count is added on top
+	shards, err := n.usage(ctx, name)
+	if err != nil {
+		return Namespace{}, err
+	}
+	for _, u := range shards {
+		keys, bytes = keys-u.Keys, bytes-u.Bytes
+	}
+	return n.update(ctx, name, func(ns *Namespace) error {
+		ns.Keys, ns.Bytes, ns.Counted = keys, bytes, time.Now().UTC()
+		return nil
+	})
+}
+
+// RecountAll recounts every namespace.
+func (n *Namespaces) RecountAll(ctx context.Context) error {
+	list, err := n.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ns := range list {
+		if _, err := n.Recount(ctx, ns.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Recounts recounts every namespace every so often until ctx is
+// cancelled, which fixes the usage of keys that expired.
+func (n *Namespaces) Recounts(ctx context.Context, every time.Duration) {
+	for {
+		select {
+		case <-time.After(every):
+		case <-ctx.Done():
+			return
+		}
+		if err := n.RecountAll(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Recounting namespaces failed: %v", err)
+		}
+	}
+}
+
+// reserve adds to the usage of the namespace, failing with ErrQuota if an
+// addition takes it over a quota. Reductions always succeed.
+func (n *Namespaces) reserve(ctx context.Context, name string, keys, bytes int64) error {
+	if keys == 0 && bytes == 0 {
+		return nil
+	}
+	ns, err := n.meta(ctx, name)
+	if err != nil {
+		return err
+	}
+	shards, err := n.usage(ctx, name)
+	if err != nil {
+		return err
+	}
+	key := usageKey(name, int(n.shard.Add(1)%usageShards))
+	for k, u := range shards {
+		if k != key {
+			ns.add(u)
+		}
+	}
+	_, err = n.primary.Update(ctx, key, func(cur *Entry) (*Entry, error) {
+		var u usage
+		if cur != nil {
+			if err := json.Unmarshal(cur.Value, &u); err != nil {
+				return nil, err
+			}
+		}
+		total := ns
+		total.add(u)
+		if keys > 0 && ns.MaxKeys > 0 && total.Keys+keys > ns.MaxKeys ||
+			bytes > 0 && ns.MaxBytes > 0 && total.Bytes+bytes > ns.MaxBytes {
+			return nil, ErrQuota
+		}
+		u.Keys, u.Bytes = u.Keys+keys, u.Bytes+bytes
+		value, err := json.Marshal(u)
+		return &Entry{Value: value, ExpiredAt: NoExpiry}, err
+	})
+	if errors.Is(err, ErrQuota) {
+		n.counter(name).rejected.Add(1)
+	}
+	return err
+}
+
+// release takes what a write no longer uses off the usage. The write is
+// done by then, so a failure is only logged and left for the next recount.
+func (n *Namespaces) release(ctx context.Context, name string, keys, bytes int64) {
+	if err := n.reserve(context.WithoutCancel(ctx), name, -keys, -bytes); err != nil {
+		log.Printf("Releasing the usage of namespace %s failed: %v", name, err)
+	}
+}
+
+// Stores returns the primary and replica of the namespace.
+func (n *Namespaces) Stores(name string) (primary, replica Store) {
+	return &nsStore{Store: n.primary, ns: n, name: name}, &nsStore{Store: n.replica, ns: n, name: name}
+}
+
+// nsStore is the part of a store that a namespace has.
+type nsStore struct {
+	Store
+	ns   *Namespaces
+	name string
+}
+
+// errChanged makes a write of a namespace try again when the key changed
+// after it reserved the usage.
+var errChanged = errors.New("key changed")
+
+// nsWriteAttempts is how often a write tries before giving up on a key
+// that keeps changing.
+const nsWriteAttempts = 10
+
+func (s *nsStore) key(key string) (string, error) {
+	full := nsPrefix(s.name) + key
+	if len(full) > MaxKeyLen {
+		return "", badRequest(fmt.Sprintf("keys of namespace %s must have 1 to %d bytes", s.name, MaxKeyLen-len(nsPrefix(s.name))))
+	}
+	return full, nil
+}
+
+func (s *nsStore) strip(e Entry) Entry {
+	e.Key = strings.TrimPrefix(e.Key, nsPrefix(s.name))
+	return e
+}
+
+func (s *nsStore) Get(ctx context.Context, key string) (Entry, error) {
+	s.ns.counter(s.name).reads.Add(1)
+	full, err := s.key(key)
+	if err != nil {
+		return Entry{}, err
+	}
+	e, err := s.Store.Get(ctx, full)
+	return s.strip(e), err
+}
+
+func (s *nsStore) Scan(ctx context.Context, after string, limit int) ([]Entry, error) {
+	prefix := nsPrefix(s.name)
+	entries, err := s.Store.Scan(ctx, prefix+after, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if !strings.HasPrefix(e.Key, prefix) {
+			return entries[:i], nil
+		}
+		entries[i] = s.strip(e)
+	}
+	return entries, nil
+}
+
+func size(e *Entry, key string) int64 {
+	if e == nil {
+		return 0
+	}
+	return int64(len(key) + len(e.Value))
+}
+
+// Update reads the key, runs fn, reserves what the result adds to the
+// usage and writes it if the key is still as it was read. Reductions of
+// the usage are made after the write.
+func (s *nsStore) Update(ctx context.Context, key string, fn func(cur *Entry) (*Entry, error)) (Entry, error) {
+	s.ns.counter(s.name).writes.Add(1)
+	full, err := s.key(key)
+	if err != nil {
+		return Entry{}, err
+	}
+	for range nsWriteAttempts {
+		var cur *Entry
+		e, err := s.Store.Get(ctx, full)
+		switch {
+		case err == nil:
+			e = s.strip(e)
+			cur = &e
+		case !errors.Is(err, ErrNotFound):
+			return Entry{}, err
+		}
+		var read uint64
+		if cur != nil {
+			read = cur.Version
+			copied := *cur
+			cur = &copied
+		}
+		next, err := fn(cur)
+		if err != nil {
+			return Entry{}, err
+		}
+		keys := int64(0)
+		switch {
+		case cur == nil && next != nil:
+			keys = 1
+		case cur != nil && next == nil:
+			keys = -1
+		}
+		bytes := size(next, key) - size(cur, key)
+		if err := s.ns.reserve(ctx, s.name, max(keys, 0), max(bytes, 0)); err != nil {
+			return Entry{}, err
+		}
+		written, err := s.Store.Update(ctx, full, func(now *Entry) (*Entry, error) {
+			var version uint64
+			if now != nil {
+				version = now.Version
+			}
+			if version != read {
+				return nil, errChanged
+			}
+			return next, nil
+		})
+		if err != nil {
+			// give back what was reserved
+			s.ns.release(ctx, s.name, max(keys, 0), max(bytes, 0))
+			if errors.Is(err, errChanged) {
+				continue
+			}
+			return Entry{}, err
+		}
+		s.ns.release(ctx, s.name, -min(keys, 0), -min(bytes, 0))
+		return s.strip(written), nil
+	}
+	return Entry{}, fmt.Errorf("%s kept changing", key)
+}
+
+func (s *nsStore) Put(ctx context.Context, key string, value []byte, expiredAt int64, cond Condition) (uint64, bool, error) {
+	var created bool
+	e, err := s.Update(ctx, key, func(cur *Entry) (*Entry, error) {
+		if err := cond.check(cur); err != nil {
+			return nil, err
+		}
+		created = cur == nil
+		return &Entry{Value: value, ExpiredAt: expiredAt}, nil
+	})
+	return e.Version, created, err
+}
+
+func (s *nsStore) Delete(ctx context.Context, key string, cond Condition) error {
+	_, err := s.Update(ctx, key, func(cur *Entry) (*Entry, error) {
+		if cur == nil {
+			return nil, ErrNotFound
+		}
+		return nil, cond.check(cur)
+	})
+	return err
+}
+
+// Close leaves the store open, it isn't the namespace's.
+func (s *nsStore) Close() error {
+	return nil
+}
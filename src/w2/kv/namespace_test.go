@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newNamespacesAPI(t *testing.T) (http.Handler, *Namespaces) {
+	t.Helper()
+	s := openBitcask(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	a := &API{primary: s, replica: s, changes: s.(ChangeLog), namespaces: NewNamespaces(s, s), adminKey: "admin"}
+	a.Register(r)
+	return r, a.namespaces
+}
+
+// doAs is do with headers, given as name, value pairs.
+func doAs(h http.Handler, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func createNamespace(t *testing.T, h http.Handler, body string) string {
+	t.Helper()
+	w := doAs(h, "POST", "/namespaces", body, "Authorization", "Bearer admin")
+	var resp struct {
+		APIKey string `json:"api_key"`
+	}
+	if w.Code != 201 || json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+		t.Fatalf("expected the namespace to be created but got %d %s", w.Code, w.Body)
+	}
+	return resp.APIKey
+}
+
+func TestNamespaces(t *testing.T) {
+	h, _ := newNamespacesAPI(t)
+	if w := doAs(h, "POST", "/namespaces", `{"name": "acme"}`); w.Code != 403 {
+		t.Errorf("expected 403 without the admin key but got %d", w.Code)
+	}
+	acme := createNamespace(t, h, `{"name": "acme", "max_keys": 2, "max_bytes": 20}`)
+	other := createNamespace(t, h, `{"name": "other"}`)
+	if w := doAs(h, "POST", "/namespaces", `{"name": "acme"}`, "X-API-Key", "admin"); w.Code != 409 {
+		t.Errorf("expected 409 for a namespace that exists but got %d", w.Code)
+	}
+	if w := doAs(h, "POST", "/namespaces", `{"name": "Not Valid"}`, "X-API-Key", "admin"); w.Code != 400 {
+		t.Errorf("expected 400 for a bad name but got %d", w.Code)
+	}
+
+	steps := []struct {
+		method, path, body string
+		headers            []string
+		code               int
+		resp               string
+	}{
+		{"PUT", "/ns/acme/keys/a", "1", nil, 401, ""},
+		{"PUT", "/ns/acme/keys/a", "1", []string{"X-API-Key", other}, 401, ""},
+		{"PUT", "/ns/missing/keys/a", "1", []string{"X-API-Key", acme}, 404, ""},
+		{"PUT", "/ns/acme/keys/a", "acme", []string{"Authorization", "Bearer " + acme}, 201, ""},
+		{"PUT", "/keys/a", "other", []string{"X-Namespace", "other", "X-API-Key", other}, 201, ""},
+		{"PUT", "/keys/a", "none", nil, 201, ""},
+		{"GET", "/keys/a", "", []string{"X-Namespace", "acme", "X-API-Key", acme}, 200, "acme"},
+		{"GET", "/ns/other/keys/a", "", []string{"X-API-Key", other}, 200, "other"},
+		{"GET", "/ns/other/keys/a", "", []string{"X-API-Key", "admin"}, 200, "other"},
+		{"GET", "/keys/a", "", nil, 200, "none"},
+		{"GET", "/keys/%1Eacme%1Ea", "", nil, 400, ""},
+
+		// 2 keys and 20 bytes of keys and values
+		{"POST", "/ns/acme/keys/n/incr", "", []string{"X-API-Key", acme}, 200, `{"value":1}`},
+		{"PUT", "/ns/acme/keys/b", "1", []string{"X-API-Key", acme}, 507, ""},
+		{"PUT", "/ns/acme/keys/a", strings.Repeat("x", 18), []string{"X-API-Key", acme}, 507, ""},
+		{"PUT", "/ns/acme/keys/a", strings.Repeat("x", 17), []string{"X-API-Key", acme}, 200, ""},
+		{"DELETE", "/ns/acme/keys/n", "", []string{"X-API-Key", acme}, 204, ""},
+		{"PUT", "/ns/acme/keys/a", "1", []string{"X-API-Key", acme}, 200, ""},
+		{"PUT", "/ns/acme/keys/b", "1", []string{"X-API-Key", acme}, 201, ""},
+	}
+	for _, s := range steps {
+		w := doAs(h, s.method, s.path, s.body, s.headers...)
+		if w.Code != s.code {
+			t.Errorf("%s %s: expected %d but got %d %s", s.method, s.path, s.code, w.Code, w.Body)
+		}
+		if s.resp != "" && strings.TrimSpace(w.Body.String()) != s.resp {
+			t.Errorf("%s %s: expected %q but got %q", s.method, s.path, s.resp, w.Body)
+		}
+	}
+
+	var stats NamespaceStats
+	w := doAs(h, "GET", "/namespaces/acme", "", "X-API-Key", acme)
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || stats.Keys != 2 || stats.Bytes != 4 || stats.Rejected != 2 {
+		t.Errorf("expected 2 keys of 4 bytes and 2 writes rejected but got %s", w.Body)
+	}
+	if w := doAs(h, "GET", "/namespaces/acme", "", "X-API-Key", other); w.Code != 401 {
+		t.Errorf("expected the usage of a namespace to need its key but got %d", w.Code)
+	}
+	if w := doAs(h, "GET", "/namespaces", "", "X-API-Key", acme); w.Code != 403 {
+		t.Errorf("expected listing namespaces to need the admin key but got %d", w.Code)
+	}
+	var list []NamespaceStats
+	w = doAs(h, "GET", "/namespaces", "", "X-API-Key", "admin")
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 2 || list[0].Name != "acme" || list[1].Keys != 1 {
+		t.Errorf("expected both namespaces but got %s", w.Body)
+	}
+
+	w = doAs(h, "POST", "/namespaces/acme/key", "", "X-API-Key", acme)
+	var rotated struct {
+		APIKey string `json:"api_key"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rotated); err != nil || rotated.APIKey == acme {
+		t.Fatalf("expected a new key but got %d %s", w.Code, w.Body)
+	}
+	if w := doAs(h, "GET", "/ns/acme/keys/a", "", "X-API-Key", acme); w.Code != 401 {
+		t.Errorf("expected the old key to stop working but got %d", w.Code)
+	}
+	if w := doAs(h, "GET", "/ns/acme/keys/a", "", "X-API-Key", rotated.APIKey); w.Code != 200 {
+		t.Errorf("expected the new key to work but got %d", w.Code)
+	}
+}
+
+func TestNamespaceRecount(t *testing.T) {
+	ctx := context.Background()
+	h, namespaces := newNamespacesAPI(t)
+	key := createNamespace(t, h, `{"name": "acme", "max_keys": 3}`)
+	primary, _ := namespaces.Stores("acme")
+	now := time.Now().Unix()
+	for _, k := range []string{"a", "b", "c"} {
+		if _, _, err := primary.Put(ctx, k, []byte("v"), now+1, Condition{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w := doAs(h, "PUT", "/ns/acme/keys/d", "v", "X-API-Key", key); w.Code != 507 {
+		t.Errorf("expected 507 over the quota but got %d", w.Code)
+	}
+
+	// expired keys count until the namespace is recounted
+	time.Sleep(time.Until(time.Unix(now+2, 0)))
+	if w := doAs(h, "POST", "/namespaces/acme/recount", "", "X-API-Key", key); w.Code != 403 {
+		t.Errorf("expected recounts to need the admin key but got %d", w.Code)
+	}
+	var stats NamespaceStats
+	w := doAs(h, "POST", "/namespaces/acme/recount", "", "X-API-Key", "admin")
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || stats.Keys != 0 || stats.Counted.IsZero() {
+		t.Errorf("expected no keys after the recount but got %s", w.Body)
+	}
+	if w := doAs(h, "PUT", "/ns/acme/keys/d", "v", "X-API-Key", key); w.Code != 201 {
+		t.Errorf("expected the key to fit after the recount but got %d", w.Code)
+	}
+}
+
+func TestNamespaceUsageShards(t *testing.T) {
+	ctx := context.Background()
+	h, namespaces := newNamespacesAPI(t)
+	createNamespace(t, h, `{"name": "acme", "max_keys": 20}`)
+	createNamespace(t, h, `{"name": "other"}`)
+	primary, _ := namespaces.Stores("acme")
+
+	var wg sync.WaitGroup
+	for i := range 30 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			primary.Put(ctx, fmt.Sprintf("k%d", i), []byte("v"), NoExpiry, Condition{})
+		}()
+	}
+	wg.Wait()
+	primary.Delete(ctx, "k0", Condition{})
+	primary.Delete(ctx, "k1", Condition{})
+
+	// racing writes on different shards may go a little over the quota
+	ns, err := namespaces.Get(ctx, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards, _ := namespaces.usage(ctx, "acme")
+	if ns.Keys < 18 || ns.Keys > 18+usageShards || len(shards) < 2 {
+		t.Errorf("expected about 18 keys counted over several shards but got %d over %d", ns.Keys, len(shards))
+	}
+	recounted, err := namespaces.Recount(ctx, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.Keys != recounted.Keys {
+		t.Errorf("expected the recount to find the %d keys counted but got %d", ns.Keys, recounted.Keys)
+	}
+	list, err := namespaces.List(ctx)
+	if err != nil || len(list) != 2 || list[0].Name != "acme" || list[0].Keys != ns.Keys || list[1].Name != "other" || list[1].Keys != 0 {
+		t.Errorf("expected the list to count the shards but got %+v %v", list, err)
+	}
+}
+
+// TestNamespaceKeysSQL needs the MySQL primary from kv.sql on port 3306.
+func TestNamespaceKeysSQL(t *testing.T) {
+	s := NewSQLStore("3306")
+	defer s.Close()
+	db := s.(*sqlStore).db
+	if err := db.Ping(); err != nil {
+		t.Skipf("MySQL not available: %v", err)
+	}
+	ctx := context.Background()
+	defer db.ExecContext(ctx, "DELETE FROM kv.store WHERE k LIKE '%nskeys-test%'")
+
+	namespaces := NewNamespaces(s, s)
+	for _, name := range []string{"nskeys-test-ab", "nskeys-test-abc"} {
+		if _, err := namespaces.Create(ctx, name, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a plain key must not overwrite the namespace it looks like
+	if _, _, err := s.Put(ctx, "nskeys-test-ab", []byte("plain"), NoExpiry, Condition{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := namespaces.Get(ctx, "nskeys-test-ab"); err != nil {
+		t.Errorf("expected the namespace to survive a plain key of its name but got %v", err)
+	}
+
+	// \x1enskeys-test-ab\x1ecfoo and \x1enskeys-test-abc\x1efoo only differ
+	// in where the separator is
+	ab, _ := namespaces.Stores("nskeys-test-ab")
+	abc, _ := namespaces.Stores("nskeys-test-abc")
+	if _, _, err := ab.Put(ctx, "cfoo", []byte("ab"), NoExpiry, Condition{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := abc.Put(ctx, "foo", []byte("abc"), NoExpiry, Condition{}); err != nil {
+		t.Fatal(err)
+	}
+	e, err := ab.Get(ctx, "cfoo")
+	if err != nil || string(e.Value) != "ab" {
+		t.Errorf("expected cfoo of nskeys-test-ab to be ab but got %q %v", e.Value, err)
+	}
+	e, err = abc.Get(ctx, "foo")
+	if err != nil || string(e.Value) != "abc" {
+		t.Errorf("expected foo of nskeys-test-abc to be abc but got %q %v", e.Value, err)
+	}
+}
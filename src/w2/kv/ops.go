@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// The read-modify-write commands, each a single Store.Update so they are
+// atomic across kv servers sharing a database.
+
+// ErrNotInteger is returned by Incr for values that aren't a decimal int64,
+// or would overflow.
+var ErrNotInteger = errors.New("value is not an integer or out of range")
+
+// Incr adds delta to the integer value of key and returns the result. A
+// missing key counts as 0, its ttl is kept otherwise.
+func Incr(ctx context.Context, s Store, key string, delta int64) (int64, error) {
+	var n int64
+	_, err := s.Update(ctx, key, func(cur *Entry) (*Entry, error) {
+		next := Entry{ExpiredAt: NoExpiry}
+		n = 0
+		if cur != nil {
+			next.ExpiredAt = cur.ExpiredAt
+			var err error
+			if n, err = strconv.ParseInt(string(cur.Value), 10, 64); err != nil {
+				return nil, ErrNotInteger
+			}
+		}
+		if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+			return nil, ErrNotInteger
+		}
+		n += delta
+		next.Value = strconv.AppendInt(nil, n, 10)
+		return &next, nil
+	})
+	return n, err
+}
+
+// Expire changes when key expires, NoExpiry makes it persistent. It
+// returns ErrNotFound if the key doesn't exist.
+func Expire(ctx context.Context, s Store, key string, expiredAt int64) error {
+	_, err := s.Update(ctx, key, func(cur *Entry) (*Entry, error) {
+		if cur == nil {
+			return nil, ErrNotFound
+		}
+		return &Entry{Value: cur.Value, ExpiredAt: expiredAt}, nil
+	})
+	return err
+}
+
+// GetSet writes key and returns the entry it replaced, found is false if
+// there was none.
+func GetSet(ctx context.Context, s Store, key string, value []byte, expiredAt int64) (old Entry, found bool, err error) {
+	_, err = s.Update(ctx, key, func(cur *Entry) (*Entry, error) {
+		old, found = Entry{}, cur != nil
+		if found {
+			old = *cur
+		}
+		return &Entry{Value: value, ExpiredAt: expiredAt}, nil
+	})
+	return old, found, err
+}
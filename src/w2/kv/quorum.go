@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kv/ring"
+)
+
+// ErrQuorum is returned when fewer replicas than the quorum answered.
+var ErrQuorum = errors.New("not enough replicas answered")
+
+// Quorum is how many replicas keep each key, N, and how many of them have
+// to answer a read, R, or acknowledge a write, W. With R+W > N every read
+// sees the latest acknowledged write.
+type Quorum struct {
+	N, R, W int
+}
+
+func (q Quorum) String() string {
+	return fmt.Sprintf("N=%d R=%d W=%d", q.N, q.R, q.W)
+}
+
+type quorumKey struct{}
+
+// WithQuorum makes the operations of a quorumStore under ctx use q.
+func WithQuorum(ctx context.Context, q Quorum) context.Context {
+	return context.WithValue(ctx, quorumKey{}, q)
+}
+
+const (
+	// hintEvery is the pause between attempts to deliver hinted writes.
+	hintEvery = time.Second
+	// maxHints is how many writes are kept for a replica that is down, the
+	// ones beyond are dropped.
+	maxHints = 100000
+	// replicaTimeout bounds the writes and repairs that go on after the
+	// request returned.
+	replicaTimeout = 5 * time.Second
+)
+
+// quorumStore is the leaderless mode: every key is kept by the first N
+// nodes the ring walks to from its hash, any node can coordinate any
+// operation. Writes go to all N and return once W acknowledged, reads ask
+// all N, return the newest record once R answered and write it back to the
+// replicas that answered with an older one, read repair.
+//
+// Versions are assigned by the coordinators, from their clocks, and the
+// highest wins. Conditional writes and Update read the quorum first, they
+// aren't atomic like on the other stores: of two concurrent writes from
+// different coordinators the later version wins.
+//
+// Writes a replica missed because it was down are kept as hints by the
+// coordinator and delivered once it is back. Hints are kept in memory.
+type quorumStore struct {
+	nodes map[string]Replica
+	ring  *ring.Ring
+	def   Quorum
+	clock clock
+	hints hints
+
+	repaired  atomic.Int64
+	inflight  sync.WaitGroup // writes and repairs that outlive their request
+	stop      context.CancelFunc
+	delivered chan struct{}
+}
+
+// QuorumStats is what /debug/quorum shows.
+type QuorumStats struct {
+	Quorum    Quorum         `json:"quorum"`
+	Nodes     []string       `json:"nodes"`
+	Hints     map[string]int `json:"hints"`
+	Delivered int64          `json:"delivered"`
+	Dropped   int64          `json:"dropped"`
+	Repaired  int64          `json:"repaired"`
+}
+
+// NewQuorumStore coordinates the nodes as self, which orders the versions
+// of writes coordinated in the same microsecond.
+func NewQuorumStore(self string, nodes map[string]Replica, vnodes int, def Quorum) *quorumStore {
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	s := &quorumStore{
+		nodes:     nodes,
+		ring:      ring.New(vnodes, names...),
+		def:       def,
+		clock:     clock{id: ring.Hash(self) & clockIDMask},
+		hints:     hints{pending: make(map[string]map[string]Record)},
+		stop:      stop,
+		delivered: make(chan struct{}),
+	}
+	go s.deliverHints(ctx)
+	return s
+}
+
+func (s *quorumStore) quorum(ctx context.Context) (Quorum, error) {
+	q, ok := ctx.Value(quorumKey{}).(Quorum)
+	if !ok {
+		q = s.def
+	}
+	if q.R < 1 || q.W < 1 || q.R > q.N || q.W > q.N || q.N > len(s.nodes) {
+		return q, badRequest(fmt.Sprintf("%v is not a quorum of %d nodes, R and W have to be from 1 to N", q, len(s.nodes)))
+	}
+	return q, nil
+}
+
+type reply struct {
+	node string
+	r    Record
+	err  error
+}
+
+// read returns the newest record of key, with version 0 if no replica has
+// one.
+func (s *quorumStore) read(ctx context.Context, key string) (Record, error) {
+	q, err := s.quorum(ctx)
+	if err != nil {
+		return Record{}, err
+	}
+	owners := s.ring.Lookup(key, q.N)
+	replies := make(chan reply, len(owners))
+	for _, node := range owners {
+		go func() {
+			r, err := s.nodes[node].Read(ctx, key)
+			if errors.Is(err, ErrNotFound) {
+				r, err = Record{Key: key}, nil
+			}
+			replies <- reply{node, r, err}
+		}()
+	}
+	var answered []reply
+	var errs []error
+	for len(answered) < q.R && len(errs) <= len(owners)-q.R {
+		select {
+		case rep := <-replies:
+			if rep.err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", rep.node, rep.err))
+			} else {
+				answered = append(answered, rep)
+			}
+		case <-ctx.Done():
+			return Record{}, ctx.Err()
+		}
+	}
+	if len(answered) < q.R {
+		return Record{}, fmt.Errorf("%w: %d of %v answered: %w", ErrQuorum, len(answered), q, errors.Join(errs...))
+	}
+	newest := answered[0].r
+	for _, rep := range answered[1:] {
+		if rep.r.Version > newest.Version {
+			newest = rep.r
+		}
+	}
+	s.clock.observe(newest.Version)
+
+	// the replicas that are still to answer are repaired too
+	pending := len(owners) - len(answered) - len(errs)
+	s.inflight.Add(1)
+	go func() {
+		defer s.inflight.Done()
+		for range pending {
+			if rep := <-replies; rep.err == nil {
+				answered = append(answered, rep)
+			}
+		}
+		s.repair(newest, answered)
+	}()
+	return newest, nil
+}
+
+// repair writes newest to the replicas that answered with an older record.
+func (s *quorumStore) repair(newest Record, answered []reply) {
+	ctx, cancel := context.WithTimeout(context.Background(), replicaTimeout)
+	defer cancel()
+	for _, rep := range answered {
+		if rep.r.Version >= newest.Version {
+			continue
+		}
+		if _, err := s.nodes[rep.node].Write(ctx, newest); err != nil {
+			s.hints.add(rep.node, newest)
+			continue
+		}
+		s.repaired.Add(1)
+	}
+}
+
+// write sends r to the N replicas of its key and returns once W
+// acknowledged it. The replicas that fail get a hint.
+func (s *quorumStore) write(ctx context.Context, r Record) error {
+	q, err := s.quorum(ctx)
+	if err != nil {
+		return err
+	}
+	owners := s.ring.Lookup(r.Key, q.N)
+	replies := make(chan reply, len(owners))
+	// the writes go on when the request returns after W of them
+	wctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), replicaTimeout)
+	var wg sync.WaitGroup
+	for _, node := range owners {
+		wg.Add(1)
+		s.inflight.Add(1)
+		go func() {
+			defer s.inflight.Done()
+			defer wg.Done()
+			_, err := s.nodes[node].Write(wctx, r)
+			if err != nil {
+				s.hints.add(node, r)
+			}
+			replies <- reply{node: node, err: err}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+	}()
+	acked := 0
+	var errs []error
+	for acked < q.W && len(errs) <= len(owners)-q.W {
+		select {
+		case rep := <-replies:
+			if rep.err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", rep.node, rep.err))
+			} else {
+				acked++
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if acked < q.W {
+		return fmt.Errorf("%w: %d of %v acknowledged: %w", ErrQuorum, acked, q, errors.Join(errs...))
+	}
+	return nil
+}
+
+func (s *quorumStore) Get(ctx context.Context, key string) (Entry, error) {
+	r, err := s.read(ctx, key)
+	if err != nil {
+		return Entry{}, err
+	}
+	if !r.live(time.Now().Unix()) {
+		return Entry{}, ErrNotFound
+	}
+	return Entry{Key: key, Value: r.Value, ExpiredAt: r.ExpiredAt, Version: r.Version}, nil
+}
+
+// Update reads the quorum, runs fn on what it read and writes the result
+// with a newer version.
+func (s *quorumStore) Update(ctx context.Context, key string, fn func(cur *Entry) (*Entry, error)) (Entry, error) {
+	r, err := s.read(ctx, key)
+	if err != nil {
+		return Entry{}, err
+	}
+	var cur *Entry
+	if r.live(time.Now().Unix()) {
+		cur = &Entry{Key: key, Value: r.Value, ExpiredAt: r.ExpiredAt, Version: r.Version}
+	}
+	next, err := fn(cur)
+	if err != nil {
+		return Entry{}, err
+	}
+	if next == nil && cur == nil {
+		return Entry{}, nil
+	}
+	w := Record{Key: key, Version: s.clock.next(r.Version), ExpiredAt: NoExpiry, Deleted: true}
+	if next != nil {
+		w = Record{Key: key, Value: next.Value, ExpiredAt: next.ExpiredAt, Version: w.Version}
+	}
+	if err := s.write(ctx, w); err != nil {
+		return Entry{}, err
+	}
+	if w.Deleted {
+		return Entry{}, nil
+	}
+	return Entry{Key: key, Value: w.Value, ExpiredAt: w.ExpiredAt, Version: w.Version}, nil
+}
+
+func (s *quorumStore) Put(ctx context.Context, key string, value []byte, expiredAt int64, cond Condition) (uint64, bool, error) {
+	var created bool
+	e, err := s.Update(ctx, key, func(cur *Entry) (*Entry, error) {
+		if err := cond.check(cur); err != nil {
+			return nil, err
+		}
+		created = cur == nil
+		return &Entry{Value: value, ExpiredAt: expiredAt}, nil
+	})
+	return e.Version, created, err
+}
+
+func (s *quorumStore) Delete(ctx context.Context, key string, cond Condition) error {
+	_, err := s.Update(ctx, key, func(cur *Entry) (*Entry, error) {
+		if cur == nil {
+			return nil, ErrNotFound
+		}
+		return nil, cond.check(cur)
+	})
+	return err
+}
+
+// Scan merges the pages of all nodes that answer, keeping the newest
+// record of each key. A page only covers the keys up to the last one of
+// the nodes that filled theirs, those after it may be on the next page of
+// a node.
+func (s *quorumStore) Scan(ctx context.Context, after string, limit int) ([]Entry, error) {
+	now := time.Now().Unix()
+	var entries []Entry
+	for len(entries) < limit {
+		newest := make(map[string]Record)
+		var bound string
+		more, answered := false, 0
+		var errs []error
+		for name, node := range s.nodes {
+			records, err := node.Scan(ctx, after, limit)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			answered++
+			for _, r := range records {
+				if r.Version > newest[r.Key].Version {
+					newest[r.Key] = r
+				}
+			}
+			if len(records) == limit {
+				if last := records[len(records)-1].Key; !more || last < bound {
+					bound = last
+				}
+				more = true
+			}
+		}
+		if answered == 0 {
+			return nil, fmt.Errorf("%w: %w", ErrQuorum, errors.Join(errs...))
+		}
+		keys := make([]string, 0, len(newest))
+		for key, r := range newest {
+			if (!more || key <= bound) && r.live(now) {
+				keys = append(keys, key)
+			}
+		}
+		slices.Sort(keys)
+		for _, key := range keys[:min(len(keys), limit-len(entries))] {
+			r := newest[key]
+			entries = append(entries, Entry{Key: key, Value: r.Value, ExpiredAt: r.ExpiredAt, Version: r.Version})
+		}
+		if !more {
+			break
+		}
+		after = bound
+	}
+	return entries, nil
+}
+
+func (s *quorumStore) Close() error {
+	s.stop()
+	<-s.delivered
+	s.inflight.Wait()
+	var errs []error
+	for _, node := range s.nodes {
+		if c, ok := node.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *quorumStore) Stats() QuorumStats {
+	stats := QuorumStats{Quorum: s.def, Nodes: s.ring.Nodes(), Repaired: s.repaired.Load()}
+	stats.Hints, stats.Delivered, stats.Dropped = s.hints.stats()
+	return stats
+}
+
+func (s *quorumStore) deliverHints(ctx context.Context) {
+	defer close(s.delivered)
+	t := time.NewTicker(hintEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.handoff(ctx)
+		}
+	}
+}
+
+// handoff tries to deliver the hints of every node, stopping at the first
+// write a node fails.
+func (s *quorumStore) handoff(ctx context.Context) {
+	for _, node := range s.hints.nodes() {
+		for _, r := range s.hints.of(node) {
+			if _, err := s.nodes[node].Write(ctx, r); err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Hints for %s not delivered: %v", node, err)
+				}
+				break
+			}
+			s.hints.delivered(node, r)
+		}
+	}
+}
+
+// hints are the writes nodes missed, at most one per key, the newest.
+type hints struct {
+	mu      sync.Mutex
+	pending map[string]map[string]Record // by node and key
+	sent    int64
+	dropped int64
+}
+
+func (h *hints) add(node string, r Record) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := h.pending[node]
+	if keys == nil {
+		keys = make(map[string]Record)
+		h.pending[node] = keys
+	}
+	old, ok := keys[r.Key]
+	switch {
+	case ok && old.Version >= r.Version:
+	case !ok && len(keys) >= maxHints:
+		h.dropped++
+	default:
+		keys[r.Key] = r
+	}
+}
+
+func (h *hints) nodes() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var nodes []string
+	for node, keys := range h.pending {
+		if len(keys) > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func (h *hints) of(node string) []Record {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records := make([]Record, 0, len(h.pending[node]))
+	for _, r := range h.pending[node] {
+		records = append(records, r)
+	}
+	slices.SortFunc(records, func(a, b Record) int { return strings.Compare(a.Key, b.Key) })
+	return records
+}
+
+// delivered drops the hint of r, unless a newer one was added meanwhile.
+func (h *hints) delivered(node string, r Record) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if cur, ok := h.pending[node][r.Key]; ok && cur.Version == r.Version {
+		delete(h.pending[node], r.Key)
+		h.sent++
+	}
+}
+
+func (h *hints) stats() (map[string]int, int64, int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := make(map[string]int, len(h.pending))
+	for node, keys := range h.pending {
+		counts[node] = len(keys)
+	}
+	return counts, h.sent, h.dropped
+}
+
+// clockIDMask is the low bits of a version that hold the id of the
+// coordinator, the rest is microseconds since the epoch.
+const clockIDMask = 1<<10 - 1
+
+// clock hands out versions that grow with the time, and beyond every
+// version the coordinator saw, so a write always wins over what it read
+// even if the clocks of the nodes disagree.
+type clock struct {
+	mu   sync.Mutex
+	id   uint64
+	last uint64
+}
+
+func (c *clock) next(seen uint64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := uint64(time.Now().UnixMicro())<<10 | c.id
+	if floor := (max(c.last, seen)>>10+1)<<10 | c.id; v < floor {
+		v = floor
+	}
+	c.last = v
+	return v
+}
+
+func (c *clock) observe(v uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = max(c.last, v)
+}
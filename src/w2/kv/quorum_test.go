@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errDown = errors.New("node is down")
+
+// flakyReplica fails every operation while it is down.
+type flakyReplica struct {
+	Replica
+	down atomic.Bool
+}
+
+func (f *flakyReplica) Read(ctx context.Context, key string) (Record, error) {
+	if f.down.Load() {
+		return Record{}, errDown
+	}
+	return f.Replica.Read(ctx, key)
+}
+
+func (f *flakyReplica) Write(ctx context.Context, r Record) (bool, error) {
+	if f.down.Load() {
+		return false, errDown
+	}
+	return f.Replica.Write(ctx, r)
+}
+
+func (f *flakyReplica) Scan(ctx context.Context, after string, limit int) ([]Record, error) {
+	if f.down.Load() {
+		return nil, errDown
+	}
+	return f.Replica.Scan(ctx, after, limit)
+}
+
+func (f *flakyReplica) Close() error {
+	return f.Replica.(*localReplica).Close()
+}
+
+func openNodes(t *testing.T, names ...string) (map[string]Replica, map[string]*flakyReplica) {
+	t.Helper()
+	nodes, flaky := make(map[string]Replica), make(map[string]*flakyReplica)
+	for name, s := range openShards(t, names...) {
+		flaky[name] = &flakyReplica{Replica: &localReplica{store: s}}
+		nodes[name] = flaky[name]
+	}
+	return nodes, flaky
+}
+
+// stored returns the record node keeps of key.
+func stored(t *testing.T, node Replica, key string) Record {
+	t.Helper()
+	r, err := node.(*flakyReplica).Replica.Read(context.Background(), key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestQuorumWrites(t *testing.T) {
+	nodes, flaky := openNodes(t, "a", "b", "c", "d", "e")
+	s := NewQuorumStore("a", nodes, 32, Quorum{N: 3, R: 2, W: 2})
+	defer s.Close()
+	ctx := context.Background()
+
+	version, created, err := s.Put(ctx, "k", []byte("1"), NoExpiry, Condition{})
+	if err != nil || !created {
+		t.Fatalf("expected k to be created, got %v", err)
+	}
+	s.inflight.Wait()
+	owners := s.ring.Lookup("k", 3)
+	for name := range nodes {
+		r := stored(t, nodes[name], "k")
+		if owns := slices.Contains(owners, name); owns != (r.Version == version) {
+			t.Errorf("expected k on its owners %v only, %s has version %d", owners, name, r.Version)
+		}
+	}
+
+	// one owner down still makes a quorum, the write it missed is hinted
+	flaky[owners[2]].down.Store(true)
+	if _, _, err := s.Put(ctx, "k", []byte("2"), NoExpiry, Condition{}); err != nil {
+		t.Fatalf("expected a write with one owner down to succeed but got %v", err)
+	}
+	s.inflight.Wait()
+	if e, err := s.Get(ctx, "k"); err != nil || string(e.Value) != "2" {
+		t.Errorf("expected 2 but got %q %v", e.Value, err)
+	}
+
+	// two owners down don't, unless the request needs fewer acknowledgements
+	flaky[owners[1]].down.Store(true)
+	if _, _, err := s.Put(ctx, "k", []byte("3"), NoExpiry, Condition{}); !errors.Is(err, ErrQuorum) {
+		t.Errorf("expected ErrQuorum with two owners down but got %v", err)
+	}
+	one := WithQuorum(ctx, Quorum{N: 3, R: 1, W: 1})
+	if _, _, err := s.Put(one, "k", []byte("4"), NoExpiry, Condition{}); err != nil {
+		t.Fatalf("expected a write with W=1 to succeed but got %v", err)
+	}
+	s.inflight.Wait()
+	if hints := s.Stats().Hints; hints[owners[1]] != 1 || hints[owners[2]] != 1 {
+		t.Errorf("expected a hint of k for each node that was down but got %v", hints)
+	}
+
+	// the hints are delivered once the nodes are back
+	flaky[owners[1]].down.Store(false)
+	flaky[owners[2]].down.Store(false)
+	s.handoff(ctx)
+	for _, name := range owners {
+		if r := stored(t, nodes[name], "k"); string(r.Value) != "4" {
+			t.Errorf("expected %s to have 4 but it has %q", name, r.Value)
+		}
+	}
+	if stats := s.Stats(); stats.Hints[owners[1]] != 0 || stats.Delivered != 2 {
+		t.Errorf("expected the hints to be delivered but got %+v", stats)
+	}
+
+	for _, q := range []Quorum{{3, 4, 1}, {3, 0, 1}, {6, 1, 1}} {
+		if _, err := s.Get(WithQuorum(ctx, q), "k"); err == nil || !strings.Contains(err.Error(), "not a quorum") {
+			t.Errorf("expected %v to be refused but got %v", q, err)
+		}
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	nodes, flaky := openNodes(t, "a", "b", "c")
+	s := NewQuorumStore("a", nodes, 32, Quorum{N: 3, R: 2, W: 2})
+	defer s.Close()
+	ctx := context.Background()
+	all := WithQuorum(ctx, Quorum{N: 3, R: 3, W: 2})
+
+	s.Put(ctx, "k", []byte("old"), NoExpiry, Condition{})
+	s.Put(ctx, "gone", []byte("old"), NoExpiry, Condition{})
+	s.inflight.Wait()
+	flaky["c"].down.Store(true)
+	s.Put(ctx, "k", []byte("new"), NoExpiry, Condition{})
+	s.Delete(ctx, "gone", Condition{})
+	s.inflight.Wait()
+	// c missed both writes and won't get their hints
+	s.hints.mu.Lock()
+	clear(s.hints.pending)
+	s.hints.mu.Unlock()
+	flaky["c"].down.Store(false)
+
+	if e, err := s.Get(all, "k"); err != nil || string(e.Value) != "new" {
+		t.Errorf("expected the newest value but got %q %v", e.Value, err)
+	}
+	// the tombstone wins over the value c still has
+	if _, err := s.Get(all, "gone"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the deleted key not to be found but got %v", err)
+	}
+	s.inflight.Wait()
+	if r := stored(t, nodes["c"], "k"); string(r.Value) != "new" {
+		t.Errorf("expected c to be repaired but it has %q", r.Value)
+	}
+	if r := stored(t, nodes["c"], "gone"); !r.Deleted {
+		t.Errorf("expected c to get the tombstone but it has %+v", r)
+	}
+	if repaired := s.Stats().Repaired; repaired != 2 {
+		t.Errorf("expected 2 repairs but got %d", repaired)
+	}
+
+	entries, err := s.Scan(ctx, "", 10)
+	if err != nil || len(entries) != 1 || entries[0].Key != "k" {
+		t.Errorf("expected the scan to skip the tombstone but got %v %v", entries, err)
+	}
+}
+
+func TestQuorumCoordinators(t *testing.T) {
+	nodes, _ := openNodes(t, "a", "b", "c")
+	a := NewQuorumStore("a", nodes, 32, Quorum{N: 3, R: 2, W: 2})
+	b := NewQuorumStore("b", nodes, 32, Quorum{N: 3, R: 2, W: 2})
+	defer a.Close()
+	defer b.Close()
+	ctx := context.Background()
+
+	// every coordinator writes over what it read
+	for i := range 10 {
+		s := []*quorumStore{a, b}[i%2]
+		if n, err := Incr(ctx, s, "n", 1); err != nil || n != int64(i+1) {
+			t.Fatalf("expected %d but got %d %v", i+1, n, err)
+		}
+	}
+	version, _, err := a.Put(ctx, "k", []byte("v"), NoExpiry, Condition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Put(ctx, "k", []byte("w"), NoExpiry, Condition{IfVersion: version + 1}); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected a conflict but got %v", err)
+	}
+	if _, _, err := b.Put(ctx, "k", []byte("w"), NoExpiry, Condition{IfVersion: version}); err != nil {
+		t.Errorf("expected the write at the version to succeed but got %v", err)
+	}
+}
+
+// TestQuorumOverHTTP runs three servers, a coordinates and reaches b and c
+// through their /internal endpoints.
+func TestQuorumOverHTTP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	stores := openShards(t, "a", "b", "c")
+	servers := make(map[string]*httptest.Server)
+	for _, name := range []string{"b", "c"} {
+		h := gin.New()
+		local := &localReplica{store: stores[name]}
+		// b and c only serve their records
+		s := NewQuorumStore(name, map[string]Replica{name: local}, 8, Quorum{1, 1, 1})
+		defer s.Close()
+		(&API{quorum: s, local: local}).Register(h)
+		servers[name] = httptest.NewServer(h)
+		defer servers[name].Close()
+	}
+	nodes := map[string]Replica{
+		"a": &localReplica{store: stores["a"]},
+		"b": newHTTPReplica(servers["b"].URL),
+		"c": newHTTPReplica(servers["c"].URL),
+	}
+	s := NewQuorumStore("a", nodes, 32, Quorum{N: 3, R: 2, W: 3})
+	defer s.Close()
+	h := gin.New()
+	(&API{primary: s, replica: s, quorum: s, local: nodes["a"].(*localReplica)}).Register(h)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		h.ServeHTTP(w, req)
+		return w
+	}
+	if w := do("PUT", "/keys/k", "v"); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 but got %d %s", w.Code, w.Body)
+	}
+	for name, node := range nodes {
+		if r, err := node.Read(context.Background(), "k"); err != nil || string(r.Value) != "v" {
+			t.Errorf("expected k on %s but got %q %v", name, r.Value, err)
+		}
+	}
+
+	servers["c"].Close()
+	if w := do("PUT", "/keys/k", "w"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with c down and W=3 but got %d %s", w.Code, w.Body)
+	}
+	if w := do("PUT", "/keys/k?w=2", "w"); w.Code != http.StatusOK {
+		t.Errorf("expected 200 with W=2 but got %d %s", w.Code, w.Body)
+	}
+	if w := do("GET", "/keys/k?r=3", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with c down and R=3 but got %d %s", w.Code, w.Body)
+	}
+	if w := do("GET", "/keys/k", ""); w.Code != http.StatusOK || w.Body.String() != "w" {
+		t.Errorf("expected w but got %d %s", w.Code, w.Body)
+	}
+	if w := do("GET", "/keys/k?n=x", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad n but got %d", w.Code)
+	}
+	if w := do("GET", "/debug/quorum", ""); !strings.Contains(w.Body.String(), `"hints":{"c":1}`) {
+		t.Errorf("expected a hint for c but got %s", w.Body)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Record is a key as replicas of the quorum mode keep it. Versions are
+// assigned by the coordinator of the write, the highest wins. Deletes are
+// kept as tombstones, and records are kept for a while after they expire,
+// so a replica that missed the delete or expiry can't bring the old value
+// back through read repair.
+type Record struct {
+	Key       string `json:"key"`
+	Value     []byte `json:"value,omitempty"`
+	ExpiredAt int64  `json:"expired_at"`
+	Version   uint64 `json:"version"`
+	Deleted   bool   `json:"deleted,omitempty"`
+}
+
+func (r Record) live(now int64) bool {
+	return !r.Deleted && r.ExpiredAt > now
+}
+
+// recordGrace is how long tombstones and expired records are kept.
+const recordGrace = 24 * 60 * 60
+
+// Replica is a node of the quorum mode. Errors mean the node can't be
+// reached, Read returns ErrNotFound for keys it has no record of.
+type Replica interface {
+	Read(ctx context.Context, key string) (Record, error)
+	// Write keeps r if it is newer than the record the replica has, and
+	// reports whether it was.
+	Write(ctx context.Context, r Record) (bool, error)
+	// Scan pages through the records in byte order of the keys.
+	Scan(ctx context.Context, after string, limit int) ([]Record, error)
+}
+
+// localReplica keeps the records in a Store, in the value of each key:
+// version u64 | expiredAt i64 | deleted u8 | value
+type localReplica struct {
+	store Store
+}
+
+const recordHeader = 17
+
+func encodeRecord(r Record) []byte {
+	b := make([]byte, recordHeader, recordHeader+len(r.Value))
+	binary.BigEndian.PutUint64(b, r.Version)
+	binary.BigEndian.PutUint64(b[8:], uint64(r.ExpiredAt))
+	if r.Deleted {
+		b[16] = 1
+	}
+	return append(b, r.Value...)
+}
+
+func decodeRecord(e Entry) (Record, error) {
+	if len(e.Value) < recordHeader {
+		return Record{}, fmt.Errorf("record of %s is corrupt", e.Key)
+	}
+	return Record{
+		Key:       e.Key,
+		Version:   binary.BigEndian.Uint64(e.Value),
+		ExpiredAt: int64(binary.BigEndian.Uint64(e.Value[8:])),
+		Deleted:   e.Value[16] == 1,
+		Value:     e.Value[recordHeader:],
+	}, nil
+}
+
+func (l *localReplica) Read(ctx context.Context, key string) (Record, error) {
+	e, err := l.store.Get(ctx, key)
+	if err != nil {
+		return Record{}, err
+	}
+	return decodeRecord(e)
+}
+
+func (l *localReplica) Write(ctx context.Context, r Record) (bool, error) {
+	// the store drops the record once it is past its grace period
+	keep := int64(NoExpiry)
+	switch {
+	case r.Deleted:
+		keep = time.Now().Unix() + recordGrace
+	case r.ExpiredAt != NoExpiry:
+		keep = min(r.ExpiredAt+recordGrace, NoExpiry)
+	}
+	_, err := l.store.Update(ctx, r.Key, func(cur *Entry) (*Entry, error) {
+		if cur != nil {
+			old, err := decodeRecord(*cur)
+			if err == nil && old.Version >= r.Version {
+				return nil, errSkip
+			}
+		}
+		return &Entry{Value: encodeRecord(r), ExpiredAt: keep}, nil
+	})
+	if errors.Is(err, errSkip) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *localReplica) Close() error {
+	return l.store.Close()
+}
+
+func (l *localReplica) Scan(ctx context.Context, after string, limit int) ([]Record, error) {
+	entries, err := l.store.Scan(ctx, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0, len(entries))
+	for _, e := range entries {
+		r, err := decodeRecord(e)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// httpReplica is another kv server, reached through its /internal
+// endpoints.
+type httpReplica struct {
+	base   string
+	client *http.Client
+}
+
+func newHTTPReplica(base string) *httpReplica {
+	return &httpReplica{base: base, client: &http.Client{Timeout: 2 * time.Second}}
+}
+
+func (h *httpReplica) do(ctx context.Context, method, path string, body, out any) error {
+	var in io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		in = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, h.base+path, in)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(out)
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		return fmt.Errorf("%s %s: %s", method, h.base+path, resp.Status)
+	}
+}
+
+func (h *httpReplica) Read(ctx context.Context, key string) (Record, error) {
+	var r Record
+	err := h.do(ctx, "GET", "/internal/records/"+url.PathEscape(key), nil, &r)
+	return r, err
+}
+
+func (h *httpReplica) Write(ctx context.Context, r Record) (bool, error) {
+	var resp struct{ Applied bool }
+	err := h.do(ctx, "PUT", "/internal/records/"+url.PathEscape(r.Key), r, &resp)
+	return resp.Applied, err
+}
+
+func (h *httpReplica) Scan(ctx context.Context, after string, limit int) ([]Record, error) {
+	var records []Record
+	q := url.Values{"after": {after}, "limit": {strconv.Itoa(limit)}}
+	err := h.do(ctx, "GET", "/internal/records?"+q.Encode(), nil, &records)
+	return records, err
+}
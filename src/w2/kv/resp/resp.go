@@ -0,0 +1,187 @@
+// Package resp reads commands and writes replies in the Redis
+// serialization protocol, RESP2 and RESP3.
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxArgs bounds the arguments of a command and MaxBulk the size of
+	// one, so a client can't make the server allocate without bound.
+	MaxArgs = 1 << 16
+	MaxBulk = 1 << 20
+)
+
+// ErrProtocol is returned for input that isn't RESP, the connection can't
+// be used after it.
+var ErrProtocol = errors.New("protocol error")
+
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Buffered is the number of bytes read ahead, more than zero when the
+// client pipelined further commands.
+func (r *Reader) Buffered() int {
+	return r.r.Buffered()
+}
+
+// ReadCommand reads an array of bulk strings, or an inline command as
+// typed into telnet. Empty inline lines are skipped.
+func (r *Reader) ReadCommand() ([][]byte, error) {
+	for {
+		line, err := r.line()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '*' {
+			if args := bytes.Fields(line); len(args) > 0 {
+				return args, nil
+			}
+			continue
+		}
+		n, err := length(line[1:], MaxArgs)
+		if err != nil {
+			return nil, err
+		}
+		args := make([][]byte, 0, n)
+		for range n {
+			arg, err := r.bulk()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		if len(args) > 0 {
+			return args, nil
+		}
+	}
+}
+
+func (r *Reader) bulk() ([]byte, error) {
+	line, err := r.line()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return nil, fmt.Errorf("%w: expected a bulk string", ErrProtocol)
+	}
+	n, err := length(line[1:], MaxBulk)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n+2)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return nil, err
+	}
+	if b[n] != '\r' || b[n+1] != '\n' {
+		return nil, fmt.Errorf("%w: bulk string not terminated", ErrProtocol)
+	}
+	return b[:n], nil
+}
+
+// line reads up to \r\n, or \n for inline commands.
+func (r *Reader) line() ([]byte, error) {
+	line, err := r.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("%w: line too long", ErrProtocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(line[:len(line)-1], []byte("\r")), nil
+}
+
+func length(b []byte, limit int) (int, error) {
+	n, err := strconv.Atoi(string(b))
+	if err != nil || n < 0 || n > limit {
+		return 0, fmt.Errorf("%w: invalid length %q", ErrProtocol, b)
+	}
+	return n, nil
+}
+
+// Writer buffers replies until Flush. Proto is 2 or 3 and decides how
+// nulls and maps are written.
+type Writer struct {
+	w     *bufio.Writer
+	Proto int
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w), Proto: 2}
+}
+
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Simple writes a simple string, which must not contain \r or \n.
+func (w *Writer) Simple(s string) {
+	w.w.WriteByte('+')
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+// lineBreaks turns the line breaks of an error into spaces, like Redis
+// does, messages may quote what the client sent.
+var lineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
+// Error writes an error, msg starts with its kind such as ERR.
+func (w *Writer) Error(msg string) {
+	w.w.WriteByte('-')
+	w.w.WriteString(lineBreaks.Replace(msg))
+	w.w.WriteString("\r\n")
+}
+
+func (w *Writer) Int(n int64) {
+	w.header(':', n)
+}
+
+func (w *Writer) Bulk(b []byte) {
+	w.header('$', int64(len(b)))
+	w.w.Write(b)
+	w.w.WriteString("\r\n")
+}
+
+func (w *Writer) BulkString(s string) {
+	w.Bulk([]byte(s))
+}
+
+func (w *Writer) Null() {
+	if w.Proto == 3 {
+		w.w.WriteString("_\r\n")
+		return
+	}
+	w.w.WriteString("$-1\r\n")
+}
+
+// Array starts an array of n elements, written next.
+func (w *Writer) Array(n int) {
+	w.header('*', int64(n))
+}
+
+// Map starts a map of n key value pairs, an array of 2n elements in RESP2.
+func (w *Writer) Map(n int) {
+	if w.Proto == 3 {
+		w.header('%', int64(n))
+		return
+	}
+	w.Array(2 * n)
+}
+
+func (w *Writer) header(kind byte, n int64) {
+	w.w.WriteByte(kind)
+	w.w.WriteString(strconv.FormatInt(n, 10))
+	w.w.WriteString("\r\n")
+}
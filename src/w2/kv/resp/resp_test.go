@@ -0,0 +1,58 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	r := NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$1\r\na\r\n\r\nPING  hello\r\n*1\r\n$0\r\n\r\n"))
+	for _, want := range []string{"GET a", "PING hello", ""} {
+		args, err := r.ReadCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(bytes.Join(args, []byte(" "))); got != want {
+			t.Errorf("expected %q but got %q", want, got)
+		}
+	}
+	if _, err := r.ReadCommand(); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	}
+}
+
+func TestReadCommandRejectsBadInput(t *testing.T) {
+	for _, in := range []string{
+		"*1\r\n:1\r\n",
+		"*1\r\n$3\r\nabcd\r\n",
+		"*-5\r\n",
+		"*1\r\n$2000000\r\n",
+	} {
+		if _, err := NewReader(strings.NewReader(in)).ReadCommand(); !errors.Is(err, ErrProtocol) {
+			t.Errorf("%q: expected a protocol error but got %v", in, err)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	w.Array(3)
+	w.BulkString("v")
+	w.Null()
+	w.Int(-2)
+	w.Proto = 3
+	w.Map(1)
+	w.Simple("proto")
+	w.Null()
+	w.Error("ERR nope")
+	w.Error("ERR unknown command 'x\r\n+OK'")
+	w.Flush()
+	want := "*3\r\n$1\r\nv\r\n$-1\r\n:-2\r\n%1\r\n+proto\r\n_\r\n-ERR nope\r\n-ERR unknown command 'x  +OK'\r\n"
+	if b.String() != want {
+		t.Errorf("expected %q but got %q", want, b.String())
+	}
+}
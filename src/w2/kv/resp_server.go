@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kv/resp"
+)
+
+// RESPServer lets Redis clients use the store. It speaks RESP2, and RESP3
+// after HELLO 3, and answers pipelined commands in one write. Reads go to
+// the primary so clients read their own writes, unless the connection
+// sent READONLY, like a Redis cluster client reading from replicas.
+type RESPServer struct {
+	primary Store
+	replica Store
+
+	ids   atomic.Int64
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func NewRESPServer(primary, replica Store) *RESPServer {
+	return &RESPServer{primary: primary, replica: replica, conns: make(map[net.Conn]struct{})}
+}
+
+// Serve accepts connections until ctx is cancelled, then closes them.
+func (s *RESPServer) Serve(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go func() {
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			s.serveConn(ctx, conn)
+		}()
+	}
+}
+
+// respConn is the state of one client connection.
+type respConn struct {
+	s   *RESPServer
+	ctx context.Context
+	id  int64
+	w   *resp.Writer
+
+	readonly bool // reads go to the replica
+}
+
+// reader is the store reads of the connection go to.
+func (c *respConn) reader() Store {
+	if c.readonly {
+		return c.s.replica
+	}
+	return c.s.primary
+}
+
+func (s *RESPServer) serveConn(ctx context.Context, conn net.Conn) {
+	r := resp.NewReader(conn)
+	c := &respConn{s: s, ctx: ctx, id: s.ids.Add(1), w: resp.NewWriter(conn)}
+	for {
+		args, err := r.ReadCommand()
+		if errors.Is(err, resp.ErrProtocol) {
+			c.w.Error("ERR " + err.Error())
+			c.w.Flush()
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				log.Printf("RESP connection %d: %v", c.id, err)
+			}
+			return
+		}
+		name := strings.ToLower(string(args[0]))
+		cmd, ok := respCommands[name]
+		switch {
+		case !ok:
+			c.w.Error("ERR unknown command '" + string(args[0]) + "'")
+		case cmd.arity > 0 && len(args) != cmd.arity, cmd.arity < 0 && len(args) < -cmd.arity:
+			c.w.Error("ERR wrong number of arguments for '" + name + "' command")
+		default:
+			cmd.fn(c, args[1:])
+		}
+		// answer everything the client pipelined at once
+		if r.Buffered() == 0 || name == "quit" {
+			if err := c.w.Flush(); err != nil || name == "quit" {
+				return
+			}
+		}
+	}
+}
+
+// respCommand is a supported command. arity counts the command name,
+// negative means at least that many arguments.
+type respCommand struct {
+	arity int
+	fn    func(c *respConn, args [][]byte)
+}
+
+var respCommands = map[string]respCommand{
+	"ping":    {-1, (*respConn).ping},
+	"echo":    {2, func(c *respConn, args [][]byte) { c.w.Bulk(args[0]) }},
+	"hello":   {-1, (*respConn).hello},
+	"client":  {-2, (*respConn).client},
+	"command": {-1, func(c *respConn, args [][]byte) { c.w.Array(0) }},
+	"select":  {2, (*respConn).selectDB},
+	"readonly": {1, func(c *respConn, args [][]byte) {
+		c.readonly = true
+		c.w.Simple("OK")
+	}},
+	"readwrite": {1, func(c *respConn, args [][]byte) {
+		c.readonly = false
+		c.w.Simple("OK")
+	}},
+	"quit":    {-1, func(c *respConn, args [][]byte) { c.w.Simple("OK") }},
+	"get":     {2, (*respConn).get},
+	"mget":    {-2, (*respConn).mget},
+	"exists":  {-2, (*respConn).exists},
+	"set":     {-3, (*respConn).set},
+	"getset":  {3, (*respConn).getset},
+	"del":     {-2, (*respConn).del},
+	"expire":  {3, (*respConn).expire},
+	"ttl":     {2, (*respConn).ttl},
+	"persist": {2, (*respConn).persist},
+	"incr":    {2, func(c *respConn, args [][]byte) { c.incr(args[0], 1) }},
+	"decr":    {2, func(c *respConn, args [][]byte) { c.incr(args[0], -1) }},
+	"incrby":  {3, func(c *respConn, args [][]byte) { c.incrBy(args, 1) }},
+	"decrby":  {3, func(c *respConn, args [][]byte) { c.incrBy(args, -1) }},
+}
+
+// fail replies with an error, logging the ones that aren't the client's.
+func (c *respConn) fail(err error) {
+	var reqErr *requestError
+	switch {
+	case errors.As(err, &reqErr):
+		c.w.Error("ERR " + reqErr.msg)
+	case errors.Is(err, ErrNotInteger), errors.Is(err, ErrThrottled):
+		c.w.Error("ERR " + err.Error())
+	default:
+		log.Printf("RESP connection %d: %v", c.id, err)
+		c.w.Error("ERR " + err.Error())
+	}
+}
+
+func (c *respConn) key(b []byte) (string, bool) {
+	key := string(b)
+	if err := checkKey(key); err != nil {
+		c.fail(err)
+		return "", false
+	}
+	return key, true
+}
+
+func (c *respConn) ping(args [][]byte) {
+	switch len(args) {
+	case 0:
+		c.w.Simple("PONG")
+	case 1:
+		c.w.Bulk(args[0])
+	default:
+		c.w.Error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+// hello switches the protocol version. AUTH and SETNAME are accepted and
+// ignored.
+func (c *respConn) hello(args [][]byte) {
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			c.w.Error("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if proto != 2 && proto != 3 {
+			c.w.Error("NOPROTO unsupported protocol version")
+			return
+		}
+		c.w.Proto = proto
+	}
+	c.w.Map(7)
+	c.w.BulkString("server")
+	c.w.BulkString("kv")
+	c.w.BulkString("version")
+	c.w.BulkString("1.0.0")
+	c.w.BulkString("proto")
+	c.w.Int(int64(c.w.Proto))
+	c.w.BulkString("id")
+	c.w.Int(c.id)
+	c.w.BulkString("mode")
+	c.w.BulkString("standalone")
+	c.w.BulkString("role")
+	c.w.BulkString("master")
+	c.w.BulkString("modules")
+	c.w.Array(0)
+}
+
+// client answers what client libraries send when they connect.
+func (c *respConn) client(args [][]byte) {
+	switch strings.ToLower(string(args[0])) {
+	case "setname", "setinfo":
+		c.w.Simple("OK")
+	case "getname":
+		c.w.Null()
+	case "id":
+		c.w.Int(c.id)
+	default:
+		c.w.Error("ERR unknown subcommand '" + string(args[0]) + "'")
+	}
+}
+
+// selectDB only knows database 0.
+func (c *respConn) selectDB(args [][]byte) {
+	if string(args[0]) != "0" {
+		c.w.Error("ERR DB index is out of range")
+		return
+	}
+	c.w.Simple("OK")
+}
+
+func (c *respConn) get(args [][]byte) {
+	key, ok := c.key(args[0])
+	if !ok {
+		return
+	}
+	e, err := c.reader().Get(c.ctx, key)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.w.Null()
+	case err != nil:
+		c.fail(err)
+	default:
+		c.w.Bulk(e.Value)
+	}
+}
+
+func (c *respConn) mget(args [][]byte) {
+	entries := make([]*Entry, len(args))
+	for i, arg := range args {
+		key, ok := c.key(arg)
+		if !ok {
+			return
+		}
+		e, err := c.reader().Get(c.ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		entries[i] = &e
+	}
+	c.w.Array(len(entries))
+	for _, e := range entries {
+		if e == nil {
+			c.w.Null()
+		} else {
+			c.w.Bulk(e.Value)
+		}
+	}
+}
+
+func (c *respConn) exists(args [][]byte) {
+	var n int64
+	for _, arg := range args {
+		key, ok := c.key(arg)
+		if !ok {
+			return
+		}
+		_, err := c.reader().Get(c.ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		n++
+	}
+	c.w.Int(n)
+}
+
+// set supports SET key value [EX seconds | PX milliseconds] [NX | XX].
+// Expiry is kept in seconds, so PX rounds up.
+func (c *respConn) set(args [][]byte) {
+	key, ok := c.key(args[0])
+	if !ok {
+		return
+	}
+	value := args[1]
+	if err := checkValue(value); err != nil {
+		c.fail(err)
+		return
+	}
+	expiredAt := int64(NoExpiry)
+	var cond Condition
+	var hasTTL bool
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); {
+		case (opt == "EX" || opt == "PX") && !hasTTL && i+1 < len(args):
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				c.w.Error("ERR value is not an integer or out of range")
+				return
+			}
+			if opt == "PX" {
+				n = (n + 999) / 1000
+			}
+			if expiredAt, err = expiry(n); err != nil {
+				c.w.Error("ERR invalid expire time in 'set' command")
+				return
+			}
+			hasTTL = true
+			i++
+		case opt == "NX" && !cond.IfExists:
+			cond.IfAbsent = true
+		case opt == "XX" && !cond.IfAbsent:
+			cond.IfExists = true
+		default:
+			c.w.Error("ERR syntax error")
+			return
+		}
+	}
+	_, _, err := c.s.primary.Put(c.ctx, key, value, expiredAt, cond)
+	switch {
+	case errors.Is(err, ErrConflict):
+		c.w.Null()
+	case err != nil:
+		c.fail(err)
+	default:
+		c.w.Simple("OK")
+	}
+}
+
+func (c *respConn) getset(args [][]byte) {
+	key, ok := c.key(args[0])
+	if !ok {
+		return
+	}
+	if err := checkValue(args[1]); err != nil {
+		c.fail(err)
+		return
+	}
+	old, found, err := GetSet(c.ctx, c.s.primary, key, args[1], NoExpiry)
+	switch {
+	case err != nil:
+		c.fail(err)
+	case !found:
+		c.w.Null()
+	default:
+		c.w.Bulk(old.Value)
+	}
+}
+
+func (c *respConn) del(args [][]byte) {
+	var n int64
+	for _, arg := range args {
+		key, ok := c.key(arg)
+		if !ok {
+			return
+		}
+		err := c.s.primary.Delete(c.ctx, key, Condition{})
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		n++
+	}
+	c.w.Int(n)
+}
+
+// expire replies 1 if the key exists, a ttl that isn't positive deletes it.
+func (c *respConn) expire(args [][]byte) {
+	key, ok := c.key(args[0])
+	if !ok {
+		return
+	}
+	seconds, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		c.w.Error("ERR value is not an integer or out of range")
+		return
+	}
+	if seconds <= 0 {
+		err = c.s.primary.Delete(c.ctx, key, Condition{})
+	} else {
+		var expiredAt int64
+		if expiredAt, err = expiry(seconds); err != nil {
+			c.w.Error("ERR invalid expire time in 'expire' command")
+			return
+		}
+		err = Expire(c.ctx, c.s.primary, key, expiredAt)
+	}
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.w.Int(0)
+	case err != nil:
+		c.fail(err)
+	default:
+		c.w.Int(1)
+	}
+}
+
+// ttl replies -2 for missing keys and -1 for keys that don't expire.
+func (c *respConn) ttl(args [][]byte) {
+	key, ok := c.key(args[0])
+	if !ok {
+		return
+	}
+	e, err := c.reader().Get(c.ctx, key)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.w.Int(-2)
+	case err != nil:
+		c.fail(err)
+	case e.ExpiredAt == NoExpiry:
+		c.w.Int(-1)
+	default:
+		c.w.Int(max(e.ExpiredAt-time.Now().Unix(), 0))
+	}
+}
+
+// errNoTTL leaves a key alone in persist.
+var errNoTTL = errors.New("key has no ttl")
+
+// persist replies 1 if it removed a ttl.
+func (c *respConn) persist(args [][]byte) {
+	key, ok := c.key(args[0])
+	if !ok {
+		return
+	}
+	_, err := c.s.primary.Update(c.ctx, key, func(cur *Entry) (*Entry, error) {
+		if cur == nil {
+			return nil, ErrNotFound
+		}
+		if cur.ExpiredAt == NoExpiry {
+			return nil, errNoTTL
+		}
+		return &Entry{Value: cur.Value, ExpiredAt: NoExpiry}, nil
+	})
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, errNoTTL):
+		c.w.Int(0)
+	case err != nil:
+		c.fail(err)
+	default:
+		c.w.Int(1)
+	}
+}
+
+func (c *respConn) incrBy(args [][]byte, sign int64) {
+	by, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || by == math.MinInt64 {
+		c.w.Error("ERR value is not an integer or out of range")
+		return
+	}
+	c.incr(args[0], sign*by)
+}
+
+func (c *respConn) incr(arg []byte, delta int64) {
+	key, ok := c.key(arg)
+	if !ok {
+		return
+	}
+	n, err := Incr(c.ctx, c.s.primary, key, delta)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.w.Int(n)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func startRESP(t *testing.T) string {
+	t.Helper()
+	s := openBitcask(t)
+	return serveRESP(t, s, s)
+}
+
+func serveRESP(t *testing.T, primary, replica Store) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewRESPServer(primary, replica).Serve(ctx, ln)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ln.Addr().String()
+}
+
+func TestRESPWithGoRedis(t *testing.T) {
+	addr := startRESP(t)
+	for _, proto := range []int{2, 3} {
+		rdb := redis.NewClient(&redis.Options{Addr: addr, Protocol: proto})
+		defer rdb.Close()
+		ctx := context.Background()
+		prefix := map[int]string{2: "two:", 3: "three:"}[proto]
+
+		if err := rdb.Ping(ctx).Err(); err != nil {
+			t.Fatalf("RESP%d: %v", proto, err)
+		}
+		if _, err := rdb.Get(ctx, prefix+"a").Result(); err != redis.Nil {
+			t.Errorf("RESP%d: expected a nil reply but got %v", proto, err)
+		}
+		if err := rdb.Set(ctx, prefix+"a", "one", 0).Err(); err != nil {
+			t.Fatalf("RESP%d: %v", proto, err)
+		}
+		if ok, _ := rdb.SetNX(ctx, prefix+"a", "2", 0).Result(); ok {
+			t.Errorf("RESP%d: expected SETNX of an existing key to fail", proto)
+		}
+		if ok, _ := rdb.SetXX(ctx, prefix+"b", "2", time.Minute).Result(); ok {
+			t.Errorf("RESP%d: expected SET XX of a missing key to fail", proto)
+		}
+		rdb.Set(ctx, prefix+"b", "2", 1500*time.Millisecond)
+		// 2s from the time of the SET, which may have been a second ago
+		if ttl, _ := rdb.TTL(ctx, prefix+"b").Result(); ttl < time.Second || ttl > 2*time.Second {
+			t.Errorf("RESP%d: expected PX to round up to 2s but got %s", proto, ttl)
+		}
+		if ttl, _ := rdb.TTL(ctx, prefix+"a").Result(); ttl != -1 {
+			t.Errorf("RESP%d: expected no ttl but got %s", proto, ttl)
+		}
+		if ok, _ := rdb.Expire(ctx, prefix+"a", time.Minute).Result(); !ok {
+			t.Errorf("RESP%d: expected EXPIRE to find a", proto)
+		}
+		values, err := rdb.MGet(ctx, prefix+"a", prefix+"missing", prefix+"b").Result()
+		if err != nil || len(values) != 3 || values[0] != "one" || values[1] != nil || values[2] != "2" {
+			t.Errorf("RESP%d: unexpected MGET %v %v", proto, values, err)
+		}
+		if n, _ := rdb.Exists(ctx, prefix+"a", prefix+"b", prefix+"missing").Result(); n != 2 {
+			t.Errorf("RESP%d: expected 2 to exist but got %d", proto, n)
+		}
+		if n, _ := rdb.Incr(ctx, prefix+"n").Result(); n != 1 {
+			t.Errorf("RESP%d: expected INCR to start at 1 but got %d", proto, n)
+		}
+		if err := rdb.Incr(ctx, prefix+"a").Err(); err == nil || !strings.Contains(err.Error(), "not an integer") {
+			t.Errorf("RESP%d: expected INCR of a to fail but got %v", proto, err)
+		}
+		if n, _ := rdb.Del(ctx, prefix+"a", prefix+"b", prefix+"missing").Result(); n != 2 {
+			t.Errorf("RESP%d: expected 2 deletes but got %d", proto, n)
+		}
+
+		pipe := rdb.Pipeline()
+		set := pipe.Set(ctx, prefix+"p", "x", 0)
+		get := pipe.Get(ctx, prefix+"p")
+		if _, err := pipe.Exec(ctx); err != nil || set.Err() != nil || get.Val() != "x" {
+			t.Errorf("RESP%d: unexpected pipeline results %v %v %q", proto, err, set.Err(), get.Val())
+		}
+	}
+}
+
+func TestRESPPipelining(t *testing.T) {
+	conn, err := net.Dial("tcp", startRESP(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// inline and array commands in a single write
+	io.WriteString(conn, "SET k v\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\nNOPE\r\nGET\r\nPING\r\nQUIT\r\n")
+	want := []string{"+OK", "$1", "v", "-ERR unknown command 'NOPE'", "-ERR wrong number of arguments for 'get' command", "+PONG", "+OK"}
+	lines := bufio.NewScanner(conn)
+	for _, w := range want {
+		if !lines.Scan() {
+			t.Fatalf("expected %q but the connection ended", w)
+		}
+		if lines.Text() != w {
+			t.Errorf("expected %q but got %q", w, lines.Text())
+		}
+	}
+	if lines.Scan() {
+		t.Errorf("expected QUIT to close the connection but got %q", lines.Text())
+	}
+}
+
+func TestRESPReadOnly(t *testing.T) {
+	primary, replica := openBitcask(t), openBitcask(t)
+	replica.Put(context.Background(), "k", []byte("stale"), NoExpiry, Condition{})
+	conn, err := net.Dial("tcp", serveRESP(t, primary, replica))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// reads go to the primary until READONLY
+	io.WriteString(conn, "GET k\r\nREADONLY\r\nGET k\r\nREADWRITE\r\nEXISTS k\r\n")
+	want := []string{"$-1", "+OK", "$5", "stale", "+OK", ":0"}
+	lines := bufio.NewScanner(conn)
+	for _, w := range want {
+		if !lines.Scan() {
+			t.Fatalf("expected %q but the connection ended", w)
+		}
+		if lines.Text() != w {
+			t.Errorf("expected %q but got %q", w, lines.Text())
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Package ring is a consistent hash ring. Every node is placed on the ring
+// at many points, its virtual nodes, so keys spread evenly and adding or
+// removing a node only moves the keys next to its points.
+package ring
+
+import (
+	"cmp"
+	"hash/fnv"
+	"slices"
+	"strconv"
+)
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// Ring is immutable, With and Without return changed copies, so it can be
+// shared without locking.
+type Ring struct {
+	vnodes int
+	nodes  []string
+	points []point // sorted by hash
+}
+
+// New places each node at vnodes points.
+func New(vnodes int, nodes ...string) *Ring {
+	r := &Ring{vnodes: max(vnodes, 1)}
+	for _, node := range nodes {
+		r = r.With(node)
+	}
+	return r
+}
+
+func Hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// fnv alone clusters similar strings such as node#1 and node#2
+	return mix(h.Sum64())
+}
+
+// mix is the finalizer of splitmix64.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// With returns the ring with node added.
+func (r *Ring) With(node string) *Ring {
+	if slices.Contains(r.nodes, node) {
+		return r
+	}
+	next := &Ring{vnodes: r.vnodes, nodes: append(slices.Clone(r.nodes), node), points: slices.Clone(r.points)}
+	slices.Sort(next.nodes)
+	for i := range r.vnodes {
+		next.points = append(next.points, point{Hash(node + "#" + strconv.Itoa(i)), node})
+	}
+	slices.SortFunc(next.points, func(a, b point) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(a.node, b.node))
+	})
+	return next
+}
+
+// Without returns the ring with node removed.
+func (r *Ring) Without(node string) *Ring {
+	if !slices.Contains(r.nodes, node) {
+		return r
+	}
+	next := &Ring{vnodes: r.vnodes}
+	for _, n := range r.nodes {
+		if n != node {
+			next.nodes = append(next.nodes, n)
+		}
+	}
+	for _, p := range r.points {
+		if p.node != node {
+			next.points = append(next.points, p)
+		}
+	}
+	return next
+}
+
+func (r *Ring) Nodes() []string {
+	return slices.Clone(r.nodes)
+}
+
+func (r *Ring) VNodes() int {
+	return r.vnodes
+}
+
+// Lookup returns the n distinct nodes that own key, walking clockwise from
+// its hash. The first is its primary owner. Fewer are returned if the ring
+// has fewer nodes.
+func (r *Ring) Lookup(key string, n int) []string {
+	return r.walk(Hash(key), n)
+}
+
+func (r *Ring) walk(h uint64, n int) []string {
+	n = min(n, len(r.nodes))
+	if n <= 0 {
+		return nil
+	}
+	owners := make([]string, 0, n)
+	start, _ := slices.BinarySearchFunc(r.points, h, func(p point, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+	for i := 0; len(owners) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !slices.Contains(owners, p.node) {
+			owners = append(owners, p.node)
+		}
+	}
+	return owners
+}
+
+// Shares returns the fraction of the hash space each node is the primary
+// owner of.
+func (r *Ring) Shares() map[string]float64 {
+	shares := make(map[string]float64, len(r.nodes))
+	if len(r.nodes) == 1 {
+		shares[r.nodes[0]] = 1
+		return shares
+	}
+	for i, p := range r.points {
+		// p owns the arc from the previous point up to itself, which
+		// wraps around for the first point
+		prev := r.points[(i+len(r.points)-1)%len(r.points)].hash
+		shares[p.node] += float64(p.hash-prev) / (1 << 64)
+	}
+	return shares
+}
@@ -0,0 +1,67 @@
+package ring
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestLookupReturnsDistinctOwners(t *testing.T) {
+	r := New(64, "a", "b", "c")
+	for i := range 1000 {
+		owners := r.Lookup(fmt.Sprint("key-", i), 2)
+		if len(owners) != 2 || owners[0] == owners[1] {
+			t.Fatalf("expected two distinct owners but got %v", owners)
+		}
+	}
+	if owners := r.Lookup("k", 5); len(owners) != 3 {
+		t.Errorf("expected at most as many owners as nodes but got %v", owners)
+	}
+	if owners := New(8).Lookup("k", 1); owners != nil {
+		t.Errorf("expected no owners on an empty ring but got %v", owners)
+	}
+}
+
+func TestKeysSpreadEvenly(t *testing.T) {
+	r := New(128, "a", "b", "c", "d")
+	counts := map[string]int{}
+	for i := range 100000 {
+		counts[r.Lookup(fmt.Sprint("key-", i), 1)[0]]++
+	}
+	// with 128 points per node the shares vary by about a tenth
+	for node, n := range counts {
+		if math.Abs(float64(n)-25000) > 7500 {
+			t.Errorf("expected about 25000 keys on %s but got %d", node, n)
+		}
+	}
+	var total float64
+	for _, share := range r.Shares() {
+		total += share
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("expected the shares to add up to 1 but got %f", total)
+	}
+}
+
+func TestAddingANodeOnlyMovesKeysToIt(t *testing.T) {
+	before := New(128, "a", "b", "c")
+	after := before.With("d")
+	moved := 0
+	for i := range 10000 {
+		key := fmt.Sprint("key-", i)
+		was, is := before.Lookup(key, 1)[0], after.Lookup(key, 1)[0]
+		if was != is {
+			moved++
+			if is != "d" {
+				t.Fatalf("expected %s to move to d but it moved to %s", key, is)
+			}
+		}
+	}
+	if moved < 1500 || moved > 3500 {
+		t.Errorf("expected about a quarter of the keys to move but %d did", moved)
+	}
+	if back := after.Without("d"); !slices.Equal(back.Nodes(), before.Nodes()) || len(back.points) != len(before.points) {
+		t.Errorf("expected removing d to restore the ring")
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"kv/ring"
+)
+
+// shardedStore spreads the keys over several stores, the shards, with a
+// consistent hash ring. Every key is kept on the first Replicas shards the
+// ring walks to from its hash. Writes go to all of them, the first one
+// decides whether the condition holds and the version, reads go to the
+// first one that has the key.
+//
+// Adding or removing a shard rebalances online: while the keys that move
+// are copied, writes go to their old and new owners and reads try the new
+// owners first. Every operation holds mu for reading, so a change of the
+// ring waits for the operations that routed with the old one.
+type shardedStore struct {
+	replicas int
+
+	mu     sync.RWMutex
+	shards map[string]Store
+	ring   *ring.Ring
+	next   *ring.Ring // during a rebalance
+
+	statusMu sync.Mutex
+	status   RebalanceStatus
+}
+
+type RebalanceStatus struct {
+	State    string    `json:"state"` // idle, copying, cleaning, done or failed
+	Adding   string    `json:"adding,omitempty"`
+	Removing string    `json:"removing,omitempty"`
+	Scanned  int64     `json:"scanned"`
+	Copied   int64     `json:"copied"`
+	Deleted  int64     `json:"deleted"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started,omitzero"`
+	Finished time.Time `json:"finished,omitzero"`
+}
+
+var errRebalancing = &requestError{409, "a rebalance is in progress"}
+
+// rebalanceBatch is how many keys a rebalance reads from a shard at once.
+const rebalanceBatch = 500
+
+func NewShardedStore(shards map[string]Store, vnodes, replicas int) *shardedStore {
+	names := make([]string, 0, len(shards))
+	for name := range shards {
+		names = append(names, name)
+	}
+	return &shardedStore{
+		replicas: max(replicas, 1),
+		shards:   shards,
+		ring:     ring.New(vnodes, names...),
+		status:   RebalanceStatus{State: "idle"},
+	}
+}
+
+// OpenShard opens the store described by spec, bitcask:<dir> or
+// sql:<port>.
+func OpenShard(spec string) (Store, error) {
+	kind, arg, ok := strings.Cut(spec, ":")
+	switch {
+	case ok && kind == "bitcask":
+		return OpenBitcask(arg)
+	case ok && kind == "sql":
+		return NewSQLStore(arg), nil
+	}
+	return nil, fmt.Errorf("unknown shard %q, expected bitcask:<dir> or sql:<port>", spec)
+}
+
+// owners returns where to write key, and where to read it from in order.
+// Must be called with mu held.
+func (s *shardedStore) owners(key string) (writes, reads []Store) {
+	names := s.ring.Lookup(key, s.replicas)
+	if s.next == nil {
+		for _, name := range names {
+			writes = append(writes, s.shards[name])
+		}
+		return writes, writes
+	}
+	next := s.next.Lookup(key, s.replicas)
+	// the old owners first, so a copy that reads the old owner while
+	// holding the new one never misses a write that reached the new one
+	for _, name := range append(names, next...) {
+		if st := s.shards[name]; !slices.Contains(writes, st) {
+			writes = append(writes, st)
+		}
+	}
+	for _, name := range append(next, names...) {
+		if st := s.shards[name]; !slices.Contains(reads, st) {
+			reads = append(reads, st)
+		}
+	}
+	return writes, reads
+}
+
+func (s *shardedStore) Get(ctx context.Context, key string) (Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, reads := s.owners(key)
+	var errs []error
+	for _, st := range reads {
+		e, err := st.Get(ctx, key)
+		if err == nil {
+			return e, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return Entry{}, errors.Join(errs...)
+	}
+	return Entry{}, ErrNotFound
+}
+
+func (s *shardedStore) Put(ctx context.Context, key string, value []byte, expiredAt int64, cond Condition) (uint64, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	writes, _ := s.owners(key)
+	version, created, err := writes[0].Put(ctx, key, value, expiredAt, cond)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, st := range writes[1:] {
+		if _, _, err := st.Put(ctx, key, value, expiredAt, Condition{}); err != nil {
+			return 0, false, err
+		}
+	}
+	return version, created, nil
+}
+
+func (s *shardedStore) Delete(ctx context.Context, key string, cond Condition) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	writes, _ := s.owners(key)
+	if err := writes[0].Delete(ctx, key, cond); err != nil {
+		return err
+	}
+	return deleteFrom(ctx, writes[1:], key)
+}
+
+func deleteFrom(ctx context.Context, stores []Store, key string) error {
+	for _, st := range stores {
+		if err := st.Delete(ctx, key, Condition{}); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update runs fn on the first owner and writes its result to the others.
+func (s *shardedStore) Update(ctx context.Context, key string, fn func(cur *Entry) (*Entry, error)) (Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	writes, _ := s.owners(key)
+	var existed bool
+	var next *Entry
+	e, err := writes[0].Update(ctx, key, func(cur *Entry) (*Entry, error) {
+		existed = cur != nil
+		var err error
+		next, err = fn(cur)
+		return next, err
+	})
+	switch {
+	case err != nil:
+		return Entry{}, err
+	case next != nil:
+		for _, st := range writes[1:] {
+			if _, _, err := st.Put(ctx, key, next.Value, next.ExpiredAt, Condition{}); err != nil {
+				return Entry{}, err
+			}
+		}
+	case existed:
+		if err := deleteFrom(ctx, writes[1:], key); err != nil {
+			return Entry{}, err
+		}
+	}
+	return e, nil
+}
+
+// Scan merges the pages of all shards, dropping the copies of replicas.
+func (s *shardedStore) Scan(ctx context.Context, after string, limit int) ([]Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var all []Entry
+	for _, st := range s.shards {
+		entries, err := st.Scan(ctx, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, entries...)
+	}
+	slices.SortStableFunc(all, func(a, b Entry) int { return strings.Compare(a.Key, b.Key) })
+	all = slices.CompactFunc(all, func(a, b Entry) bool { return a.Key == b.Key })
+	return all[:min(limit, len(all))], nil
+}
+
+func (s *shardedStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, st := range s.shards {
+		errs = append(errs, st.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// RingInfo describes the ring for /ring.
+type RingInfo struct {
+	VNodes    int                `json:"vnodes"`
+	Replicas  int                `json:"replicas"`
+	Shards    []string           `json:"shards"`
+	Shares    map[string]float64 `json:"shares"`
+	Next      []string           `json:"next,omitempty"` // shards after the rebalance
+	Owners    []string           `json:"owners,omitempty"`
+	Rebalance RebalanceStatus    `json:"rebalance"`
+}
+
+// Ring describes the ring, with the owners of key if it isn't empty.
+func (s *shardedStore) Ring(key string) RingInfo {
+	s.mu.RLock()
+	info := RingInfo{
+		VNodes:   s.ring.VNodes(),
+		Replicas: s.replicas,
+		Shards:   s.ring.Nodes(),
+		Shares:   s.ring.Shares(),
+	}
+	if s.next != nil {
+		info.Next = s.next.Nodes()
+	}
+	if key != "" {
+		info.Owners = s.ring.Lookup(key, s.replicas)
+	}
+	s.mu.RUnlock()
+	s.statusMu.Lock()
+	info.Rebalance = s.status
+	s.statusMu.Unlock()
+	return info
+}
+
+// AddShard starts moving the keys name will own to it, the rebalance runs
+// until it is done or ctx is cancelled.
+func (s *shardedStore) AddShard(ctx context.Context, name string, st Store) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next != nil {
+		return errRebalancing
+	}
+	if _, ok := s.shards[name]; ok {
+		return &requestError{409, "shard " + name + " already exists"}
+	}
+	s.shards[name] = st
+	s.start(ctx, s.ring.With(name), RebalanceStatus{Adding: name})
+	return nil
+}
+
+// RemoveShard starts moving the keys of name to the shards that own them
+// next. The shard is closed once it is out of the ring.
+func (s *shardedStore) RemoveShard(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next != nil {
+		return errRebalancing
+	}
+	if _, ok := s.shards[name]; !ok {
+		return ErrNotFound
+	}
+	if len(s.ring.Nodes()) == 1 {
+		return badRequest("can't remove the last shard")
+	}
+	s.start(ctx, s.ring.Without(name), RebalanceStatus{Removing: name})
+	return nil
+}
+
+// start must be called with mu held.
+func (s *shardedStore) start(ctx context.Context, next *ring.Ring, status RebalanceStatus) {
+	s.next = next
+	status.State, status.Started = "copying", time.Now()
+	s.setStatus(func(st *RebalanceStatus) { *st = status })
+	go func() {
+		err := s.rebalance(ctx, status)
+		s.setStatus(func(st *RebalanceStatus) {
+			st.State, st.Finished = "done", time.Now()
+			if err != nil {
+				st.State, st.Error = "failed", err.Error()
+			}
+		})
+		if err != nil {
+			log.Printf("Rebalance failed: %v", err)
+		}
+	}()
+}
+
+func (s *shardedStore) setStatus(fn func(st *RebalanceStatus)) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	fn(&s.status)
+}
+
+// rebalance copies the keys that get new owners, switches to the new ring
+// and then deletes the keys from the shards that no longer own them.
+func (s *shardedStore) rebalance(ctx context.Context, status RebalanceStatus) error {
+	s.mu.RLock()
+	old, next := s.ring, s.next
+	shards := make(map[string]Store, len(s.shards))
+	for name, st := range s.shards {
+		shards[name] = st
+	}
+	s.mu.RUnlock()
+
+	err := s.eachKey(ctx, shards, old.Nodes(), func(name string, e Entry) error {
+		owned := old.Lookup(e.Key, s.replicas)
+		for _, owner := range next.Lookup(e.Key, s.replicas) {
+			if slices.Contains(owned, owner) {
+				continue
+			}
+			copied, err := copyKey(ctx, shards[name], shards[owner], e.Key)
+			if err != nil {
+				return err
+			}
+			if copied {
+				s.setStatus(func(st *RebalanceStatus) { st.Copied++ })
+			}
+		}
+		return nil
+	})
+	s.mu.Lock()
+	if err != nil {
+		// everything was written to the old owners as well
+		s.next = nil
+		if status.Adding != "" {
+			delete(s.shards, status.Adding)
+			shards[status.Adding].Close()
+		}
+		s.mu.Unlock()
+		return err
+	}
+	s.ring, s.next = next, nil
+	if status.Removing != "" {
+		delete(s.shards, status.Removing)
+		shards[status.Removing].Close()
+		delete(shards, status.Removing)
+	}
+	s.mu.Unlock()
+
+	s.setStatus(func(st *RebalanceStatus) { st.State = "cleaning" })
+	return s.eachKey(ctx, shards, next.Nodes(), func(name string, e Entry) error {
+		if slices.Contains(next.Lookup(e.Key, s.replicas), name) {
+			return nil
+		}
+		err := shards[name].Delete(ctx, e.Key, Condition{IfVersion: e.Version})
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) {
+			return nil
+		}
+		if err == nil {
+			s.setStatus(func(st *RebalanceStatus) { st.Deleted++ })
+		}
+		return err
+	})
+}
+
+// eachKey scans the given shards and calls fn with every entry.
+func (s *shardedStore) eachKey(ctx context.Context, shards map[string]Store, names []string, fn func(name string, e Entry) error) error {
+	for _, name := range names {
+		for after := ""; ; {
+			entries, err := shards[name].Scan(ctx, after, rebalanceBatch)
+			if err != nil {
+				return fmt.Errorf("scanning %s: %w", name, err)
+			}
+			if len(entries) == 0 {
+				break
+			}
+			for _, e := range entries {
+				if err := fn(name, e); err != nil {
+					return err
+				}
+			}
+			s.setStatus(func(st *RebalanceStatus) { st.Scanned += int64(len(entries)) })
+			after = entries[len(entries)-1].Key
+		}
+	}
+	return nil
+}
+
+// errSkip leaves a key alone in an Update.
+var errSkip = errors.New("skip")
+
+// copyKey copies key from one shard to another that doesn't have it yet.
+// It reads the source while holding the key on the target, and writes
+// reach the source first, so it can't resurrect a deleted key or overwrite
+// a newer value.
+func copyKey(ctx context.Context, from, to Store, key string) (bool, error) {
+	_, err := to.Update(ctx, key, func(cur *Entry) (*Entry, error) {
+		if cur != nil {
+			return nil, errSkip
+		}
+		e, err := from.Get(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			return nil, errSkip
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Entry{Value: e.Value, ExpiredAt: e.ExpiredAt}, nil
+	})
+	if errors.Is(err, errSkip) {
+		return false, nil
+	}
+	return err == nil, err
+}
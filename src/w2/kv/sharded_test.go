@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openShards(t *testing.T, names ...string) map[string]Store {
+	t.Helper()
+	shards := make(map[string]Store)
+	for _, name := range names {
+		s, err := OpenBitcask(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards[name] = s
+	}
+	return shards
+}
+
+// checkPlacement makes sure every key is on exactly its owners, with the
+// expected value.
+func checkPlacement(t *testing.T, s *shardedStore, want map[string]string) {
+	t.Helper()
+	ctx := context.Background()
+	for key, value := range want {
+		owners := s.ring.Lookup(key, s.replicas)
+		for name, shard := range s.shards {
+			e, err := shard.Get(ctx, key)
+			switch owns := slices.Contains(owners, name); {
+			case owns && (err != nil || string(e.Value) != value):
+				t.Fatalf("expected %s=%s on %s but got %q %v", key, value, name, e.Value, err)
+			case !owns && !errors.Is(err, ErrNotFound):
+				t.Fatalf("expected %s not to be on %s", key, name)
+			}
+		}
+	}
+}
+
+func TestShardedStore(t *testing.T) {
+	s := NewShardedStore(openShards(t, "a", "b", "c"), 32, 2)
+	defer s.Close()
+	ctx := context.Background()
+	want := map[string]string{}
+	for i := range 200 {
+		key := fmt.Sprint("key-", i)
+		want[key] = fmt.Sprint(i)
+		if _, created, err := s.Put(ctx, key, []byte(want[key]), NoExpiry, Condition{}); err != nil || !created {
+			t.Fatalf("expected %s to be created, got %v", key, err)
+		}
+	}
+	checkPlacement(t, s, want)
+
+	// the other replica answers when the first owner lost the key
+	owners := s.ring.Lookup("key-1", 2)
+	s.shards[owners[0]].Delete(ctx, "key-1", Condition{})
+	if e, err := s.Get(ctx, "key-1"); err != nil || string(e.Value) != "1" {
+		t.Errorf("expected the second owner to answer but got %q %v", e.Value, err)
+	}
+
+	if n, err := Incr(ctx, s, "n", 5); err != nil || n != 5 {
+		t.Fatalf("expected 5 but got %d %v", n, err)
+	}
+	checkPlacement(t, s, map[string]string{"n": "5", "key-2": "2"})
+	if err := s.Delete(ctx, "n", Condition{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range s.ring.Lookup("n", 2) {
+		if _, err := s.shards[name].Get(ctx, "n"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected n to be deleted from %s", name)
+		}
+	}
+
+	entries, err := s.Scan(ctx, "key-198", 3)
+	if err != nil || len(entries) != 3 || entries[0].Key != "key-199" || entries[1].Key != "key-2" || entries[2].Key != "key-20" {
+		t.Errorf("expected the scan to merge the shards, got %v %v", entries, err)
+	}
+}
+
+func waitForRebalance(t *testing.T, s *shardedStore) RebalanceStatus {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(5 * time.Millisecond) {
+		if st := s.Ring("").Rebalance; st.State == "done" || st.State == "failed" {
+			return st
+		}
+	}
+	t.Fatal("the rebalance didn't finish")
+	return RebalanceStatus{}
+}
+
+func TestRebalanceWhileWriting(t *testing.T) {
+	s := NewShardedStore(openShards(t, "a", "b", "c"), 32, 2)
+	defer s.Close()
+	ctx := context.Background()
+	want := map[string]string{}
+	for i := range 1000 {
+		key := fmt.Sprint("key-", i)
+		want[key] = "old"
+		s.Put(ctx, key, []byte("old"), NoExpiry, Condition{})
+	}
+
+	// keep rewriting and deleting keys while the ring changes
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := fmt.Sprint("key-", i%1000)
+			if i%7 == 0 {
+				if err := s.Delete(ctx, key, Condition{}); err == nil {
+					delete(want, key)
+				}
+			} else {
+				value := fmt.Sprint("new-", i)
+				if _, _, err := s.Put(ctx, key, []byte(value), NoExpiry, Condition{}); err == nil {
+					want[key] = value
+				}
+			}
+			time.Sleep(10 * time.Microsecond)
+		}
+	}()
+
+	for _, change := range []func() error{
+		func() error { return s.AddShard(ctx, "d", openShards(t, "d")["d"]) },
+		func() error { return s.RemoveShard(ctx, "a") },
+	} {
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddShard(ctx, "e", nil); !errors.Is(err, errRebalancing) {
+			t.Errorf("expected a second rebalance to be refused but got %v", err)
+		}
+		// the writes may have copied every key before the rebalance got
+		// to it
+		if st := waitForRebalance(t, s); st.State != "done" {
+			t.Fatalf("unexpected rebalance %+v", st)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if nodes := s.ring.Nodes(); !slices.Equal(nodes, []string{"b", "c", "d"}) {
+		t.Errorf("expected shards b, c and d but got %v", nodes)
+	}
+	checkPlacement(t, s, want)
+}
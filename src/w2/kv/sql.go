@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	io "github.com/sanjay-vasudeva/ioutil"
+)
+
+// sqlStore keeps the data in the kv.store table, see kv.sql.
+//
+// Versions start at the time of the write in microseconds and go up by at
+// least one with every write, so a key that is deleted and created again
+// doesn't get a version it had before.
+//
+// Every write also adds its change to kv.changes in the same transaction.
+type sqlStore struct {
+	db      *sql.DB
+	written notifier // wakes up watchers on local writes
+	// stopCleanup stops the Cleaner of the store when it is closed, so a
+	// shard that is removed doesn't keep cleaning up
+	stopCleanup context.CancelFunc
+}
+
+func NewSQLStore(port string) Store {
+	return &sqlStore{db: NewConn(port)}
+}
+
+func (s *sqlStore) Get(ctx context.Context, key string) (Entry, error) {
+	e := Entry{Key: key}
+	row := s.db.QueryRowContext(ctx, "SELECT value, expired_at, version FROM kv.store WHERE k = ? AND expired_at > UNIX_TIMESTAMP()", key)
+	err := row.Scan(&e.Value, &e.ExpiredAt, &e.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Entry{}, ErrNotFound
+	}
+	return e, err
+}
+
+// Scan compares keys as bytes, like the binary collation of the primary
+// key, so every page starts with a seek in the index.
+func (s *sqlStore) Scan(ctx context.Context, after string, limit int) ([]Entry, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT k, value, expired_at, version FROM kv.store "+
+		"WHERE k > ? AND expired_at > UNIX_TIMESTAMP() ORDER BY k LIMIT ?", after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(&e.Key, &e.Value, &e.ExpiredAt, &e.Version); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// ScanKeys lists keys in the order of Scan without reading the values.
+func (s *sqlStore) ScanKeys(ctx context.Context, after string, limit int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT k FROM kv.store WHERE k > ? AND expired_at > UNIX_TIMESTAMP() ORDER BY k LIMIT ?", after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Snapshot reads kv.store in one transaction with a consistent snapshot,
+// so it sees the table as of its start without locking it.
+func (s *sqlStore) Snapshot(ctx context.Context, prefix string, fn func(Entry) error) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "SET TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), "ROLLBACK")
+
+	// k is compared as bytes, so LIKE matches exactly the prefix
+	like := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+	rows, err := conn.QueryContext(ctx, "SELECT k, value, expired_at, version FROM kv.store "+
+		"WHERE k LIKE ? AND expired_at > UNIX_TIMESTAMP() ORDER BY k", like)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(&e.Key, &e.Value, &e.ExpiredAt, &e.Version); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlStore) Put(ctx context.Context, key string, value []byte, expiredAt int64, cond Condition) (uint64, bool, error) {
+	// putKey1 and putKey2 can't check a condition, return the version or
+	// log the change
+	var version uint64
+	var created bool
+	err := retryDeadlocks(func() (err error) {
+		version, created, err = putKey3(ctx, key, value, expiredAt, cond, s.db)
+		return err
+	})
+	if err == nil {
+		s.written.notify()
+	}
+	return version, created, err
+}
+
+func (s *sqlStore) Delete(ctx context.Context, key string, cond Condition) error {
+	err := retryDeadlocks(func() error {
+		return deleteIf(ctx, key, cond, s.db)
+	})
+	if err == nil {
+		s.written.notify()
+	}
+	return err
+}
+
+// nowMicros is the lowest version a write gets.
+const nowMicros = "CAST(UNIX_TIMESTAMP(NOW(6)) * 1000000 AS UNSIGNED)"
+
+// tombstone deletes a key, with a new version like any other write so
+// anti-entropy knows the delete is recent.
+const tombstone = "UPDATE kv.store SET expired_at = -1, version = GREATEST(version + 1, " + nowMicros + ") WHERE k = ?"
+
+func (s *sqlStore) Close() error {
+	if s.stopCleanup != nil {
+		s.stopCleanup()
+	}
+	return s.db.Close()
+}
+
+// approach 1: Check if key exists and decide whether to insert or update
+func putKey1(ctx context.Context, key string, value []byte, expiredAt int64, db *sql.DB) (bool, error) {
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(1) FROM kv.store WHERE k = ?", key).Scan(&count); err != nil {
+		return false, err
+	}
+
+	var err error
+	if count == 0 {
+		_, err = db.ExecContext(ctx, "INSERT INTO kv.store (k, value, expired_at, version) VALUES (?, ?, ?, "+nowMicros+")", key, value, expiredAt)
+	} else {
+		_, err = db.ExecContext(ctx, "UPDATE kv.store SET value = ?, expired_at = ?, version = GREATEST(version + 1, "+nowMicros+") WHERE k = ?", value, expiredAt, key)
+	}
+	return count == 0, err
+}
+
+// approach 2: Insert or update the key in a single query. MySQL reports 1
+// affected row for an insert and 2 for an update, but a key that had
+// expired and is still in the table also counts as an update.
+func putKey2(ctx context.Context, key string, value []byte, expiredAt int64, db *sql.DB) (bool, error) {
+	res, err := db.ExecContext(ctx, upsert, key, value, expiredAt, value, expiredAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+const upsert = "INSERT INTO kv.store (k, value, expired_at, version) VALUES (?, ?, ?, " + nowMicros + ") " +
+	"ON DUPLICATE KEY UPDATE value = ?, expired_at = ?, version = GREATEST(version + 1, " + nowMicros + ")"
+
+// approach 3: Lock the row while checking whether it is live, so we know
+// if the put creates the key even when an expired row is in the way, and
+// can check the condition against it
+func putKey3(ctx context.Context, key string, value []byte, expiredAt int64, cond Condition, db *sql.DB) (uint64, bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	cur, err := lockLive(ctx, tx, key)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := cond.check(cur); err != nil {
+		return 0, false, err
+	}
+	if _, err = tx.ExecContext(ctx, upsert, key, value, expiredAt, value, expiredAt); err != nil {
+		return 0, false, err
+	}
+	e := Entry{Key: key, Value: value, ExpiredAt: expiredAt}
+	if err := tx.QueryRowContext(ctx, "SELECT version FROM kv.store WHERE k = ?", key).Scan(&e.Version); err != nil {
+		return 0, false, err
+	}
+	if err := logChange(ctx, tx, "put", e); err != nil {
+		return 0, false, err
+	}
+	return e.Version, cur == nil, tx.Commit()
+}
+
+// logChange adds a change to kv.changes, value and expiry are kept for puts.
+func logChange(ctx context.Context, tx *sql.Tx, op string, e Entry) error {
+	var value, expiredAt any
+	if op == "put" {
+		value, expiredAt = e.Value, e.ExpiredAt
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO kv.changes (k, op, value, expired_at, version) VALUES (?, ?, ?, ?, ?)", e.Key, op, value, expiredAt, e.Version)
+	return err
+}
+
+// lockLive locks the row of key and returns it, or nil if the key isn't
+// live.
+func lockLive(ctx context.Context, tx *sql.Tx, key string) (*Entry, error) {
+	var live bool
+	e := Entry{Key: key}
+	err := tx.QueryRowContext(ctx, "SELECT expired_at > UNIX_TIMESTAMP(), value, expired_at, version FROM kv.store WHERE k = ? FOR UPDATE", key).
+		Scan(&live, &e.Value, &e.ExpiredAt, &e.Version)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && !live {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Update holds the lock on the row of key while fn runs, or on the gap
+// where it would be if the key doesn't exist. Two updates creating the same
+// key both get the gap lock and one of them deadlocks, so it is retried and
+// fn may run more than once.
+func (s *sqlStore) Update(ctx context.Context, key string, fn func(cur *Entry) (*Entry, error)) (Entry, error) {
+	var e Entry
+	err := retryDeadlocks(func() (err error) {
+		e, err = s.update(ctx, key, fn)
+		return err
+	})
+	if err == nil {
+		s.written.notify()
+	}
+	return e, err
+}
+
+const errDeadlock = 1213
+
+// retryDeadlocks runs fn again, up to 3 times in all, while it deadlocks.
+// Puts, deletes and updates lock the row of the key with lockLive, or the
+// gap where it would be, so any two of them on a missing key can deadlock.
+func retryDeadlocks(fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		var myErr *mysql.MySQLError
+		if attempt < 3 && errors.As(err, &myErr) && myErr.Number == errDeadlock {
+			continue
+		}
+		return err
+	}
+}
+
+func (s *sqlStore) update(ctx context.Context, key string, fn func(cur *Entry) (*Entry, error)) (Entry, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer tx.Rollback()
+
+	cur, err := lockLive(ctx, tx, key)
+	if err != nil {
+		return Entry{}, err
+	}
+	next, err := fn(cur)
+	if err != nil {
+		return Entry{}, err
+	}
+	e := Entry{Key: key}
+	switch {
+	case next == nil && cur == nil:
+		return e, nil
+	case next == nil:
+		// the change has the version of the tombstone, like a put
+		gone := Entry{Key: key}
+		_, err = tx.ExecContext(ctx, tombstone, key)
+		if err == nil {
+			err = tx.QueryRowContext(ctx, "SELECT version FROM kv.store WHERE k = ?", key).Scan(&gone.Version)
+		}
+		if err == nil {
+			err = logChange(ctx, tx, "delete", gone)
+		}
+	default:
+		e.Value, e.ExpiredAt = next.Value, next.ExpiredAt
+		_, err = tx.ExecContext(ctx, upsert, key, e.Value, e.ExpiredAt, e.Value, e.ExpiredAt)
+		if err == nil {
+			err = tx.QueryRowContext(ctx, "SELECT version FROM kv.store WHERE k = ?", key).Scan(&e.Version)
+		}
+		if err == nil {
+			err = logChange(ctx, tx, "put", e)
+		}
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	return e, tx.Commit()
+}
+
+// approach 1: delete the key from the database
+func deleteKey1(ctx context.Context, key string, db *sql.DB) (bool, error) {
+	return deleted(db.ExecContext(ctx, "DELETE FROM kv.store WHERE k = ?", key))
+}
+
+// approach 2: set the expired at column to special value so we can
+// avoid index rebalancing
+func deleteKey2(ctx context.Context, key string, db *sql.DB) (bool, error) {
+	return deleted(db.ExecContext(ctx, "UPDATE kv.store set expired_at = -1 where k = ?", key))
+}
+
+// approach 3: Include where clause to filter out already expired keys
+// so that we can save 2 disk IOs. One in clustered index and other in secondary index
+func deleteKey3(ctx context.Context, key string, db *sql.DB) (bool, error) {
+	return deleted(db.ExecContext(ctx, "UPDATE kv.store set expired_at = -1 where k = ? and expired_at > UNIX_TIMESTAMP()", key))
+}
+
+// deleteIf is approach 3 behind a check of the condition, logging the
+// change.
+func deleteIf(ctx context.Context, key string, cond Condition, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	cur, err := lockLive(ctx, tx, key)
+	if err != nil {
+		return err
+	}
+	if cur == nil {
+		return ErrNotFound
+	}
+	if err := cond.check(cur); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, tombstone, key); err != nil {
+		return err
+	}
+	gone := Entry{Key: key}
+	if err := tx.QueryRowContext(ctx, "SELECT version FROM kv.store WHERE k = ?", key).Scan(&gone.Version); err != nil {
+		return err
+	}
+	if err := logChange(ctx, tx, "delete", gone); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func deleted(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func NewConn(port string) *sql.DB {
+	return io.NewConn(port, "root", "password", "kv")
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+
+	"kv/bitcask"
+)
+
+var (
+	ErrNotFound = errors.New("key not found")
+	// ErrConflict is returned when the condition of a write doesn't hold.
+	ErrConflict = errors.New("condition not met")
+)
+
+// NoExpiry is the expired_at of keys without a ttl, the column is an int.
+const NoExpiry = math.MaxInt32
+
+// Limits of the kv.store columns.
+const (
+	MaxKeyLen    = 128
+	MaxValueSize = 65535
+)
+
+// Entry is a live key. ExpiredAt is a unix timestamp in seconds. Version
+// changes with every write of the key.
+type Entry struct {
+	Key       string
+	Value     []byte
+	ExpiredAt int64
+	Version   uint64
+}
+
+// Condition makes a write depend on the current state of the key, the zero
+// value always writes.
+type Condition struct {
+	IfVersion uint64 // the key must be live at this version
+	IfExists  bool
+	IfAbsent  bool
+}
+
+func (c Condition) check(cur *Entry) error {
+	switch {
+	case c.IfAbsent && cur != nil,
+		c.IfExists && cur == nil,
+		c.IfVersion != 0 && (cur == nil || cur.Version != c.IfVersion):
+		return ErrConflict
+	}
+	return nil
+}
+
+// Store is what the HTTP handlers read from and write to. Get and Delete
+// return ErrNotFound for keys that don't exist or have expired. Writes
+// return ErrConflict if their condition doesn't hold, Put returns the new
+// version and whether it created the key.
+//
+// Update is the read-modify-write behind INCR, EXPIRE and the like: it runs
+// fn on the live entry of key, or nil if there is none, and writes what fn
+// returns, nil meaning delete, with no other write of the key in between,
+// even from another kv server. It returns the entry written.
+//
+// Scan pages through the live entries in byte order of the keys, starting
+// after the given key.
+type Store interface {
+	Get(ctx context.Context, key string) (Entry, error)
+	Put(ctx context.Context, key string, value []byte, expiredAt int64, cond Condition) (uint64, bool, error)
+	Delete(ctx context.Context, key string, cond Condition) error
+	Update(ctx context.Context, key string, fn func(cur *Entry) (*Entry, error)) (Entry, error)
+	Scan(ctx context.Context, after string, limit int) ([]Entry, error)
+	Close() error
+}
+
+// bitcaskStore keeps the data in an embedded bitcask database, so it needs
+// no MySQL and there is no replica to read from. Versions are the sequence
+// numbers of the writes.
+//
+// Its change log is kept in memory. Nothing deletes expired keys, they are
+// dropped by merges, so the log has no expire changes.
+type bitcaskStore struct {
+	db *bitcask.DB
+	*memLog
+}
+
+func OpenBitcask(dir string) (Store, error) {
+	log := newMemLog(maxMemChanges)
+	opts := bitcask.DefaultOptions()
+	opts.OnWrite = log.onWrite
+	db, err := bitcask.Open(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	log.start, log.head = db.Seq(), db.Seq()
+	return &bitcaskStore{db: db, memLog: log}, nil
+}
+
+// maxMemChanges is how many changes the bitcask store keeps for watchers.
+const maxMemChanges = 100000
+
+func (s *bitcaskStore) Get(ctx context.Context, key string) (Entry, error) {
+	e, err := s.db.Get(key)
+	if errors.Is(err, bitcask.ErrNotFound) {
+		return Entry{}, ErrNotFound
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	return fromBitcask(e), nil
+}
+
+func fromBitcask(e bitcask.Entry) Entry {
+	return Entry{Key: e.Key, Value: e.Value, ExpiredAt: e.ExpiredAt, Version: e.Seq}
+}
+
+// Update runs fn under the bitcask write lock.
+func (s *bitcaskStore) Update(ctx context.Context, key string, fn func(cur *Entry) (*Entry, error)) (Entry, error) {
+	e, err := s.db.Update(key, func(cur *bitcask.Entry) (*bitcask.Entry, error) {
+		var entry *Entry
+		if cur != nil {
+			e := fromBitcask(*cur)
+			entry = &e
+		}
+		next, err := fn(entry)
+		if next == nil || err != nil {
+			return nil, err
+		}
+		return &bitcask.Entry{Value: next.Value, ExpiredAt: next.ExpiredAt}, nil
+	})
+	return fromBitcask(e), err
+}
+
+func (s *bitcaskStore) Scan(ctx context.Context, after string, limit int) ([]Entry, error) {
+	entries, err := s.db.Scan(after, limit)
+	if err != nil {
+		return nil, err
+	}
+	scanned := make([]Entry, len(entries))
+	for i, e := range entries {
+		scanned[i] = fromBitcask(e)
+	}
+	return scanned, nil
+}
+
+func (s *bitcaskStore) Put(ctx context.Context, key string, value []byte, expiredAt int64, cond Condition) (uint64, bool, error) {
+	if cond == (Condition{}) {
+		version, replaced, err := s.db.Put(key, value, expiredAt)
+		return version, !replaced, err
+	}
+	var created bool
+	e, err := s.Update(ctx, key, func(cur *Entry) (*Entry, error) {
+		if err := cond.check(cur); err != nil {
+			return nil, err
+		}
+		created = cur == nil
+		return &Entry{Value: value, ExpiredAt: expiredAt}, nil
+	})
+	return e.Version, created, err
+}
+
+func (s *bitcaskStore) Delete(ctx context.Context, key string, cond Condition) error {
+	_, err := s.Update(ctx, key, func(cur *Entry) (*Entry, error) {
+		if cur == nil {
+			return nil, ErrNotFound
+		}
+		return nil, cond.check(cur)
+	})
+	return err
+}
+
+// Snapshot reads a snapshot of the bitcask database, writes go on meanwhile.
+func (s *bitcaskStore) Snapshot(ctx context.Context, prefix string, fn func(Entry) error) error {
+	snap, err := s.db.Snapshot(prefix)
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	for {
+		e, err := snap.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(fromBitcask(e)); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *bitcaskStore) Close() error {
+	return s.db.Close()
+}
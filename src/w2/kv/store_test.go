@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"kv/cache"
+)
+
+// Compare the backends with
+//
+//	go test -run NONE -bench . -benchtime 10000x
+//
+// the SQL ones need the MySQL primary from kv.sql on port 3306.
+
+func benchmarkStore(b *testing.B, s Store) {
+	ctx := context.Background()
+	value := make([]byte, 100)
+	expiredAt := time.Now().Add(time.Hour).Unix()
+
+	b.Run("Put", func(b *testing.B) {
+		for i := range b.N {
+			if _, _, err := s.Put(ctx, fmt.Sprintf("bench-%d", i%1000), value, expiredAt, Condition{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Get", func(b *testing.B) {
+		for i := range b.N {
+			if _, err := s.Get(ctx, fmt.Sprintf("bench-%d", i%1000)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkBitcask(b *testing.B) {
+	s, err := OpenBitcask(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	benchmarkStore(b, s)
+}
+
+func BenchmarkSQL(b *testing.B) {
+	s := NewSQLStore("3306")
+	defer s.Close()
+	if err := s.(*sqlStore).db.Ping(); err != nil {
+		b.Skipf("MySQL not available: %v", err)
+	}
+	benchmarkStore(b, s)
+}
+
+func TestCachedStore(t *testing.T) {
+	s, err := OpenBitcask(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := NewCache(cache.Options{MaxBytes: 1 << 20, NegativeTTL: time.Minute})
+	primary, replica := &invalidating{Store: s, cache: c}, newCachedStore(s, c)
+	ctx := context.Background()
+
+	if _, err := replica.Get(ctx, "a"); err != ErrNotFound {
+		t.Fatalf("expected a to be missing but got %v", err)
+	}
+	primary.Put(ctx, "a", []byte("1"), NoExpiry, Condition{})
+	if e, err := replica.Get(ctx, "a"); err != nil || string(e.Value) != "1" {
+		t.Fatalf("expected the put to invalidate the negative entry, got %s %v", e.Value, err)
+	}
+	replica.Get(ctx, "a")
+	primary.Delete(ctx, "a", Condition{})
+	if _, err := replica.Get(ctx, "a"); err != ErrNotFound {
+		t.Errorf("expected the delete to invalidate a, got %v", err)
+	}
+	if s := c.Stats(); s.Hits != 1 || s.Misses != 3 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestIncrIsAtomic(t *testing.T) {
+	s, err := OpenBitcask(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				if _, err := Incr(ctx, s, "n", 1); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if e, _ := s.Get(ctx, "n"); string(e.Value) != "1000" {
+		t.Errorf("expected 1000 but got %s", e.Value)
+	}
+}
+
+func TestMemLogTruncates(t *testing.T) {
+	l := newMemLog(4)
+	ctx := context.Background()
+	for seq := uint64(1); seq <= 5; seq++ {
+		l.append(Change{Seq: seq, Op: "put", Key: "k"})
+	}
+	if _, _, err := l.Changes(ctx, 1, 10); err != ErrTruncated {
+		t.Errorf("expected the oldest changes to be dropped but got %v", err)
+	}
+	changes, next, err := l.Changes(ctx, 2, 10)
+	if err != nil || len(changes) != 3 || next != 5 {
+		t.Errorf("expected changes 3 to 5 but got %v %d %v", changes, next, err)
+	}
+}